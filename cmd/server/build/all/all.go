@@ -0,0 +1,22 @@
+// Package all compiles the upload store backends into the server, each
+// registering its URL schemes with the upload package. Every backend but local
+// directories can be left out with its build tag, keeping its dependencies out
+// of the binary:
+//
+//	no_s3         s3://
+//	no_gcs        gs://
+//	no_azure      azure://
+//	no_sftp       sftp://
+//	no_webdav     webdav+http:// and webdav+https://
+//	no_calibre    calibre+http:// and calibre+https://
+//	no_calibreweb calibre-web+http:// and calibre-web+https://
+//	no_calibredb  calibredb:
+//	no_mail       mailto:
+//
+// such as go build -tags no_s3,no_gcs,no_azure ./cmd/server. Local
+// directories (file://) are always available.
+package all
+
+import (
+	_ "github.com/funayman/ebook-uploader/upload/stores/uploadfs"
+)
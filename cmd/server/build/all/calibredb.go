@@ -0,0 +1,7 @@
+//go:build !no_calibredb
+
+package all
+
+import (
+	_ "github.com/funayman/ebook-uploader/upload/stores/uploadcalibredb"
+)
@@ -0,0 +1,7 @@
+//go:build !no_gcs
+
+package all
+
+import (
+	_ "github.com/funayman/ebook-uploader/upload/stores/uploadgcs"
+)
@@ -0,0 +1,7 @@
+//go:build !no_s3
+
+package all
+
+import (
+	_ "github.com/funayman/ebook-uploader/upload/stores/uploads3"
+)
@@ -0,0 +1,7 @@
+//go:build !no_webdav
+
+package all
+
+import (
+	_ "github.com/funayman/ebook-uploader/upload/stores/uploadwebdav"
+)
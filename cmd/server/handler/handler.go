@@ -4,11 +4,14 @@ package handler
 import (
 	"net/http"
 	"os"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/funayman/ebook-uploader/cmd/server/handler/uploadgrp"
 	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/archive"
+	"github.com/funayman/ebook-uploader/upload/calibre"
 	"github.com/funayman/ebook-uploader/web"
 	"github.com/funayman/ebook-uploader/web/mid"
 )
@@ -19,6 +22,19 @@ type Config struct {
 	Log           *zap.SugaredLogger
 	UploadCore    *upload.Core
 	MaxUploadSize int64
+	UploadTimeout time.Duration
+
+	ExtractArchives bool
+	ArchiveLimits   archive.Limits
+
+	// BasicAuthUser and BasicAuthPassword protect every endpoint with basic
+	// auth when the user is set.
+	BasicAuthUser     string
+	BasicAuthPassword string
+
+	UploaderHeader string
+
+	Tracker *calibre.Tracker
 }
 
 func Mux(config Config) http.Handler {
@@ -27,6 +43,9 @@ func Mux(config Config) http.Handler {
 		mid.Errors(config.Log),
 		mid.Panics(),
 	}
+	if config.BasicAuthUser != "" {
+		globalMids = append(globalMids, mid.BasicAuth(config.BasicAuthUser, config.BasicAuthPassword))
+	}
 
 	app := web.NewApp(
 		config.ShutdownCh,
@@ -38,6 +57,14 @@ func Mux(config Config) http.Handler {
 		Log:           config.Log,
 		UploadCore:    config.UploadCore,
 		MaxUploadSize: config.MaxUploadSize,
+		UploadTimeout: config.UploadTimeout,
+
+		ExtractArchives: config.ExtractArchives,
+		ArchiveLimits:   config.ArchiveLimits,
+
+		UploaderHeader: config.UploaderHeader,
+
+		Tracker: config.Tracker,
 	})
 
 	return app
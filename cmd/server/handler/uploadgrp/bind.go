@@ -2,10 +2,13 @@ package uploadgrp
 
 import (
 	"net/http"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/archive"
+	"github.com/funayman/ebook-uploader/upload/calibre"
 	"github.com/funayman/ebook-uploader/web"
 	"github.com/funayman/ebook-uploader/web/mid"
 )
@@ -14,12 +17,35 @@ type Config struct {
 	Log           *zap.SugaredLogger
 	UploadCore    *upload.Core
 	MaxUploadSize int64
+
+	// UploadTimeout is the write timeout of the requests posting uploads,
+	// which are processed and saved before they are answered; zero keeps the
+	// write timeout of the server.
+	UploadTimeout time.Duration
+
+	// ExtractArchives saves the books found in uploaded archives instead of
+	// the archives themselves.
+	ExtractArchives bool
+	ArchiveLimits   archive.Limits
+
+	// UploaderHeader names the header holding the user authenticated by a
+	// reverse proxy, used by the routing rules. The header is trusted as is,
+	// so the proxy must strip it from the requests it forwards; empty ignores
+	// it.
+	UploaderHeader string
+
+	// Tracker follows the uploads until Calibre added them to its library,
+	// nil when they are not tracked.
+	Tracker *calibre.Tracker
 }
 
 func Bind(app *web.App, config Config) {
-	h := newHandler(config.UploadCore, config.MaxUploadSize)
+	h := newHandler(config)
 
 	app.Handle(http.MethodGet, "/upload", h.uploadForm)
-	app.Handle(http.MethodPost, "/upload", h.uploadFile, mid.LimitBodySize(config.MaxUploadSize))
+	app.Handle(http.MethodPost, "/upload", h.uploadFile, mid.LimitBodySize(config.MaxUploadSize), mid.WriteTimeout(config.UploadTimeout))
+	app.Handle(http.MethodPost, "/upload/metadata", h.extractMetadata, mid.LimitBodySize(config.MaxUploadSize), mid.WriteTimeout(config.UploadTimeout))
+	app.Handle(http.MethodPost, "/upload/route", h.routeFile, mid.LimitBodySize(config.MaxUploadSize), mid.WriteTimeout(config.UploadTimeout))
 	app.Handle(http.MethodGet, "/upload/complete", h.uploadSuccessError)
+	app.Handle(http.MethodGet, "/upload/ingest/{id}", h.ingestionStatus)
 }
@@ -0,0 +1,89 @@
+package uploadgrp
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"strconv"
+	"strings"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/isbn"
+	"github.com/funayman/ebook-uploader/validate"
+)
+
+// form field names for the optional per-file metadata. Each is suffixed with
+// the index of the file within the upload input, e.g. "title-0".
+const (
+	fieldTitle       = "title"
+	fieldAuthors     = "authors"
+	fieldSeries      = "series"
+	fieldSeriesIndex = "series_index"
+	fieldTags        = "tags"
+	fieldLanguage    = "language"
+	fieldISBN        = "isbn"
+	fieldDate        = "date"
+)
+
+var (
+	ErrInvalidNumber = errors.New("must be a number")
+)
+
+// formMetadata reads the metadata provided for the i-th file of the form. The
+// returned error is a validate.FieldErrors using the form field names.
+func formMetadata(form *multipart.Form, i int) (upload.Metadata, error) {
+	value := func(field string) string {
+		vs := form.Value[fmt.Sprintf("%s-%d", field, i)]
+		if len(vs) == 0 {
+			return ""
+		}
+		return strings.TrimSpace(vs[0])
+	}
+
+	md := upload.Metadata{
+		Title:    value(fieldTitle),
+		Authors:  splitList(value(fieldAuthors), "&;"),
+		Series:   value(fieldSeries),
+		Tags:     splitList(value(fieldTags), ","),
+		Language: value(fieldLanguage),
+		ISBN:     value(fieldISBN),
+		Date:     value(fieldDate),
+	}
+
+	if n, ok := isbn.Normalize(md.ISBN); ok {
+		md.ISBN = n
+	}
+
+	var fe validate.FieldErrors
+
+	if v := value(fieldSeriesIndex); v != "" {
+		idx, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			fe.Add(fmt.Sprintf("%s-%d", fieldSeriesIndex, i), ErrInvalidNumber)
+		} else {
+			md.SeriesIndex = idx
+		}
+	}
+
+	if err := md.Validate(); err != nil {
+		for _, f := range validate.GetFieldErrors(err) {
+			fe = append(fe, validate.FieldError{
+				Field: fmt.Sprintf("%s-%d", f.Field, i),
+				Err:   f.Err,
+			})
+		}
+	}
+
+	return md, fe.Err()
+}
+
+// splitList splits s on any of the separators, dropping empty values.
+func splitList(s, seps string) []string {
+	var list []string
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool { return strings.ContainsRune(seps, r) }) {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
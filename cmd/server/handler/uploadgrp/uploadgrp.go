@@ -5,32 +5,64 @@ import (
 	"context"
 	"errors"
 	"html/template"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 
 	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/archive"
+	"github.com/funayman/ebook-uploader/upload/calibre"
+	"github.com/funayman/ebook-uploader/validate"
 	"github.com/funayman/ebook-uploader/web"
+	"github.com/funayman/ebook-uploader/web/mid"
 )
 
 const (
 	defaultFormUploadID = "btn-upload"
+
+	// queryIngestion lists the ingestions shown by the completion page
+	queryIngestion = "ingestion"
 )
 
 var (
 	ErrMissingFormField = errors.New("missing required form field")
 )
 
+var (
+	// acceptedFormats are the extensions of the files accepted for upload.
+	acceptedFormats = []string{
+		".prc", ".cbr", ".lit", ".doc", ".djvu", ".opus", ".html", ".odt", ".ogg", ".cbz", ".rtf",
+		".mobi", ".mp3", ".wav", ".m4b", ".fb2", ".epub", ".azw3", ".pdf", ".mp4", ".m4a", ".azw",
+		".docx", ".kepub", ".txt", ".cbt", ".flac", ".md", ".markdown",
+	}
+
+	// archiveFormats are accepted as well when archives are extracted.
+	archiveFormats = []string{".zip", ".7z", ".rar", ".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2"}
+)
+
 type handler struct {
-	uploadCore    *upload.Core
-	maxUploadSize int64
-	formUploadID  string
+	uploadCore     *upload.Core
+	maxUploadSize  int64
+	formUploadID   string
+	unpacker       *archive.Unpacker
+	uploaderHeader string
+	tracker        *calibre.Tracker
 }
 
-func newHandler(uploadCore *upload.Core, maxUploadSize int64) *handler {
-	return &handler{
-		uploadCore:    uploadCore,
-		maxUploadSize: maxUploadSize,
-		formUploadID:  defaultFormUploadID,
+func newHandler(config Config) *handler {
+	h := handler{
+		uploadCore:     config.UploadCore,
+		maxUploadSize:  config.MaxUploadSize,
+		formUploadID:   defaultFormUploadID,
+		uploaderHeader: config.UploaderHeader,
+		tracker:        config.Tracker,
+	}
+	if config.ExtractArchives {
+		h.unpacker = archive.NewUnpacker(config.UploadCore, config.ArchiveLimits, accepted)
 	}
+	return &h
 }
 
 func (h *handler) uploadForm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
@@ -38,24 +70,151 @@ func (h *handler) uploadForm(ctx context.Context, w http.ResponseWriter, r *http
 <html>
 	<head>
 		<title>Simple eBook Uploader</title>
+		<style>
+			fieldset { margin: 1em 0; max-width: 40em; }
+			label { display: block; margin: .25em 0; }
+			label span { display: inline-block; width: 8em; }
+			#errors { color: #b00; white-space: pre-wrap; }
+		</style>
 	</head>
 	<body>
-		<form action="/upload" method="POST" enctype="multipart/form-data">
+		<form id="upload" action="/upload" method="POST" enctype="multipart/form-data">
 			<input
 				id="{{ .InputID }}"
 				name="{{ .InputID }}"
 				type="file"
-				accept=".prc,.cbr,.lit,.doc,.djvu,.opus,.html,.odt,.ogg,.cbz,.rtf,.mobi,.mp3,.wav,.m4b,.fb2,.epub,.azw3,.pdf,.mp4,.m4a,.azw,.docx,.kepub,.txt,.cbt,.flac"
+				accept="{{ .Accept }}"
 				multiple />
+			<div id="files"></div>
 			<button type="submit">SUBMIT!</button>
 		</form>
+		<pre id="errors"></pre>
+		<script type="text/javascript">
+			var fields = [
+				["title", "Title"],
+				["authors", "Author(s)"],
+				["series", "Series"],
+				["series_index", "Series Index"],
+				["tags", "Tags"],
+				["language", "Language"],
+				["isbn", "ISBN"],
+				["date", "Date"]
+			];
+			var form = document.getElementById("upload");
+			var input = document.getElementById({{ .InputID }});
+			var files = document.getElementById("files");
+
+			// guess takes a first pass at the metadata using the common
+			// "Author - Title.ext" naming convention
+			function guess(name) {
+				var base = name.replace(/\.[^.]+$/, "").replace(/_/g, " ");
+				var parts = base.split(" - ");
+				if (parts.length >= 2) {
+					return { authors: [parts[0].trim()], title: parts.slice(1).join(" - ").trim() };
+				}
+				return { title: base.trim() };
+			}
+
+			// prefill sets the fields the user has not touched yet
+			function prefill(fieldset, i, md) {
+				fields.forEach(function(f) {
+					var el = fieldset.querySelector("[name='" + f[0] + "-" + i + "']");
+					var v = md[f[0]];
+					if (Array.isArray(v)) {
+						v = v.join(f[0] === "authors" ? " & " : ", ");
+					}
+					if (!v || (el.value !== "" && !el.dataset.auto)) {
+						return;
+					}
+					el.value = v;
+					el.dataset.auto = "1";
+				});
+			}
+
+			// extract asks the server for the metadata embedded in the file
+			function extract(file) {
+				var data = new FormData();
+				data.append(input.name, file);
+				return fetch("/upload/metadata", { method: "POST", body: data }).then(function(resp) {
+					if (!resp.ok) {
+						throw new Error(resp.statusText);
+					}
+					return resp.json();
+				});
+			}
+
+			input.addEventListener("change", function() {
+				files.replaceChildren();
+				Array.from(input.files).forEach(function(file, i) {
+					var fieldset = document.createElement("fieldset");
+					var legend = document.createElement("legend");
+					legend.textContent = file.name;
+					fieldset.appendChild(legend);
+
+					fields.forEach(function(f) {
+						var label = document.createElement("label");
+						var span = document.createElement("span");
+						var el = document.createElement("input");
+						span.textContent = f[1];
+						el.name = f[0] + "-" + i;
+						el.addEventListener("input", function() { delete el.dataset.auto; });
+						label.appendChild(span);
+						label.appendChild(el);
+						fieldset.appendChild(label);
+					});
+					files.appendChild(fieldset);
+
+					prefill(fieldset, i, guess(file.name));
+					extract(file).then(function(md) { prefill(fieldset, i, md); }).catch(function() {});
+				});
+			});
+
+			form.addEventListener("submit", function(e) {
+				e.preventDefault();
+				document.getElementById("errors").textContent = "";
+				fetch(form.action, { method: "POST", body: new FormData(form) }).then(function(resp) {
+					return resp.json().then(function(data) {
+						if (!resp.ok) {
+							document.getElementById("errors").textContent = JSON.stringify(data, null, 2);
+							return;
+						}
+						// files which were rejected or skipped, and duplicates
+						// which were saved anyway, are listed rather than
+						// redirecting past them
+						var notes = [];
+						data.files.forEach(function(f) {
+							if (f.error) {
+								notes.push(f.filename + ": " + f.error);
+							}
+							(f.problems || []).forEach(function(p) {
+								if (p.code === "DUPLICATE") {
+									notes.push(f.filename + ": " + p.message);
+								}
+							});
+						});
+						if (notes.length > 0) {
+							document.getElementById("errors").textContent = notes.join("\n");
+							return;
+						}
+						window.location.href = data.location;
+					});
+				});
+			});
+		</script>
 	</body>
 </html>
 `
+	accept := acceptedFormats
+	if h.unpacker != nil {
+		accept = append(slices.Clip(accept), archiveFormats...)
+	}
+
 	data := struct {
 		InputID string
+		Accept  string
 	}{
 		InputID: h.formUploadID,
+		Accept:  strings.Join(accept, ","),
 	}
 
 	t := template.Must(template.New("").Parse(form))
@@ -72,30 +231,233 @@ func (h *handler) uploadFile(ctx context.Context, w http.ResponseWriter, r *http
 		return ErrMissingFormField
 	}
 
-	for _, mpf := range r.MultipartForm.File[h.formUploadID] {
-		err := func() error {
-			src, err := mpf.Open()
+	files := r.MultipartForm.File[h.formUploadID]
+	ctx = upload.WithUploader(ctx, h.uploader(ctx, r))
+	ctx = upload.WithTraceID(ctx, web.GetTraceID(ctx))
+
+	// validate the metadata of every file before saving any of them
+	mds := make([]upload.Metadata, len(files))
+	var fe validate.FieldErrors
+	for i := range files {
+		md, err := formMetadata(r.MultipartForm, i)
+		if err != nil {
+			fe = append(fe, validate.GetFieldErrors(err)...)
+		}
+		mds[i] = md
+	}
+	if err := fe.Err(); err != nil {
+		return err
+	}
+
+	// Calibre may add the books to its library as soon as they are saved
+	mark, marked := h.mark(ctx)
+
+	results := make([]upload.Result, 0, len(files))
+	for i, mpf := range files {
+		if h.unpacker != nil && archive.IsArchive(mpf.Filename) {
+			res, err := h.saveArchive(ctx, mpf, mds[i])
 			if err != nil {
 				return err
 			}
+			results = append(results, res...)
+			continue
+		}
+
+		res, err := func() (upload.Result, error) {
+			src, err := mpf.Open()
+			if err != nil {
+				return upload.Result{}, err
+			}
 			defer src.Close()
 
-			return h.uploadCore.Save(mpf.Filename, src)
+			return h.uploadCore.Save(ctx, mpf.Filename, src, mds[i])
 		}()
 
-		if err != nil {
+		switch {
+		case upload.IsRejected(err):
+			res = upload.Result{Filename: mpf.Filename, Error: err.Error()}
+		case err != nil:
 			return err
 		}
+		results = append(results, res)
+	}
+
+	data := struct {
+		Location string          `json:"location"`
+		Files    []upload.Result `json:"files"`
+	}{
+		Location: h.track(ctx, mark, marked, results),
+		Files:    results,
+	}
+	return web.RespondJSON(ctx, w, data, http.StatusOK)
+}
+
+// mark returns the high-water mark of the Calibre library the saved files are
+// tracked from, false when they are not tracked.
+func (h *handler) mark(ctx context.Context) (int64, bool) {
+	if h.tracker == nil {
+		return 0, false
+	}
+	mark, err := h.tracker.Mark(ctx)
+	return mark, err == nil
+}
+
+// track follows the saved files until Calibre added them to its library,
+// returning the location of the completion page showing their progress. The
+// mark is the one taken before saving them, the files are not tracked when
+// there is none.
+func (h *handler) track(ctx context.Context, mark int64, marked bool, results []upload.Result) string {
+	const location = "/upload/complete"
+	if !marked {
+		return location
+	}
+
+	q := url.Values{}
+	for i, res := range results {
+		if res.Error != "" || res.Key == "" {
+			continue
+		}
+		if id, ok := h.tracker.Track(ctx, mark, res.Filename, res.Key, res.Metadata); ok {
+			results[i].Ingestion = id
+			q.Add(queryIngestion, id)
+		}
+	}
+	if len(q) == 0 {
+		return location
+	}
+	return location + "?" + q.Encode()
+}
+
+// ingestionStatus returns the progress of Calibre adding an upload to its
+// library.
+func (h *handler) ingestionStatus(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if h.tracker == nil {
+		return web.RespondJSON(ctx, w, map[string]any{"error": "ingestion tracking is disabled"}, http.StatusNotFound)
+	}
+
+	in, err := h.tracker.Status(ctx, web.URLParam(r, "id"))
+	switch {
+	case errors.Is(err, calibre.ErrUnknownIngestion):
+		return web.RespondJSON(ctx, w, map[string]any{"error": err.Error()}, http.StatusNotFound)
+	case err != nil:
+		return err
+	}
+
+	return web.RespondJSON(ctx, w, in, http.StatusOK)
+}
+
+// saveArchive saves every book found in the uploaded archive, returning a
+// result per file of the archive.
+func (h *handler) saveArchive(ctx context.Context, mpf *multipart.FileHeader, md upload.Metadata) ([]upload.Result, error) {
+	src, err := mpf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	return h.unpacker.Save(ctx, mpf.Filename, src, mpf.Size, md)
+}
+
+// accepted reports whether the file name has one of the accepted extensions.
+func accepted(name string) bool {
+	name = strings.ToLower(name)
+	return slices.ContainsFunc(acceptedFormats, func(ext string) bool {
+		return strings.HasSuffix(name, ext)
+	})
+}
+
+// extractMetadata returns the metadata the processors find for the first
+// uploaded file. It is used by the upload form to pre-fill the metadata
+// fields.
+func (h *handler) extractMetadata(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseMultipartForm(h.maxUploadSize); err != nil {
+		return err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File[h.formUploadID]
+	if len(files) == 0 {
+		return ErrMissingFormField
+	}
+
+	f, err := files[0].Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// a rejection is reported once the file is uploaded, the metadata found
+	// so far is still useful to the form
+	res, err := h.uploadCore.Inspect(ctx, files[0].Filename, f, files[0].Size, upload.Metadata{})
+	if err != nil && !upload.IsRejected(err) {
+		return err
+	}
+
+	return web.RespondJSON(ctx, w, res.Metadata, http.StatusOK)
+}
+
+// routeFile explains which store the first uploaded file would be saved to,
+// using the metadata fields of the form like an upload does, without storing
+// it. Transformations, such as a conversion to EPUB, are not applied so rules
+// on the format see the file as uploaded.
+func (h *handler) routeFile(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseMultipartForm(h.maxUploadSize); err != nil {
+		return err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File[h.formUploadID]
+	if len(files) == 0 {
+		return ErrMissingFormField
+	}
+
+	md, err := formMetadata(r.MultipartForm, 0)
+	if err != nil {
+		return err
+	}
+
+	f, err := files[0].Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctx = upload.WithUploader(ctx, h.uploader(ctx, r))
+	ctx = upload.WithTraceID(ctx, web.GetTraceID(ctx))
+	res, route, err := h.uploadCore.Route(ctx, files[0].Filename, f, files[0].Size, md)
+	if err != nil && !upload.IsRejected(err) {
+		return err
+	}
+	if err != nil {
+		res.Error = err.Error()
 	}
 
 	data := struct {
-		Location string `json:"location"`
+		upload.Result
+		Uploader string        `json:"uploader,omitempty"`
+		Route    *upload.Route `json:"route,omitempty"`
 	}{
-		Location: "/upload/complete",
+		Result:   res,
+		Uploader: upload.GetUploader(ctx),
+		Route:    route,
 	}
 	return web.RespondJSON(ctx, w, data, http.StatusOK)
 }
 
+// uploader returns the name of the user uploading, authenticated either by
+// the basic auth middleware or by a reverse proxy setting the uploader header.
+// The credentials of the request are not used on their own as nothing checked
+// them.
+func (h *handler) uploader(ctx context.Context, r *http.Request) string {
+	if name := mid.GetUser(ctx); name != "" {
+		return name
+	}
+	if h.uploaderHeader != "" {
+		return r.Header.Get(h.uploaderHeader)
+	}
+	return ""
+}
+
 func (h *handler) uploadSuccessError(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	status := 200
 	html := `
@@ -105,7 +467,42 @@ func (h *handler) uploadSuccessError(ctx context.Context, w http.ResponseWriter,
 	</head>
 	<body>
 		<h1>File Successfully Uploaded!~</h1>
-
+{{ if .Ingestions }}
+		<p>Waiting for Calibre to add the books to the library.</p>
+		<ul>
+			{{ range .Ingestions }}<li data-ingestion="{{ . }}">Waiting...</li>
+			{{ end }}
+		</ul>
+		<p><a href="/">Go to CalibreWeb</a></p>
+		<script type="text/javascript">
+			var labels = {
+				waiting: "waiting for Calibre to pick it up",
+				importing: "being added to the library",
+				timeout: "not found in the library, Calibre may still be adding it"
+			};
+			document.querySelectorAll("li[data-ingestion]").forEach(function(li) {
+				var poll = function() {
+					fetch("/upload/ingest/" + encodeURIComponent(li.dataset.ingestion)).then(function(resp) {
+						return resp.json();
+					}).then(function(data) {
+						if (data.status === "ingested") {
+							var a = document.createElement("a");
+							a.href = data.url;
+							a.textContent = data.title;
+							li.textContent = data.filename + ": added as ";
+							li.appendChild(a);
+							return;
+						}
+						li.textContent = data.filename + ": " + (labels[data.status] || data.error);
+						if (data.status === "waiting" || data.status === "importing") {
+							setTimeout(poll, 2000);
+						}
+					}).catch(function() { setTimeout(poll, 5000); });
+				};
+				poll();
+			});
+		</script>
+{{ else }}
 		<p>Redirecting you to CalibreWeb in <span id="seconds">{{ .Seconds }}</span> seconds</p>
 		<script type="text/javascript">
 			var timeleft = {{ .Seconds }};
@@ -118,13 +515,16 @@ func (h *handler) uploadSuccessError(ctx context.Context, w http.ResponseWriter,
 				}
 			},1000);
 		</script>
+{{ end }}
 	</body>
 </html>
 `
 	data := struct {
-		Seconds int64
+		Seconds    int64
+		Ingestions []string
 	}{
-		Seconds: 10,
+		Seconds:    10,
+		Ingestions: r.URL.Query()[queryIngestion],
 	}
 
 	t := template.Must(template.New("").Parse(html))
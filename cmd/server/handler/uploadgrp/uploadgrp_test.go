@@ -0,0 +1,233 @@
+package uploadgrp
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/archive"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadfault"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadmem"
+	"github.com/funayman/ebook-uploader/web"
+	"github.com/funayman/ebook-uploader/web/mid"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+// newTestApp returns the upload handlers saving to an in-memory store.
+func newTestApp(t *testing.T, config Config) (*web.App, *uploadmem.Store) {
+	t.Helper()
+
+	store := uploadmem.NewStore(log)
+	if config.UploadCore == nil {
+		config.UploadCore = upload.NewCore(log, store)
+	}
+	config.Log = log
+	config.MaxUploadSize = 1 << 20
+
+	app := web.NewApp(make(chan os.Signal, 1), web.NewCorsOptions(), mid.Errors(log))
+	Bind(app, config)
+	return app, store
+}
+
+// uploadRequest returns a form upload of the files, by name, with the form
+// values.
+func uploadRequest(t *testing.T, files map[string]string, values map[string]string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		fw, err := mw.CreateFormFile(defaultFormUploadID, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	for k, v := range values {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestUploadFieldErrors(t *testing.T) {
+	tests := []struct {
+		value string
+		field string
+	}{
+		{"NaN", "series_index-0"},
+		{"+Inf", "series_index-0"},
+		{"-1", "series_index-0"},
+		{"1e400", "series_index-0"},
+		{"one", "series_index-0"},
+	}
+	for _, tt := range tests {
+		app, store := newTestApp(t, Config{})
+
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, uploadRequest(t, map[string]string{"book.txt": "book"}, map[string]string{
+			"series-0":       "Discworld",
+			"series_index-0": tt.value,
+		}))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d; got %d: %s", tt.value, http.StatusBadRequest, w.Code, w.Body)
+			continue
+		}
+		var resp struct {
+			Fields map[string]string `json:"fields"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: decode response: %v", tt.value, err)
+			continue
+		}
+		if _, ok := resp.Fields[tt.field]; !ok || len(resp.Fields) != 1 {
+			t.Errorf("%s: expected an error for %s; got: %v", tt.value, tt.field, resp.Fields)
+		}
+		if store.Len() != 0 {
+			t.Errorf("%s: expected nothing to be saved; got: %q", tt.value, store.Names())
+		}
+	}
+}
+
+func TestUploadArchiveSameName(t *testing.T) {
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	for _, f := range []struct{ name, content string }{
+		{"pratchett/book.txt", "Mort"},
+		{"gaiman/book.txt", "Coraline"},
+	} {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(f.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	app, store := newTestApp(t, Config{
+		ExtractArchives: true,
+		ArchiveLimits:   archive.Limits{MaxFiles: 10, MaxFileSize: 1 << 20, MaxTotalSize: 1 << 20},
+	})
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, uploadRequest(t, map[string]string{"books.zip": zb.String()}, nil))
+	if w.Code >= http.StatusBadRequest {
+		t.Fatalf("expected success; got %d: %s", w.Code, w.Body)
+	}
+
+	// saved at the top of the store, where Calibre looks for them
+	for name, content := range map[string]string{
+		"book.txt":   "Mort",
+		"book-1.txt": "Coraline",
+	} {
+		got, ok := store.Get(name)
+		if !ok {
+			t.Errorf("%s: not saved; saved: %q", name, store.Names())
+			continue
+		}
+		if string(got.Data) != content {
+			t.Errorf("%s: expected %q; got %q", name, content, got.Data)
+		}
+	}
+}
+
+func TestUploadStoreRejected(t *testing.T) {
+	reject := upload.RejectErr("DUPLICATE", errors.New(`"Mort" by Terry Pratchett is already in the library`))
+	store := uploadfault.NewStore(log, uploadmem.NewStore(log), uploadfault.Match("refused.epub", uploadfault.Fault{Err: reject}))
+	app, _ := newTestApp(t, Config{UploadCore: upload.NewCore(log, store)})
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, uploadRequest(t, map[string]string{"refused.epub": "epub", "saved.epub": "epub"}, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d; got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var resp struct {
+		Files []upload.Result `json:"files"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	errs := map[string]string{}
+	for _, res := range resp.Files {
+		errs[res.Filename] = res.Error
+	}
+	if len(errs) != 2 || !strings.Contains(errs["refused.epub"], "Mort") || errs["saved.epub"] != "" {
+		t.Errorf("expected the reason of the store for refused.epub only; got: %q", errs)
+	}
+}
+
+func TestUploader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		auth   bool
+		want   string
+	}{
+		{name: "unverified basic auth", want: ""},
+		{name: "proxy header", header: "Remote-User", want: "alice"},
+		{name: "verified basic auth", header: "Remote-User", auth: true, want: "mallory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Log:            log,
+				UploadCore:     upload.NewCore(log, uploadmem.NewStore(log)),
+				MaxUploadSize:  1 << 20,
+				UploaderHeader: tt.header,
+			}
+			mids := []web.Middleware{mid.Errors(log)}
+			if tt.auth {
+				mids = append(mids, mid.BasicAuth("mallory", "secret"))
+			}
+			app := web.NewApp(make(chan os.Signal, 1), web.NewCorsOptions(), mids...)
+			Bind(app, config)
+
+			r := uploadRequest(t, map[string]string{"book.txt": "book"}, nil)
+			r.URL.Path = "/upload/route"
+			r.SetBasicAuth("mallory", "secret")
+			r.Header.Set("Remote-User", "alice")
+
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected %d; got %d: %s", http.StatusOK, w.Code, w.Body)
+			}
+
+			var resp struct {
+				Uploader string `json:"uploader"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if resp.Uploader != tt.want {
+				t.Errorf("expected uploader %q; got %q", tt.want, resp.Uploader)
+			}
+		})
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,12 +19,25 @@ import (
 	"github.com/inhies/go-bytesize"
 	"go.uber.org/zap"
 
+	_ "github.com/funayman/ebook-uploader/cmd/server/build/all"
 	"github.com/funayman/ebook-uploader/cmd/server/handler"
 	"github.com/funayman/ebook-uploader/upload"
-	"github.com/funayman/ebook-uploader/upload/stores/uploadfs"
-	"github.com/funayman/ebook-uploader/upload/stores/uploadgcs"
+	"github.com/funayman/ebook-uploader/upload/archive"
+	"github.com/funayman/ebook-uploader/upload/calibre"
+	"github.com/funayman/ebook-uploader/upload/convert"
+	"github.com/funayman/ebook-uploader/upload/formats/epub"
+	"github.com/funayman/ebook-uploader/upload/formats/fb2"
+	"github.com/funayman/ebook-uploader/upload/formats/mobi"
+	"github.com/funayman/ebook-uploader/upload/formats/office"
+	"github.com/funayman/ebook-uploader/upload/formats/pdf"
+	"github.com/funayman/ebook-uploader/upload/formats/text"
+	"github.com/funayman/ebook-uploader/upload/language"
+	"github.com/funayman/ebook-uploader/upload/lookup"
+	"github.com/funayman/ebook-uploader/upload/scan"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadkepub"
 	"github.com/funayman/ebook-uploader/upload/stores/uploadmulti"
-	"github.com/funayman/ebook-uploader/upload/stores/uploads3"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadopf"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadscan"
 	"github.com/funayman/ebook-uploader/web"
 	"github.com/funayman/ebook-uploader/web/debug"
 )
@@ -53,22 +69,94 @@ func run(ctx context.Context, log *zap.SugaredLogger) error {
 		Web struct {
 			ReadTimeout        time.Duration `conf:"default:60s"`
 			WriteTimeout       time.Duration `conf:"default:10s"`
+			UploadTimeout      time.Duration `conf:"default:30m,help:write timeout of the upload requests; longer than the conversion and store timeouts as uploads are converted and saved before they are answered"`
 			IdleTimeout        time.Duration `conf:"default:120s"`
 			ShutdownTimeout    time.Duration `conf:"default:20s"`
 			HostPort           string        `conf:"default:0.0.0.0:8000"`
 			DebugHostPort      string        `conf:"default:0.0.0.0:4000"`
 			CORSAllowedOrigins []string      `conf:"default:*"`
 			MaxFileSize        string        `conf:"default:50MB"`
+			BasicAuthUser      string        `conf:"help:user required with basic auth on every endpoint; disabled when empty"`
+			BasicAuthPassword  string        `conf:"mask"`
 		}
 		Upload struct {
-			FS struct {
-				Dirs []string `conf:"default:./uploads"`
+			KeyTemplate   string
+			OPFSidecar    bool `conf:"default:false"`
+			EmbedMetadata bool `conf:"default:true"`
+			EPUB          struct {
+				Validate        bool `conf:"default:true"`
+				Fix             bool `conf:"default:false"`
+				DefaultLanguage string
+			}
+			Text struct {
+				Normalize bool `conf:"default:true"`
+				ToEPUB    bool `conf:"default:false"`
+			}
+			Language struct {
+				Detect        bool    `conf:"default:true"`
+				MinConfidence float64 `conf:"default:0.5"`
+			}
+			Lookup struct {
+				Enabled   bool          `conf:"default:false"`
+				URL       string        `conf:"default:https://openlibrary.org"`
+				Timeout   time.Duration `conf:"default:10s"`
+				CacheTTL  time.Duration `conf:"default:24h"`
+				CacheSize int           `conf:"default:1000"`
+			}
+			Calibre struct {
+				Library       string        `conf:"help:Calibre library directory or metadata.db used to find duplicates and follow ingestion"`
+				WatchDir      string        `conf:"help:folder Calibre adds books from; uploads saved there are followed until they are in the library"`
+				WebURL        string        `conf:"default:/,help:Calibre-Web address the added books are linked to"`
+				IngestTimeout time.Duration `conf:"default:10m"`
+			}
+			Duplicates struct {
+				Action    string  `conf:"default:warn,help:what to do with books already in the Calibre library (off|warn|refuse)"`
+				Threshold float64 `conf:"default:0.9,help:similarity of titles and authors from 0 to 1 where 1 only matches the same words"`
+			}
+			Archive struct {
+				Extract      bool   `conf:"default:true"`
+				MaxFiles     int    `conf:"default:200"`
+				MaxFileSize  string `conf:"default:500MB"`
+				MaxTotalSize string `conf:"default:2GB"`
+				MaxDepth     int    `conf:"default:1"`
+			}
+			Convert struct {
+				Command       string `conf:"help:external converter such as ebook-convert; disabled when empty"`
+				Args          []string
+				Formats       []string      `conf:"default:.lit;.doc;.prc;.pdb;.lrf"`
+				Output        string        `conf:"default:.epub"`
+				KeepOriginal  bool          `conf:"default:true"`
+				Timeout       time.Duration `conf:"default:10m"`
+				Concurrency   int           `conf:"default:2"`
+				MaxOutputSize string        `conf:"default:500MB"`
+				MaxMemory     string        `conf:"default:0B,help:address space limit of the command; 0B for none as Qt WebEngine reserves far more than it uses"`
+				MaxCPU        time.Duration `conf:"default:10m"`
+			}
+			Route struct {
+				Rules          []string `conf:"help:routing rules separated by semicolons"`
+				File           string   `conf:"help:file holding a routing rule per line"`
+				Stores         []string `conf:"help:stores used by the rules as name=location where the location is a directory or store URL; see stores"`
+				UploaderHeader string   `conf:"help:header naming the user authenticated by a reverse proxy such as Remote-User; the proxy must strip it from client requests"`
+				Scans          []string `conf:"help:library scans after saving to a store as name=abs+http://token@host:13378/library or komga+http://... or kavita+http://..."`
+			}
+			Scan struct {
+				Delay   time.Duration `conf:"default:10s,help:wait for the rest of an upload before scanning"`
+				Retries int           `conf:"default:3"`
+				Backoff time.Duration `conf:"default:30s"`
+				Timeout time.Duration `conf:"default:30s"`
+			}
+			Stores []string `conf:"help:stores as URLs such as file:///uploads?atomic=1 or s3://bucket/prefix?endpoint=http://minio:9000 or gs://bucket/prefix or azure://container/prefix or sftp://user@host/dir or webdav+https://host/dav or calibre+http://host:8080 or calibre-web+http://host:8083 or calibredb:/library or mailto:address with kepub=alongside|replace for KEPUB conversion"`
+			FS     struct {
+				Dirs  []string `conf:"help:directories to save to; see stores; ./uploads when neither directories nor stores are set"`
+				KEPUB string   `conf:"default:off,help:KEPUB conversion (off|alongside|replace)"`
 			}
 			GCP struct {
-				Buckets []string
+				Buckets []string `conf:"help:buckets to save to; see stores"`
+				KEPUB   string   `conf:"default:off,help:KEPUB conversion (off|alongside|replace)"`
 			}
 			S3 struct {
-				Buckets []string
+				Buckets []string `conf:"help:buckets to save to; see stores"`
+				KEPUB   string   `conf:"default:off,help:KEPUB conversion (off|alongside|replace)"`
 			}
 		}
 		conf.Version
@@ -110,42 +198,238 @@ func run(ctx context.Context, log *zap.SugaredLogger) error {
 
 	stores := []upload.Storer{}
 
-	if len(config.Upload.FS.Dirs) > 0 {
-		for _, dir := range config.Upload.FS.Dirs {
-			uploadStoreFS, err := uploadfs.NewStore(log, dir)
-			if err != nil {
-				return err
-			}
-			stores = append(stores, uploadStoreFS)
+	// kepub optionally wraps a store with the KEPUB conversion
+	kepub := func(mode string, store upload.Storer) (upload.Storer, error) {
+		m, err := uploadkepub.ParseMode(mode)
+		if err != nil {
+			return nil, err
+		}
+		if m == uploadkepub.Off {
+			return store, nil
 		}
+		return uploadkepub.NewStore(log, store, m), nil
 	}
 
-	if len(config.Upload.GCP.Buckets) > 0 {
-		for _, bucket := range config.Upload.GCP.Buckets {
-			uploadStoreGCS, err := uploadgcs.NewStore(log, bucket)
-			if err != nil {
-				return err
-			}
-			stores = append(stores, uploadStoreGCS)
+	// openStore opens the store of the location with the backend registered
+	// for its scheme, converting to KEPUB as the kepub option of the URL says
+	// or, without one, as the mode
+	openStore := func(location, mode string) (upload.Storer, error) {
+		if u, err := url.Parse(location); err == nil && u.Query().Has("kepub") {
+			q := u.Query()
+			mode = q.Get("kepub")
+			q.Del("kepub")
+			u.RawQuery = q.Encode()
+			location = u.String()
+		}
+		store, err := upload.OpenStore(ctx, log, location)
+		if err != nil {
+			return nil, err
 		}
+		return kepub(mode, store)
 	}
 
-	if len(config.Upload.S3.Buckets) > 0 {
-		for _, bucket := range config.Upload.S3.Buckets {
-			uploadStoreS3, err := uploads3.NewStore(log, bucket)
-			if err != nil {
-				return err
-			}
-			stores = append(stores, uploadStoreS3)
+	// locations are the stores of the configuration with their KEPUB
+	// conversion, which the stores set as URLs give with their kepub option
+	type entry struct {
+		url   string
+		kepub string
+	}
+	locations := []entry{}
+	for _, s := range config.Upload.Stores {
+		locations = append(locations, entry{url: s, kepub: "off"})
+	}
+	dirs := config.Upload.FS.Dirs
+	if dirs == nil && len(config.Upload.Stores) == 0 {
+		dirs = []string{"./uploads"}
+	}
+	for _, dir := range dirs {
+		if dir != "" {
+			locations = append(locations, entry{url: dir, kepub: config.Upload.FS.KEPUB})
+		}
+	}
+	for _, bucket := range config.Upload.GCP.Buckets {
+		locations = append(locations, entry{url: "gs://" + bucket, kepub: config.Upload.GCP.KEPUB})
+	}
+	for _, bucket := range config.Upload.S3.Buckets {
+		locations = append(locations, entry{url: "s3://" + bucket, kepub: config.Upload.S3.KEPUB})
+	}
+
+	for _, l := range locations {
+		store, err := openStore(l.url, l.kepub)
+		if err != nil {
+			return fmt.Errorf("store %s: %w", redact(l.url), err)
+		}
+		stores = append(stores, store)
+	}
+
+	// wrap adds the OPF sidecars to every store, including the stores
+	// of the routing rules
+	wrap := func(store upload.Storer) upload.Storer { return store }
+
+	if config.Upload.OPFSidecar {
+		wrap = func(store upload.Storer) upload.Storer {
+			return uploadopf.NewStore(log, store)
+		}
+	}
+
+	// scans are the library scans triggered after saving to a store, by the
+	// name of the store
+	scans := map[string][]*scan.Hook{}
+	for _, s := range config.Upload.Route.Scans {
+		name, location, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("library scan %q: expected name=location", s)
+		}
+		if name != upload.DefaultStore && !slices.ContainsFunc(config.Upload.Route.Stores, func(entry string) bool { return strings.HasPrefix(entry, name+"=") }) {
+			return fmt.Errorf("library scan %q: %w", s, upload.ErrUnknownStore)
+		}
+		scanner, err := scan.Parse(http.DefaultClient, location)
+		if err != nil {
+			return fmt.Errorf("library scan of %s: %w", name, err)
 		}
+		scans[name] = append(scans[name], scan.NewHook(log, scanner, scan.Config{
+			Delay:   config.Upload.Scan.Delay,
+			Retries: config.Upload.Scan.Retries,
+			Backoff: config.Upload.Scan.Backoff,
+			Timeout: config.Upload.Scan.Timeout,
+		}))
+	}
+	// scanStores are drained on shutdown so the scans of the last uploads
+	// are not lost
+	var scanStores []*uploadscan.Store
+	withScans := func(name string, store upload.Storer) upload.Storer {
+		if hooks := scans[name]; len(hooks) > 0 {
+			s := uploadscan.NewStore(store, hooks...)
+			scanStores = append(scanStores, s)
+			return s
+		}
+		return store
 	}
 
-	store, err := uploadmulti.NewStore(log, stores...)
+	multi, err := uploadmulti.NewStore(log, stores...)
 	if err != nil {
 		return err
 	}
+	store := withScans(upload.DefaultStore, wrap(multi))
+
+	// uploads are converted first so the rest of the pipeline sees the
+	// converted books, which are inspected, validated, embedded with metadata
+	// and fixed like any other
+	processors := []upload.Processor{}
+	if config.Upload.Convert.Command != "" {
+		maxOutputSize, err := bytesize.Parse(config.Upload.Convert.MaxOutputSize)
+		if err != nil {
+			return fmt.Errorf("parse convert max output size: %w", err)
+		}
+		maxMemory, err := bytesize.Parse(config.Upload.Convert.MaxMemory)
+		if err != nil {
+			return fmt.Errorf("parse convert max memory: %w", err)
+		}
+
+		converter, err := convert.NewConverter(log, convert.Config{
+			Command:       config.Upload.Convert.Command,
+			Args:          config.Upload.Convert.Args,
+			Formats:       config.Upload.Convert.Formats,
+			Output:        config.Upload.Convert.Output,
+			Timeout:       config.Upload.Convert.Timeout,
+			Concurrency:   config.Upload.Convert.Concurrency,
+			MaxOutputSize: int64(maxOutputSize),
+			MaxMemory:     int64(maxMemory),
+			MaxCPU:        config.Upload.Convert.MaxCPU,
+			KeepOriginal:  config.Upload.Convert.KeepOriginal,
+		})
+		if err != nil {
+			return err
+		}
+		processors = append(processors, upload.Transform(converter))
+	}
 
-	uploadCore := upload.NewCore(log, store)
+	// uploads are inspected and enriched before the validators and
+	// transformers so they see the complete metadata
+	processors = append(processors,
+		upload.Inspect(epub.Extractor{}, pdf.Extractor{}, office.Extractor{}, fb2.Extractor{}, mobi.Extractor{}),
+	)
+
+	if config.Upload.Lookup.Enabled {
+		provider := lookup.NewOpenLibrary(log, config.Upload.Lookup.URL, config.Upload.Lookup.Timeout)
+		cache := lookup.NewCache(provider, config.Upload.Lookup.CacheTTL, config.Upload.Lookup.CacheSize)
+		processors = append(processors, upload.Enrich(lookup.NewEnricher(cache)))
+	}
+
+	// the language is only detected when neither the file nor the lookup
+	// provided one
+	if config.Upload.Language.Detect {
+		detector := language.NewDetector(config.Upload.Language.MinConfidence,
+			epub.Extractor{}, pdf.Extractor{}, office.Extractor{}, fb2.Extractor{}, mobi.Extractor{}, text.Sampler{})
+		processors = append(processors, detector)
+	}
+
+	var library *calibre.Library
+	if config.Upload.Calibre.Library != "" {
+		library, err = calibre.OpenLibrary(config.Upload.Calibre.Library)
+		if err != nil {
+			return fmt.Errorf("open calibre library: %w", err)
+		}
+	}
+
+	if library != nil && config.Upload.Duplicates.Action != "off" {
+		var refuse bool
+		switch config.Upload.Duplicates.Action {
+		case "warn":
+		case "refuse":
+			refuse = true
+		default:
+			return fmt.Errorf("unknown duplicates action %q", config.Upload.Duplicates.Action)
+		}
+		processors = append(processors, calibre.NewDuplicates(library, config.Upload.Duplicates.Threshold, refuse))
+	}
+
+	if config.Upload.EPUB.Validate {
+		processors = append(processors, upload.Validate(epub.Validator{}))
+	}
+
+	transformers := []upload.Transformer{}
+	if config.Upload.Text.Normalize {
+		transformers = append(transformers, text.Normalizer{})
+	}
+	if config.Upload.Text.ToEPUB {
+		transformers = append(transformers, text.Converter{})
+	}
+	if config.Upload.EmbedMetadata {
+		transformers = append(transformers, epub.Embedder{})
+	}
+	if config.Upload.EPUB.Fix {
+		transformers = append(transformers, epub.Fixer{Language: config.Upload.EPUB.DefaultLanguage})
+	}
+	processors = append(processors, upload.Transform(transformers...))
+
+	coreOpts := []upload.Option{
+		upload.WithProcessors(processors...),
+	}
+
+	if len(config.Upload.Route.Rules) > 0 || config.Upload.Route.File != "" {
+		router, err := newRouter(config.Upload.Route.Rules, config.Upload.Route.File, config.Upload.Route.Stores, func(name, location string) (upload.Storer, error) {
+			store, err := openStore(location, "off")
+			if err != nil {
+				return nil, err
+			}
+			return withScans(name, wrap(store)), nil
+		})
+		if err != nil {
+			return err
+		}
+		coreOpts = append(coreOpts, upload.WithRouter(router))
+	}
+
+	if config.Upload.KeyTemplate != "" {
+		kt, err := upload.ParseKeyTemplate(config.Upload.KeyTemplate)
+		if err != nil {
+			return fmt.Errorf("parse key template: %w", err)
+		}
+		coreOpts = append(coreOpts, upload.WithKeyTemplate(kt))
+	}
+
+	uploadCore := upload.NewCore(log, store, coreOpts...)
 
 	// -------------------------------------------------------------------------
 	// main web service
@@ -155,12 +439,45 @@ func run(ctx context.Context, log *zap.SugaredLogger) error {
 		return err
 	}
 
+	archiveMaxFileSize, err := bytesize.Parse(config.Upload.Archive.MaxFileSize)
+	if err != nil {
+		return fmt.Errorf("parse archive max file size: %w", err)
+	}
+	archiveMaxTotalSize, err := bytesize.Parse(config.Upload.Archive.MaxTotalSize)
+	if err != nil {
+		return fmt.Errorf("parse archive max total size: %w", err)
+	}
+
+	var tracker *calibre.Tracker
+	if config.Upload.Calibre.WatchDir != "" {
+		if library == nil {
+			return errors.New("following ingestion needs the calibre library")
+		}
+		tracker = calibre.NewTracker(library, config.Upload.Calibre.WatchDir, config.Upload.Calibre.WebURL, config.Upload.Calibre.IngestTimeout)
+	}
+
 	mux := handler.Mux(handler.Config{
 		ShutdownCh:    shutdownCh,
 		CORSOrigins:   config.Web.CORSAllowedOrigins,
 		Log:           log,
 		UploadCore:    uploadCore,
 		MaxUploadSize: int64(maxUploadSize),
+		UploadTimeout: config.Web.UploadTimeout,
+
+		Tracker: tracker,
+
+		ExtractArchives: config.Upload.Archive.Extract,
+		ArchiveLimits: archive.Limits{
+			MaxFiles:     config.Upload.Archive.MaxFiles,
+			MaxFileSize:  int64(archiveMaxFileSize),
+			MaxTotalSize: int64(archiveMaxTotalSize),
+			MaxDepth:     config.Upload.Archive.MaxDepth,
+		},
+
+		BasicAuthUser:     config.Web.BasicAuthUser,
+		BasicAuthPassword: config.Web.BasicAuthPassword,
+
+		UploaderHeader: config.Upload.Route.UploaderHeader,
 	})
 
 	svr := http.Server{
@@ -193,9 +510,87 @@ func run(ctx context.Context, log *zap.SugaredLogger) error {
 			svr.Close()
 			return fmt.Errorf("could not stop server gracefully: %w", err)
 		}
+
+		for _, s := range scanStores {
+			s.Close()
+		}
 	case err := <-serverErrors:
 		return fmt.Errorf("cannot start server: %w", err)
 	}
 
 	return nil
 }
+
+// newRouter builds the upload router from the rules given in the config and
+// in the rules file, and the named stores they use.
+func newRouter(ruleList []string, file string, storeList []string, open func(name, location string) (upload.Storer, error)) (*upload.Router, error) {
+	text := strings.Join(ruleList, "\n")
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read routing rules: %w", err)
+		}
+		text += "\n" + string(b)
+	}
+
+	rules, err := upload.ParseRules(strings.NewReader(text))
+	if err != nil {
+		return nil, fmt.Errorf("parse routing rules: %w", err)
+	}
+
+	stores := make(map[string]upload.Storer, len(storeList))
+	for _, s := range storeList {
+		name, location, ok := strings.Cut(s, "=")
+		if !ok || name == "" || location == "" {
+			return nil, fmt.Errorf("routing store %q: expected name=location", s)
+		}
+		store, err := open(name, location)
+		if err != nil {
+			return nil, fmt.Errorf("routing store %s: %w", name, err)
+		}
+		stores[name] = store
+	}
+
+	return upload.NewRouter(stores, rules)
+}
+
+// redact hides the password of the location when it is a URL, and the values
+// of its options holding credentials, for errors.
+func redact(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	q := u.Query()
+	masked := false
+	for name, values := range q {
+		if !credential(name) {
+			continue
+		}
+		for i := range values {
+			values[i] = "xxxxx"
+		}
+		masked = true
+	}
+	if masked {
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
+
+// credential reports whether the URL option of the name holds a credential,
+// such as the key of an account or the password of a server.
+func credential(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "key", "sas", "sig":
+		return true
+	}
+	for _, word := range []string{"password", "passphrase", "secret", "token"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,306 @@
+// Package archive walks the files of ZIP, 7z, RAR and tar archives uploaded as
+// bundles of books, guarding against zip bombs and malicious entry names, and
+// saves the books found one by one.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/nwaples/rardecode/v2"
+)
+
+var (
+	ErrUnsupported  = errors.New("unsupported archive format")
+	ErrTooManyFiles = errors.New("archive has too many files")
+	ErrTooLarge     = errors.New("archive content too large")
+	ErrFileTooLarge = errors.New("archive entry too large")
+	ErrTooDeep      = errors.New("archive nested too deeply")
+	ErrInvalidPath  = errors.New("invalid archive entry path")
+	ErrNotRegular   = errors.New("archive entry is not a regular file")
+)
+
+// Limits bound the work done extracting an archive. The sizes are checked
+// against the bytes actually extracted, not the sizes the archive claims. Zero
+// values disable a limit.
+type Limits struct {
+	// MaxFiles is the number of file entries, including the files of nested
+	// archives.
+	MaxFiles int
+	// MaxFileSize is the extracted size of a single entry.
+	MaxFileSize int64
+	// MaxTotalSize is the extracted size of all entries together.
+	MaxTotalSize int64
+	// MaxDepth is the number of nested archives opened. At 0 archives found
+	// inside the upload are reported with ErrTooDeep.
+	MaxDepth int
+}
+
+// Entry is a file found in an archive.
+type Entry struct {
+	// Path is the cleaned path of the entry within the uploaded archive. The
+	// entries of nested archives are prefixed with the path of the archive.
+	Path string
+	// Err is set for entries which are skipped, such as directories linking
+	// elsewhere or entries with a path escaping the archive.
+	Err error
+
+	r io.Reader
+}
+
+// Name returns the file name of the entry.
+func (e Entry) Name() string {
+	return path.Base(e.Path)
+}
+
+// Read reads the content of the entry, failing once a size limit is hit.
+func (e Entry) Read(p []byte) (int, error) {
+	if e.r == nil {
+		return 0, e.Err
+	}
+	return e.r.Read(p)
+}
+
+// Format returns the archive format of the file name, or an empty string when
+// the name is not one of a supported archive.
+func Format(name string) string {
+	name = strings.ToLower(name)
+	for _, f := range []struct{ ext, format string }{
+		{".zip", "zip"},
+		{".7z", "7z"},
+		{".rar", "rar"},
+		{".tar", "tar"},
+		{".tar.gz", "tar.gz"},
+		{".tgz", "tar.gz"},
+		{".tar.bz2", "tar.bz2"},
+		{".tbz2", "tar.bz2"},
+	} {
+		if strings.HasSuffix(name, f.ext) {
+			return f.format
+		}
+	}
+	return ""
+}
+
+// IsArchive reports whether the file name is one of a supported archive.
+func IsArchive(name string) bool {
+	return Format(name) != ""
+}
+
+// Walk calls fn for every file of the archive, in the order of the archive,
+// opening nested archives up to the configured depth. The entry is only valid
+// until fn returns. An error returned by fn, a limit being hit or a damaged
+// archive stops the walk and is returned.
+func Walk(ctx context.Context, name string, r io.ReaderAt, size int64, limits Limits, fn func(Entry) error) error {
+	w := walker{ctx: ctx, limits: limits, fn: fn}
+	return w.walk("", name, r, size, 0)
+}
+
+type walker struct {
+	ctx    context.Context
+	limits Limits
+	fn     func(Entry) error
+
+	files int
+	total int64
+}
+
+// walk walks the archive found at prefix, which is empty for the upload.
+func (w *walker) walk(prefix, name string, r io.ReaderAt, size int64, depth int) error {
+	next := func(p string, rc io.Reader, mode fs.FileMode) error {
+		return w.entry(prefix, p, rc, mode, depth)
+	}
+
+	switch Format(name) {
+	case "zip":
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return fmt.Errorf("zip: %w", err)
+		}
+		for _, f := range zr.File {
+			if err := w.open(f.Name, f.Mode(), f.Open, next); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "7z":
+		zr, err := sevenzip.NewReader(r, size)
+		if err != nil {
+			return fmt.Errorf("7z: %w", err)
+		}
+		for _, f := range zr.File {
+			if err := w.open(f.Name, f.Mode(), f.Open, next); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "rar":
+		rr, err := rardecode.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return fmt.Errorf("rar: %w", err)
+		}
+		for {
+			h, err := rr.Next()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("rar: %w", err)
+			}
+			if err := next(h.Name, rr, h.Mode()); err != nil {
+				return err
+			}
+		}
+
+	case "tar", "tar.gz", "tar.bz2":
+		var src io.Reader = io.NewSectionReader(r, 0, size)
+		switch Format(name) {
+		case "tar.gz":
+			gz, err := gzip.NewReader(src)
+			if err != nil {
+				return fmt.Errorf("gzip: %w", err)
+			}
+			defer gz.Close()
+			src = gz
+		case "tar.bz2":
+			src = bzip2.NewReader(src)
+		}
+
+		tr := tar.NewReader(src)
+		for {
+			h, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("tar: %w", err)
+			}
+			if err := next(h.Name, tr, h.FileInfo().Mode()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return ErrUnsupported
+}
+
+// open opens an entry of a random access archive.
+func (w *walker) open(name string, mode fs.FileMode, open func() (io.ReadCloser, error), next func(string, io.Reader, fs.FileMode) error) error {
+	if !mode.IsRegular() {
+		return next(name, nil, mode)
+	}
+
+	rc, err := open()
+	if err != nil {
+		return fmt.Errorf("open %s: %w", name, err)
+	}
+	defer rc.Close()
+
+	return next(name, rc, mode)
+}
+
+// entry handles a single entry of an archive.
+func (w *walker) entry(prefix, name string, r io.Reader, mode fs.FileMode, depth int) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if mode.IsDir() {
+		return nil
+	}
+
+	p, ok := cleanPath(name)
+	if !ok {
+		return w.fn(Entry{Path: path.Join(prefix, path.Base(strings.ReplaceAll(name, `\`, "/"))), Err: ErrInvalidPath})
+	}
+	p = path.Join(prefix, p)
+
+	if !mode.IsRegular() || r == nil {
+		return w.fn(Entry{Path: p, Err: ErrNotRegular})
+	}
+
+	w.files++
+	if w.limits.MaxFiles > 0 && w.files > w.limits.MaxFiles {
+		return ErrTooManyFiles
+	}
+
+	lr := &limitedReader{r: r, w: w}
+
+	if !IsArchive(p) {
+		return w.fn(Entry{Path: p, r: lr})
+	}
+	if depth >= w.limits.MaxDepth {
+		return w.fn(Entry{Path: p, Err: ErrTooDeep})
+	}
+
+	// nested archives need random access, so they are copied to disk first
+	f, err := os.CreateTemp("", "upload-archive-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	n, err := io.Copy(f, lr)
+	if err != nil {
+		return fmt.Errorf("extract %s: %w", p, err)
+	}
+
+	return w.walk(p, p, f, n, depth+1)
+}
+
+// cleanPath cleans the path of an entry, rejecting absolute paths and paths
+// escaping the archive.
+func cleanPath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if name == "" || strings.ContainsRune(name, 0) || path.IsAbs(name) {
+		return "", false
+	}
+	// windows drive letters
+	if len(name) >= 2 && name[1] == ':' {
+		return "", false
+	}
+
+	p := path.Clean(name)
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return "", false
+	}
+
+	return p, true
+}
+
+// limitedReader counts the bytes extracted against the limits.
+type limitedReader struct {
+	r io.Reader
+	w *walker
+	n int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	lr.w.total += int64(n)
+
+	switch {
+	case lr.w.limits.MaxFileSize > 0 && lr.n > lr.w.limits.MaxFileSize:
+		return n, ErrFileTooLarge
+	case lr.w.limits.MaxTotalSize > 0 && lr.w.total > lr.w.limits.MaxTotalSize:
+		return n, ErrTooLarge
+	}
+
+	return n, err
+}
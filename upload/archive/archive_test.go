@@ -0,0 +1,139 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type file struct {
+	name string
+	data []byte
+}
+
+func buildZip(t *testing.T, files ...file) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatalf("zip.Create: %v", err)
+		}
+		w.Write(f.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip.Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func buildTarGz(t *testing.T, files ...file) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.data)), Typeflag: tar.TypeReg})
+		tw.Write(f.data)
+	}
+	tw.WriteHeader(&tar.Header{Name: "link.epub", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink})
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// walk collects the entries of the archive, mapping each path to its content
+// or error.
+func walk(name string, data []byte, limits Limits) (map[string]string, error) {
+	got := make(map[string]string)
+	err := Walk(context.Background(), name, bytes.NewReader(data), int64(len(data)), limits, func(e Entry) error {
+		if e.Err != nil {
+			got[e.Path] = "error: " + e.Err.Error()
+			return nil
+		}
+		b, err := io.ReadAll(e)
+		if err != nil {
+			return err
+		}
+		got[e.Path] = string(b)
+		return nil
+	})
+	return got, err
+}
+
+func TestWalk(t *testing.T) {
+	inner := buildZip(t, file{"b.epub", []byte("b")}, file{"deeper.zip", buildZip(t, file{"c.epub", []byte("c")})})
+	data := buildZip(t,
+		file{"books/a.epub", []byte("a")},
+		file{"books/", nil},
+		file{"../../evil.epub", []byte("x")},
+		file{`C:\windows.epub`, []byte("x")},
+		file{"inner.zip", inner},
+	)
+
+	got, err := walk("bundle.zip", data, Limits{MaxDepth: 1})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+
+	want := map[string]string{
+		"books/a.epub":         "a",
+		"evil.epub":            "error: " + ErrInvalidPath.Error(),
+		"windows.epub":         "error: " + ErrInvalidPath.Error(),
+		"inner.zip/b.epub":     "b",
+		"inner.zip/deeper.zip": "error: " + ErrTooDeep.Error(),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect entries; expected: %v; got: %v", want, got)
+	}
+}
+
+func TestWalkTar(t *testing.T) {
+	data := buildTarGz(t, file{"a.epub", []byte("a")}, file{"./dir/../b.epub", []byte("b")})
+
+	got, err := walk("bundle.tgz", data, Limits{})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+
+	want := map[string]string{
+		"a.epub":    "a",
+		"b.epub":    "b",
+		"link.epub": "error: " + ErrNotRegular.Error(),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect entries; expected: %v; got: %v", want, got)
+	}
+}
+
+func TestWalkLimits(t *testing.T) {
+	big := bytes.Repeat([]byte{0}, 1<<20)
+	data := buildZip(t, file{"a.epub", big}, file{"b.epub", big}, file{"c.epub", []byte("c")})
+
+	tests := []struct {
+		name   string
+		limits Limits
+		want   error
+	}{
+		{name: "files", limits: Limits{MaxFiles: 2}, want: ErrTooManyFiles},
+		{name: "file size", limits: Limits{MaxFileSize: 1 << 19}, want: ErrFileTooLarge},
+		{name: "total size", limits: Limits{MaxTotalSize: 3 << 19}, want: ErrTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := walk("bomb.zip", data, tt.limits); !errors.Is(err, tt.want) {
+				t.Errorf("incorrect error; expected: %v; got: %v", tt.want, err)
+			}
+		})
+	}
+}
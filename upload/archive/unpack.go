@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+// kepubExt is the double extension of KEPUBs, kept whole by the suffixes of
+// the names
+const kepubExt = ".kepub.epub"
+
+// Saver saves a single book, as upload.Core does.
+type Saver interface {
+	Save(ctx context.Context, name string, src io.ReadCloser, md upload.Metadata) (upload.Result, error)
+}
+
+// Unpacker saves the books of an uploaded archive one by one, so that each
+// goes through the processors and stores of the Saver as if it had been
+// uploaded on its own.
+type Unpacker struct {
+	saver  Saver
+	limits Limits
+	accept func(name string) bool
+}
+
+// NewUnpacker returns an Unpacker saving the entries of archives with the
+// saver. Only the entries whose file name is accepted are saved, all of them
+// when accept is nil.
+func NewUnpacker(saver Saver, limits Limits, accept func(name string) bool) *Unpacker {
+	return &Unpacker{saver: saver, limits: limits, accept: accept}
+}
+
+// Save saves every book found in the archive, returning a result per file of
+// the archive. Books are saved under their file name without the folders of
+// the archive, as Calibre only adds the books at the top of its watch folder;
+// books of the same name in different folders get a numbered suffix so they do
+// not overwrite each other.
+// Files which are not accepted, or could not be saved, are reported with an
+// error rather than failing the archive; hitting one of the limits stops the
+// extraction and is reported as the result of the archive itself. The
+// metadata provided for the archive only contributes its tags and language
+// since the books have little else in common.
+func (u *Unpacker) Save(ctx context.Context, name string, r io.ReaderAt, size int64, md upload.Metadata) ([]upload.Result, error) {
+	shared := upload.Metadata{Tags: md.Tags, Language: md.Language}
+
+	var results []upload.Result
+	taken := map[string]bool{}
+	err := Walk(ctx, name, r, size, u.limits, func(e Entry) error {
+		res := upload.Result{Filename: e.Path}
+
+		switch {
+		case e.Err != nil:
+			res.Error = e.Err.Error()
+
+		case u.accept != nil && !u.accept(e.Name()):
+			res.Error = upload.ErrUnsupportedFormat.Error()
+
+		default:
+			saved, err := u.saver.Save(ctx, uniqueName(taken, e.Name()), io.NopCloser(e), shared)
+			switch {
+			case isLimit(err) || ctx.Err() != nil:
+				return err
+			case err != nil:
+				res.Error = err.Error()
+			default:
+				res = saved
+				res.Filename = e.Path
+			}
+		}
+
+		res.Archive = name
+		results = append(results, res)
+		return nil
+	})
+
+	switch {
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case err != nil:
+		results = append(results, upload.Result{Filename: name, Error: err.Error()})
+	}
+
+	return results, nil
+}
+
+// uniqueName returns the name or, when it is taken already, the name with a
+// numbered suffix, and takes it. Names are compared without regard to case as
+// many file systems do.
+func uniqueName(taken map[string]bool, name string) string {
+	ext := path.Ext(name)
+	if strings.HasSuffix(strings.ToLower(name), kepubExt) {
+		ext = name[len(name)-len(kepubExt):]
+	}
+
+	candidate := name
+	for i := 1; taken[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	taken[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// isLimit reports whether the error is one of the limits, which stop the
+// extraction rather than failing a single entry.
+func isLimit(err error) bool {
+	return errors.Is(err, ErrTooLarge) ||
+		errors.Is(err, ErrFileTooLarge) ||
+		errors.Is(err, ErrTooManyFiles)
+}
@@ -0,0 +1,89 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/funayman/logger"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadmem"
+)
+
+func TestUnpacker(t *testing.T) {
+	log, _ := logger.New("TESTS", logger.WithLevel("FATAL"))
+	store := uploadmem.NewStore(log)
+
+	data := buildZip(t,
+		file{"pratchett/book.epub", []byte("Mort")},
+		file{"gaiman/book.epub", []byte("Coraline")},
+		file{"gaiman/Book.kepub.epub", []byte("Coraline for Kobo")},
+		file{"gaiman/more/book.kepub.epub", []byte("Neverwhere for Kobo")},
+		file{"notes.exe", []byte("nope")},
+	)
+	accept := func(name string) bool { return strings.HasSuffix(name, ".epub") }
+	u := NewUnpacker(upload.NewCore(log, store), Limits{MaxFiles: 10}, accept)
+
+	results, err := u.Save(context.Background(), "books.zip", bytes.NewReader(data), int64(len(data)), upload.Metadata{Tags: []string{"fantasy"}})
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("expected a result per entry; got: %+v", results)
+	}
+
+	for _, res := range results {
+		if res.Archive != "books.zip" {
+			t.Errorf("%s: expected archive books.zip; got %q", res.Filename, res.Archive)
+		}
+		if (res.Error != "") != (res.Filename == "notes.exe") {
+			t.Errorf("%s: unexpected error %q", res.Filename, res.Error)
+		}
+	}
+
+	// Calibre only adds the books at the top of its watch folder
+	for name, content := range map[string]string{
+		"book.epub":         "Mort",
+		"book-1.epub":       "Coraline",
+		"Book.kepub.epub":   "Coraline for Kobo",
+		"book-1.kepub.epub": "Neverwhere for Kobo",
+	} {
+		f, ok := store.Get(name)
+		if !ok {
+			t.Errorf("%s: not saved; saved: %q", name, store.Names())
+			continue
+		}
+		if string(f.Data) != content {
+			t.Errorf("%s: expected %q; got %q", name, content, f.Data)
+		}
+		if len(f.Metadata.Tags) != 1 || f.Metadata.Tags[0] != "fantasy" {
+			t.Errorf("%s: expected the archive tags; got %q", name, f.Metadata.Tags)
+		}
+	}
+	if store.Len() != 4 {
+		t.Errorf("expected 4 books saved; got: %q", store.Names())
+	}
+}
+
+func TestUnpackerLimit(t *testing.T) {
+	log, _ := logger.New("TESTS", logger.WithLevel("FATAL"))
+	store := uploadmem.NewStore(log)
+
+	data := buildZip(t, file{"a.epub", []byte("a")}, file{"b.epub", []byte("b")}, file{"c.epub", []byte("c")})
+	u := NewUnpacker(upload.NewCore(log, store), Limits{MaxFiles: 2}, nil)
+
+	results, err := u.Save(context.Background(), "bomb.zip", bytes.NewReader(data), int64(len(data)), upload.Metadata{})
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	last := results[len(results)-1]
+	if last.Filename != "bomb.zip" || !strings.Contains(last.Error, ErrTooManyFiles.Error()) {
+		t.Errorf("expected the limit reported for the archive; got: %+v", last)
+	}
+	if store.Len() != 2 {
+		t.Errorf("expected the entries before the limit saved; got: %q", store.Names())
+	}
+}
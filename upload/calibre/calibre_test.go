@@ -0,0 +1,262 @@
+package calibre
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+// testSchema is the part of the schema of Calibre's metadata.db the library
+// reads.
+const testSchema = `
+CREATE TABLE books (id INTEGER PRIMARY KEY AUTOINCREMENT, title TEXT NOT NULL DEFAULT 'Unknown', sort TEXT, series_index REAL NOT NULL DEFAULT 1.0, author_sort TEXT, path TEXT NOT NULL DEFAULT '');
+CREATE TABLE authors (id INTEGER PRIMARY KEY, name TEXT NOT NULL COLLATE NOCASE, sort TEXT COLLATE NOCASE, link TEXT NOT NULL DEFAULT '', UNIQUE(name));
+CREATE TABLE books_authors_link (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, author INTEGER NOT NULL, UNIQUE(book, author));
+CREATE TABLE series (id INTEGER PRIMARY KEY, name TEXT NOT NULL COLLATE NOCASE, sort TEXT COLLATE NOCASE, link TEXT NOT NULL DEFAULT '', UNIQUE(name));
+CREATE TABLE books_series_link (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, series INTEGER NOT NULL, UNIQUE(book));
+CREATE TABLE identifiers (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, type TEXT NOT NULL DEFAULT 'isbn' COLLATE NOCASE, val TEXT NOT NULL COLLATE NOCASE, UNIQUE(book, type));
+CREATE TABLE data (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, format TEXT NOT NULL COLLATE NOCASE, uncompressed_size INTEGER NOT NULL, name TEXT NOT NULL, UNIQUE(book, format));
+
+INSERT INTO books (id, title) VALUES (1, 'The Colour of Magic'), (2, 'Dune: Deluxe Edition'), (3, 'Poems');
+INSERT INTO authors (id, name, sort) VALUES (1, 'Terry Pratchett', 'Pratchett, Terry'), (2, 'Frank Herbert', 'Herbert, Frank'), (3, 'Doe| Jane', 'Doe, Jane');
+INSERT INTO books_authors_link (book, author) VALUES (1, 1), (2, 2), (3, 3);
+INSERT INTO series (id, name, sort) VALUES (1, 'Discworld', 'Discworld');
+INSERT INTO books_series_link (book, series) VALUES (1, 1);
+INSERT INTO identifiers (book, type, val) VALUES (2, 'isbn', '978-0-441-17271-9'), (2, 'amazon', 'B00B7NPRY8');
+INSERT INTO data (book, format, uncompressed_size, name) VALUES (1, 'EPUB', 100, 'x'), (1, 'AZW3', 100, 'x');
+`
+
+// newLibrary returns a library in a temporary directory, and the directory.
+func newLibrary(t *testing.T) (*Library, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(dir, DatabaseName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(testSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	lib, err := OpenLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lib, dir
+}
+
+func TestLibrary(t *testing.T) {
+	lib, _ := newLibrary(t)
+	books, err := lib.Books(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 3 {
+		t.Fatalf("expected 3 books; got: %+v", books)
+	}
+
+	b := books[1]
+	if b.Title != "Dune: Deluxe Edition" || b.Authors[0] != "Frank Herbert" || len(b.ISBNs) != 1 || b.ISBNs[0] != "9780441172719" {
+		t.Errorf("unexpected book: %+v", b)
+	}
+	if books[2].Authors[0] != "Doe, Jane" || len(books[0].Formats) != 2 || books[0].Series != "Discworld" || books[0].SeriesIndex != 1 {
+		t.Errorf("unexpected books: %+v", books)
+	}
+}
+
+func TestFind(t *testing.T) {
+	lib, _ := newLibrary(t)
+	books, err := lib.Books(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		md        upload.Metadata
+		threshold float64
+		want      int64
+	}{
+		{md: upload.Metadata{ISBN: "9780441172719"}, threshold: 1, want: 2},
+		{md: upload.Metadata{Title: "the colour of magic", Authors: []string{"Pratchett, Terry"}}, threshold: 1, want: 1},
+		{md: upload.Metadata{Title: "Colour of Magic", Authors: []string{"Terry Pratchett"}}, threshold: 1, want: 1},
+		{md: upload.Metadata{Title: "The Color of Magic", Authors: []string{"Terry Pratchet"}}, threshold: 1},
+		{md: upload.Metadata{Title: "The Color of Magic", Authors: []string{"Terry Pratchet"}}, threshold: 0.9, want: 1},
+		{md: upload.Metadata{Title: "Dune", Authors: []string{"Frank Herbert"}}, threshold: 1, want: 2},
+		{md: upload.Metadata{Title: "Poèms", Authors: []string{"Jane Doe"}}, threshold: 1, want: 3},
+		{md: upload.Metadata{Title: "Poems"}, threshold: 1},
+		{md: upload.Metadata{Title: "Poems", Authors: []string{"John Roe"}}, threshold: 0.9},
+	}
+
+	for _, tt := range tests {
+		b, ok := Find(books, tt.md, tt.threshold)
+		if b.ID != tt.want || ok != (tt.want != 0) {
+			t.Errorf("%+v (%.1f): expected book %d; got: %d", tt.md, tt.threshold, tt.want, b.ID)
+		}
+	}
+}
+
+func TestFindVolumes(t *testing.T) {
+	books := []Book{
+		{ID: 1, Title: "Berserk Volume 12", Authors: []string{"Kentaro Miura"}, Series: "Berserk", SeriesIndex: 12},
+		{ID: 2, Title: "Berserk", Authors: []string{"Kentaro Miura"}, Series: "Berserk", SeriesIndex: 14},
+	}
+
+	tests := []struct {
+		md   upload.Metadata
+		want int64
+	}{
+		{md: upload.Metadata{Title: "Berserk Volume 12", Authors: []string{"Kentaro Miura"}}, want: 1},
+		{md: upload.Metadata{Title: "Berserk Volume 012", Authors: []string{"Kentaro Miura"}}, want: 1},
+		{md: upload.Metadata{Title: "Berserk Volume 13", Authors: []string{"Kentaro Miura"}}},
+		{md: upload.Metadata{Title: "Berserk", Authors: []string{"Kentaro Miura"}, Series: "Berserk", SeriesIndex: 14}, want: 2},
+		{md: upload.Metadata{Title: "Berserk", Authors: []string{"Kentaro Miura"}, Series: "Berserk", SeriesIndex: 13}},
+	}
+
+	for _, tt := range tests {
+		b, ok := Find(books, tt.md, 0.9)
+		if b.ID != tt.want || ok != (tt.want != 0) {
+			t.Errorf("%+v: expected book %d; got: %d", tt.md, tt.want, b.ID)
+		}
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	lib, _ := newLibrary(t)
+	md := upload.Metadata{Title: "The Colour of Magic", Authors: []string{"Terry Pratchett"}}
+	data := []byte("book")
+
+	core := upload.NewCore(zap.NewNop().Sugar(), nil, upload.WithProcessors(NewDuplicates(lib, 0.9, false)))
+	res, err := core.Inspect(context.Background(), "book.epub", bytes.NewReader(data), int64(len(data)), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Problems) != 1 || res.Problems[0].Code != CodeDuplicate {
+		t.Errorf("expected duplicate warning; got: %+v", res.Problems)
+	}
+
+	core = upload.NewCore(zap.NewNop().Sugar(), nil, upload.WithProcessors(NewDuplicates(lib, 0.9, true)))
+	_, err = core.Inspect(context.Background(), "book.epub", bytes.NewReader(data), int64(len(data)), md)
+	if !upload.IsRejected(err) {
+		t.Errorf("expected rejection; got: %v", err)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	ctx := context.Background()
+	lib, dir := newLibrary(t)
+	watch := t.TempDir()
+	if err := os.WriteFile(filepath.Join(watch, "mort.epub"), []byte("book"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := NewTracker(lib, watch, "https://books.example.com/", time.Hour)
+	mark, err := tracker.Mark(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tracker.Track(ctx, mark, "mort.epub", "elsewhere.epub", upload.Metadata{}); ok {
+		t.Error("expected upload outside of the watched folder not to be tracked")
+	}
+	id, ok := tracker.Track(ctx, mark, "mort.epub", "mort.epub", upload.Metadata{Authors: []string{"Terry Pratchett"}})
+	if !ok {
+		t.Fatal("expected upload to be tracked")
+	}
+
+	status := func(want string) Ingestion {
+		t.Helper()
+		in, err := tracker.Status(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in.Status != want {
+			t.Fatalf("expected: %s; got: %+v", want, in)
+		}
+		return in
+	}
+
+	status(IngestWaiting)
+	if err := os.Remove(filepath.Join(watch, "mort.epub")); err != nil {
+		t.Fatal(err)
+	}
+	status(IngestImporting)
+
+	// Calibre adds the book, named after the file
+	db, err := sql.Open("sqlite", filepath.Join(dir, DatabaseName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("INSERT INTO books (id, title) VALUES (4, 'Mort')"); err != nil {
+		t.Fatal(err)
+	}
+	// the library is read again when the database was modified
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, DatabaseName), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	in := status(IngestDone)
+	if in.BookID != 4 || in.URL != "https://books.example.com/book/4" {
+		t.Errorf("unexpected ingestion: %+v", in)
+	}
+
+	if _, err := tracker.Status(ctx, "unknown"); !errors.Is(err, ErrUnknownIngestion) {
+		t.Errorf("expected ErrUnknownIngestion; got: %v", err)
+	}
+}
+
+func TestTrackerFastImport(t *testing.T) {
+	ctx := context.Background()
+	lib, dir := newLibrary(t)
+	watch := t.TempDir()
+
+	tracker := NewTracker(lib, watch, "", time.Hour)
+	mark, err := tracker.Mark(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Calibre adds the book before the upload is tracked
+	if err := os.WriteFile(filepath.Join(watch, "mort.epub"), []byte("book"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", filepath.Join(dir, DatabaseName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("INSERT INTO books (id, title) VALUES (4, 'Mort')"); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, DatabaseName), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	id, ok := tracker.Track(ctx, mark, "mort.epub", "mort.epub", upload.Metadata{})
+	if !ok {
+		t.Fatal("expected upload to be tracked")
+	}
+	if err := os.Remove(filepath.Join(watch, "mort.epub")); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := tracker.Status(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Status != IngestDone || in.BookID != 4 {
+		t.Errorf("expected book 4 to be found; got: %+v", in)
+	}
+}
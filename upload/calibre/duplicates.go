@@ -0,0 +1,204 @@
+package calibre
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+// CodeDuplicate is the code of the problem reported, or of the rejection,
+// for uploads the library already holds.
+const CodeDuplicate = "DUPLICATE"
+
+// reNumber finds the numbers of normalized titles
+var reNumber = regexp.MustCompile(`\d+`)
+
+// leading articles ignored when comparing titles
+var articles = []string{"the", "a", "an"}
+
+// Duplicates is an upload.Processor finding the uploads a Calibre library
+// already holds, by ISBN or by title and author. Duplicates are reported as a
+// warning, or refused.
+type Duplicates struct {
+	library   *Library
+	threshold float64
+	refuse    bool
+}
+
+// NewDuplicates returns a processor comparing uploads with the books of the
+// library. Titles and authors match when their similarity, between 0 and 1, is
+// at least threshold; 1 only matches titles and authors which differ in case,
+// accents, punctuation and leading articles. Duplicates are rejected when
+// refuse is true.
+func NewDuplicates(library *Library, threshold float64, refuse bool) *Duplicates {
+	return &Duplicates{library: library, threshold: threshold, refuse: refuse}
+}
+
+// Process implements the upload.Processor interface.
+func (d *Duplicates) Process(ctx context.Context, f *upload.File) error {
+	books, err := d.library.Books(ctx)
+	if err != nil {
+		return err
+	}
+
+	book, ok := Find(books, f.Metadata, d.threshold)
+	if !ok {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%q by %s is already in the library", book.Title, strings.Join(book.Authors, " & "))
+	if len(book.Formats) > 0 {
+		msg += " as " + strings.Join(book.Formats, ", ")
+	}
+	if d.refuse {
+		return upload.Reject(CodeDuplicate, msg)
+	}
+
+	f.Problems = append(f.Problems, upload.Problem{Code: CodeDuplicate, Severity: upload.SeverityWarning, Message: msg})
+	return nil
+}
+
+func (d *Duplicates) String() string { return "duplicates" }
+
+// Find returns the first book with the ISBN of the upload or, failing that,
+// with a matching title and author, see NewDuplicates for the threshold.
+// Uploads without an author only match by ISBN. The numbers of the titles and
+// the series indexes of books in a series must be the same, so that the
+// volumes of a series are not taken for each other.
+func Find(books []Book, md upload.Metadata, threshold float64) (Book, bool) {
+	if md.ISBN != "" {
+		for _, b := range books {
+			if slices.Contains(b.ISBNs, md.ISBN) {
+				return b, true
+			}
+		}
+	}
+
+	if md.Title == "" || len(md.Authors) == 0 {
+		return Book{}, false
+	}
+
+	titles := titleKeys(md.Title)
+	authors := make([]string, len(md.Authors))
+	for i, a := range md.Authors {
+		authors[i] = authorKey(a)
+	}
+
+	for _, b := range books {
+		if md.Series != "" && b.Series != "" && md.SeriesIndex != 0 && md.SeriesIndex != b.SeriesIndex {
+			continue
+		}
+		if !titleMatches(titles, titleKeys(b.Title), threshold) {
+			continue
+		}
+		for _, a := range b.Authors {
+			key := authorKey(a)
+			if slices.ContainsFunc(authors, func(s string) bool { return similarity(s, key) >= threshold }) {
+				return b, true
+			}
+		}
+	}
+
+	return Book{}, false
+}
+
+// titleMatches compares the titles, and the titles without their subtitles.
+// Titles only match when they hold the same numbers.
+func titleMatches(a, b []string, threshold float64) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if slices.Equal(numbers(x), numbers(y)) && similarity(x, y) >= threshold {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// titleKeys returns the normalized title and, for titles with a subtitle, the
+// normalized main title.
+func titleKeys(title string) []string {
+	keys := []string{normalize(title, true)}
+	if main, _, ok := strings.Cut(title, ":"); ok {
+		keys = append(keys, normalize(main, true))
+	}
+	return keys
+}
+
+// numbers returns the numbers of the normalized text, without leading zeros so
+// that "Volume 01" and "Volume 1" hold the same number.
+func numbers(s string) []string {
+	var nums []string
+	for _, n := range reNumber.FindAllString(s, -1) {
+		if n = strings.TrimLeft(n, "0"); n == "" {
+			n = "0"
+		}
+		nums = append(nums, n)
+	}
+	return nums
+}
+
+// authorKey returns the normalized words of the name in order, so that "Doe,
+// Jane" and "Jane Doe" are the same author.
+func authorKey(name string) string {
+	words := strings.Fields(normalize(name, false))
+	slices.Sort(words)
+	return strings.Join(words, " ")
+}
+
+// normalize lowers the text and removes its accents, punctuation and, for
+// titles, leading article.
+func normalize(s string, title bool) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	if r, _, err := transform.String(t, s); err == nil {
+		s = r
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if title && len(words) > 1 && slices.Contains(articles, words[0]) {
+		words = words[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// similarity returns 1 minus the edit distance of the strings relative to the
+// longest of them.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	n := max(len(ra), len(rb))
+	if n == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(n)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
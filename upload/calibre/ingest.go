@@ -0,0 +1,192 @@
+package calibre
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+// States of an ingestion.
+const (
+	// IngestWaiting is an upload still in the watched folder.
+	IngestWaiting = "waiting"
+	// IngestImporting is an upload Calibre took from the watched folder but
+	// which is not in the library yet.
+	IngestImporting = "importing"
+	// IngestDone is an upload found in the library.
+	IngestDone = "ingested"
+	// IngestTimedOut is an upload not found in the library in time.
+	IngestTimedOut = "timeout"
+)
+
+const (
+	// Calibre imports the books with the metadata it reads from them, only
+	// new books are searched so titles match more loosely than duplicates
+	ingestThreshold = 0.8
+
+	// how long ingestions are kept once they timed out
+	ingestRetention = time.Hour
+)
+
+var (
+	ErrUnknownIngestion = errors.New("unknown ingestion")
+)
+
+// Ingestion is the progress of Calibre importing an upload.
+type Ingestion struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Status   string `json:"status"`
+	BookID   int64  `json:"book_id,omitempty"`
+	Title    string `json:"title,omitempty"`
+	// URL is the page of the book in Calibre-Web.
+	URL string `json:"url,omitempty"`
+}
+
+type ingestion struct {
+	Ingestion
+	path    string
+	md      upload.Metadata
+	lastID  int64
+	started time.Time
+}
+
+// Tracker follows uploads saved to the folder Calibre watches until Calibre
+// takes them from the folder and adds them to its library.
+type Tracker struct {
+	library *Library
+	dir     string
+	webURL  string
+	timeout time.Duration
+
+	mu         sync.Mutex
+	ingestions map[string]*ingestion
+}
+
+// NewTracker returns a tracker for the uploads saved to dir, the folder
+// Calibre adds books from to the library. The books are linked to their page
+// in the Calibre-Web instance at webURL, which may be relative to the
+// uploader. Uploads not found in the library within timeout are given up.
+func NewTracker(library *Library, dir, webURL string, timeout time.Duration) *Tracker {
+	return &Tracker{
+		library:    library,
+		dir:        dir,
+		webURL:     strings.TrimSuffix(webURL, "/"),
+		timeout:    timeout,
+		ingestions: map[string]*ingestion{},
+	}
+}
+
+// Mark returns the highest ID of the books in the library. It is taken before
+// saving the uploads passed to Track, as Calibre may add them to the library
+// as soon as they are saved.
+func (t *Tracker) Mark(ctx context.Context) (int64, error) {
+	books, err := t.library.Books(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var mark int64
+	for _, b := range books {
+		mark = max(mark, b.ID)
+	}
+	return mark, nil
+}
+
+// Track starts following the upload saved under key, returning the ID of its
+// ingestion. Only the books added to the library after mark, as returned by
+// Mark before saving, can be the upload. Uploads which are not in the watched
+// folder, because they were saved to another store, are not tracked.
+func (t *Tracker) Track(ctx context.Context, mark int64, filename, key string, md upload.Metadata) (string, bool) {
+	path := filepath.Join(t.dir, filepath.FromSlash(key))
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+
+	// Calibre titles books without metadata after their file
+	if md.Title == "" {
+		md.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	in := &ingestion{
+		Ingestion: Ingestion{ID: uuid.NewString(), Filename: filename, Status: IngestWaiting},
+		path:      path,
+		md:        md,
+		lastID:    mark,
+		started:   time.Now(),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, old := range t.ingestions {
+		if time.Since(old.started) > t.timeout+ingestRetention {
+			delete(t.ingestions, id)
+		}
+	}
+	t.ingestions[in.ID] = in
+
+	return in.ID, true
+}
+
+// Status returns the progress of the ingestion, checking the watched folder
+// and the library.
+func (t *Tracker) Status(ctx context.Context, id string) (Ingestion, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	in, ok := t.ingestions[id]
+	if !ok {
+		return Ingestion{}, ErrUnknownIngestion
+	}
+	if in.Status == IngestDone || in.Status == IngestTimedOut {
+		return in.Ingestion, nil
+	}
+
+	if _, err := os.Stat(in.path); errors.Is(err, os.ErrNotExist) {
+		in.Status = IngestImporting
+
+		books, err := t.library.Books(ctx)
+		if err != nil {
+			return Ingestion{}, err
+		}
+		if b, ok := t.find(books, in); ok {
+			in.Status, in.BookID, in.Title = IngestDone, b.ID, b.Title
+			in.URL = t.webURL + "/book/" + strconv.FormatInt(b.ID, 10)
+			return in.Ingestion, nil
+		}
+	}
+
+	if time.Since(in.started) > t.timeout {
+		in.Status = IngestTimedOut
+	}
+	return in.Ingestion, nil
+}
+
+// find returns the book added since the upload was tracked with its ISBN or
+// title.
+func (t *Tracker) find(books []Book, in *ingestion) (Book, bool) {
+	titles := titleKeys(in.md.Title)
+	for _, b := range books {
+		if b.ID <= in.lastID {
+			continue
+		}
+		if in.md.ISBN != "" && slices.Contains(b.ISBNs, in.md.ISBN) {
+			return b, true
+		}
+		if titleMatches(titles, titleKeys(b.Title), ingestThreshold) {
+			return b, true
+		}
+	}
+	return Book{}, false
+}
@@ -0,0 +1,211 @@
+// Package calibre reads the books of a Calibre library, to find the uploads
+// the library already holds.
+package calibre
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	// registers the pure Go "sqlite" driver
+	_ "modernc.org/sqlite"
+
+	"github.com/funayman/ebook-uploader/upload/isbn"
+)
+
+// DatabaseName is the name of the database in a Calibre library directory.
+const DatabaseName = "metadata.db"
+
+// Book is a book of the library.
+type Book struct {
+	ID      int64
+	Title   string
+	Authors []string
+	ISBNs   []string
+	// Series is the series of the book, empty when it has none, and
+	// SeriesIndex its place in the series.
+	Series      string
+	SeriesIndex float64
+	// Formats are the formats of the book in the library, such as EPUB.
+	Formats []string
+}
+
+// Library reads the books of a Calibre library. The books are kept in memory
+// and read again when the database changes.
+type Library struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	books   []Book
+}
+
+// OpenLibrary returns the library at path, the library directory or its
+// metadata.db. The database is opened read only, every time it changed.
+func OpenLibrary(path string) (*Library, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		path = filepath.Join(path, DatabaseName)
+	}
+
+	l := &Library{path: path}
+	if _, err := l.Books(context.Background()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Books returns the books of the library.
+func (l *Library) Books(ctx context.Context) ([]Book, error) {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.books != nil && fi.ModTime().Equal(l.modTime) {
+		return l.books, nil
+	}
+
+	books, err := l.read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", l.path, err)
+	}
+	l.books, l.modTime = books, fi.ModTime()
+
+	return books, nil
+}
+
+// read reads the books from the database.
+func (l *Library) read(ctx context.Context) ([]Book, error) {
+	abs, err := filepath.Abs(l.path)
+	if err != nil {
+		return nil, err
+	}
+	dsn := url.URL{
+		Scheme:   "file",
+		Path:     filepath.ToSlash(abs),
+		RawQuery: "mode=ro&_pragma=query_only(1)&_pragma=busy_timeout(5000)",
+	}
+	db, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	books := []Book{}
+	index := map[int64]int{}
+
+	err = query(ctx, db, "SELECT id, title, series_index FROM books ORDER BY id", func(rows *sql.Rows) error {
+		var b Book
+		if err := rows.Scan(&b.ID, &b.Title, &b.SeriesIndex); err != nil {
+			return err
+		}
+		index[b.ID] = len(books)
+		books = append(books, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Calibre stores the commas of author names as |
+	err = query(ctx, db, "SELECT l.book, a.name FROM books_authors_link l JOIN authors a ON a.id = l.author ORDER BY l.id", func(rows *sql.Rows) error {
+		var (
+			id   int64
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			books[i].Authors = append(books[i].Authors, strings.ReplaceAll(name, "|", ","))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = query(ctx, db, "SELECT l.book, s.name FROM books_series_link l JOIN series s ON s.id = l.series", func(rows *sql.Rows) error {
+		var (
+			id   int64
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			books[i].Series = name
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = query(ctx, db, "SELECT book, val FROM identifiers WHERE type = 'isbn'", func(rows *sql.Rows) error {
+		var (
+			id  int64
+			val string
+		)
+		if err := rows.Scan(&id, &val); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			if n, ok := isbn.Normalize(val); ok {
+				books[i].ISBNs = append(books[i].ISBNs, n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = query(ctx, db, "SELECT book, format FROM data ORDER BY format", func(rows *sql.Rows) error {
+		var (
+			id     int64
+			format string
+		)
+		if err := rows.Scan(&id, &format); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			books[i].Formats = append(books[i].Formats, format)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return books, nil
+}
+
+// query calls scan for every row the query returns.
+func query(ctx context.Context, db *sql.DB, q string, scan func(*sql.Rows) error) error {
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
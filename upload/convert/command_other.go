@@ -0,0 +1,14 @@
+//go:build !unix
+
+package convert
+
+import (
+	"context"
+	"os/exec"
+)
+
+// limitedCommand runs the command without resource limits, which are not
+// supported on this platform.
+func limitedCommand(ctx context.Context, cfg Config, args []string) *exec.Cmd {
+	return exec.CommandContext(ctx, cfg.Command, args...)
+}
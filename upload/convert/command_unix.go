@@ -0,0 +1,38 @@
+//go:build unix
+
+package convert
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// limitedCommand runs the command in its own process group, applying the
+// resource limits through the shell's ulimit.
+func limitedCommand(ctx context.Context, cfg Config, args []string) *exec.Cmd {
+	name := cfg.Command
+
+	if cfg.MaxMemory > 0 || cfg.MaxCPU > 0 {
+		script := ""
+		if cfg.MaxMemory > 0 {
+			script += fmt.Sprintf("ulimit -v %d || exit 1; ", max(cfg.MaxMemory>>10, 1))
+		}
+		if cfg.MaxCPU > 0 {
+			script += fmt.Sprintf("ulimit -t %d || exit 1; ", max(int64(cfg.MaxCPU.Seconds()+0.5), 1))
+		}
+		script += `exec "$@"`
+
+		args = append([]string{"-c", script, "sh", name}, args...)
+		name = "/bin/sh"
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	return cmd
+}
@@ -0,0 +1,274 @@
+// Package convert runs an external command, such as Calibre's ebook-convert,
+// to convert uploads the uploader cannot handle natively. The Converter is a
+// transformer of the upload pipeline.
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+var (
+	ErrNoCommand    = errors.New("no conversion command configured")
+	ErrTimeout      = errors.New("conversion timed out")
+	ErrOutputTooBig = errors.New("conversion output too large")
+	ErrNoOutput     = errors.New("conversion produced no output")
+)
+
+// Config configures a Converter. The command is invoked the way ebook-convert
+// expects it: `Command input output Args...`, with both files in a temporary
+// directory which is removed afterwards.
+type Config struct {
+	Command string
+	Args    []string
+
+	// Formats lists the extensions converted, such as ".lit" or ".doc".
+	Formats []string
+	// Output is the extension of the converted file, ".epub" when empty.
+	Output string
+	// KeepOriginal stores the uploaded file as well as the converted one.
+	KeepOriginal bool
+
+	// Timeout bounds a single conversion, including the time spent waiting
+	// for a free slot.
+	Timeout time.Duration
+	// Concurrency is the number of conversions run at the same time. Further
+	// conversions wait for a slot.
+	Concurrency int
+	// MaxOutputSize rejects conversions producing larger files.
+	MaxOutputSize int64
+	// MaxMemory and MaxCPU cap the address space and the CPU time of the
+	// command where the platform supports resource limits.
+	MaxMemory int64
+	MaxCPU    time.Duration
+}
+
+type Converter struct {
+	log *zap.SugaredLogger
+	cfg Config
+	sem chan struct{}
+}
+
+func NewConverter(log *zap.SugaredLogger, cfg Config) (*Converter, error) {
+	if cfg.Command == "" {
+		return nil, ErrNoCommand
+	}
+	if _, err := exec.LookPath(cfg.Command); err != nil {
+		return nil, fmt.Errorf("conversion command: %w", err)
+	}
+
+	if cfg.Output == "" {
+		cfg.Output = ".epub"
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	for i, f := range cfg.Formats {
+		cfg.Formats[i] = normalizeExt(f)
+	}
+	cfg.Output = normalizeExt(cfg.Output)
+
+	return &Converter{
+		log: log,
+		cfg: cfg,
+		sem: make(chan struct{}, cfg.Concurrency),
+	}, nil
+}
+
+// Accepts reports whether files with the name are converted.
+func (c *Converter) Accepts(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, f := range c.cfg.Formats {
+		if f == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// OutputName returns the name of the file converted from name.
+func (c *Converter) OutputName(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + c.cfg.Output
+}
+
+// Transform implements the upload.Transformer interface, converting the files
+// in one of the formats of the converter. Files which fail to convert are
+// stored as they are.
+func (c *Converter) Transform(ctx context.Context, w io.Writer, name string, r io.ReaderAt, size int64, md upload.Metadata) error {
+	if !c.Accepts(name) {
+		return upload.ErrUnsupportedFormat
+	}
+
+	out, err := c.Convert(ctx, name, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(w, out); err != nil {
+		return fmt.Errorf("copy output: %w", err)
+	}
+	return nil
+}
+
+// Rename implements the upload.Renamer interface.
+func (c *Converter) Rename(name string) string {
+	return c.OutputName(name)
+}
+
+// KeepOriginal implements the upload.Keeper interface.
+func (c *Converter) KeepOriginal() bool {
+	return c.cfg.KeepOriginal
+}
+
+// Convert converts the source and returns the converted file. The file is
+// removed from disk when it is closed.
+func (c *Converter) Convert(ctx context.Context, name string, src io.Reader) (*Output, error) {
+	if c.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.Timeout)
+		defer cancel()
+	}
+
+	select {
+	case c.sem <- struct{}{}:
+		defer func() { <-c.sem }()
+	case <-ctx.Done():
+		return nil, c.ctxErr(ctx)
+	}
+
+	dir, err := os.MkdirTemp("", "upload-convert-*")
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.run(ctx, dir, name, src)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (c *Converter) run(ctx context.Context, dir, name string, src io.Reader) (*Output, error) {
+	// the upload name is never passed to the command, only its extension
+	input := filepath.Join(dir, "input"+strings.ToLower(path.Ext(name)))
+	output := filepath.Join(dir, "output"+c.cfg.Output)
+
+	f, err := os.Create(input)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("write input: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("write input: %w", err)
+	}
+
+	cmd := c.command(ctx, input, output)
+	cmd.Dir = dir
+
+	var stderr bytes.Buffer
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &limitedBuffer{buf: &stderr, max: 4 << 10}
+
+	start := time.Now()
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return nil, c.ctxErr(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", c.cfg.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	fi, err := os.Stat(output)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, ErrNoOutput
+	case err != nil:
+		return nil, err
+	case c.cfg.MaxOutputSize > 0 && fi.Size() > c.cfg.MaxOutputSize:
+		return nil, fmt.Errorf("%w: %d bytes", ErrOutputTooBig, fi.Size())
+	}
+
+	c.log.Infow("converted upload", "filename", name, "command", c.cfg.Command, "duration", time.Since(start), "bytes", fi.Size())
+
+	of, err := os.Open(output)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Output{File: of, Name: c.OutputName(name), Size: fi.Size(), dir: dir}, nil
+}
+
+// command builds the command converting input to output. Where supported,
+// the whole process group is killed when the context is done since converters
+// like ebook-convert spawn workers of their own.
+func (c *Converter) command(ctx context.Context, input, output string) *exec.Cmd {
+	args := append([]string{input, output}, c.cfg.Args...)
+
+	cmd := limitedCommand(ctx, c.cfg, args)
+	cmd.WaitDelay = 5 * time.Second
+
+	return cmd
+}
+
+func (c *Converter) ctxErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
+// =============================================================================
+
+// Output is a converted file.
+type Output struct {
+	*os.File
+	Name string
+	Size int64
+	dir  string
+}
+
+// Close closes and removes the converted file.
+func (o *Output) Close() error {
+	err := o.File.Close()
+	os.RemoveAll(o.dir)
+	return err
+}
+
+// limitedBuffer keeps the first max bytes written to it, discarding the rest.
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if n := lb.max - lb.buf.Len(); n > 0 {
+		lb.buf.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
+
+func normalizeExt(ext string) string {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
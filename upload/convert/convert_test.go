@@ -0,0 +1,213 @@
+//go:build unix
+
+package convert
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadmem"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+// stub writes a script standing in for ebook-convert.
+func stub(t *testing.T, body string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "ebook-convert")
+	if err := os.WriteFile(p, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	return p
+}
+
+func TestConvert(t *testing.T) {
+	// uppercases the input, recording the arguments
+	cmd := stub(t, `tr a-z A-Z < "$1" > "$2"; echo "$3" >> "$2"`)
+
+	c, err := NewConverter(log, Config{
+		Command: cmd,
+		Args:    []string{"--no-default-epub-cover"},
+		Formats: []string{"lit", ".DOC"},
+	})
+	if err != nil {
+		t.Fatalf("NewConverter: %v", err)
+	}
+
+	if !c.Accepts("book.doc") || c.Accepts("book.epub") {
+		t.Fatalf("incorrect accepted formats")
+	}
+
+	out, err := c.Convert(context.Background(), "my book.doc", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	data, _ := io.ReadAll(out)
+	out.Close()
+
+	if got, want := string(data), "HELLO--no-default-epub-cover\n"; got != want {
+		t.Errorf("incorrect output; expected: %q; got: %q", want, got)
+	}
+	if out.Name != "my book.epub" {
+		t.Errorf("incorrect output name; expected: my book.epub; got: %q", out.Name)
+	}
+	if _, err := os.Stat(out.dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected work directory to be removed")
+	}
+}
+
+func TestConvertLimits(t *testing.T) {
+	cmd := stub(t, `ulimit -v > "$2"; ulimit -t >> "$2"`)
+
+	c, err := NewConverter(log, Config{
+		Command:   cmd,
+		Formats:   []string{".lit"},
+		MaxMemory: 512 << 20,
+		MaxCPU:    30 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewConverter: %v", err)
+	}
+
+	out, err := c.Convert(context.Background(), "book.lit", strings.NewReader("x"))
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	defer out.Close()
+
+	data, _ := io.ReadAll(out)
+	if got, want := string(data), "524288\n30\n"; got != want {
+		t.Errorf("incorrect limits; expected: %q; got: %q", want, got)
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		script string
+		cfg    Config
+		want   error
+	}{
+		{name: "timeout", script: `sleep 5; cp "$1" "$2"`, cfg: Config{Timeout: 100 * time.Millisecond}, want: ErrTimeout},
+		{name: "no output", script: `exit 0`, want: ErrNoOutput},
+		{name: "too big", script: `head -c 2048 /dev/zero > "$2"`, cfg: Config{MaxOutputSize: 1024}, want: ErrOutputTooBig},
+		{name: "failure", script: `echo broken >&2; exit 3`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Command = stub(t, tt.script)
+			tt.cfg.Formats = []string{".lit"}
+
+			c, err := NewConverter(log, tt.cfg)
+			if err != nil {
+				t.Fatalf("NewConverter: %v", err)
+			}
+
+			_, err = c.Convert(context.Background(), "book.lit", strings.NewReader("x"))
+			switch {
+			case err == nil:
+				t.Fatalf("expected an error")
+			case tt.want != nil && !errors.Is(err, tt.want):
+				t.Errorf("incorrect error; expected: %v; got: %v", tt.want, err)
+			case tt.want == nil && !strings.Contains(err.Error(), "broken"):
+				t.Errorf("expected error to contain the command output; got: %v", err)
+			}
+		})
+	}
+}
+
+func TestConvertConcurrency(t *testing.T) {
+	dir := t.TempDir()
+
+	// fails when another conversion is running at the same time
+	cmd := stub(t, `mkdir "`+dir+`/lock" || exit 1; sleep 0.1; rmdir "`+dir+`/lock"; cp "$1" "$2"`)
+
+	c, err := NewConverter(log, Config{Command: cmd, Formats: []string{".lit"}, Concurrency: 1})
+	if err != nil {
+		t.Fatalf("NewConverter: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := c.Convert(context.Background(), "book.lit", strings.NewReader("x"))
+			if err != nil {
+				errs <- err
+				return
+			}
+			out.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Convert: %v", err)
+	}
+}
+
+func TestTransform(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		script string
+		keep   bool
+		want   map[string]string
+	}{
+		{name: "converted", script: `tr a-z A-Z < "$1" > "$2"`, want: map[string]string{"book.epub": "HELLO"}},
+		{name: "kept", script: `tr a-z A-Z < "$1" > "$2"`, keep: true, want: map[string]string{"book.epub": "HELLO", "book.lit": "hello"}},
+		{name: "failed", script: `exit 1`, keep: true, want: map[string]string{"book.lit": "hello"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewConverter(log, Config{Command: stub(t, tt.script), Formats: []string{".lit"}, KeepOriginal: tt.keep})
+			if err != nil {
+				t.Fatalf("NewConverter: %v", err)
+			}
+			store := uploadmem.NewStore(log)
+			core := upload.NewCore(log, store, upload.WithProcessors(upload.Transform(c)))
+
+			if _, err := core.Save(context.Background(), "book.lit", io.NopCloser(strings.NewReader("hello")), upload.Metadata{}); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			for _, name := range []string{"book.epub", "book.lit"} {
+				f, ok := store.Get(name)
+				if want, expected := tt.want[name]; ok != expected || string(f.Data) != want {
+					t.Errorf("%s: expected %q (saved %t); got %q (saved %t)", name, want, expected, f.Data, ok)
+				}
+			}
+
+			// other formats are left alone
+			if _, err := core.Save(context.Background(), "book.epub", io.NopCloser(strings.NewReader("epub")), upload.Metadata{}); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			if f, _ := store.Get("book.epub"); string(f.Data) != "epub" {
+				t.Errorf("expected the epub unchanged; got %q", f.Data)
+			}
+		})
+	}
+}
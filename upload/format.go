@@ -0,0 +1,38 @@
+package upload
+
+import (
+	"path"
+	"strings"
+)
+
+// Kinds of upload returned by Format.
+const (
+	FormatEbook     = "ebook"
+	FormatComic     = "comic"
+	FormatAudiobook = "audiobook"
+	FormatDocument  = "document"
+)
+
+var formats = map[string]string{
+	".epub": FormatEbook, ".kepub": FormatEbook, ".mobi": FormatEbook,
+	".azw": FormatEbook, ".azw3": FormatEbook, ".prc": FormatEbook,
+	".fb2": FormatEbook, ".lit": FormatEbook, ".pdb": FormatEbook,
+	".lrf": FormatEbook, ".djvu": FormatEbook, ".pdf": FormatEbook,
+
+	".cbz": FormatComic, ".cbr": FormatComic, ".cb7": FormatComic,
+	".cbt": FormatComic,
+
+	".m4b": FormatAudiobook, ".m4a": FormatAudiobook, ".mp3": FormatAudiobook,
+	".mp4": FormatAudiobook, ".ogg": FormatAudiobook, ".opus": FormatAudiobook,
+	".flac": FormatAudiobook, ".wav": FormatAudiobook,
+
+	".doc": FormatDocument, ".docx": FormatDocument, ".odt": FormatDocument,
+	".rtf": FormatDocument, ".txt": FormatDocument, ".html": FormatDocument,
+	".md": FormatDocument, ".markdown": FormatDocument,
+}
+
+// Format returns the kind of upload, one of the Format constants, based on
+// the extension of the file name. Unknown extensions return an empty string.
+func Format(name string) string {
+	return formats[strings.ToLower(path.Ext(name))]
+}
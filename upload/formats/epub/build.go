@@ -0,0 +1,185 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/opf"
+)
+
+// Chapter is a chapter of a book created by Build.
+type Chapter struct {
+	Title string
+	// Body is the XHTML content of the chapter body. It must be well formed
+	// and must not contain the body element itself.
+	Body string
+}
+
+// Build writes a minimal EPUB3 book holding the chapters to w. The book has
+// both a navigation document and an NCX so EPUB2 readers find the table of
+// contents as well. Books without a language are marked as undetermined.
+func Build(w io.Writer, md upload.Metadata, chapters []Chapter) error {
+	if md.Title == "" {
+		md.Title = "Untitled"
+	}
+	if md.Language == "" {
+		md.Language = "und"
+	}
+
+	uid := "urn:uuid:" + newUUID()
+	if md.ISBN != "" {
+		uid = "urn:isbn:" + md.ISBN
+	}
+
+	type file struct {
+		name string
+		data []byte
+	}
+	files := []file{
+		{containerPath, []byte(buildContainer)},
+		{"OEBPS/content.opf", buildPackage(md, uid, len(chapters))},
+		{"OEBPS/nav.xhtml", buildChapterNav(md, chapters)},
+		{"OEBPS/toc.ncx", buildChapterNCX(md, uid, chapters)},
+	}
+	for i, c := range chapters {
+		files = append(files, file{"OEBPS/" + chapterFile(i), buildChapter(md.Language, c)})
+	}
+
+	zw := zip.NewWriter(w)
+	if err := writeMimetype(zw); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, f := range files {
+		if err := writeFile(zw, f.name, now, f.data); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+const buildContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+func chapterFile(i int) string {
+	return fmt.Sprintf("chapter-%03d.xhtml", i+1)
+}
+
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func buildPackage(md upload.Metadata, uid string, chapters int) []byte {
+	var b bytes.Buffer
+
+	// the ISBN, if any, is the unique identifier already
+	md.ISBN = ""
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<package xmlns="` + opf.NamespaceOPF + `" version="3.0" unique-identifier="uid">` + "\n")
+	b.WriteString(`  <metadata xmlns:dc="` + opf.NamespaceDC + `" xmlns:opf="` + opf.NamespaceOPF + `">` + "\n")
+	b.WriteString(`    <dc:identifier id="uid">` + escape(uid) + "</dc:identifier>\n")
+	b.Write(opf.MetadataElementsEPUB3(md, "    "))
+	b.WriteString(`    <meta property="dcterms:modified">` + time.Now().UTC().Format("2006-01-02T15:04:05Z") + "</meta>\n")
+	b.WriteString("  </metadata>\n")
+
+	b.WriteString("  <manifest>\n")
+	b.WriteString(`    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>` + "\n")
+	b.WriteString(`    <item id="ncx" href="toc.ncx" media-type="` + mediaTypeNCX + `"/>` + "\n")
+	for i := 0; i < chapters; i++ {
+		fmt.Fprintf(&b, `    <item id="chapter-%d" href="%s" media-type="application/xhtml+xml"/>`+"\n", i+1, chapterFile(i))
+	}
+	b.WriteString("  </manifest>\n")
+
+	b.WriteString(`  <spine toc="ncx">` + "\n")
+	for i := 0; i < chapters; i++ {
+		fmt.Fprintf(&b, `    <itemref idref="chapter-%d"/>`+"\n", i+1)
+	}
+	b.WriteString("  </spine>\n")
+	b.WriteString("</package>\n")
+
+	return b.Bytes()
+}
+
+func buildChapter(lang string, c Chapter) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	b.WriteString("<!DOCTYPE html>\n")
+	b.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="` + escape(lang) + `" lang="` + escape(lang) + `">` + "\n")
+	b.WriteString("<head><title>" + escape(c.Title) + "</title></head>\n")
+	b.WriteString("<body>\n")
+	b.WriteString(c.Body)
+	b.WriteString("\n</body>\n</html>\n")
+
+	return b.Bytes()
+}
+
+func buildChapterNav(md upload.Metadata, chapters []Chapter) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	b.WriteString("<!DOCTYPE html>\n")
+	b.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="` + namespaceOPS + `">` + "\n")
+	b.WriteString("<head><title>" + escape(md.Title) + "</title></head>\n")
+	b.WriteString("<body>\n")
+	b.WriteString(`  <nav epub:type="toc" id="toc">` + "\n")
+	b.WriteString("    <h1>Contents</h1>\n")
+	b.WriteString("    <ol>\n")
+	for i, c := range chapters {
+		b.WriteString(`      <li><a href="` + chapterFile(i) + `">` + escape(c.Title) + "</a></li>\n")
+	}
+	b.WriteString("    </ol>\n")
+	b.WriteString("  </nav>\n")
+	b.WriteString("</body>\n</html>\n")
+
+	return b.Bytes()
+}
+
+func buildChapterNCX(md upload.Metadata, uid string, chapters []Chapter) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<ncx xmlns="` + namespaceNCX + `" version="2005-1">` + "\n")
+	b.WriteString("  <head>\n")
+	b.WriteString(`    <meta name="dtb:uid" content="` + escape(uid) + `"/>` + "\n")
+	b.WriteString(`    <meta name="dtb:depth" content="1"/>` + "\n")
+	b.WriteString(`    <meta name="dtb:totalPageCount" content="0"/>` + "\n")
+	b.WriteString(`    <meta name="dtb:maxPageNumber" content="0"/>` + "\n")
+	b.WriteString("  </head>\n")
+	b.WriteString("  <docTitle><text>" + escape(md.Title) + "</text></docTitle>\n")
+	b.WriteString("  <navMap>\n")
+	for i, c := range chapters {
+		fmt.Fprintf(&b, `    <navPoint id="navpoint-%d" playOrder="%d">`+"\n", i+1, i+1)
+		b.WriteString("      <navLabel><text>" + escape(c.Title) + "</text></navLabel>\n")
+		b.WriteString(`      <content src="` + chapterFile(i) + `"/>` + "\n")
+		b.WriteString("    </navPoint>\n")
+	}
+	b.WriteString("  </navMap>\n")
+	b.WriteString("</ncx>\n")
+
+	return b.Bytes()
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
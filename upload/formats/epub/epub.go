@@ -0,0 +1,254 @@
+// Package epub provides support for reading EPUB containers.
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/opf"
+	"github.com/funayman/ebook-uploader/upload/isbn"
+)
+
+const (
+	MimeType      = "application/epub+zip"
+	containerPath = "META-INF/container.xml"
+
+	// the part of the book searched for an ISBN when the package has none
+	isbnDocuments = 5
+	isbnTextSize  = 64 << 10
+
+	// maxFileSize bounds the documents of the container read into memory,
+	// such as the package document and the XHTML of the spine, so that a
+	// small archive cannot expand into a huge document.
+	maxFileSize = 8 << 20
+)
+
+var (
+	ErrNoRootFile   = errors.New("container has no rootfile")
+	ErrFileTooLarge = errors.New("file too large to read")
+)
+
+// Book is an opened EPUB container.
+type Book struct {
+	Zip *zip.Reader
+
+	// RootFile is the path of the package document within the container.
+	RootFile string
+	Package  *opf.Package
+}
+
+// Open reads the container and package document of the EPUB.
+func Open(r io.ReaderAt, size int64) (*Book, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("zip: %w", err)
+	}
+
+	root, err := rootFile(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := readFile(zr, root)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg, err := opf.Parse(bytes.NewReader(doc))
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", root, err)
+	}
+
+	return &Book{Zip: zr, RootFile: root, Package: pkg}, nil
+}
+
+// Resolve returns the container path of an href found in the package
+// document.
+func (b *Book) Resolve(href string) string {
+	return path.Join(path.Dir(b.RootFile), hrefPath(href))
+}
+
+// hrefPath returns the path of an href without its query and fragment,
+// unescaped as in Text/chapter%201.xhtml, or as is when the escaping is
+// invalid.
+func hrefPath(href string) string {
+	if i := strings.IndexAny(href, "#?"); i >= 0 {
+		href = href[:i]
+	}
+	if p, err := url.PathUnescape(href); err == nil {
+		href = p
+	}
+	return href
+}
+
+// Item returns the manifest item with the id.
+func (b *Book) Item(id string) (opf.Item, bool) {
+	for _, it := range b.Package.Manifest {
+		if it.ID == id && id != "" {
+			return it, true
+		}
+	}
+	return opf.Item{}, false
+}
+
+// Nav returns the manifest item of the EPUB3 navigation document.
+func (b *Book) Nav() (opf.Item, bool) {
+	for _, it := range b.Package.Manifest {
+		if slices.Contains(strings.Fields(it.Properties), "nav") {
+			return it, true
+		}
+	}
+	return opf.Item{}, false
+}
+
+func rootFile(zr *zip.Reader) (string, error) {
+	doc, err := readFile(zr, containerPath)
+	if err != nil {
+		return "", err
+	}
+
+	var container struct {
+		RootFiles []struct {
+			FullPath  string `xml:"full-path,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.NewDecoder(bytes.NewReader(doc)).Decode(&container); err != nil {
+		return "", fmt.Errorf("parse %s: %w", containerPath, err)
+	}
+
+	for _, rf := range container.RootFiles {
+		if rf.MediaType == "" || rf.MediaType == "application/oebps-package+xml" {
+			return rf.FullPath, nil
+		}
+	}
+
+	return "", ErrNoRootFile
+}
+
+// readFile reads the entry of the container, refusing entries larger than
+// maxFileSize rather than reading them.
+func readFile(zr *zip.Reader, name string) ([]byte, error) {
+	f, err := zr.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	// the size of the header is checked first, the limit still applies to
+	// entries lying about it
+	if fi, err := f.Stat(); err == nil && fi.Size() > maxFileSize {
+		return nil, fmt.Errorf("%s: %w", name, ErrFileTooLarge)
+	}
+	data, err := io.ReadAll(io.LimitReader(f, maxFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	if len(data) > maxFileSize {
+		return nil, fmt.Errorf("%s: %w", name, ErrFileTooLarge)
+	}
+	return data, nil
+}
+
+// =============================================================================
+
+// Extractor reads the metadata of EPUB uploads.
+type Extractor struct{}
+
+// Extract implements the upload.Extractor interface.
+func (Extractor) Extract(name string, r io.ReaderAt, size int64) (upload.Metadata, error) {
+	if !IsEPUB(name) {
+		return upload.Metadata{}, upload.ErrUnsupportedFormat
+	}
+
+	b, err := Open(r, size)
+	if err != nil {
+		return upload.Metadata{}, err
+	}
+
+	md := b.Package.BookMetadata()
+
+	// books without an ISBN identifier usually still print it on the
+	// copyright page, found in the first few documents
+	if md.ISBN == "" {
+		if found := isbn.Find(b.Text(isbnDocuments, isbnTextSize)); len(found) > 0 {
+			md.ISBN = found[0]
+		}
+	}
+
+	return md, nil
+}
+
+// Sample implements the language.Sampler interface, returning the text of the
+// spine up to max bytes.
+func (Extractor) Sample(name string, r io.ReaderAt, size int64, max int) (string, error) {
+	if !IsEPUB(name) {
+		return "", upload.ErrUnsupportedFormat
+	}
+
+	b, err := Open(r, size)
+	if err != nil {
+		return "", err
+	}
+	return b.Text(len(b.Package.Spine.ItemRefs), max), nil
+}
+
+// Text returns the text of the first documents of the spine, up to size bytes.
+func (b *Book) Text(documents, size int) string {
+	var sb strings.Builder
+
+	for i, ref := range b.Package.Spine.ItemRefs {
+		if i >= documents || sb.Len() >= size {
+			break
+		}
+		it, ok := b.Item(ref.IDRef)
+		if !ok || it.MediaType != "application/xhtml+xml" {
+			continue
+		}
+		doc, err := b.readFile(b.Resolve(it.Href))
+		if err != nil {
+			continue
+		}
+
+		dec := xml.NewDecoder(bytes.NewReader(bytes.TrimLeft(bytes.TrimPrefix(doc, utf8BOM), " \t\r\n")))
+		dec.Strict = false
+		dec.Entity = xml.HTMLEntity
+		dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+			return input, nil
+		}
+
+		for sb.Len() < size {
+			tok, err := dec.Token()
+			if err != nil {
+				break
+			}
+			switch t := tok.(type) {
+			case xml.CharData:
+				sb.Write(t)
+			case xml.EndElement:
+				// keep the text of adjacent blocks apart
+				sb.WriteByte('\n')
+			}
+		}
+	}
+
+	text := sb.String()
+	if len(text) > size {
+		text = text[:size]
+	}
+	return text
+}
+
+// IsEPUB reports whether the filename has an EPUB extension.
+func IsEPUB(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".epub")
+}
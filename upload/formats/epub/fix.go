@@ -0,0 +1,217 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/opf"
+)
+
+// Fixer repairs the EPUB problems found by Check which can be fixed without
+// guessing at the content of the book: the mimetype entry, XML declarations, a
+// missing dc:language and a missing or broken table of contents. It also adds
+// the EPUB2 cover meta to books which only mark their cover the EPUB3 way.
+type Fixer struct {
+	// Language is used for books without a dc:language when the upload
+	// metadata does not have one either. Left empty, such books are not fixed.
+	Language string
+}
+
+// Transform implements the upload.Transformer interface.
+func (f Fixer) Transform(ctx context.Context, w io.Writer, name string, r io.ReaderAt, size int64, md upload.Metadata) error {
+	if !IsEPUB(name) {
+		return upload.ErrUnsupportedFormat
+	}
+	return f.Fix(w, r, size, md.Language)
+}
+
+// Fix writes a repaired copy of the EPUB to w. upload.ErrUnchanged is returned,
+// before anything is written, when there is nothing it can fix.
+func (f Fixer) Fix(w io.Writer, r io.ReaderAt, size int64, lang string) error {
+	problems := Check(r, size)
+
+	b, err := Open(r, size)
+	if err != nil {
+		return err
+	}
+
+	has := func(codes ...string) bool {
+		return slices.ContainsFunc(problems, func(p upload.Problem) bool {
+			return slices.Contains(codes, p.Code)
+		})
+	}
+
+	fx := fixes{book: b, replace: make(map[string][]byte)}
+
+	if has(CodeMimetypeMissing, CodeMimetypeNotFirst, CodeMimetypeCompressed, CodeMimetypeContent, CodeMimetypeExtraField) {
+		// the mimetype entry is always rewritten by Book.write
+		fx.changed = true
+	}
+
+	for _, p := range problems {
+		if p.Code != CodeXMLDeclaration {
+			continue
+		}
+		doc, err := fx.file(p.Path)
+		if err != nil {
+			return err
+		}
+		if fixed, ok := fixXMLDeclaration(doc); ok {
+			fx.set(p.Path, fixed)
+		}
+	}
+
+	if lang == "" {
+		lang = f.Language
+	}
+	if has(CodeLanguageMissing) && lang != "" {
+		if err := fx.rewritePackage(func(doc []byte) ([]byte, error) {
+			doc, _, err := opf.Rewrite(doc, upload.Metadata{Language: lang})
+			return doc, err
+		}); err != nil {
+			return err
+		}
+	}
+
+	doc, err := fx.file(b.RootFile)
+	if err != nil {
+		return err
+	}
+	if doc, ok, err := opf.FixCover(doc); err == nil && ok {
+		fx.set(b.RootFile, doc)
+	}
+
+	epub3 := strings.HasPrefix(b.Package.Version, "3")
+	switch {
+	case !epub3 && has(CodeNCXMissing, CodeNCXInvalid, CodeNCXBrokenLink):
+		if err := fx.toc(b.Package.Spine.Toc, "toc.ncx", mediaTypeNCX, "", b.buildNCX); err != nil {
+			return err
+		}
+	case epub3 && has(CodeNavMissing, CodeNavInvalid, CodeNavBrokenLink):
+		nav, _ := b.Nav()
+		if err := fx.toc(nav.ID, "nav.xhtml", "application/xhtml+xml", "nav", b.buildNav); err != nil {
+			return err
+		}
+	}
+
+	if !fx.changed {
+		return upload.ErrUnchanged
+	}
+
+	return b.write(w, fx.replace)
+}
+
+// fixes holds the entries replaced while fixing a book.
+type fixes struct {
+	book    *Book
+	replace map[string][]byte
+	changed bool
+}
+
+func (fx *fixes) file(name string) ([]byte, error) {
+	if doc, ok := fx.replace[name]; ok {
+		return doc, nil
+	}
+	return fx.book.readFile(name)
+}
+
+func (fx *fixes) set(name string, doc []byte) {
+	fx.replace[name] = doc
+	fx.changed = true
+}
+
+func (fx *fixes) rewritePackage(fn func([]byte) ([]byte, error)) error {
+	doc, err := fx.file(fx.book.RootFile)
+	if err != nil {
+		return err
+	}
+	doc, err = fn(doc)
+	if err != nil {
+		return fmt.Errorf("rewrite %s: %w", fx.book.RootFile, err)
+	}
+	fx.set(fx.book.RootFile, doc)
+	return nil
+}
+
+// toc regenerates the table of contents of the manifest item with the id. When
+// there is no such item a new one is added to the manifest using the file name
+// and properties provided.
+func (fx *fixes) toc(id, filename, mediaType, properties string, build func(name string) []byte) error {
+	b := fx.book
+
+	if it, ok := b.Item(id); ok && it.MediaType == mediaType {
+		p := b.Resolve(it.Href)
+		fx.set(p, build(p))
+		return nil
+	}
+
+	it := opf.Item{
+		ID:         fx.uniqueID(strings.TrimSuffix(filename, path.Ext(filename))),
+		Href:       fx.uniqueHref(filename),
+		MediaType:  mediaType,
+		Properties: properties,
+	}
+
+	if err := fx.rewritePackage(func(doc []byte) ([]byte, error) {
+		return opf.AddItem(doc, it, properties == "")
+	}); err != nil {
+		return err
+	}
+
+	p := b.Resolve(it.Href)
+	fx.set(p, build(p))
+	return nil
+}
+
+func (fx *fixes) uniqueID(id string) string {
+	candidate := id
+	for i := 1; ; i++ {
+		if _, ok := fx.book.Item(candidate); !ok {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", id, i)
+	}
+}
+
+func (fx *fixes) uniqueHref(href string) string {
+	ext := path.Ext(href)
+	candidate := href
+	for i := 1; ; i++ {
+		if !fx.book.exists(fx.book.Resolve(candidate)) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(href, ext), i, ext)
+	}
+}
+
+// =============================================================================
+
+// fixXMLDeclaration replaces a misplaced or malformed XML declaration, or one
+// declaring an encoding other than UTF-8 on a document which is valid UTF-8,
+// with a standard declaration. Documents which would need transcoding are not
+// fixed.
+func fixXMLDeclaration(doc []byte) ([]byte, bool) {
+	body := bytes.TrimLeft(bytes.TrimPrefix(doc, utf8BOM), " \t\r\n")
+	if !bytes.HasPrefix(body, []byte("<?xml")) {
+		return nil, false
+	}
+
+	end := bytes.Index(body, []byte("?>"))
+	if end < 0 {
+		return nil, false
+	}
+	body = body[end+2:]
+
+	if !utf8.Valid(body) {
+		return nil, false
+	}
+
+	return append([]byte(`<?xml version="1.0" encoding="utf-8"?>`), body...), true
+}
@@ -0,0 +1,188 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+const (
+	testContainer = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`
+
+	// leading whitespace before the declaration, no dc:language and an NCX
+	// which is referenced but missing
+	testPackage = `
+<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:title>Test Book</dc:title>
+    <dc:identifier id="uid">urn:uuid:1</dc:identifier>
+  </metadata>
+  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="ch1"/>
+  </spine>
+</package>`
+
+	testChapter = `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>One</title></head><body><h1>Chapter&nbsp;One</h1></body></html>`
+)
+
+// buildEPUB creates an EPUB whose mimetype entry is compressed and not first.
+func buildEPUB(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct{ name, data string }{
+		{"META-INF/container.xml", testContainer},
+		{"mimetype", MimeType},
+		{"OEBPS/content.opf", testPackage},
+		{"OEBPS/ch1.xhtml", testChapter},
+	} {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatalf("zip.Create: %v", err)
+		}
+		w.Write([]byte(f.data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip.Close: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestCheckAndFix(t *testing.T) {
+	book := buildEPUB(t)
+
+	codes := make(map[string]bool)
+	for _, p := range Check(bytes.NewReader(book), int64(len(book))) {
+		codes[p.Code] = true
+	}
+	for _, code := range []string{CodeMimetypeNotFirst, CodeMimetypeCompressed, CodeXMLDeclaration, CodeLanguageMissing, CodeNCXMissing} {
+		if !codes[code] {
+			t.Errorf("expected problem %q; got: %v", code, codes)
+		}
+	}
+
+	var fixed bytes.Buffer
+	if err := (Fixer{Language: "en"}).Fix(&fixed, bytes.NewReader(book), int64(len(book)), ""); err != nil {
+		t.Fatalf("Fix: %v", err)
+	}
+
+	if problems := Check(bytes.NewReader(fixed.Bytes()), int64(fixed.Len())); len(problems) > 0 {
+		t.Errorf("expected no problems after fixing; got: %+v", problems)
+	}
+
+	b, err := Open(bytes.NewReader(fixed.Bytes()), int64(fixed.Len()))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got := b.Package.BookMetadata().Language; got != "en" {
+		t.Errorf("incorrect language; expected: en; got: %q", got)
+	}
+	if b.Zip.File[0].Name != mimetypePath || b.Zip.File[0].Method != zip.Store {
+		t.Errorf("mimetype is not the first stored entry")
+	}
+
+	var again bytes.Buffer
+	err = (Fixer{Language: "en"}).Fix(&again, bytes.NewReader(fixed.Bytes()), int64(fixed.Len()), "")
+	if err != upload.ErrUnchanged {
+		t.Errorf("expected fixed book to be unchanged; got: %v", err)
+	}
+}
+
+func TestCheckFileTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct{ name, data string }{
+		{"mimetype", MimeType},
+		{"META-INF/container.xml", testContainer},
+		{"OEBPS/content.opf", testPackage},
+		// compresses to a few kilobytes
+		{"OEBPS/ch1.xhtml", "<html>" + strings.Repeat(" ", maxFileSize) + "</html>"},
+	} {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatalf("zip.Create: %v", err)
+		}
+		w.Write([]byte(f.data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip.Close: %v", err)
+	}
+	book := buf.Bytes()
+
+	found := false
+	for _, p := range Check(bytes.NewReader(book), int64(len(book))) {
+		found = found || (p.Code == CodeFileTooLarge && p.Path == "OEBPS/ch1.xhtml" && p.Severity == upload.SeverityError)
+	}
+	if !found {
+		t.Error("expected the chapter to be reported as too large")
+	}
+
+	b, err := Open(bytes.NewReader(book), int64(len(book)))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := b.readFile("OEBPS/ch1.xhtml"); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("expected ErrFileTooLarge; got: %v", err)
+	}
+}
+
+func TestEscapedHref(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct{ name, data string }{
+		{"mimetype", MimeType},
+		{"META-INF/container.xml", testContainer},
+		{"OEBPS/content.opf", strings.Replace(testPackage, `href="ch1.xhtml"`, `href="Text/chapter%201.xhtml"`, 1)},
+		{"OEBPS/Text/chapter 1.xhtml", testChapter},
+	} {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatalf("zip.Create: %v", err)
+		}
+		w.Write([]byte(f.data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip.Close: %v", err)
+	}
+	book := buf.Bytes()
+
+	for _, p := range Check(bytes.NewReader(book), int64(len(book))) {
+		if p.Code == CodeManifestFileMissing {
+			t.Errorf("unexpected problem: %+v", p)
+		}
+	}
+
+	b, err := Open(bytes.NewReader(book), int64(len(book)))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if text := b.Text(1, 1024); !strings.Contains(text, "Chapter") {
+		t.Errorf("expected the text of the chapter; got %q", text)
+	}
+
+	// the regenerated table of contents links to the escaped href
+	var fixed bytes.Buffer
+	if err := (Fixer{Language: "en"}).Fix(&fixed, bytes.NewReader(book), int64(len(book)), ""); err != nil {
+		t.Fatalf("Fix: %v", err)
+	}
+	if problems := Check(bytes.NewReader(fixed.Bytes()), int64(fixed.Len())); len(problems) > 0 {
+		t.Errorf("expected no problems after fixing; got: %+v", problems)
+	}
+}
@@ -0,0 +1,265 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// KEPUBExt is the extension Kobo readers require to treat a book as KEPUB.
+	KEPUBExt = ".kepub.epub"
+
+	// koboStyle is added to the head of every document. Unlike Calibre's
+	// KoboTouchExtended driver no kobo.js script is added next to it: the
+	// readers do not need it, kepubify leaves it out as well, and the script
+	// would have to be shipped in the book and declared as scripted content in
+	// the manifest of EPUB3 books.
+	koboStyle = `<style type="text/css" class="kobostylehacks">div#book-inner { margin-top: 0; margin-bottom: 0; }</style>`
+)
+
+var (
+	// a sentence ends with punctuation, optionally followed by closing quotes
+	// or brackets, and whitespace
+	reSentenceEnd = regexp.MustCompile(`[.!?…]+["'”’)\]]*\s+`)
+
+	// elements starting a new kobo paragraph
+	koboBlocks = map[string]bool{
+		"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+		"li": true, "dt": true, "dd": true, "td": true, "th": true, "pre": true,
+		"blockquote": true, "figcaption": true, "caption": true, "div": true,
+	}
+
+	// elements whose text is never wrapped
+	koboSkip = map[string]bool{
+		"script": true, "style": true, "head": true, "title": true, "svg": true, "math": true,
+	}
+)
+
+// KEPUBName returns the name of the KEPUB converted from the EPUB name.
+func KEPUBName(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), KEPUBExt) {
+		return name
+	}
+	return strings.TrimSuffix(name, path.Ext(name)) + KEPUBExt
+}
+
+// ConvertKEPUB writes a KEPUB version of the EPUB to w. Every content document
+// of the spine gets the markup Kobo readers use for their reading statistics,
+// highlighting and page layout: the text is split into koboSpan elements per
+// sentence, the body is wrapped in the book-columns/book-inner divs and the
+// kobo style hacks are added to the head. Documents which already contain kobo
+// spans are left untouched.
+func ConvertKEPUB(w io.Writer, r io.ReaderAt, size int64) error {
+	b, err := Open(r, size)
+	if err != nil {
+		return err
+	}
+
+	replace := make(map[string][]byte)
+	for _, ref := range b.Package.Spine.ItemRefs {
+		it, ok := b.Item(ref.IDRef)
+		if !ok || it.MediaType != "application/xhtml+xml" {
+			continue
+		}
+
+		p := b.Resolve(it.Href)
+		if _, done := replace[p]; done {
+			continue
+		}
+
+		doc, err := b.readFile(p)
+		if err != nil {
+			return err
+		}
+
+		out, err := koboDocument(doc)
+		if err != nil {
+			return fmt.Errorf("convert %s: %w", p, err)
+		}
+		replace[p] = out
+	}
+
+	return b.write(w, replace)
+}
+
+// koboDocument adds the kobo markup to an XHTML document. Like the package
+// rewriting, markup is spliced into the original bytes so everything else in
+// the document is kept as is.
+func koboDocument(doc []byte) ([]byte, error) {
+	if bytes.Contains(doc, []byte(`koboSpan`)) {
+		return doc, nil
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	var (
+		edits       []edit
+		stack       []string
+		skip        int
+		para, seg   int
+		inBody      bool
+		headEnd     = -1
+		bodyOpenEnd = -1
+		bodyClose   = -1
+	)
+
+	for {
+		off := int(dec.InputOffset())
+		tok, err := dec.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := int(dec.InputOffset())
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			stack = append(stack, name)
+			if koboSkip[name] {
+				skip++
+			}
+			switch {
+			case name == "body":
+				inBody = true
+				if !bytes.HasSuffix(doc[off:end], []byte("/>")) {
+					bodyOpenEnd = end
+				}
+			case inBody && koboBlocks[name]:
+				para++
+				seg = 0
+			}
+
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			if koboSkip[name] && skip > 0 {
+				skip--
+			}
+			switch name {
+			case "head":
+				if headEnd < 0 {
+					headEnd = off
+				}
+			case "body":
+				inBody = false
+				if bodyOpenEnd >= 0 && off >= bodyOpenEnd {
+					bodyClose = off
+				}
+			}
+
+		case xml.CharData:
+			if !inBody || skip > 0 || len(bytes.TrimSpace(t)) == 0 {
+				continue
+			}
+			if para == 0 {
+				para = 1
+			}
+			edits = append(edits, koboSpans(doc, off, end, para, &seg)...)
+		}
+	}
+
+	if bodyOpenEnd < 0 || bodyClose < 0 {
+		return nil, errors.New("document has no body")
+	}
+
+	edits = append(edits,
+		edit{at: bodyOpenEnd, text: `<div id="book-columns"><div id="book-inner">`},
+		edit{at: bodyClose, text: `</div></div>`},
+	)
+	if headEnd >= 0 {
+		edits = append(edits, edit{at: headEnd, text: koboStyle})
+	}
+
+	return applyInserts(doc, edits), nil
+}
+
+// koboSpans wraps every sentence of the raw text found in doc[start:end] in a
+// koboSpan.
+func koboSpans(doc []byte, start, end, para int, seg *int) []edit {
+	raw := doc[start:end]
+
+	// CDATA sections are left alone
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("<![CDATA[")) {
+		return nil
+	}
+
+	var edits []edit
+	wrap := func(from, to int) {
+		// leading whitespace stays outside of the span
+		for from < to && isSpace(raw[from]) {
+			from++
+		}
+		if from >= to {
+			return
+		}
+		*seg++
+		edits = append(edits,
+			edit{at: start + from, text: fmt.Sprintf(`<span class="koboSpan" id="kobo.%d.%d">`, para, *seg)},
+			edit{at: start + to, text: `</span>`},
+		)
+	}
+
+	pos := 0
+	for _, loc := range reSentenceEnd.FindAllIndex(raw, -1) {
+		wrap(pos, loc[1])
+		pos = loc[1]
+	}
+	wrap(pos, len(raw))
+
+	return edits
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// edit inserts text at an offset of a document.
+type edit struct {
+	at   int
+	text string
+}
+
+// applyInserts applies the edits to the document. Edits at the same offset are
+// applied in the order they were added.
+func applyInserts(doc []byte, edits []edit) []byte {
+	sortEdits(edits)
+
+	var b bytes.Buffer
+	b.Grow(len(doc) + len(edits)*32)
+
+	pos := 0
+	for _, e := range edits {
+		b.Write(doc[pos:e.at])
+		b.WriteString(e.text)
+		pos = e.at
+	}
+	b.Write(doc[pos:])
+
+	return b.Bytes()
+}
+
+func sortEdits(edits []edit) {
+	// insertion sort keeps edits at the same offset stable and the edits are
+	// mostly ordered already
+	for i := 1; i < len(edits); i++ {
+		for j := i; j > 0 && edits[j].at < edits[j-1].at; j-- {
+			edits[j], edits[j-1] = edits[j-1], edits[j]
+		}
+	}
+}
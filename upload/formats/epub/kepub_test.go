@@ -0,0 +1,72 @@
+package epub
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestKoboDocument(t *testing.T) {
+	doc := `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>One</title></head>
+<body>
+<h1>Chapter&nbsp;One</h1>
+<p>It was late. &ldquo;Who?&rdquo; she asked <em>again</em>.</p>
+<script>var a = 1. + 2;</script>
+<p><br/></p>
+</body></html>`
+
+	out, err := koboDocument([]byte(doc))
+	if err != nil {
+		t.Fatalf("koboDocument: %v", err)
+	}
+	got := string(out)
+
+	for _, want := range []string{
+		`<title>One</title>` + koboStyle + `</head>`,
+		`<body><div id="book-columns"><div id="book-inner">`,
+		`<h1><span class="koboSpan" id="kobo.1.1">Chapter&nbsp;One</span></h1>`,
+		`<p><span class="koboSpan" id="kobo.2.1">It was late. </span><span class="koboSpan" id="kobo.2.2">&ldquo;Who?&rdquo; she asked </span>`,
+		`<em><span class="koboSpan" id="kobo.2.3">again</span></em><span class="koboSpan" id="kobo.2.4">.</span></p>`,
+		`<script>var a = 1. + 2;</script>`,
+		`<p><br/></p>`,
+		`</div></div></body>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected output to contain %q; got:\n%s", want, got)
+		}
+	}
+
+	again, err := koboDocument(out)
+	if err != nil {
+		t.Fatalf("koboDocument: %v", err)
+	}
+	if !bytes.Equal(again, out) {
+		t.Errorf("expected converted document to be unchanged")
+	}
+}
+
+func TestConvertKEPUB(t *testing.T) {
+	book := buildEPUB(t)
+
+	var out bytes.Buffer
+	if err := ConvertKEPUB(&out, bytes.NewReader(book), int64(len(book))); err != nil {
+		t.Fatalf("ConvertKEPUB: %v", err)
+	}
+
+	b, err := Open(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	ch, err := b.readFile("OEBPS/ch1.xhtml")
+	if err != nil {
+		t.Fatalf("readFile: %v", err)
+	}
+	if !bytes.Contains(ch, []byte(`id="kobo.1.1"`)) {
+		t.Errorf("expected chapter to contain kobo spans; got:\n%s", ch)
+	}
+
+	if got := KEPUBName("books/one.epub"); got != "books/one.kepub.epub" {
+		t.Errorf("incorrect kepub name; expected: books/one.kepub.epub; got: %q", got)
+	}
+}
@@ -0,0 +1,156 @@
+package epub
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/opf"
+)
+
+const (
+	mimetypePath = "mimetype"
+)
+
+// Rewrite copies the EPUB to w with its package metadata replaced by md. The
+// container is streamed entry by entry: every entry besides the package
+// document is copied without being recompressed, in its original order, after
+// an uncompressed mimetype entry. upload.ErrUnchanged is returned, before
+// anything is written, when the book already holds the metadata.
+func Rewrite(w io.Writer, r io.ReaderAt, size int64, md upload.Metadata) error {
+	b, err := Open(r, size)
+	if err != nil {
+		return err
+	}
+
+	doc, err := b.readFile(b.RootFile)
+	if err != nil {
+		return err
+	}
+
+	doc, changed, err := opf.Rewrite(doc, md)
+	if err != nil {
+		return fmt.Errorf("rewrite %s: %w", b.RootFile, err)
+	}
+	if !changed {
+		return upload.ErrUnchanged
+	}
+
+	return b.write(w, map[string][]byte{b.RootFile: doc})
+}
+
+// write copies the container to w, replacing the contents of the entries found
+// in replace. Entries of replace which are not in the container are added at
+// the end.
+func (b *Book) write(w io.Writer, replace map[string][]byte) error {
+	zw := zip.NewWriter(w)
+
+	if err := writeMimetype(zw); err != nil {
+		return err
+	}
+
+	written := make(map[string]bool)
+	for _, f := range b.Zip.File {
+		if f.Name == mimetypePath {
+			continue
+		}
+
+		data, ok := replace[f.Name]
+		if !ok {
+			if err := zw.Copy(f); err != nil {
+				return fmt.Errorf("copy %s: %w", f.Name, err)
+			}
+			continue
+		}
+
+		if err := writeFile(zw, f.Name, f.Modified, data); err != nil {
+			return err
+		}
+		written[f.Name] = true
+	}
+
+	added := make([]string, 0, len(replace))
+	for name := range replace {
+		if !written[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+
+	for _, name := range added {
+		if err := writeFile(zw, name, time.Now(), replace[name]); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func writeFile(zw *zip.Writer, name string, modified time.Time, data []byte) error {
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return fmt.Errorf("create %s: %w", name, err)
+	}
+	if _, err := fw.Write(data); err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return nil
+}
+
+// writeMimetype writes the mimetype entry the way the OCF spec requires it:
+// stored, without a data descriptor and without extra fields.
+func writeMimetype(zw *zip.Writer) error {
+	data := []byte(MimeType)
+
+	fw, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               mimetypePath,
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(len(data)),
+		UncompressedSize64: uint64(len(data)),
+	})
+	if err != nil {
+		return fmt.Errorf("create mimetype: %w", err)
+	}
+	if _, err := fw.Write(data); err != nil {
+		return fmt.Errorf("write mimetype: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Book) exists(name string) bool {
+	f, err := b.Zip.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+func (b *Book) readFile(name string) ([]byte, error) {
+	return readFile(b.Zip, name)
+}
+
+// =============================================================================
+
+// Embedder writes the upload metadata into EPUB uploads so corrections made by
+// the uploader are kept with the book.
+type Embedder struct{}
+
+// Transform implements the upload.Transformer interface.
+func (Embedder) Transform(ctx context.Context, w io.Writer, name string, r io.ReaderAt, size int64, md upload.Metadata) error {
+	if !IsEPUB(name) {
+		return upload.ErrUnsupportedFormat
+	}
+	return Rewrite(w, r, size, md)
+}
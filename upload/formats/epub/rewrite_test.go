@@ -0,0 +1,121 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+// testPackage3 marks its cover the EPUB3 way only.
+const testPackage3 = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">urn:uuid:1</dc:identifier>
+    <dc:title>Test Book</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="img" href="cover.jpg" media-type="image/jpeg" properties="cover-image"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>`
+
+// buildEPUB3 creates a well formed EPUB3 holding testPackage3.
+func buildEPUB3(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	mw, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		t.Fatalf("zip.Create: %v", err)
+	}
+	mw.Write([]byte(MimeType))
+	for _, f := range []struct{ name, data string }{
+		{"META-INF/container.xml", testContainer},
+		{"OEBPS/content.opf", testPackage3},
+		{"OEBPS/ch1.xhtml", testChapter},
+		{"OEBPS/cover.jpg", "jpeg"},
+	} {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatalf("zip.Create: %v", err)
+		}
+		w.Write([]byte(f.data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip.Close: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestRewrite(t *testing.T) {
+	book := buildEPUB3(t)
+
+	// nothing edited: the book is left alone despite its missing cover meta
+	var out bytes.Buffer
+	err := Rewrite(&out, bytes.NewReader(book), int64(len(book)), upload.Metadata{Title: "Test Book", Language: "en"})
+	if !errors.Is(err, upload.ErrUnchanged) || out.Len() != 0 {
+		t.Fatalf("expected upload.ErrUnchanged and nothing written; got %d bytes: %v", out.Len(), err)
+	}
+
+	if err := Rewrite(&out, bytes.NewReader(book), int64(len(book)), upload.Metadata{Title: "New Title"}); err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+	if first := zr.File[0]; first.Name != "mimetype" || first.Method != zip.Store {
+		t.Errorf("expected the mimetype entry first and stored; got %s with method %d", first.Name, first.Method)
+	}
+	for _, p := range Check(bytes.NewReader(out.Bytes()), int64(out.Len())) {
+		if strings.HasPrefix(p.Code, "mimetype-") {
+			t.Errorf("unexpected problem: %+v", p)
+		}
+	}
+
+	b, err := Open(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if md := b.Package.BookMetadata(); md.Title != "New Title" {
+		t.Errorf("expected the new title; got: %q", md.Title)
+	}
+}
+
+func TestFixCover(t *testing.T) {
+	book := buildEPUB3(t)
+
+	var fixed bytes.Buffer
+	if err := (Fixer{}).Fix(&fixed, bytes.NewReader(book), int64(len(book)), ""); err != nil {
+		t.Fatalf("Fix: %v", err)
+	}
+
+	b, err := Open(bytes.NewReader(fixed.Bytes()), int64(fixed.Len()))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	doc, err := b.readFile(b.RootFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(doc), `<meta name="cover" content="img"/>`) {
+		t.Errorf("expected the cover meta\n%s", doc)
+	}
+
+	// fixed books are left alone
+	var again bytes.Buffer
+	if err := (Fixer{}).Fix(&again, bytes.NewReader(fixed.Bytes()), int64(fixed.Len()), ""); !errors.Is(err, upload.ErrUnchanged) {
+		t.Errorf("expected upload.ErrUnchanged; got: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// tocEntry is a single entry of a generated table of contents.
+type tocEntry struct {
+	label string
+	path  string
+}
+
+// spineTOC builds a flat table of contents from the linear spine items, using
+// the title of every document as its label.
+func (b *Book) spineTOC() []tocEntry {
+	var entries []tocEntry
+
+	for _, ref := range b.Package.Spine.ItemRefs {
+		if ref.Linear == "no" {
+			continue
+		}
+		it, ok := b.Item(ref.IDRef)
+		if !ok {
+			continue
+		}
+
+		p := b.Resolve(it.Href)
+		label := b.documentTitle(p)
+		if label == "" {
+			label = fmt.Sprintf("Chapter %d", len(entries)+1)
+		}
+		entries = append(entries, tocEntry{label: label, path: p})
+	}
+
+	return entries
+}
+
+// documentTitle returns the first heading, or the title, of the XHTML document.
+func (b *Book) documentTitle(name string) string {
+	doc, err := b.readFile(name)
+	if err != nil {
+		return ""
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(bytes.TrimLeft(bytes.TrimPrefix(doc, utf8BOM), " \t\r\n")))
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+
+	var title string
+	var capture *strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return title
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "title", "h1", "h2", "h3":
+				capture = &strings.Builder{}
+			}
+		case xml.CharData:
+			if capture != nil {
+				capture.Write(t)
+			}
+		case xml.EndElement:
+			if capture == nil {
+				continue
+			}
+			text := strings.Join(strings.Fields(capture.String()), " ")
+			capture = nil
+			switch {
+			case text == "":
+			case t.Name.Local == "title":
+				title = text
+			default:
+				return text
+			}
+		}
+	}
+}
+
+// buildNCX renders an EPUB2 NCX document stored at name.
+func (b *Book) buildNCX(name string) []byte {
+	var buf bytes.Buffer
+	esc := func(s string) string {
+		var eb bytes.Buffer
+		xml.EscapeText(&eb, []byte(s))
+		return eb.String()
+	}
+
+	md := b.Package.BookMetadata()
+	uid := ""
+	for _, id := range b.Package.Metadata.Identifiers {
+		if id.ID == b.Package.UniqueIdentifier || uid == "" {
+			uid = strings.TrimSpace(id.Value)
+		}
+	}
+
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<ncx xmlns="` + namespaceNCX + `" version="2005-1">` + "\n")
+	buf.WriteString("  <head>\n")
+	buf.WriteString(`    <meta name="dtb:uid" content="` + esc(uid) + `"/>` + "\n")
+	buf.WriteString(`    <meta name="dtb:depth" content="1"/>` + "\n")
+	buf.WriteString(`    <meta name="dtb:totalPageCount" content="0"/>` + "\n")
+	buf.WriteString(`    <meta name="dtb:maxPageNumber" content="0"/>` + "\n")
+	buf.WriteString("  </head>\n")
+	buf.WriteString("  <docTitle><text>" + esc(md.Title) + "</text></docTitle>\n")
+	buf.WriteString("  <navMap>\n")
+	for i, e := range b.spineTOC() {
+		fmt.Fprintf(&buf, `    <navPoint id="navpoint-%d" playOrder="%d">`+"\n", i+1, i+1)
+		buf.WriteString("      <navLabel><text>" + esc(e.label) + "</text></navLabel>\n")
+		buf.WriteString(`      <content src="` + esc(relative(name, e.path)) + `"/>` + "\n")
+		buf.WriteString("    </navPoint>\n")
+	}
+	buf.WriteString("  </navMap>\n")
+	buf.WriteString("</ncx>\n")
+
+	return buf.Bytes()
+}
+
+// buildNav renders an EPUB3 navigation document stored at name.
+func (b *Book) buildNav(name string) []byte {
+	var buf bytes.Buffer
+	esc := func(s string) string {
+		var eb bytes.Buffer
+		xml.EscapeText(&eb, []byte(s))
+		return eb.String()
+	}
+
+	buf.WriteString(xml.Header)
+	buf.WriteString("<!DOCTYPE html>\n")
+	buf.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="` + namespaceOPS + `">` + "\n")
+	buf.WriteString("  <head><title>Contents</title></head>\n")
+	buf.WriteString("  <body>\n")
+	buf.WriteString(`    <nav epub:type="toc" id="toc">` + "\n")
+	buf.WriteString("      <h1>Contents</h1>\n")
+	buf.WriteString("      <ol>\n")
+	for _, e := range b.spineTOC() {
+		buf.WriteString(`        <li><a href="` + esc(relative(name, e.path)) + `">` + esc(e.label) + "</a></li>\n")
+	}
+	buf.WriteString("      </ol>\n")
+	buf.WriteString("    </nav>\n")
+	buf.WriteString("  </body>\n")
+	buf.WriteString("</html>\n")
+
+	return buf.Bytes()
+}
+
+// relative returns the href of target relative to the document at base,
+// escaped as a URL path.
+func relative(base, target string) string {
+	rel, err := filepath.Rel(filepath.FromSlash(path.Dir(base)), filepath.FromSlash(target))
+	if err != nil {
+		rel = target
+	}
+	return (&url.URL{Path: filepath.ToSlash(rel)}).EscapedPath()
+}
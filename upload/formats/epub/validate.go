@@ -0,0 +1,456 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/opf"
+)
+
+// Problem codes reported by Check. They cover the subset of epubcheck rules
+// which most often cause readers and Send-to-Kindle to reject a book.
+const (
+	CodeZipInvalid          = "zip-invalid"
+	CodeMimetypeMissing     = "mimetype-missing"
+	CodeMimetypeNotFirst    = "mimetype-not-first"
+	CodeMimetypeCompressed  = "mimetype-compressed"
+	CodeMimetypeContent     = "mimetype-content"
+	CodeMimetypeExtraField  = "mimetype-extra-field"
+	CodeContainerInvalid    = "container-invalid"
+	CodeXMLDeclaration      = "xml-declaration"
+	CodeXMLInvalid          = "xml-invalid"
+	CodeFileTooLarge        = "file-too-large"
+	CodePackageInvalid      = "package-invalid"
+	CodeTitleMissing        = "title-missing"
+	CodeIdentifierMissing   = "identifier-missing"
+	CodeUniqueIdentifier    = "unique-identifier"
+	CodeLanguageMissing     = "language-missing"
+	CodeManifestFileMissing = "manifest-file-missing"
+	CodeManifestDuplicateID = "manifest-duplicate-id"
+	CodeSpineEmpty          = "spine-empty"
+	CodeSpineItemMissing    = "spine-item-missing"
+	CodeNCXMissing          = "ncx-missing"
+	CodeNCXInvalid          = "ncx-invalid"
+	CodeNCXBrokenLink       = "ncx-broken-link"
+	CodeNavMissing          = "nav-missing"
+	CodeNavInvalid          = "nav-invalid"
+	CodeNavBrokenLink       = "nav-broken-link"
+)
+
+const (
+	namespaceNCX = "http://www.daisy.org/z3986/2005/ncx/"
+	namespaceOPS = "http://www.idpf.org/2007/ops"
+	mediaTypeNCX = "application/x-dtbncx+xml"
+)
+
+var (
+	reXMLDecl = regexp.MustCompile(`^<\?xml\s+version\s*=\s*["']1\.[01]["'](\s+encoding\s*=\s*["']([A-Za-z0-9._-]+)["'])?(\s+standalone\s*=\s*["'](yes|no)["'])?\s*\?>`)
+	utf8BOM   = []byte{0xEF, 0xBB, 0xBF}
+)
+
+// Validator reports structural problems with EPUB uploads.
+type Validator struct{}
+
+// Validate implements the upload.Validator interface.
+func (Validator) Validate(ctx context.Context, name string, r io.ReaderAt, size int64) ([]upload.Problem, error) {
+	if !IsEPUB(name) {
+		return nil, upload.ErrUnsupportedFormat
+	}
+	return Check(r, size), nil
+}
+
+// Check validates the structure of the EPUB.
+func Check(r io.ReaderAt, size int64) []upload.Problem {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return []upload.Problem{problem(CodeZipInvalid, upload.SeverityError, "", err.Error())}
+	}
+
+	c := checker{zip: zr}
+	c.mimetype()
+	c.book()
+
+	return c.problems
+}
+
+// checker collects the problems found while checking a book.
+type checker struct {
+	zip      *zip.Reader
+	b        *Book
+	problems []upload.Problem
+}
+
+func (c *checker) add(code, severity, path, format string, args ...any) {
+	c.problems = append(c.problems, problem(code, severity, path, fmt.Sprintf(format, args...)))
+}
+
+func problem(code, severity, path, msg string) upload.Problem {
+	return upload.Problem{Code: code, Severity: severity, Path: path, Message: msg}
+}
+
+func (c *checker) mimetype() {
+	var mt *zip.File
+	for i, f := range c.zip.File {
+		if f.Name != mimetypePath {
+			continue
+		}
+		mt = f
+		if i != 0 {
+			c.add(CodeMimetypeNotFirst, upload.SeverityError, mimetypePath, "mimetype must be the first entry of the container")
+		}
+		break
+	}
+
+	if mt == nil {
+		c.add(CodeMimetypeMissing, upload.SeverityError, mimetypePath, "container has no mimetype entry")
+		return
+	}
+
+	if mt.Method != zip.Store {
+		c.add(CodeMimetypeCompressed, upload.SeverityError, mimetypePath, "mimetype must be stored uncompressed")
+	}
+	if len(mt.Extra) > 0 {
+		c.add(CodeMimetypeExtraField, upload.SeverityWarning, mimetypePath, "mimetype entry must not use the zip extra field")
+	}
+
+	rc, err := mt.Open()
+	if err != nil {
+		c.add(CodeMimetypeContent, upload.SeverityError, mimetypePath, "cannot read mimetype: %v", err)
+		return
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, 64))
+	if err != nil || string(data) != MimeType {
+		c.add(CodeMimetypeContent, upload.SeverityError, mimetypePath, "mimetype must contain %q", MimeType)
+	}
+}
+
+func (c *checker) book() {
+	root, err := rootFile(c.zip)
+	if err != nil {
+		c.add(CodeContainerInvalid, upload.SeverityError, containerPath, "%v", err)
+		return
+	}
+	b := &Book{Zip: c.zip, RootFile: root}
+	c.b = b
+
+	doc, ok := c.xmlFile(root, CodePackageInvalid)
+	if !ok {
+		return
+	}
+
+	pkg, err := opf.Parse(bytes.NewReader(doc))
+	if err != nil {
+		c.add(CodePackageInvalid, upload.SeverityError, root, "%v", err)
+		return
+	}
+	b.Package = pkg
+
+	c.metadata()
+	c.manifest()
+	c.spine()
+
+	if strings.HasPrefix(pkg.Version, "3") {
+		c.nav()
+		return
+	}
+	c.ncx()
+}
+
+func (c *checker) metadata() {
+	b := c.b
+	pm := b.Package.Metadata
+
+	if len(pm.Titles) == 0 || strings.TrimSpace(pm.Titles[0].Value) == "" {
+		c.add(CodeTitleMissing, upload.SeverityError, b.RootFile, "package has no dc:title")
+	}
+	if len(pm.Languages) == 0 || strings.TrimSpace(pm.Languages[0].Value) == "" {
+		c.add(CodeLanguageMissing, upload.SeverityError, b.RootFile, "package has no dc:language")
+	}
+
+	if len(pm.Identifiers) == 0 {
+		c.add(CodeIdentifierMissing, upload.SeverityError, b.RootFile, "package has no dc:identifier")
+		return
+	}
+	for _, id := range pm.Identifiers {
+		if id.ID != "" && id.ID == b.Package.UniqueIdentifier {
+			return
+		}
+	}
+	c.add(CodeUniqueIdentifier, upload.SeverityError, b.RootFile, "unique-identifier %q does not reference a dc:identifier", b.Package.UniqueIdentifier)
+}
+
+func (c *checker) manifest() {
+	b := c.b
+	ids := make(map[string]bool)
+	nav, _ := b.Nav()
+
+	for _, it := range b.Package.Manifest {
+		if ids[it.ID] {
+			c.add(CodeManifestDuplicateID, upload.SeverityError, b.RootFile, "duplicate manifest id %q", it.ID)
+		}
+		ids[it.ID] = true
+
+		// the table of contents is checked on its own
+		if isRemote(it.Href) || it.ID == b.Package.Spine.Toc || it.ID == nav.ID {
+			continue
+		}
+
+		p := b.Resolve(it.Href)
+		if !c.exists(p) {
+			c.add(CodeManifestFileMissing, upload.SeverityError, p, "manifest item %q references a missing file", it.ID)
+			continue
+		}
+		if strings.Contains(it.MediaType, "xml") {
+			c.xmlFile(p, CodeXMLInvalid)
+		}
+	}
+}
+
+func (c *checker) spine() {
+	b := c.b
+	if len(b.Package.Spine.ItemRefs) == 0 {
+		c.add(CodeSpineEmpty, upload.SeverityError, b.RootFile, "spine has no items")
+		return
+	}
+
+	for _, ref := range b.Package.Spine.ItemRefs {
+		if _, ok := b.Item(ref.IDRef); !ok {
+			c.add(CodeSpineItemMissing, upload.SeverityError, b.RootFile, "spine references unknown manifest item %q", ref.IDRef)
+		}
+	}
+}
+
+func (c *checker) ncx() {
+	b := c.b
+
+	it, ok := b.Item(b.Package.Spine.Toc)
+	if !ok || it.MediaType != mediaTypeNCX {
+		c.add(CodeNCXMissing, upload.SeverityError, b.RootFile, "spine does not reference an NCX table of contents")
+		return
+	}
+
+	p := b.Resolve(it.Href)
+	if !c.exists(p) {
+		c.add(CodeNCXMissing, upload.SeverityError, p, "NCX table of contents is missing")
+		return
+	}
+	doc, ok := c.xmlFile(p, CodeNCXInvalid)
+	if !ok {
+		return
+	}
+
+	var ncx struct {
+		XMLName xml.Name
+		Sources []struct {
+			Src string `xml:"src,attr"`
+		} `xml:"navMap>navPoint>content"`
+	}
+	if err := decodeXML(doc, &ncx); err != nil || ncx.XMLName.Space != namespaceNCX || ncx.XMLName.Local != "ncx" {
+		c.add(CodeNCXInvalid, upload.SeverityError, p, "not an NCX document")
+		return
+	}
+	if len(ncx.Sources) == 0 {
+		c.add(CodeNCXInvalid, upload.SeverityError, p, "NCX has no navigation points")
+	}
+
+	for _, src := range ncx.Sources {
+		if target := resolveFrom(p, src.Src); target != "" && !c.exists(target) {
+			c.add(CodeNCXBrokenLink, upload.SeverityError, p, "navigation point references missing file %q", src.Src)
+		}
+	}
+}
+
+func (c *checker) nav() {
+	b := c.b
+
+	it, ok := b.Nav()
+	if !ok {
+		c.add(CodeNavMissing, upload.SeverityError, b.RootFile, "manifest has no item with the nav property")
+		return
+	}
+
+	p := b.Resolve(it.Href)
+	if !c.exists(p) {
+		c.add(CodeNavMissing, upload.SeverityError, p, "nav document is missing")
+		return
+	}
+	doc, ok := c.xmlFile(p, CodeNavInvalid)
+	if !ok {
+		return
+	}
+
+	links, found := navLinks(doc)
+	if !found {
+		c.add(CodeNavInvalid, upload.SeverityError, p, `nav document has no nav element with epub:type="toc"`)
+		return
+	}
+
+	for _, href := range links {
+		if target := resolveFrom(p, href); target != "" && !c.exists(target) {
+			c.add(CodeNavBrokenLink, upload.SeverityError, p, "toc references missing file %q", href)
+		}
+	}
+}
+
+// xmlFile reads the entry, reporting a bad XML declaration or, using the
+// invalid code, a document which cannot be read or is not well formed. The
+// bool is false when the entry could not be read or parsed.
+func (c *checker) xmlFile(name string, invalid string) ([]byte, bool) {
+	doc, err := readFile(c.zip, name)
+	switch {
+	case errors.Is(err, ErrFileTooLarge):
+		c.add(CodeFileTooLarge, upload.SeverityError, name, "file is larger than %d bytes", maxFileSize)
+		return nil, false
+	case err != nil:
+		c.add(invalid, upload.SeverityError, name, "cannot read file: %v", err)
+		return nil, false
+	}
+
+	if msg := checkXMLDeclaration(doc); msg != "" {
+		c.add(CodeXMLDeclaration, upload.SeverityError, name, "%s", msg)
+	}
+
+	if err := decodeXML(doc, nil); err != nil {
+		c.add(invalid, upload.SeverityError, name, "%v", err)
+		return nil, false
+	}
+
+	return doc, true
+}
+
+func (c *checker) exists(name string) bool {
+	f, err := c.zip.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// =============================================================================
+
+// checkXMLDeclaration returns a description of the problem with the XML
+// declaration of the document, or an empty string when it is acceptable. The
+// declaration is optional, but when present it must be the very first thing in
+// the document and declare an encoding EPUB allows.
+func checkXMLDeclaration(doc []byte) string {
+	doc = bytes.TrimPrefix(doc, utf8BOM)
+
+	i := bytes.Index(doc, []byte("<?xml"))
+	switch {
+	case i < 0:
+		return ""
+	case i > 0 && len(bytes.TrimSpace(doc[:i])) == 0:
+		return "content before the XML declaration"
+	case i > 0:
+		return ""
+	}
+
+	m := reXMLDecl.FindSubmatch(doc)
+	if m == nil {
+		return "malformed XML declaration"
+	}
+
+	if enc := strings.ToLower(string(m[2])); enc != "" && enc != "utf-8" && enc != "utf-16" {
+		return fmt.Sprintf("encoding %q is not allowed, documents must be UTF-8 or UTF-16", m[2])
+	}
+
+	return ""
+}
+
+// decodeXML parses the whole document into v, or only checks that it is well
+// formed when v is nil. HTML entities are accepted since XHTML content
+// documents commonly use them.
+func decodeXML(doc []byte, v any) error {
+	dec := xml.NewDecoder(bytes.NewReader(bytes.TrimLeft(bytes.TrimPrefix(doc, utf8BOM), " \t\r\n")))
+	dec.Entity = xml.HTMLEntity
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		// the declared encoding is checked separately
+		return input, nil
+	}
+
+	if v != nil {
+		return dec.Decode(v)
+	}
+
+	for {
+		_, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// navLinks returns the hrefs of the EPUB3 toc nav, reporting whether the nav
+// element was found.
+func navLinks(doc []byte) ([]string, bool) {
+	dec := xml.NewDecoder(bytes.NewReader(bytes.TrimLeft(bytes.TrimPrefix(doc, utf8BOM), " \t\r\n")))
+	dec.Entity = xml.HTMLEntity
+	dec.Strict = false
+
+	var links []string
+	depth, found := 0, false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return links, found
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth > 0 {
+				depth++
+			}
+			if depth == 0 && t.Name.Local == "nav" {
+				for _, a := range t.Attr {
+					if a.Name.Space == namespaceOPS && a.Name.Local == "type" && strings.Contains(a.Value, "toc") {
+						depth, found = 1, true
+					}
+				}
+			}
+			if depth > 0 && t.Name.Local == "a" {
+				for _, a := range t.Attr {
+					if a.Name.Local == "href" {
+						links = append(links, a.Value)
+					}
+				}
+			}
+		case xml.EndElement:
+			if depth > 0 {
+				depth--
+			}
+		}
+	}
+}
+
+// resolveFrom resolves a link found in the document at base to a container
+// path. Remote links and fragments within the same document resolve to an
+// empty string.
+func resolveFrom(base, href string) string {
+	if isRemote(href) {
+		return ""
+	}
+	if href = hrefPath(href); href == "" {
+		return ""
+	}
+	return path.Join(path.Dir(base), href)
+}
+
+func isRemote(href string) bool {
+	u, err := url.Parse(href)
+	return err == nil && u.Scheme != ""
+}
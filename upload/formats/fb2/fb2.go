@@ -0,0 +1,176 @@
+// Package fb2 reads the metadata and text of FictionBook 2 documents.
+package fb2
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/opf"
+	"github.com/funayman/ebook-uploader/upload/isbn"
+)
+
+// the description comes first, the part of the file read to find it
+const maxDescriptionSize = 1 << 20
+
+// description is the metadata section of a FictionBook.
+type description struct {
+	TitleInfo struct {
+		Genres   []string `xml:"genre"`
+		Authors  []author `xml:"author"`
+		Title    string   `xml:"book-title"`
+		Date     string   `xml:"date"`
+		Lang     string   `xml:"lang"`
+		Sequence []struct {
+			Name   string `xml:"name,attr"`
+			Number string `xml:"number,attr"`
+		} `xml:"sequence"`
+	} `xml:"title-info"`
+	PublishInfo struct {
+		ISBN string `xml:"isbn"`
+		Year string `xml:"year"`
+	} `xml:"publish-info"`
+}
+
+type author struct {
+	FirstName  string `xml:"first-name"`
+	MiddleName string `xml:"middle-name"`
+	LastName   string `xml:"last-name"`
+	Nickname   string `xml:"nickname"`
+}
+
+func (a author) String() string {
+	name := clean(strings.Join([]string{a.FirstName, a.MiddleName, a.LastName}, " "))
+	if name == "" {
+		name = clean(a.Nickname)
+	}
+	return name
+}
+
+// Extractor reads the metadata of FB2 uploads.
+type Extractor struct{}
+
+// Extract implements the upload.Extractor interface.
+func (Extractor) Extract(name string, r io.ReaderAt, size int64) (upload.Metadata, error) {
+	if !IsFB2(name) {
+		return upload.Metadata{}, upload.ErrUnsupportedFormat
+	}
+
+	dec := newDecoder(io.NewSectionReader(r, 0, min(size, maxDescriptionSize)))
+
+	var desc description
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return upload.Metadata{}, fmt.Errorf("find description: %w", err)
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "description" {
+			if err := dec.DecodeElement(&desc, &se); err != nil {
+				return upload.Metadata{}, fmt.Errorf("decode description: %w", err)
+			}
+			break
+		}
+	}
+
+	ti := desc.TitleInfo
+	md := upload.Metadata{
+		Title:    clean(ti.Title),
+		Language: clean(ti.Lang),
+		Date:     opf.Date(ti.Date),
+	}
+	for _, a := range ti.Authors {
+		if s := a.String(); s != "" {
+			md.Authors = append(md.Authors, s)
+		}
+	}
+	for _, g := range ti.Genres {
+		if g = clean(g); g != "" {
+			md.Tags = append(md.Tags, g)
+		}
+	}
+	if len(ti.Sequence) > 0 {
+		md.Series = clean(ti.Sequence[0].Name)
+		if md.Series != "" {
+			md.SeriesIndex = opf.SeriesIndex(ti.Sequence[0].Number)
+		}
+	}
+	if md.Date == "" {
+		md.Date = opf.Date(desc.PublishInfo.Year)
+	}
+	if n, ok := isbn.Normalize(desc.PublishInfo.ISBN); ok {
+		md.ISBN = n
+	}
+
+	return md, nil
+}
+
+// Sample implements the language.Sampler interface, returning the text of the
+// bodies of the book.
+func (Extractor) Sample(name string, r io.ReaderAt, size int64, max int) (string, error) {
+	if !IsFB2(name) {
+		return "", upload.ErrUnsupportedFormat
+	}
+
+	dec := newDecoder(io.NewSectionReader(r, 0, size))
+
+	var sb strings.Builder
+	depth := 0
+	for sb.Len() < max {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "body" || depth > 0 {
+				depth++
+			}
+		case xml.EndElement:
+			if depth > 0 {
+				depth--
+				sb.WriteByte('\n')
+			}
+		case xml.CharData:
+			if depth > 0 {
+				sb.Write(t)
+			}
+		}
+	}
+
+	text := sb.String()
+	if len(text) > max {
+		text = text[:max]
+	}
+	return text, nil
+}
+
+// IsFB2 reports whether the filename has an FB2 extension.
+func IsFB2(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".fb2")
+}
+
+// newDecoder returns a lenient decoder for FictionBooks, many of which are in
+// a legacy encoding such as Windows-1251.
+func newDecoder(r io.Reader) *xml.Decoder {
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}
+	return dec
+}
+
+// clean collapses the whitespace of a value.
+func clean(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,107 @@
+package fb2
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+const testBook = `<?xml version="1.0" encoding="windows-1251"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+  <description>
+    <title-info>
+      <genre>sf_fantasy</genre>
+      <author><first-name>Михаил</first-name><middle-name>Афанасьевич</middle-name><last-name>Булгаков</last-name></author>
+      <author><nickname>Anon</nickname></author>
+      <book-title>Мастер и  Маргарита</book-title>
+      <date value="1967-01-01">1967</date>
+      <lang>ru</lang>
+      <sequence name="Романы" number="3"/>
+    </title-info>
+    <publish-info>
+      <isbn>978-5-17-090630-7</isbn>
+    </publish-info>
+  </description>
+  <body>
+    <section><title><p>Глава 1</p></title><p>Никогда не разговаривайте с неизвестными.</p></section>
+  </body>
+  <binary id="cover.jpg" content-type="image/jpeg">AAAA</binary>
+</FictionBook>`
+
+func newBook(t *testing.T) *bytes.Reader {
+	t.Helper()
+
+	b, err := charmap.Windows1251.NewEncoder().String(testBook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader([]byte(b))
+}
+
+func TestExtract(t *testing.T) {
+	r := newBook(t)
+	md, err := Extractor{}.Extract("book.fb2", r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := upload.Metadata{
+		Title:       "Мастер и Маргарита",
+		Authors:     []string{"Михаил Афанасьевич Булгаков", "Anon"},
+		Series:      "Романы",
+		SeriesIndex: 3,
+		Tags:        []string{"sf_fantasy"},
+		Language:    "ru",
+		ISBN:        "9785170906307",
+		Date:        "1967",
+	}
+	if !reflect.DeepEqual(md, want) {
+		t.Errorf("expected: %+v; got: %+v", want, md)
+	}
+
+	if _, err := (Extractor{}).Extract("book.epub", r, r.Size()); !errors.Is(err, upload.ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat; got: %v", err)
+	}
+}
+
+func TestSample(t *testing.T) {
+	r := newBook(t)
+	text, err := Extractor{}.Sample("book.fb2", r, r.Size(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "Никогда не разговаривайте") || strings.Contains(text, "Маргарита") || strings.Contains(text, "AAAA") {
+		t.Errorf("expected body text only; got: %q", text)
+	}
+}
+
+func TestExtractSeriesIndex(t *testing.T) {
+	tests := []struct {
+		number string
+		want   float64
+	}{
+		{"2.5", 2.5},
+		{"nan", 0},
+		{"inf", 0},
+		{"1e400", 0},
+		{"-1", 0},
+		{"first", 0},
+	}
+	for _, tt := range tests {
+		book := `<FictionBook><description><title-info><book-title>Mort</book-title><sequence name="Discworld" number="` + tt.number + `"/></title-info></description></FictionBook>`
+		r := strings.NewReader(book)
+		md, err := Extractor{}.Extract("book.fb2", r, r.Size())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.number, err)
+		}
+		if md.SeriesIndex != tt.want {
+			t.Errorf("%s: expected %v; got %v", tt.number, tt.want, md.SeriesIndex)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+// Package mobi reads the metadata and text of Mobipocket and Kindle (AZW,
+// AZW3) books.
+package mobi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"path"
+	"strings"
+
+	"golang.org/x/text/encoding/charmap"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/opf"
+	"github.com/funayman/ebook-uploader/upload/isbn"
+)
+
+const (
+	pdbHeaderSize = 78
+	pdbRecordSize = 8
+
+	// the largest record read, text records are 4KB and headers a few more
+	maxRecordSize = 1 << 20
+
+	// offsets in record 0, the PalmDOC header followed by the MOBI header
+	offCompression   = 0
+	offRecordCount   = 8
+	offEncryption    = 12
+	offMOBI          = 16
+	offHeaderLength  = 20
+	offEncoding      = 28
+	offFullName      = 84
+	offFullNameLen   = 88
+	offEXTHFlags     = 128
+	flagEXTH         = 0x40
+	offExtraFlags    = 242
+	minExtraFlagsLen = 228
+
+	compressionNone    = 1
+	compressionPalmDOC = 2
+
+	encodingUTF8 = 65001
+
+	// EXTH record types
+	exthAuthor   = 100
+	exthISBN     = 104
+	exthSubject  = 105
+	exthDate     = 106
+	exthTitle    = 503
+	exthLanguage = 524
+)
+
+var (
+	ErrNotMOBI     = errors.New("not a mobipocket book")
+	ErrEncrypted   = errors.New("book is encrypted")
+	ErrCompression = errors.New("unsupported compression")
+)
+
+// Extractor reads the title, authors, subjects, language, ISBN and publication
+// date of MOBI, AZW and AZW3 uploads from their EXTH header.
+type Extractor struct{}
+
+// Extract implements the upload.Extractor interface.
+func (Extractor) Extract(name string, r io.ReaderAt, size int64) (upload.Metadata, error) {
+	if !IsMOBI(name) {
+		return upload.Metadata{}, upload.ErrUnsupportedFormat
+	}
+
+	b, err := open(r, size)
+	if err != nil {
+		return upload.Metadata{}, err
+	}
+
+	md := upload.Metadata{Title: b.name}
+	for _, rec := range b.exth {
+		value := strings.TrimSpace(b.decode(rec.data))
+		if value == "" {
+			continue
+		}
+		switch rec.typ {
+		case exthTitle:
+			md.Title = value
+		case exthAuthor:
+			md.Authors = append(md.Authors, value)
+		case exthSubject:
+			md.Tags = append(md.Tags, value)
+		case exthLanguage:
+			md.Language = value
+		case exthDate:
+			md.Date = opf.Date(value)
+		case exthISBN:
+			if n, ok := isbn.Normalize(value); ok {
+				md.ISBN = n
+			}
+		}
+	}
+
+	return md, nil
+}
+
+// Sample implements the language.Sampler interface, returning the text of the
+// start of the book without its markup.
+func (Extractor) Sample(name string, r io.ReaderAt, size int64, max int) (string, error) {
+	if !IsMOBI(name) {
+		return "", upload.ErrUnsupportedFormat
+	}
+
+	b, err := open(r, size)
+	if err != nil {
+		return "", err
+	}
+
+	// markup takes up much of the text, read more to make up for it
+	raw, err := b.text(r, 4*max)
+	if err != nil {
+		return "", err
+	}
+
+	text := stripTags(b.decode(raw))
+	if len(text) > max {
+		text = text[:max]
+	}
+	return text, nil
+}
+
+// IsMOBI reports whether the filename has a MOBI, AZW, AZW3 or PRC extension.
+func IsMOBI(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".mobi", ".azw", ".azw3", ".prc":
+		return true
+	}
+	return false
+}
+
+// =============================================================================
+
+type exthRecord struct {
+	typ  uint32
+	data []byte
+}
+
+// book is the header of a Mobipocket book.
+type book struct {
+	offsets     []int64
+	size        int64
+	compression uint16
+	textRecords int
+	utf8        bool
+	extraFlags  uint16
+	name        string
+	exth        []exthRecord
+}
+
+// open reads the PDB header, the record list and the headers in record 0.
+func open(r io.ReaderAt, size int64) (*book, error) {
+	hdr := make([]byte, pdbHeaderSize)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotMOBI, err)
+	}
+	if typ := string(hdr[60:68]); typ != "BOOKMOBI" && typ != "TEXtREAd" {
+		return nil, fmt.Errorf("%w: type %q", ErrNotMOBI, typ)
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[76:]))
+	list := make([]byte, n*pdbRecordSize)
+	if _, err := r.ReadAt(list, pdbHeaderSize); err != nil {
+		return nil, fmt.Errorf("read record list: %w", err)
+	}
+	b := &book{size: size}
+	for i := 0; i < n; i++ {
+		b.offsets = append(b.offsets, int64(binary.BigEndian.Uint32(list[i*pdbRecordSize:])))
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%w: no records", ErrNotMOBI)
+	}
+
+	rec0, err := b.record(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rec0) < offMOBI {
+		return nil, fmt.Errorf("%w: short header", ErrNotMOBI)
+	}
+	if binary.BigEndian.Uint16(rec0[offEncryption:]) != 0 {
+		return nil, ErrEncrypted
+	}
+	b.compression = binary.BigEndian.Uint16(rec0[offCompression:])
+	b.textRecords = int(binary.BigEndian.Uint16(rec0[offRecordCount:]))
+
+	// plain PalmDOC books have no MOBI header
+	if len(rec0) < offEXTHFlags+4 || string(rec0[offMOBI:offMOBI+4]) != "MOBI" {
+		return b, nil
+	}
+
+	headerLen := int(binary.BigEndian.Uint32(rec0[offHeaderLength:]))
+	b.utf8 = binary.BigEndian.Uint32(rec0[offEncoding:]) == encodingUTF8
+	if headerLen >= minExtraFlagsLen && len(rec0) >= offExtraFlags+2 {
+		b.extraFlags = binary.BigEndian.Uint16(rec0[offExtraFlags:])
+	}
+
+	start := int(binary.BigEndian.Uint32(rec0[offFullName:]))
+	end := start + int(binary.BigEndian.Uint32(rec0[offFullNameLen:]))
+	if start > 0 && end <= len(rec0) {
+		b.name = strings.TrimSpace(b.decode(rec0[start:end]))
+	}
+
+	if binary.BigEndian.Uint32(rec0[offEXTHFlags:])&flagEXTH != 0 {
+		b.exth = parseEXTH(rec0[min(offMOBI+headerLen, len(rec0)):])
+	}
+
+	return b, nil
+}
+
+// parseEXTH returns the records of an EXTH header, ignoring a truncated end.
+func parseEXTH(data []byte) []exthRecord {
+	if len(data) < 12 || string(data[:4]) != "EXTH" {
+		return nil
+	}
+
+	var records []exthRecord
+	count := int(binary.BigEndian.Uint32(data[8:]))
+	data = data[12:]
+	for i := 0; i < count && len(data) >= 8; i++ {
+		typ := binary.BigEndian.Uint32(data)
+		n := int(binary.BigEndian.Uint32(data[4:]))
+		if n < 8 || n > len(data) {
+			break
+		}
+		records = append(records, exthRecord{typ: typ, data: data[8:n]})
+		data = data[n:]
+	}
+	return records
+}
+
+// record returns the content of the i-th record.
+func (b *book) record(r io.ReaderAt, i int) ([]byte, error) {
+	start, end := b.offsets[i], b.size
+	if i+1 < len(b.offsets) {
+		end = b.offsets[i+1]
+	}
+	if start > end || end > b.size || end-start > maxRecordSize {
+		return nil, fmt.Errorf("%w: record %d out of bounds", ErrNotMOBI, i)
+	}
+
+	data := make([]byte, end-start)
+	if _, err := r.ReadAt(data, start); err != nil {
+		return nil, fmt.Errorf("read record %d: %w", i, err)
+	}
+	return data, nil
+}
+
+// text returns at least max bytes of the decompressed text, unless the book
+// is shorter.
+func (b *book) text(r io.ReaderAt, max int) ([]byte, error) {
+	if b.compression != compressionNone && b.compression != compressionPalmDOC {
+		return nil, fmt.Errorf("%w: %d", ErrCompression, b.compression)
+	}
+
+	var out []byte
+	for i := 1; i <= b.textRecords && i < len(b.offsets) && len(out) < max; i++ {
+		data, err := b.record(r, i)
+		if err != nil {
+			return nil, err
+		}
+		data = data[:len(data)-trailingSize(data, b.extraFlags)]
+		if b.compression == compressionPalmDOC {
+			out = decompress(out, data)
+		} else {
+			out = append(out, data...)
+		}
+	}
+	return out, nil
+}
+
+// decode returns the text in the encoding of the book, UTF-8 or Windows-1252.
+func (b *book) decode(data []byte) string {
+	if b.utf8 {
+		return strings.ToValidUTF8(string(data), "")
+	}
+	s, err := charmap.Windows1252.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(s)
+}
+
+// trailingSize returns the size of the entries the extra flags say are
+// appended to a text record.
+func trailingSize(data []byte, flags uint16) int {
+	size := 0
+	for f := flags >> 1; f != 0; f >>= 1 {
+		if f&1 != 0 && size < len(data) {
+			size += backwardVarint(data[:len(data)-size])
+		}
+	}
+	if flags&1 != 0 && size < len(data) {
+		size += int(data[len(data)-size-1]&0x3) + 1
+	}
+	return min(size, len(data))
+}
+
+// backwardVarint decodes the size at the end of a trailing entry.
+func backwardVarint(data []byte) int {
+	n := 0
+	for _, c := range data[max(len(data)-4, 0):] {
+		if c&0x80 != 0 {
+			n = 0
+		}
+		n = n<<7 | int(c&0x7f)
+	}
+	return n
+}
+
+// decompress appends the PalmDOC (LZ77) decompressed data to out.
+func decompress(out, data []byte) []byte {
+	for i := 0; i < len(data); {
+		c := data[i]
+		i++
+		switch {
+		case c >= 1 && c <= 8:
+			end := min(i+int(c), len(data))
+			out = append(out, data[i:end]...)
+			i = end
+		case c < 0x80:
+			out = append(out, c)
+		case c >= 0xc0:
+			out = append(out, ' ', c^0x80)
+		default:
+			if i >= len(data) {
+				return out
+			}
+			pair := int(c)<<8 | int(data[i])
+			i++
+			dist, n := (pair>>3)&0x7ff, pair&7+3
+			if dist == 0 || dist > len(out) {
+				continue
+			}
+			for j := 0; j < n; j++ {
+				out = append(out, out[len(out)-dist])
+			}
+		}
+	}
+	return out
+}
+
+// stripTags removes the markup of the text of a book.
+func stripTags(s string) string {
+	var sb strings.Builder
+	inTag := false
+	for _, r := range s {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>' && inTag:
+			inTag = false
+			sb.WriteByte(' ')
+		case !inTag:
+			sb.WriteRune(r)
+		}
+	}
+	return html.UnescapeString(sb.String())
+}
@@ -0,0 +1,127 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+// newBook returns a PDB file with a MOBI header, an EXTH header and a single
+// PalmDOC compressed text record followed by two trailing entries.
+func newBook(t *testing.T, encrypted bool) *bytes.Reader {
+	t.Helper()
+
+	be := binary.BigEndian
+	exth := func(typ uint32, value string) []byte {
+		b := be.AppendUint32(nil, typ)
+		b = be.AppendUint32(b, uint32(8+len(value)))
+		return append(b, value...)
+	}
+	var records []byte
+	for _, r := range [][]byte{
+		exth(exthTitle, "The Title"),
+		exth(exthAuthor, "Jane Doe"),
+		exth(exthAuthor, "John Roe"),
+		exth(exthSubject, "Fiction"),
+		exth(exthLanguage, "en-GB"),
+		exth(exthDate, "2020-05-01T00:00:00+00:00"),
+		exth(exthISBN, "978-0-306-40615-7"),
+	} {
+		records = append(records, r...)
+	}
+	header := []byte("EXTH")
+	header = be.AppendUint32(header, uint32(12+len(records)))
+	header = be.AppendUint32(header, 7)
+	header = append(header, records...)
+
+	// record 0: PalmDOC header, MOBI header, EXTH header and full name
+	const headerLen = 232
+	rec0 := make([]byte, offMOBI+headerLen)
+	be.PutUint16(rec0[offCompression:], compressionPalmDOC)
+	be.PutUint16(rec0[offRecordCount:], 1)
+	if encrypted {
+		be.PutUint16(rec0[offEncryption:], 2)
+	}
+	copy(rec0[offMOBI:], "MOBI")
+	be.PutUint32(rec0[offHeaderLength:], headerLen)
+	be.PutUint32(rec0[offEncoding:], 1252)
+	be.PutUint32(rec0[offEXTHFlags:], flagEXTH)
+	be.PutUint16(rec0[offExtraFlags:], 0b11)
+	rec0 = append(rec0, header...)
+	be.PutUint32(rec0[offFullName:], uint32(len(rec0)))
+	be.PutUint32(rec0[offFullNameLen:], 9)
+	rec0 = append(rec0, "Full Name"...)
+
+	// "<p>Caf\xe9 caf\xe9</p>": a literal, a space pair and a back reference
+	// to "caf\xe9" 5 bytes back, then a multibyte and a 3 byte trailing entry
+	text := []byte("<p>Caf")
+	text = append(text, 0x01, 0xe9, 0xe3)
+	text = be.AppendUint16(text, 0x8000|5<<3|1)
+	text = append(text, "</p>"...)
+	text = append(text, 0x00, 'X', 'Y', 0x83)
+
+	var pdb bytes.Buffer
+	hdr := make([]byte, pdbHeaderSize)
+	copy(hdr, "test")
+	copy(hdr[60:], "BOOKMOBI")
+	be.PutUint16(hdr[76:], 2)
+	pdb.Write(hdr)
+	offset := pdbHeaderSize + 2*pdbRecordSize
+	for _, r := range [][]byte{rec0, text} {
+		pdb.Write(be.AppendUint32(nil, uint32(offset)))
+		pdb.Write(make([]byte, 4))
+		offset += len(r)
+	}
+	pdb.Write(rec0)
+	pdb.Write(text)
+
+	return bytes.NewReader(pdb.Bytes())
+}
+
+func TestExtract(t *testing.T) {
+	r := newBook(t, false)
+	md, err := Extractor{}.Extract("book.azw3", r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := upload.Metadata{
+		Title:    "The Title",
+		Authors:  []string{"Jane Doe", "John Roe"},
+		Tags:     []string{"Fiction"},
+		Language: "en-GB",
+		Date:     "2020-05-01",
+		ISBN:     "9780306406157",
+	}
+	if !reflect.DeepEqual(md, want) {
+		t.Errorf("expected: %+v; got: %+v", want, md)
+	}
+
+	if _, err := (Extractor{}).Extract("book.epub", r, r.Size()); !errors.Is(err, upload.ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat; got: %v", err)
+	}
+	if _, err := (Extractor{}).Extract("book.mobi", bytes.NewReader(make([]byte, 100)), 100); !errors.Is(err, ErrNotMOBI) {
+		t.Errorf("expected ErrNotMOBI; got: %v", err)
+	}
+}
+
+func TestSample(t *testing.T) {
+	r := newBook(t, false)
+	text, err := Extractor{}.Sample("book.mobi", r, r.Size(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Café café"; strings.TrimSpace(text) != want {
+		t.Errorf("expected: %q; got: %q", want, text)
+	}
+
+	r = newBook(t, true)
+	if _, err := (Extractor{}).Sample("book.mobi", r, r.Size(), 1024); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("expected ErrEncrypted; got: %v", err)
+	}
+}
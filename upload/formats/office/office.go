@@ -0,0 +1,248 @@
+// Package office reads the document properties of Office Open XML (DOCX) and
+// OpenDocument (ODT) text documents.
+package office
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/opf"
+)
+
+const (
+	// the largest properties document read, real ones are a few kilobytes
+	maxPropertiesSize = 1 << 20
+
+	corePropertiesPath = "docProps/core.xml"
+	relationshipsPath  = "_rels/.rels"
+	metaPath           = "meta.xml"
+	documentPath       = "word/document.xml"
+	contentPath        = "content.xml"
+
+	relCoreProperties = "/metadata/core-properties"
+)
+
+var (
+	ErrNoProperties = errors.New("document has no properties")
+)
+
+// Extractor reads the title, authors, keywords, language and creation date of
+// DOCX and ODT uploads.
+type Extractor struct{}
+
+// Extract implements the upload.Extractor interface.
+func (Extractor) Extract(name string, r io.ReaderAt, size int64) (upload.Metadata, error) {
+	var parse func(*zip.Reader) (upload.Metadata, error)
+	switch {
+	case IsDOCX(name):
+		parse = docxMetadata
+	case IsODT(name):
+		parse = odtMetadata
+	default:
+		return upload.Metadata{}, upload.ErrUnsupportedFormat
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return upload.Metadata{}, fmt.Errorf("zip: %w", err)
+	}
+	return parse(zr)
+}
+
+// Sample implements the language.Sampler interface, returning the text of the
+// document body.
+func (Extractor) Sample(name string, r io.ReaderAt, size int64, max int) (string, error) {
+	var part string
+	switch {
+	case IsDOCX(name):
+		part = documentPath
+	case IsODT(name):
+		part = contentPath
+	default:
+		return "", upload.ErrUnsupportedFormat
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", fmt.Errorf("zip: %w", err)
+	}
+	f, err := zr.Open(part)
+	if err != nil {
+		return "", fmt.Errorf("open %s: %w", part, err)
+	}
+	defer f.Close()
+
+	return xmlText(f, max), nil
+}
+
+// IsDOCX reports whether the filename has a DOCX extension.
+func IsDOCX(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".docx")
+}
+
+// IsODT reports whether the filename has an ODT extension.
+func IsODT(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".odt")
+}
+
+// =============================================================================
+
+// coreProperties is the core properties part of an Office Open XML package.
+type coreProperties struct {
+	Title    string `xml:"http://purl.org/dc/elements/1.1/ title"`
+	Creator  string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Language string `xml:"http://purl.org/dc/elements/1.1/ language"`
+	Keywords string `xml:"http://schemas.openxmlformats.org/package/2006/metadata/core-properties keywords"`
+	Created  string `xml:"http://purl.org/dc/terms/ created"`
+}
+
+// relationships is the package relationships part of an Office Open XML
+// package.
+type relationships struct {
+	Relationships []struct {
+		Type   string `xml:"Type,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+func docxMetadata(zr *zip.Reader) (upload.Metadata, error) {
+	var props coreProperties
+	if err := decode(zr, corePropertiesName(zr), &props); err != nil {
+		return upload.Metadata{}, err
+	}
+
+	md := upload.Metadata{
+		Title:    clean(props.Title),
+		Authors:  split(props.Creator, ";"),
+		Tags:     split(props.Keywords, ",;"),
+		Language: clean(props.Language),
+		Date:     opf.Date(props.Created),
+	}
+	return md, nil
+}
+
+// corePropertiesName returns the name of the core properties part, which is
+// found through the package relationships.
+func corePropertiesName(zr *zip.Reader) string {
+	var rels relationships
+	if err := decode(zr, relationshipsPath, &rels); err != nil {
+		return corePropertiesPath
+	}
+	for _, rel := range rels.Relationships {
+		if strings.HasSuffix(rel.Type, relCoreProperties) {
+			return strings.TrimPrefix(path.Clean("/"+rel.Target), "/")
+		}
+	}
+	return corePropertiesPath
+}
+
+// =============================================================================
+
+// documentMeta is the meta.xml document of an OpenDocument package.
+type documentMeta struct {
+	Meta struct {
+		Title          string   `xml:"http://purl.org/dc/elements/1.1/ title"`
+		Creator        string   `xml:"http://purl.org/dc/elements/1.1/ creator"`
+		InitialCreator string   `xml:"urn:oasis:names:tc:opendocument:xmlns:meta:1.0 initial-creator"`
+		Language       string   `xml:"http://purl.org/dc/elements/1.1/ language"`
+		Keywords       []string `xml:"urn:oasis:names:tc:opendocument:xmlns:meta:1.0 keyword"`
+		CreationDate   string   `xml:"urn:oasis:names:tc:opendocument:xmlns:meta:1.0 creation-date"`
+		Date           string   `xml:"http://purl.org/dc/elements/1.1/ date"`
+	} `xml:"urn:oasis:names:tc:opendocument:xmlns:office:1.0 meta"`
+}
+
+func odtMetadata(zr *zip.Reader) (upload.Metadata, error) {
+	var doc documentMeta
+	if err := decode(zr, metaPath, &doc); err != nil {
+		return upload.Metadata{}, err
+	}
+	m := doc.Meta
+
+	// dc:creator is whoever saved the document last, the author is the
+	// initial creator
+	author := m.InitialCreator
+	if strings.TrimSpace(author) == "" {
+		author = m.Creator
+	}
+
+	md := upload.Metadata{
+		Title:    clean(m.Title),
+		Authors:  split(author, ";"),
+		Language: clean(m.Language),
+		Date:     opf.Date(m.CreationDate),
+	}
+	if md.Date == "" {
+		md.Date = opf.Date(m.Date)
+	}
+	for _, k := range m.Keywords {
+		md.Tags = append(md.Tags, split(k, ",")...)
+	}
+	return md, nil
+}
+
+// =============================================================================
+
+// decode reads the XML document stored under name in the package.
+func decode(zr *zip.Reader, name string, v any) error {
+	f, err := zr.Open(name)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrNoProperties, name)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(io.LimitReader(f, maxPropertiesSize)).Decode(v); err != nil {
+		return fmt.Errorf("parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// xmlText returns the character data of the document up to max bytes, with
+// paragraphs on lines of their own. Both WordprocessingML and OpenDocument
+// name their paragraphs and headings p and h.
+func xmlText(r io.Reader, max int) string {
+	var sb strings.Builder
+
+	dec := xml.NewDecoder(r)
+	for sb.Len() < max {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			sb.Write(t)
+		case xml.EndElement:
+			if t.Name.Local == "p" || t.Name.Local == "h" {
+				sb.WriteByte('\n')
+			}
+		}
+	}
+
+	text := sb.String()
+	if len(text) > max {
+		text = text[:max]
+	}
+	return text
+}
+
+// split splits a list of names or keywords at any of the separators.
+func split(s, seps string) []string {
+	var out []string
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool { return strings.ContainsRune(seps, r) }) {
+		if v = clean(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// clean collapses the whitespace of a property value.
+func clean(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
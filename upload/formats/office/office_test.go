@@ -0,0 +1,126 @@
+package office
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+const (
+	testRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+  <Relationship Id="rId2" Type="http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties" Target="props/core.xml"/>
+  <Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>
+</Relationships>`
+
+	testCore = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <dc:title>The  Manuscript</dc:title>
+  <dc:creator>Jane Doe; John Roe</dc:creator>
+  <cp:keywords>fantasy, draft</cp:keywords>
+  <cp:lastModifiedBy>Editor</cp:lastModifiedBy>
+  <dc:language>en-GB</dc:language>
+  <dcterms:created xsi:type="dcterms:W3CDTF">2021-03-04T10:00:00Z</dcterms:created>
+  <dcterms:modified xsi:type="dcterms:W3CDTF">2023-01-01T10:00:00Z</dcterms:modified>
+</cp:coreProperties>`
+
+	testMeta = `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-meta xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:meta="urn:oasis:names:tc:opendocument:xmlns:meta:1.0" xmlns:dc="http://purl.org/dc/elements/1.1/" office:version="1.3">
+  <office:meta>
+    <meta:initial-creator>Jane Doe</meta:initial-creator>
+    <dc:creator>Editor</dc:creator>
+    <dc:title>Notes</dc:title>
+    <dc:language>de</dc:language>
+    <meta:keyword>travel</meta:keyword>
+    <meta:keyword>journal</meta:keyword>
+    <meta:creation-date>2019-07-01T12:30:00.123</meta:creation-date>
+    <dc:date>2020-02-02T08:00:00</dc:date>
+  </office:meta>
+</office:document-meta>`
+)
+
+func newZip(t *testing.T, files map[string]string) *bytes.Reader {
+	t.Helper()
+
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(b.Bytes())
+}
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  upload.Metadata
+	}{
+		{
+			name:  "book.docx",
+			files: map[string]string{relationshipsPath: testRels, "props/core.xml": testCore},
+			want: upload.Metadata{
+				Title:    "The Manuscript",
+				Authors:  []string{"Jane Doe", "John Roe"},
+				Tags:     []string{"fantasy", "draft"},
+				Language: "en-GB",
+				Date:     "2021-03-04",
+			},
+		},
+		{
+			name:  "default.docx",
+			files: map[string]string{corePropertiesPath: testCore},
+			want: upload.Metadata{
+				Title:    "The Manuscript",
+				Authors:  []string{"Jane Doe", "John Roe"},
+				Tags:     []string{"fantasy", "draft"},
+				Language: "en-GB",
+				Date:     "2021-03-04",
+			},
+		},
+		{
+			name:  "notes.ODT",
+			files: map[string]string{metaPath: testMeta},
+			want: upload.Metadata{
+				Title:    "Notes",
+				Authors:  []string{"Jane Doe"},
+				Tags:     []string{"travel", "journal"},
+				Language: "de",
+				Date:     "2019-07-01",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		r := newZip(t, tt.files)
+		got, err := Extractor{}.Extract(tt.name, r, r.Size())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: incorrect metadata; expected: %+v; got: %+v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestExtractErrors(t *testing.T) {
+	r := newZip(t, map[string]string{"word/document.xml": "<w:document/>"})
+
+	if _, err := (Extractor{}).Extract("book.docx", r, r.Size()); !errors.Is(err, ErrNoProperties) {
+		t.Errorf("expected ErrNoProperties; got: %v", err)
+	}
+	if _, err := (Extractor{}).Extract("book.epub", r, r.Size()); !errors.Is(err, upload.ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat; got: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package opf
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrNoManifest = errors.New("package has no manifest element")
+	ErrNoSpine    = errors.New("package has no spine element")
+
+	reTocAttr = regexp.MustCompile(`\stoc\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+// AddItem adds the item to the end of the manifest of the OPF document. When
+// toc is set the toc attribute of the spine is pointed at the item, which is
+// how EPUB2 references the NCX.
+func AddItem(doc []byte, it Item, toc bool) ([]byte, error) {
+	manifest, err := locate(doc, "manifest")
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, ErrNoManifest
+	}
+
+	name := "item"
+	if i := strings.IndexByte(manifest.name, ':'); i >= 0 {
+		name = manifest.name[:i+1] + name
+	}
+
+	var b bytes.Buffer
+	b.WriteString("<" + name)
+	attr := func(k, v string) {
+		if v == "" {
+			return
+		}
+		b.WriteString(" " + k + `="`)
+		xml.EscapeText(&b, []byte(v))
+		b.WriteString(`"`)
+	}
+	attr("id", it.ID)
+	attr("href", it.Href)
+	attr("media-type", it.MediaType)
+	attr("properties", it.Properties)
+	b.WriteString("/>")
+
+	var edits []edit
+	switch {
+	case manifest.selfClosing:
+		text := ">\n" + manifest.indent + "  " + b.String() + "\n" + manifest.indent + "</" + manifest.name + ">"
+		edits = append(edits, edit{start: manifest.openEnd - 2, end: manifest.openEnd, text: []byte(text)})
+	default:
+		at := manifest.closeStart
+		text := "  " + b.String() + "\n" + manifest.indent
+		if i := bytes.LastIndexByte(doc[:at], '\n'); i >= manifest.openEnd && len(bytes.TrimSpace(doc[i:at])) == 0 {
+			at = i + 1
+			text = manifest.indent + "  " + b.String() + "\n"
+		}
+		edits = append(edits, edit{start: at, end: at, text: []byte(text)})
+	}
+
+	if toc {
+		spine, err := locate(doc, "spine")
+		if err != nil {
+			return nil, err
+		}
+		if spine == nil {
+			return nil, ErrNoSpine
+		}
+
+		tag := doc[spine.openStart:spine.openEnd]
+		value := []byte(` toc="` + it.ID + `"`)
+		if loc := reTocAttr.FindIndex(tag); loc != nil {
+			edits = append(edits, edit{start: spine.openStart + loc[0], end: spine.openStart + loc[1], text: value})
+		} else {
+			at := spine.openStart + 1 + len(spine.name)
+			edits = append(edits, edit{start: at, end: at, text: value})
+		}
+	}
+
+	return apply(doc, edits), nil
+}
+
+// located is the position of an element within a document.
+type located struct {
+	name        string
+	openStart   int
+	openEnd     int
+	closeStart  int
+	selfClosing bool
+	indent      string
+}
+
+// locate finds the child element of the root with the local name.
+func locate(doc []byte, local string) (*located, error) {
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	dec.CharsetReader = charsetReader
+
+	depth := 0
+	var loc *located
+	for {
+		off := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return loc, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("xml token: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 && t.Name.Local == local && loc == nil {
+				end := int(dec.InputOffset())
+				loc = &located{
+					name:        rawName(doc[off:end]),
+					openStart:   off,
+					openEnd:     end,
+					closeStart:  end,
+					selfClosing: bytes.HasSuffix(doc[:end], []byte("/>")),
+					indent:      lineIndent(doc, off),
+				}
+			}
+		case xml.EndElement:
+			if depth == 2 && t.Name.Local == local && loc != nil && !loc.selfClosing && loc.closeStart == loc.openEnd {
+				loc.closeStart = off
+			}
+			depth--
+		}
+	}
+}
@@ -0,0 +1,369 @@
+// Package opf reads and writes Open Packaging Format documents, the metadata
+// files found inside EPUBs and alongside books in a Calibre library.
+package opf
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/isbn"
+)
+
+const (
+	NamespaceOPF = "http://www.idpf.org/2007/opf"
+	NamespaceDC  = "http://purl.org/dc/elements/1.1/"
+)
+
+// reDate matches the calendar date at the start of an ISO 8601 timestamp.
+var reDate = regexp.MustCompile(`^[0-9]{4}(-[0-9]{2}(-[0-9]{2})?)?`)
+
+// Package is the root element of an OPF document.
+type Package struct {
+	XMLName          xml.Name        `xml:"package"`
+	Version          string          `xml:"version,attr"`
+	UniqueIdentifier string          `xml:"unique-identifier,attr"`
+	Metadata         PackageMetadata `xml:"metadata"`
+	Manifest         []Item          `xml:"manifest>item"`
+	Spine            Spine           `xml:"spine"`
+}
+
+// PackageMetadata holds the elements of the metadata section this package
+// understands. Anything else is ignored when parsing and left untouched when
+// rewriting.
+type PackageMetadata struct {
+	Titles      []Element `xml:"http://purl.org/dc/elements/1.1/ title"`
+	Creators    []Element `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Subjects    []Element `xml:"http://purl.org/dc/elements/1.1/ subject"`
+	Languages   []Element `xml:"http://purl.org/dc/elements/1.1/ language"`
+	Identifiers []Element `xml:"http://purl.org/dc/elements/1.1/ identifier"`
+	Dates       []Element `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Metas       []Meta    `xml:"meta"`
+}
+
+// Element is a Dublin Core element.
+type Element struct {
+	ID     string `xml:"id,attr"`
+	Role   string `xml:"http://www.idpf.org/2007/opf role,attr"`
+	Scheme string `xml:"http://www.idpf.org/2007/opf scheme,attr"`
+	Value  string `xml:",chardata"`
+}
+
+// Meta is either an EPUB2 name/content pair or an EPUB3 property element.
+type Meta struct {
+	ID       string `xml:"id,attr"`
+	Name     string `xml:"name,attr"`
+	Content  string `xml:"content,attr"`
+	Property string `xml:"property,attr"`
+	Refines  string `xml:"refines,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// Item is a manifest entry.
+type Item struct {
+	ID         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+// Spine is the reading order of the package.
+type Spine struct {
+	Toc      string    `xml:"toc,attr"`
+	ItemRefs []ItemRef `xml:"itemref"`
+}
+
+// ItemRef references a manifest item from the spine.
+type ItemRef struct {
+	IDRef  string `xml:"idref,attr"`
+	Linear string `xml:"linear,attr"`
+}
+
+// Parse decodes an OPF document.
+func Parse(r io.Reader) (*Package, error) {
+	var pkg Package
+
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = charsetReader
+	if err := dec.Decode(&pkg); err != nil {
+		return nil, fmt.Errorf("xml decode: %w", err)
+	}
+
+	return &pkg, nil
+}
+
+// BookMetadata converts the package metadata into upload metadata.
+func (p *Package) BookMetadata() upload.Metadata {
+	var md upload.Metadata
+	pm := p.Metadata
+
+	if len(pm.Titles) > 0 {
+		md.Title = clean(pm.Titles[0].Value)
+	}
+
+	for _, c := range pm.Creators {
+		role := c.Role
+		if role == "" && c.ID != "" {
+			role = p.refined(c.ID, "role")
+		}
+		if role != "" && role != "aut" {
+			continue
+		}
+		if v := clean(c.Value); v != "" {
+			md.Authors = append(md.Authors, v)
+		}
+	}
+
+	for _, s := range pm.Subjects {
+		if v := clean(s.Value); v != "" {
+			md.Tags = append(md.Tags, v)
+		}
+	}
+
+	if len(pm.Languages) > 0 {
+		md.Language = clean(pm.Languages[0].Value)
+	}
+
+	for _, id := range pm.Identifiers {
+		if !strings.EqualFold(id.Scheme, "isbn") && !strings.HasPrefix(strings.ToLower(strings.TrimSpace(id.Value)), "urn:isbn:") {
+			continue
+		}
+		if n, ok := isbn.Normalize(id.Value); ok {
+			md.ISBN = n
+			break
+		}
+	}
+
+	for _, d := range pm.Dates {
+		if v := Date(d.Value); v != "" {
+			md.Date = v
+			break
+		}
+	}
+
+	for _, m := range pm.Metas {
+		switch {
+		case m.Name == "calibre:series":
+			md.Series = clean(m.Content)
+		case m.Name == "calibre:series_index":
+			md.SeriesIndex = SeriesIndex(m.Content)
+		case m.Property == "belongs-to-collection" && md.Series == "":
+			md.Series = clean(m.Value)
+			if m.ID != "" {
+				md.SeriesIndex = SeriesIndex(p.refined(m.ID, "group-position"))
+			}
+		}
+	}
+
+	return md
+}
+
+// refined returns the value of the EPUB3 meta refining the element with the
+// provided id.
+func (p *Package) refined(id, property string) string {
+	for _, m := range p.Metadata.Metas {
+		if m.Refines == "#"+id && m.Property == property {
+			return strings.TrimSpace(m.Value)
+		}
+	}
+	return ""
+}
+
+// =============================================================================
+
+// Sidecar renders a standalone OPF document for the metadata, in the same
+// format Calibre uses for the metadata.opf files in its library.
+func Sidecar(md upload.Metadata) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<package xmlns="` + NamespaceOPF + `" version="2.0">` + "\n")
+	b.WriteString(`  <metadata xmlns:dc="` + NamespaceDC + `" xmlns:opf="` + NamespaceOPF + `">` + "\n")
+	b.Write(MetadataElements(md, "    "))
+	b.WriteString("  </metadata>\n")
+	b.WriteString("</package>\n")
+
+	return b.Bytes()
+}
+
+// MetadataElements renders the EPUB2 Dublin Core and calibre meta elements for
+// the metadata. Each element is written on its own line prefixed with indent.
+// The "dc" and "opf" prefixes must be bound by the enclosing document.
+func MetadataElements(md upload.Metadata, indent string) []byte {
+	ew := elementWriter{dc: "dc", opf: "opf", indent: indent}
+	ew.title(md.Title)
+	ew.authors(md.Authors)
+	ew.language(md.Language)
+	ew.tags(md.Tags)
+	ew.series(md.Series, md.SeriesIndex)
+	ew.isbn(md.ISBN)
+	ew.date(md.Date)
+
+	return ew.Bytes()
+}
+
+// MetadataElementsEPUB3 is MetadataElements for EPUB3 package documents, using
+// refines metas in place of the opf attributes.
+func MetadataElementsEPUB3(md upload.Metadata, indent string) []byte {
+	ew := elementWriter{dc: "dc", opf: "opf", epub3: true, indent: indent}
+	ew.title(md.Title)
+	ew.authors(md.Authors)
+	ew.language(md.Language)
+	ew.tags(md.Tags)
+	ew.series(md.Series, md.SeriesIndex)
+	ew.isbn(md.ISBN)
+	ew.date(md.Date)
+
+	return ew.Bytes()
+}
+
+// elementWriter writes metadata elements using the prefixes bound by the
+// document being written. EPUB3 documents get refines metas in place of the
+// EPUB2 only opf attributes.
+type elementWriter struct {
+	bytes.Buffer
+	dc     string
+	opf    string
+	epub3  bool
+	indent string
+}
+
+func (ew *elementWriter) elem(name, attrs, value string) {
+	ew.WriteString(ew.indent + "<" + ew.dc + ":" + name + attrs + ">")
+	xml.EscapeText(ew, []byte(value))
+	ew.WriteString("</" + ew.dc + ":" + name + ">\n")
+}
+
+func (ew *elementWriter) meta(name, content string) {
+	ew.WriteString(ew.indent + `<meta name="` + name + `" content="`)
+	xml.EscapeText(ew, []byte(content))
+	ew.WriteString(`"/>` + "\n")
+}
+
+func (ew *elementWriter) refines(id, property, value string) {
+	ew.WriteString(ew.indent + `<meta refines="#` + id + `" property="` + property + `">`)
+	xml.EscapeText(ew, []byte(value))
+	ew.WriteString("</meta>\n")
+}
+
+func (ew *elementWriter) title(title string) {
+	if title != "" {
+		ew.elem("title", "", title)
+	}
+}
+
+func (ew *elementWriter) authors(authors []string) {
+	for i, a := range authors {
+		if !ew.epub3 {
+			ew.elem("creator", " "+ew.opf+`:role="aut"`, a)
+			continue
+		}
+		id := fmt.Sprintf("uploader-creator-%d", i+1)
+		ew.elem("creator", ` id="`+id+`"`, a)
+		ew.refines(id, "role", "aut")
+	}
+}
+
+func (ew *elementWriter) language(lang string) {
+	if lang != "" {
+		ew.elem("language", "", lang)
+	}
+}
+
+func (ew *elementWriter) tags(tags []string) {
+	for _, t := range tags {
+		ew.elem("subject", "", t)
+	}
+}
+
+func (ew *elementWriter) series(series string, index float64) {
+	if series == "" {
+		return
+	}
+
+	idx := strconv.FormatFloat(index, 'f', -1, 64)
+
+	ew.meta("calibre:series", series)
+	if index > 0 {
+		ew.meta("calibre:series_index", idx)
+	}
+
+	if ew.epub3 {
+		id := "uploader-series"
+		ew.WriteString(ew.indent + `<meta property="belongs-to-collection" id="` + id + `">`)
+		xml.EscapeText(ew, []byte(series))
+		ew.WriteString("</meta>\n")
+		ew.refines(id, "collection-type", "series")
+		if index > 0 {
+			ew.refines(id, "group-position", idx)
+		}
+	}
+}
+
+func (ew *elementWriter) isbn(isbn string) {
+	if isbn == "" {
+		return
+	}
+	if ew.epub3 {
+		ew.elem("identifier", "", "urn:isbn:"+isbn)
+		return
+	}
+	ew.elem("identifier", " "+ew.opf+`:scheme="ISBN"`, isbn)
+}
+
+func (ew *elementWriter) date(date string) {
+	if date != "" {
+		ew.elem("date", "", date)
+	}
+}
+
+func (ew *elementWriter) cover(id string) {
+	ew.WriteString(ew.indent + `<meta name="cover" content="`)
+	xml.EscapeText(ew, []byte(id))
+	ew.WriteString(`"/>` + "\n")
+}
+
+// =============================================================================
+
+// Date returns the calendar date of an ISO 8601 date or timestamp, such as
+// "2008-10-12" for "2008-10-12T09:30:00Z", or an empty string when the value
+// does not start with a date. Calibre writes unknown dates as year 101, which
+// are dropped as well.
+func Date(s string) string {
+	s = strings.TrimSpace(s)
+	if m := reDate.FindString(s); m != "" && !strings.HasPrefix(m, "0") {
+		return m
+	}
+	return ""
+}
+
+// SeriesIndex parses the position of a book in its series, returning 0 for
+// values which are not a finite, positive number such as "nan" or "1e400".
+func SeriesIndex(s string) float64 {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
+
+// clean collapses the whitespace found in pretty printed documents.
+func clean(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// charsetReader allows documents declaring a charset other than UTF-8. Only
+// charsets which are a subset of UTF-8 are passed through untouched.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", charset)
+}
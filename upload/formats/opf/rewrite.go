@@ -0,0 +1,387 @@
+package opf
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+var (
+	ErrNoMetadata = errors.New("package has no metadata element")
+)
+
+// element is a direct child of the metadata element along with its location
+// within the document.
+type element struct {
+	name       xml.Name
+	attrs      []xml.Attr
+	start, end int
+}
+
+func (e element) attr(space, local string) string {
+	for _, a := range e.attrs {
+		if a.Name.Local == local && (a.Name.Space == space || a.Name.Space == "") {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// edit replaces doc[start:end] with text.
+type edit struct {
+	start, end int
+	text       []byte
+}
+
+// Rewrite replaces the metadata of the OPF document with the fields of md which
+// are set and differ from the current values. When the metadata changes, the
+// cover reference is repaired as well if it is missing or points to an item
+// which does not exist. Everything else in the document is kept byte for byte,
+// so the result is only as valid as the original. The returned bool reports
+// whether anything was changed.
+func Rewrite(doc []byte, md upload.Metadata) ([]byte, bool, error) {
+	return rewrite(doc, md, false)
+}
+
+// FixCover adds the EPUB2 cover meta readers such as Kobo and Calibre look
+// for, when it is missing or points to an item which is not an image, leaving
+// the rest of the document as it is. The returned bool reports whether
+// anything was changed.
+func FixCover(doc []byte) ([]byte, bool, error) {
+	return rewrite(doc, upload.Metadata{}, true)
+}
+
+// rewrite replaces the metadata as Rewrite does, repairing the cover reference
+// even when nothing else changes if cover is set.
+func rewrite(doc []byte, md upload.Metadata, cover bool) ([]byte, bool, error) {
+	pkg, err := Parse(bytes.NewReader(doc))
+	if err != nil {
+		return nil, false, err
+	}
+	current := pkg.BookMetadata()
+
+	replace := struct {
+		title, authors, language, tags, series bool
+	}{
+		title:    md.Title != "" && md.Title != current.Title,
+		authors:  len(md.Authors) > 0 && !slices.Equal(md.Authors, current.Authors),
+		language: md.Language != "" && md.Language != current.Language,
+		tags:     len(md.Tags) > 0 && !slices.Equal(md.Tags, current.Tags),
+		series:   md.Series != "" && (md.Series != current.Series || md.SeriesIndex != current.SeriesIndex),
+	}
+	coverID, fixCover := pkg.coverFix()
+
+	changed := replace.title || replace.authors || replace.language || replace.tags || replace.series
+	if !changed && !(cover && fixCover) {
+		return doc, false, nil
+	}
+
+	s, err := scan(doc)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// ids of removed elements; metas refining them are removed as well
+	removed := make(map[string]bool)
+	var edits []edit
+	remove := func(e element) {
+		if id := e.attr("", "id"); id != "" {
+			removed[id] = true
+		}
+		start := e.start
+		// take the indentation and line break with the element
+		if i := bytes.LastIndexByte(doc[:start], '\n'); i >= 0 && len(bytes.TrimSpace(doc[i:start])) == 0 {
+			start = i
+		}
+		edits = append(edits, edit{start: start, end: e.end})
+	}
+
+	for _, e := range s.children {
+		dc := e.name.Space == NamespaceDC
+		switch {
+		case dc && e.name.Local == "title" && replace.title,
+			dc && e.name.Local == "language" && replace.language,
+			dc && e.name.Local == "subject" && replace.tags:
+			remove(e)
+
+		case dc && e.name.Local == "creator" && replace.authors:
+			role := e.attr(NamespaceOPF, "role")
+			if id := e.attr("", "id"); role == "" && id != "" {
+				role = pkg.refined(id, "role")
+			}
+			if role == "" || role == "aut" {
+				remove(e)
+			}
+
+		case e.name.Local == "meta" && replace.series:
+			name := e.attr("", "name")
+			if name == "calibre:series" || name == "calibre:series_index" || e.attr("", "property") == "belongs-to-collection" {
+				remove(e)
+			}
+
+		case e.name.Local == "meta" && fixCover && e.attr("", "name") == "cover":
+			remove(e)
+		}
+	}
+
+	for _, e := range s.children {
+		if e.name.Local != "meta" {
+			continue
+		}
+		if ref := strings.TrimPrefix(e.attr("", "refines"), "#"); ref != "" && removed[ref] {
+			remove(e)
+		}
+	}
+
+	// new elements are added at the end of the metadata element
+	ew := elementWriter{
+		dc:     s.prefixes[NamespaceDC],
+		opf:    s.prefixes[NamespaceOPF],
+		epub3:  strings.HasPrefix(pkg.Version, "3"),
+		indent: s.indent,
+	}
+
+	var decl []string
+	if ew.dc == "" {
+		ew.dc = "dc"
+		decl = append(decl, ` xmlns:dc="`+NamespaceDC+`"`)
+	}
+	if ew.opf == "" && !ew.epub3 {
+		ew.opf = "opf"
+		decl = append(decl, ` xmlns:opf="`+NamespaceOPF+`"`)
+	}
+
+	if replace.title {
+		ew.title(md.Title)
+	}
+	if replace.authors {
+		ew.authors(md.Authors)
+	}
+	if replace.language {
+		ew.language(md.Language)
+	}
+	if replace.tags {
+		ew.tags(md.Tags)
+	}
+	if replace.series {
+		ew.series(md.Series, md.SeriesIndex)
+	}
+	if fixCover && coverID != "" {
+		ew.cover(coverID)
+	}
+
+	switch {
+	case s.selfClosing:
+		// <metadata/> is expanded to hold the new elements
+		text := ">\n" + ew.String() + s.closeIndent + "</" + s.metadataName + ">"
+		edits = append(edits, edit{start: s.openEnd - 2, end: s.openEnd, text: []byte(text)})
+	default:
+		at, text := s.closeStart, ew.Bytes()
+		if i := bytes.LastIndexByte(doc[:at], '\n'); i >= s.openEnd && len(bytes.TrimSpace(doc[i:at])) == 0 {
+			at = i + 1
+		} else {
+			text = append([]byte("\n"), text...)
+		}
+		edits = append(edits, edit{start: at, end: at, text: text})
+	}
+
+	if len(decl) > 0 {
+		at := s.openEnd - 1
+		if s.selfClosing {
+			at--
+		}
+		edits = append(edits, edit{start: at, end: at, text: []byte(strings.Join(decl, ""))})
+	}
+
+	return apply(doc, edits), true, nil
+}
+
+// coverFix reports whether the EPUB2 cover meta needs to be replaced and the id
+// of the manifest item it should reference.
+func (p *Package) coverFix() (string, bool) {
+	items := make(map[string]Item, len(p.Manifest))
+	for _, it := range p.Manifest {
+		items[it.ID] = it
+	}
+
+	for _, m := range p.Metadata.Metas {
+		if m.Name == "cover" {
+			if it, ok := items[m.Content]; ok && strings.HasPrefix(it.MediaType, "image/") {
+				return "", false
+			}
+		}
+	}
+
+	id := p.CoverID()
+	return id, id != ""
+}
+
+// CoverID returns the id of the manifest item holding the cover image. The
+// EPUB3 cover-image property is preferred over the EPUB2 cover meta, falling
+// back on image items named "cover".
+func (p *Package) CoverID() string {
+	var byName string
+
+	for _, it := range p.Manifest {
+		if !strings.HasPrefix(it.MediaType, "image/") {
+			continue
+		}
+		if slices.Contains(strings.Fields(it.Properties), "cover-image") {
+			return it.ID
+		}
+		if byName == "" && (strings.Contains(strings.ToLower(it.ID), "cover") || strings.Contains(strings.ToLower(it.Href), "cover")) {
+			byName = it.ID
+		}
+	}
+
+	for _, m := range p.Metadata.Metas {
+		if m.Name != "cover" {
+			continue
+		}
+		for _, it := range p.Manifest {
+			if it.ID == m.Content && strings.HasPrefix(it.MediaType, "image/") {
+				return it.ID
+			}
+		}
+	}
+
+	return byName
+}
+
+// =============================================================================
+
+// scanned is the layout of the metadata element of a document.
+type scanned struct {
+	children     []element
+	prefixes     map[string]string // namespace to prefix
+	metadataName string
+	openEnd      int
+	closeStart   int
+	selfClosing  bool
+	indent       string
+	closeIndent  string
+}
+
+func scan(doc []byte) (scanned, error) {
+	s := scanned{
+		prefixes: make(map[string]string),
+		indent:   "    ",
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	dec.CharsetReader = charsetReader
+
+	depth := 0
+	inMetadata, found := false, false
+	var cur *element
+
+	for {
+		off := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return s, fmt.Errorf("xml token: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth <= 2 {
+				for _, a := range t.Attr {
+					if a.Name.Space == "xmlns" {
+						s.prefixes[a.Value] = a.Name.Local
+					}
+				}
+			}
+			switch {
+			case depth == 2 && t.Name.Local == "metadata":
+				inMetadata, found = true, true
+				s.openEnd = int(dec.InputOffset())
+				s.selfClosing = bytes.HasSuffix(doc[:s.openEnd], []byte("/>"))
+				s.metadataName = rawName(doc[off:s.openEnd])
+				s.closeIndent = lineIndent(doc, off)
+			case inMetadata && depth == 3:
+				cur = &element{name: t.Name, attrs: t.Attr, start: off}
+			}
+
+		case xml.EndElement:
+			switch {
+			case inMetadata && depth == 3 && cur != nil:
+				cur.end = int(dec.InputOffset())
+				s.children = append(s.children, *cur)
+				cur = nil
+			case inMetadata && depth == 2:
+				s.closeStart = off
+				inMetadata = false
+			}
+			depth--
+		}
+	}
+
+	if !found {
+		return s, ErrNoMetadata
+	}
+	if len(s.children) > 0 {
+		s.indent = lineIndent(doc, s.children[0].start)
+	}
+	if s.selfClosing {
+		s.closeStart = s.openEnd
+	}
+
+	return s, nil
+}
+
+// rawName returns the element name as written in the start tag.
+func rawName(tag []byte) string {
+	name := bytes.TrimPrefix(tag, []byte("<"))
+	if i := bytes.IndexAny(name, " \t\r\n/>"); i >= 0 {
+		name = name[:i]
+	}
+	return string(name)
+}
+
+// lineIndent returns the whitespace preceding offset on its line.
+func lineIndent(doc []byte, offset int) string {
+	i := bytes.LastIndexByte(doc[:offset], '\n')
+	if i < 0 {
+		return ""
+	}
+	ws := doc[i+1 : offset]
+	if len(bytes.TrimSpace(ws)) != 0 {
+		return ""
+	}
+	return string(ws)
+}
+
+func apply(doc []byte, edits []edit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].start < edits[j].start
+	})
+
+	var b bytes.Buffer
+	pos := 0
+	for _, e := range edits {
+		if e.start < pos {
+			// overlapping removals of the same element
+			e.start = pos
+		}
+		if e.end < e.start {
+			e.end = e.start
+		}
+		b.Write(doc[pos:e.start])
+		b.Write(e.text)
+		pos = e.end
+	}
+	b.Write(doc[pos:])
+
+	return b.Bytes()
+}
@@ -0,0 +1,103 @@
+package opf
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+const epub3 = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">urn:uuid:1</dc:identifier>
+    <dc:title id="t1">Old Title</dc:title>
+    <meta refines="#t1" property="title-type">main</meta>
+    <dc:creator id="c1">Old Author</dc:creator>
+    <meta refines="#c1" property="role" scheme="marc:relators">aut</meta>
+    <dc:creator id="c2">Translator</dc:creator>
+    <meta refines="#c2" property="role" scheme="marc:relators">trl</meta>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">2024-01-01T00:00:00Z</meta>
+  </metadata>
+  <manifest>
+    <item id="img" href="images/front.jpg" media-type="image/jpeg" properties="cover-image"/>
+  </manifest>
+  <spine/>
+</package>`
+
+func TestRewrite(t *testing.T) {
+	md := upload.Metadata{
+		Title:       "New Title",
+		Authors:     []string{"New Author"},
+		Language:    "en",
+		Series:      "Saga",
+		SeriesIndex: 2,
+	}
+
+	out, changed, err := Rewrite([]byte(epub3), md)
+	if err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+	if !changed {
+		t.Fatal("expected document to change")
+	}
+
+	pkg, err := Parse(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Parse: %v\n%s", err, out)
+	}
+
+	got := pkg.BookMetadata()
+	if got.Title != md.Title || got.Series != md.Series || got.SeriesIndex != md.SeriesIndex {
+		t.Errorf("incorrect metadata; expected: %+v; got: %+v", md, got)
+	}
+	if len(got.Authors) != 1 || got.Authors[0] != "New Author" {
+		t.Errorf("incorrect authors; expected: [New Author]; got: %v", got.Authors)
+	}
+
+	for _, want := range []string{"Translator", `property="dcterms:modified"`, `<meta name="cover" content="img"/>`} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("expected output to contain %q\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"Old Title", "Old Author", `refines="#t1"`, `refines="#c1"`} {
+		if bytes.Contains(out, []byte(unwanted)) {
+			t.Errorf("expected output to not contain %q\n%s", unwanted, out)
+		}
+	}
+
+	// everything outside the metadata element is untouched
+	tail := epub3[strings.Index(epub3, "</metadata>"):]
+	if !bytes.HasSuffix(out, []byte(tail)) {
+		t.Errorf("document outside of metadata was modified\n%s", out)
+	}
+
+	// rewriting again with the same metadata is a no-op
+	if _, changed, err := Rewrite(out, md); err != nil || changed {
+		t.Errorf("expected no changes; changed: %t; err: %v", changed, err)
+	}
+}
+
+func TestFixCover(t *testing.T) {
+	// only marked the EPUB3 way, which is left alone without other changes
+	if _, changed, err := Rewrite([]byte(epub3), upload.Metadata{Language: "en"}); err != nil || changed {
+		t.Errorf("expected no changes; changed: %t; err: %v", changed, err)
+	}
+
+	out, changed, err := FixCover([]byte(epub3))
+	if err != nil || !changed {
+		t.Fatalf("expected the cover to be fixed; changed: %t; err: %v", changed, err)
+	}
+	if !bytes.Contains(out, []byte(`<meta name="cover" content="img"/>`)) {
+		t.Errorf("expected the cover meta\n%s", out)
+	}
+	if !bytes.Contains(out, []byte("Old Title")) {
+		t.Errorf("expected the metadata to be kept\n%s", out)
+	}
+
+	if _, changed, err := FixCover(out); err != nil || changed {
+		t.Errorf("expected no changes; changed: %t; err: %v", changed, err)
+	}
+}
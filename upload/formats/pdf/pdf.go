@@ -0,0 +1,223 @@
+// Package pdf provides best effort support for reading the text of PDF files.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/isbn"
+)
+
+const (
+	// the part of the file searched for an ISBN
+	scanSize     = 16 << 20
+	maxStreams   = 64
+	maxStream    = 1 << 20
+	isbnTextSize = 64 << 10
+)
+
+var (
+	keywordStream    = []byte("stream")
+	keywordEndstream = []byte("endstream")
+)
+
+// Extractor finds the ISBN of PDF uploads.
+type Extractor struct{}
+
+// Extract implements the upload.Extractor interface.
+func (Extractor) Extract(name string, r io.ReaderAt, size int64) (upload.Metadata, error) {
+	if !IsPDF(name) {
+		return upload.Metadata{}, upload.ErrUnsupportedFormat
+	}
+
+	text, err := Text(r, size, isbnTextSize)
+	if err != nil {
+		return upload.Metadata{}, err
+	}
+
+	var md upload.Metadata
+	if found := isbn.Find(text); len(found) > 0 {
+		md.ISBN = found[0]
+	}
+	return md, nil
+}
+
+// Sample implements the language.Sampler interface.
+func (Extractor) Sample(name string, r io.ReaderAt, size int64, max int) (string, error) {
+	if !IsPDF(name) {
+		return "", upload.ErrUnsupportedFormat
+	}
+	return Text(r, size, max)
+}
+
+// IsPDF reports whether the filename has a PDF extension.
+func IsPDF(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".pdf")
+}
+
+// Text returns up to size bytes of the text shown by the first content streams
+// of the PDF. It does not interpret the document structure or font encodings,
+// so the text of PDFs using embedded font encodings is not found; it is meant
+// for picking up details such as the ISBN printed on the first pages.
+func Text(r io.ReaderAt, size int64, max int) (string, error) {
+	data, err := io.ReadAll(io.NewSectionReader(r, 0, min(size, scanSize)))
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	streams := 0
+	for sb.Len() < max && streams < maxStreams {
+		i := bytes.Index(data, keywordStream)
+		if i < 0 {
+			break
+		}
+		dict := data[:i]
+		if j := bytes.LastIndex(dict, []byte("obj")); j >= 0 {
+			dict = dict[j:]
+		}
+
+		body := data[i+len(keywordStream):]
+		body = bytes.TrimPrefix(body, []byte("\r"))
+		body = bytes.TrimPrefix(body, []byte("\n"))
+
+		end := bytes.Index(body, keywordEndstream)
+		if end < 0 {
+			break
+		}
+		data = body[end+len(keywordEndstream):]
+
+		if !isContentStream(dict) {
+			continue
+		}
+		streams++
+
+		content := body[:end]
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			zr, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			// truncated or damaged streams still give their leading text
+			content, _ = io.ReadAll(io.LimitReader(zr, maxStream))
+			zr.Close()
+		}
+
+		showText(&sb, content)
+	}
+
+	text := sb.String()
+	if len(text) > max {
+		text = text[:max]
+	}
+	return text, nil
+}
+
+// isContentStream reports whether the dictionary could be the one of a page
+// content stream, skipping images, fonts and other binary streams.
+func isContentStream(dict []byte) bool {
+	for _, skip := range []string{"/Image", "/Font", "/FontFile", "/Length1", "/XRef", "/Metadata", "/DCTDecode", "/JPXDecode", "/CCITTFaxDecode", "/JBIG2Decode"} {
+		if bytes.Contains(dict, []byte(skip)) {
+			return false
+		}
+	}
+	filters := bytes.Count(dict, []byte("Decode"))
+	return filters == 0 || (filters == 1 && bytes.Contains(dict, []byte("/FlateDecode")))
+}
+
+// showText writes the strings shown by the text operators of the content
+// stream, a line per operator.
+func showText(sb *strings.Builder, content []byte) {
+	var line []byte
+
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; {
+		case c == '(':
+			s, n := literalString(content[i:])
+			line = append(line, s...)
+			i += n - 1
+		case c == '%':
+			// comments run to the end of the line
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case isOperatorStart(c):
+			j := i
+			for j < len(content) && isOperatorStart(content[j]) {
+				j++
+			}
+			switch string(content[i:j]) {
+			case "Tj", "TJ", "'", `"`, "T*", "Td", "TD", "ET":
+				if len(line) > 0 {
+					sb.Write(line)
+					sb.WriteByte('\n')
+					line = line[:0]
+				}
+			}
+			i = j - 1
+		}
+	}
+}
+
+func isOperatorStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '\'' || c == '"' || c == '*'
+}
+
+// literalString decodes the literal string at the start of b, returning it and
+// the number of bytes consumed.
+func literalString(b []byte) ([]byte, int) {
+	var s []byte
+	depth := 0
+
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch c {
+		case '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case ')':
+			depth--
+			if depth == 0 {
+				return s, i + 1
+			}
+		case '\\':
+			i++
+			if i >= len(b) {
+				return s, i
+			}
+			switch e := b[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v, n := 0, 0
+					for n < 3 && i+n < len(b) && b[i+n] >= '0' && b[i+n] <= '7' {
+						v = v*8 + int(b[i+n]-'0')
+						n++
+					}
+					s = append(s, byte(v))
+					i += n - 1
+					continue
+				}
+				s = append(s, e)
+			}
+			continue
+		}
+		s = append(s, c)
+	}
+
+	return s, len(b)
+}
@@ -0,0 +1,49 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"testing"
+)
+
+// buildPDF creates a PDF with a compressed content stream and an image stream.
+func buildPDF(t *testing.T, content string) []byte {
+	t.Helper()
+
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte(content))
+	zw.Close()
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	b.WriteString("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	b.WriteString("3 0 obj\n<< /Type /XObject /Subtype /Image /Length 6 >>\nstream\n(ISBN)\nendstream\nendobj\n")
+	fmt.Fprintf(&b, "4 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", z.Len())
+	b.Write(z.Bytes())
+	b.WriteString("\nendstream\nendobj\n%%EOF\n")
+
+	return b.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	doc := buildPDF(t, `BT /F1 12 Tf 72 700 Td (The Hobbit) Tj 0 -14 Td [(ISBN ) -250 (978-0-261-10295-8)] TJ ET
+BT (Published by \(c\) Allen \\ Unwin) Tj ET`)
+
+	text, err := Text(bytes.NewReader(doc), int64(len(doc)), 1024)
+	if err != nil {
+		t.Fatalf("Text: %v", err)
+	}
+	if want := "The Hobbit\nISBN 978-0-261-10295-8\nPublished by (c) Allen \\ Unwin\n"; text != want {
+		t.Errorf("incorrect text; expected: %q; got: %q", want, text)
+	}
+
+	md, err := Extractor{}.Extract("book.pdf", bytes.NewReader(doc), int64(len(doc)))
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if md.ISBN != "9780261102958" {
+		t.Errorf("incorrect isbn; expected: 9780261102958; got: %q", md.ISBN)
+	}
+}
@@ -0,0 +1,219 @@
+package text
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/funayman/ebook-uploader/upload/formats/epub"
+)
+
+const (
+	maxHeadingLen = 80
+
+	// headingTitle is the title following the number of a heading, which
+	// holds no sentence punctuation
+	headingTitle = `[^.!?]*[^.!?\s]`
+
+	// books without headings are split into parts of about this size so
+	// readers do not have to lay out a single huge document
+	partSize = 100 << 10
+)
+
+var (
+	// chapter headings in a few languages, numbered with digits, uppercase
+	// roman numerals or a capitalized word and optionally titled, and common
+	// front and back matter; titles are not sentences, so "Part of me wanted
+	// to stay." is no heading
+	reHeading = regexp.MustCompile(`^(?:` +
+		`(?i:chapter|chap\.|part|book|volume|kapitel|teil|chapitre|partie|cap[ií]tulo|capitolo|hoofdstuk|rozdział|глава|часть)\s+` +
+		`(?:(?:[0-9]+|[IVXLCDM]+)\.?(?:(?:\s*[:.—–-]\s*|\s+)` + headingTitle + `)?|\p{Lu}[\p{L}-]*(?:\s*[:.—–-]\s*` + headingTitle + `)?)` +
+		`|(?i:prologue?|epilogue?|introduction|preface|foreword|afterword)` +
+		`|(?:[IVXLCDM]+|[0-9]{1,3})\.?` +
+		`)$`)
+)
+
+// paragraph is a block of text found in a plain text document.
+type paragraph struct {
+	text    string
+	heading bool
+}
+
+// Chapters splits a plain text document into chapters, using lines which look
+// like chapter headings. The text before the first heading becomes a chapter
+// titled after the book.
+func Chapters(text, title string) []epub.Chapter {
+	return buildChapters(paragraphs(text), title)
+}
+
+// paragraphs splits the text into paragraphs. Most texts separate paragraphs
+// with blank lines and wrap their lines, those with hardly any blank lines
+// have a paragraph per line.
+func paragraphs(text string) []paragraph {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	lines := strings.Split(text, "\n")
+
+	blank, filled := 0, 0
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			blank++
+		} else {
+			filled++
+		}
+	}
+	blocks := blank*10 >= filled
+
+	var (
+		paras  []paragraph
+		block  []string
+		blanks = 2
+	)
+	flush := func(blanksBefore int) {
+		if len(block) == 0 {
+			return
+		}
+		if len(block) == 1 && isHeading(block[0], blanksBefore >= 2) {
+			paras = append(paras, paragraph{text: block[0], heading: true})
+		} else {
+			paras = append(paras, paragraph{text: strings.Join(block, " ")})
+		}
+		block = block[:0]
+	}
+
+	before := blanks
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		switch {
+		case l == "":
+			if len(block) > 0 {
+				flush(before)
+				blanks = 0
+			}
+			blanks++
+		case !blocks:
+			block = append(block, l)
+			flush(blanks)
+			blanks = 0
+		default:
+			if len(block) == 0 {
+				before = blanks
+			}
+			block = append(block, l)
+		}
+	}
+	flush(before)
+
+	return paras
+}
+
+// isHeading reports whether a line standing on its own looks like a heading.
+// Lines in capitals only count as headings after a larger gap.
+func isHeading(line string, gap bool) bool {
+	if len(line) > maxHeadingLen {
+		return false
+	}
+	if reHeading.MatchString(line) {
+		return true
+	}
+	return gap && isCapitals(line) && !strings.HasSuffix(line, ".")
+}
+
+func isCapitals(s string) bool {
+	letters := 0
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			if !unicode.IsUpper(r) {
+				return false
+			}
+			letters++
+		}
+	}
+	return letters >= 3
+}
+
+func buildChapters(paras []paragraph, title string) []epub.Chapter {
+	type chapter struct {
+		title string
+		paras []string
+	}
+
+	var chapters []chapter
+	current := chapter{title: title}
+	headings := 0
+
+	for i, p := range paras {
+		// a numbered heading directly followed by the name of the chapter,
+		// such as "CHAPTER I" and "AN UNEXPECTED PARTY", is merged into a
+		// single title
+		if i > 0 && paras[i-1].heading && len(current.paras) == 0 &&
+			reHeading.MatchString(paras[i-1].text) && !reHeading.MatchString(p.text) &&
+			len(p.text) <= maxHeadingLen && (p.heading || isCapitals(p.text)) {
+			current.title += ": " + p.text
+			continue
+		}
+
+		if !p.heading {
+			current.paras = append(current.paras, p.text)
+			continue
+		}
+
+		if len(current.paras) > 0 || headings > 0 {
+			chapters = append(chapters, current)
+		}
+		current = chapter{title: p.text}
+		headings++
+	}
+	chapters = append(chapters, current)
+
+	if headings == 0 {
+		return splitParts(current.paras, title)
+	}
+
+	out := make([]epub.Chapter, 0, len(chapters))
+	for _, c := range chapters {
+		var b strings.Builder
+		b.WriteString("<h2>" + escape(c.title) + "</h2>\n")
+		writeParagraphs(&b, c.paras)
+		out = append(out, epub.Chapter{Title: c.title, Body: b.String()})
+	}
+	return out
+}
+
+// splitParts splits text without headings into parts of about partSize.
+func splitParts(paras []string, title string) []epub.Chapter {
+	var parts [][]string
+	var part []string
+	size := 0
+
+	for _, p := range paras {
+		part = append(part, p)
+		size += len(p)
+		if size >= partSize {
+			parts = append(parts, part)
+			part, size = nil, 0
+		}
+	}
+	if len(part) > 0 || len(parts) == 0 {
+		parts = append(parts, part)
+	}
+
+	out := make([]epub.Chapter, 0, len(parts))
+	for i, p := range parts {
+		t := title
+		if len(parts) > 1 {
+			t = fmt.Sprintf("Part %d", i+1)
+		}
+		var b strings.Builder
+		writeParagraphs(&b, p)
+		out = append(out, epub.Chapter{Title: t, Body: b.String()})
+	}
+	return out
+}
+
+func writeParagraphs(b *strings.Builder, paras []string) {
+	for _, p := range paras {
+		b.WriteString("<p>" + escape(p) + "</p>\n")
+	}
+}
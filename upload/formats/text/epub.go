@@ -0,0 +1,63 @@
+package text
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/epub"
+)
+
+// Converter converts plain text, Markdown and RTF uploads to EPUB. Plain text
+// is split into chapters at lines which look like chapter headings, Markdown at
+// its top level headings.
+type Converter struct{}
+
+// Transform implements the upload.Transformer interface.
+func (Converter) Transform(ctx context.Context, w io.Writer, name string, r io.ReaderAt, size int64, md upload.Metadata) error {
+	if !IsText(name) && !IsMarkdown(name) && !IsRTF(name) {
+		return upload.ErrUnsupportedFormat
+	}
+
+	data, err := readAll(r, size)
+	if err != nil {
+		return err
+	}
+
+	if md.Title == "" {
+		md.Title = strings.TrimSuffix(path.Base(name), path.Ext(name))
+	}
+
+	var chapters []epub.Chapter
+	switch {
+	case IsRTF(name):
+		text, err := RTF(data)
+		if err != nil {
+			return err
+		}
+		chapters = Chapters(text, md.Title)
+
+	case IsMarkdown(name):
+		text, _, err := Decode(data)
+		if err != nil {
+			return err
+		}
+		chapters = Markdown(text, md.Title)
+
+	default:
+		text, _, err := Decode(data)
+		if err != nil {
+			return err
+		}
+		chapters = Chapters(text, md.Title)
+	}
+
+	return epub.Build(w, md, chapters)
+}
+
+// Rename implements the upload.Renamer interface.
+func (Converter) Rename(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + ".epub"
+}
@@ -0,0 +1,192 @@
+package text
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/funayman/ebook-uploader/upload/formats/epub"
+)
+
+var (
+	reMDHeading  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	reMDList     = regexp.MustCompile(`^\s{0,3}([-*+]|\d{1,9}[.)])\s+(.*)$`)
+	reMDRule     = regexp.MustCompile(`^\s{0,3}([-*_])(\s*([-*_])){2,}\s*$`)
+	reMDImage    = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	reMDLink     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)(?:\s+(?:"|'|&#34;|&#39;)[^)]*)?\)`)
+	reMDCode     = regexp.MustCompile("`([^`]+)`")
+	reMDStrong   = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	reMDEmphasis = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+)
+
+// Markdown converts a Markdown document to chapters, starting a chapter at
+// every top level heading. It supports the common subset of Markdown found in
+// manuscripts: headings, paragraphs, emphasis, lists, block quotes, code and
+// rules. Images are replaced by their description.
+func Markdown(text, title string) []epub.Chapter {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+
+	// chapters start at the highest heading level used
+	level := 7
+	fenced := false
+	for _, l := range lines {
+		if strings.HasPrefix(strings.TrimSpace(l), "```") {
+			fenced = !fenced
+		}
+		if m := reMDHeading.FindStringSubmatch(l); m != nil && !fenced {
+			level = min(level, len(m[1]))
+		}
+	}
+
+	type chapter struct {
+		title string
+		body  strings.Builder
+	}
+	chapters := []*chapter{{title: title}}
+	cur := chapters[0]
+
+	var para, quote []string
+	var list []string
+	ordered := false
+
+	flush := func() {
+		if len(para) > 0 {
+			cur.body.WriteString("<p>" + inline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+		if len(quote) > 0 {
+			cur.body.WriteString("<blockquote><p>" + inline(strings.Join(quote, " ")) + "</p></blockquote>\n")
+			quote = nil
+		}
+		if len(list) > 0 {
+			tag := "ul"
+			if ordered {
+				tag = "ol"
+			}
+			cur.body.WriteString("<" + tag + ">\n")
+			for _, item := range list {
+				cur.body.WriteString("<li>" + inline(item) + "</li>\n")
+			}
+			cur.body.WriteString("</" + tag + ">\n")
+			list = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		trimmed := strings.TrimSpace(l)
+
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			cur.body.WriteString("<pre><code>" + escape(strings.Join(code, "\n")) + "</code></pre>\n")
+
+		case trimmed == "":
+			flush()
+
+		case reMDHeading.MatchString(l):
+			flush()
+			m := reMDHeading.FindStringSubmatch(l)
+			n := len(m[1])
+			if n == level {
+				if cur.body.Len() > 0 || len(chapters) > 1 {
+					cur = &chapter{}
+					chapters = append(chapters, cur)
+				}
+				cur.title = plain(m[2])
+			}
+			// chapter headings are rendered as h1, lower levels follow
+			h := min(n-level+1, 6)
+			fmt.Fprintf(&cur.body, "<h%d>%s</h%d>\n", h, inline(m[2]), h)
+
+		case reMDRule.MatchString(l):
+			flush()
+			cur.body.WriteString("<hr/>\n")
+
+		case strings.HasPrefix(trimmed, ">"):
+			if len(para) > 0 || len(list) > 0 {
+				flush()
+			}
+			quote = append(quote, strings.TrimSpace(strings.TrimPrefix(trimmed, ">")))
+
+		case reMDList.MatchString(l):
+			m := reMDList.FindStringSubmatch(l)
+			isOrdered := m[1][0] >= '0' && m[1][0] <= '9'
+			if len(para) > 0 || len(quote) > 0 || (len(list) > 0 && isOrdered != ordered) {
+				flush()
+			}
+			ordered = isOrdered
+			list = append(list, m[2])
+
+		case len(list) > 0 && (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")):
+			// continuation of a list item
+			list[len(list)-1] += " " + trimmed
+
+		default:
+			if len(list) > 0 || len(quote) > 0 {
+				flush()
+			}
+			para = append(para, trimmed)
+		}
+	}
+	flush()
+
+	out := make([]epub.Chapter, 0, len(chapters))
+	for i, c := range chapters {
+		if c.body.Len() == 0 {
+			continue
+		}
+		t := c.title
+		if t == "" {
+			t = fmt.Sprintf("Chapter %d", i+1)
+		}
+		out = append(out, epub.Chapter{Title: t, Body: c.body.String()})
+	}
+	if len(out) == 0 {
+		out = append(out, epub.Chapter{Title: title, Body: "<p></p>"})
+	}
+	return out
+}
+
+// inline renders the inline Markdown of a block as XHTML.
+func inline(s string) string {
+	s = escape(s)
+	s = reMDImage.ReplaceAllString(s, "$1")
+
+	// code spans are set aside so their content is not formatted
+	var codes []string
+	s = reMDCode.ReplaceAllStringFunc(s, func(m string) string {
+		codes = append(codes, "<code>"+reMDCode.FindStringSubmatch(m)[1]+"</code>")
+		return fmt.Sprintf("\x00%d\x00", len(codes)-1)
+	})
+
+	// the quotes of link titles are escaped as &#34; and &#39; by now
+	s = reMDLink.ReplaceAllString(s, `<a href="$2">$1</a>`)
+	s = reMDStrong.ReplaceAllString(s, "<strong>$1$2</strong>")
+	s = reMDEmphasis.ReplaceAllString(s, "<em>$1$2</em>")
+
+	for i, c := range codes {
+		s = strings.Replace(s, fmt.Sprintf("\x00%d\x00", i), c, 1)
+	}
+	return s
+}
+
+// plain strips the inline Markdown of a heading for use as a title.
+func plain(s string) string {
+	s = reMDImage.ReplaceAllString(s, "$1")
+	s = strings.NewReplacer("**", "", "__", "", "*", "", "`", "").Replace(s)
+	return strings.TrimSpace(reMDLink.ReplaceAllString(s, "$1"))
+}
+
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,249 @@
+package text
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+var ErrNotRTF = errors.New("not an RTF document")
+
+// rtfSkip are the destinations whose content is not part of the text.
+var rtfSkip = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true,
+	"pict": true, "object": true, "header": true, "headerl": true,
+	"headerr": true, "headerf": true, "footer": true, "footerl": true,
+	"footerr": true, "footerf": true, "footnote": true, "listtable": true,
+	"listoverridetable": true, "rsidtbl": true, "generator": true,
+	"xmlnstbl": true, "themedata": true, "datastore": true,
+	"latentstyles": true, "fldinst": true, "filetbl": true, "revtbl": true,
+}
+
+// rtfWords are the control words standing for characters.
+var rtfWords = map[string]string{
+	"par": "\n\n", "sect": "\n\n", "page": "\n\n", "line": "\n", "tab": "\t",
+	"emdash": "—", "endash": "–", "bullet": "•",
+	"lquote": "‘", "rquote": "’", "ldblquote": "“",
+	"rdblquote": "”", "emspace": " ", "enspace": " ",
+	"qmspace": " ", "~": " ", "-": "", "_": "‑",
+}
+
+// RTF returns the plain text of an RTF document, with paragraphs separated by
+// blank lines. Formatting, pictures and other embedded objects are dropped.
+func RTF(data []byte) (string, error) {
+	if !strings.HasPrefix(string(data), `{\rtf`) {
+		return "", ErrNotRTF
+	}
+
+	type state struct {
+		skip bool
+		uc   int
+	}
+
+	var (
+		out     strings.Builder
+		stack   []state
+		cur     = state{uc: 1}
+		dec     = encoding.Encoding(charmap.Windows1252).NewDecoder()
+		pending []byte // bytes of \'hh escapes not yet decoded
+		skipN   int    // fallback characters left to skip after \u
+		star    bool   // the group started with \*
+		high    rune   // high surrogate waiting for its pair
+	)
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if s, err := dec.Bytes(pending); err == nil {
+			out.Write(s)
+		}
+		pending = pending[:0]
+	}
+	write := func(s string) {
+		flush()
+		if !cur.skip {
+			out.WriteString(s)
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+
+		switch c {
+		case '{':
+			flush()
+			stack = append(stack, cur)
+			star = false
+			skipN = 0
+			continue
+		case '}':
+			flush()
+			if len(stack) == 0 {
+				return out.String(), nil
+			}
+			cur = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			skipN = 0
+			continue
+		case '\r', '\n':
+			continue
+		}
+
+		if c != '\\' {
+			if skipN > 0 {
+				skipN--
+				continue
+			}
+			if !cur.skip {
+				flush()
+				out.WriteByte(c)
+			}
+			continue
+		}
+
+		// control symbol or word
+		i++
+		if i >= len(data) {
+			break
+		}
+		c = data[i]
+
+		switch {
+		case c == '\\' || c == '{' || c == '}':
+			if skipN > 0 {
+				skipN--
+				continue
+			}
+			write(string(c))
+
+		case c == '\'':
+			if i+2 >= len(data) {
+				break
+			}
+			b, err := strconv.ParseUint(string(data[i+1:i+3]), 16, 8)
+			i += 2
+			if err != nil {
+				continue
+			}
+			if skipN > 0 {
+				skipN--
+				continue
+			}
+			if !cur.skip {
+				pending = append(pending, byte(b))
+			}
+
+		case c == '*':
+			star = true
+
+		case c == '\r' || c == '\n':
+			write("\n\n")
+
+		case !isLetter(c):
+			if s, ok := rtfWords[string(c)]; ok {
+				write(s)
+			}
+
+		default:
+			start := i
+			for i < len(data) && isLetter(data[i]) {
+				i++
+			}
+			word := string(data[start:i])
+
+			numStart := i
+			if i < len(data) && data[i] == '-' {
+				i++
+			}
+			for i < len(data) && data[i] >= '0' && data[i] <= '9' {
+				i++
+			}
+			param, hasParam := 0, i > numStart
+			if hasParam {
+				param, _ = strconv.Atoi(string(data[numStart:i]))
+			}
+			// a space delimiting the control word is part of it
+			if i >= len(data) || data[i] != ' ' {
+				i--
+			}
+
+			switch {
+			case word == "u" && hasParam:
+				if param < 0 {
+					param += 0x10000
+				}
+				r := rune(param)
+				skipN = cur.uc
+				// characters outside the BMP arrive as surrogate pairs
+				if utf16.IsSurrogate(r) && r < 0xDC00 {
+					high = r
+					break
+				}
+				if high != 0 {
+					r, high = utf16.DecodeRune(high, r), 0
+				}
+				write(string(r))
+			case word == "uc" && hasParam:
+				cur.uc = param
+			case word == "ansicpg" && hasParam:
+				if e := codepage(param); e != nil {
+					dec = e.NewDecoder()
+				}
+			case rtfSkip[word] || star:
+				cur.skip = true
+			default:
+				if s, ok := rtfWords[word]; ok {
+					write(s)
+				}
+			}
+			star = false
+		}
+	}
+	flush()
+
+	return out.String(), nil
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// codepage returns the Windows code page used by \ansicpg.
+func codepage(n int) encoding.Encoding {
+	switch n {
+	case 437:
+		return charmap.CodePage437
+	case 850:
+		return charmap.CodePage850
+	case 866:
+		return charmap.CodePage866
+	case 874:
+		return charmap.Windows874
+	case 1250:
+		return charmap.Windows1250
+	case 1251:
+		return charmap.Windows1251
+	case 1252:
+		return charmap.Windows1252
+	case 1253:
+		return charmap.Windows1253
+	case 1254:
+		return charmap.Windows1254
+	case 1255:
+		return charmap.Windows1255
+	case 1256:
+		return charmap.Windows1256
+	case 1257:
+		return charmap.Windows1257
+	case 1258:
+		return charmap.Windows1258
+	case 10000:
+		return charmap.Macintosh
+	}
+	return nil
+}
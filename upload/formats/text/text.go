@@ -0,0 +1,178 @@
+// Package text normalizes plain text uploads to UTF-8 and converts plain text,
+// Markdown and RTF uploads to EPUB.
+package text
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/saintfish/chardet"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+const (
+	// the largest text file handled, larger uploads are stored as they are
+	maxTextSize = 64 << 20
+
+	// detections less confident than this fall back to Windows-1252, the
+	// most common encoding of legacy text files
+	minConfidence = 30
+)
+
+var (
+	ErrTooLarge = errors.New("text file too large")
+
+	utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+)
+
+// IsText reports whether the filename has a plain text extension.
+func IsText(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".txt")
+}
+
+// IsMarkdown reports whether the filename has a Markdown extension.
+func IsMarkdown(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// IsRTF reports whether the filename has an RTF extension.
+func IsRTF(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".rtf")
+}
+
+// Decode returns the text as UTF-8 together with the name of the charset it
+// was found to use. Byte order marks are honoured and removed, valid UTF-8 is
+// taken as is and anything else is detected statistically.
+func Decode(data []byte) (string, string, error) {
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		return string(data[len(utf8BOM):]), "UTF-8", nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return decodeWith(unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), data, "UTF-16LE")
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return decodeWith(unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), data, "UTF-16BE")
+	case utf8.Valid(data):
+		return string(data), "UTF-8", nil
+	}
+
+	charset := "windows-1252"
+	enc := encoding.Encoding(charmap.Windows1252)
+
+	if res, err := chardet.NewTextDetector().DetectBest(data); err == nil && res.Confidence >= minConfidence {
+		if e := lookupEncoding(res.Charset); e != nil {
+			charset, enc = res.Charset, e
+		}
+	}
+
+	return decodeWith(enc, data, charset)
+}
+
+func decodeWith(enc encoding.Encoding, data []byte, charset string) (string, string, error) {
+	out, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", "", err
+	}
+	return string(out), charset, nil
+}
+
+// lookupEncoding maps the charset names used by the detector to encodings.
+func lookupEncoding(charset string) encoding.Encoding {
+	for _, name := range []string{charset, strings.ReplaceAll(charset, "-", "")} {
+		if e, err := htmlindex.Get(name); err == nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// =============================================================================
+
+// Normalizer rewrites plain text uploads as UTF-8 without a byte order mark, so
+// Calibre does not have to guess their encoding.
+type Normalizer struct{}
+
+// Transform implements the upload.Transformer interface.
+func (Normalizer) Transform(ctx context.Context, w io.Writer, name string, r io.ReaderAt, size int64, md upload.Metadata) error {
+	if !IsText(name) {
+		return upload.ErrUnsupportedFormat
+	}
+
+	data, err := readAll(r, size)
+	if err != nil {
+		return err
+	}
+	if utf8.Valid(data) && !bytes.HasPrefix(data, utf8BOM) {
+		return upload.ErrUnchanged
+	}
+
+	text, _, err := Decode(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, text)
+	return err
+}
+
+func readAll(r io.ReaderAt, size int64) ([]byte, error) {
+	if size > maxTextSize {
+		return nil, ErrTooLarge
+	}
+	return io.ReadAll(io.NewSectionReader(r, 0, size))
+}
+
+// =============================================================================
+
+// Sampler returns the text of plain text, Markdown and RTF uploads.
+type Sampler struct{}
+
+// Sample implements the language.Sampler interface.
+func (Sampler) Sample(name string, r io.ReaderAt, size int64, max int) (string, error) {
+	if !IsText(name) && !IsMarkdown(name) && !IsRTF(name) {
+		return "", upload.ErrUnsupportedFormat
+	}
+
+	// RTF needs more than max bytes for max bytes of text, its control words
+	// are dropped
+	limit := int64(max)
+	if IsRTF(name) {
+		limit *= 4
+	}
+
+	data, err := io.ReadAll(io.NewSectionReader(r, 0, min(size, limit)))
+	if err != nil {
+		return "", err
+	}
+
+	if IsRTF(name) {
+		return RTF(data)
+	}
+
+	// a UTF-8 sample may end in the middle of a character
+	if int64(len(data)) < size {
+		t := data
+		for i := 0; i < utf8.UTFMax-1 && len(t) > 0 && !utf8.Valid(t); i++ {
+			t = t[:len(t)-1]
+		}
+		if utf8.Valid(t) {
+			data = t
+		}
+	}
+
+	text, _, err := Decode(data)
+	return text, err
+}
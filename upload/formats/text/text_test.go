@@ -0,0 +1,263 @@
+package text
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/epub"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		charset string
+	}{
+		{
+			name:    "utf-8",
+			data:    []byte("Café au lait"),
+			want:    "Café au lait",
+			charset: "UTF-8",
+		},
+		{
+			name:    "utf-8 bom",
+			data:    []byte("\xEF\xBB\xBFCafé"),
+			want:    "Café",
+			charset: "UTF-8",
+		},
+		{
+			name:    "utf-16le",
+			data:    []byte{0xFF, 0xFE, 'C', 0, 'a', 0, 'f', 0, 0xE9, 0},
+			want:    "Café",
+			charset: "UTF-16LE",
+		},
+		{
+			name: "windows-1252",
+			data: []byte("\x93Il \xe9tait une fois,\x94 dit-elle. " +
+				"La premi\xe8re fois qu\x92elle le vit, il \xe9tait d\xe9j\xe0 tr\xe8s tard et " +
+				"la for\xeat \xe9tait sombre. Elle ne savait pas o\xf9 aller, ni \xe0 qui parler."),
+			want: "“Il était une fois,” dit-elle. " +
+				"La première fois qu’elle le vit, il était déjà très tard et " +
+				"la forêt était sombre. Elle ne savait pas où aller, ni à qui parler.",
+		},
+	}
+
+	for _, tt := range tests {
+		got, charset, err := Decode(tt.data)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: incorrect text; expected: %q; got: %q", tt.name, tt.want, got)
+		}
+		if tt.charset != "" && charset != tt.charset {
+			t.Errorf("%s: incorrect charset; expected: %q; got: %q", tt.name, tt.charset, charset)
+		}
+	}
+}
+
+func TestNormalizer(t *testing.T) {
+	transform := func(name string, data []byte) (string, error) {
+		var out bytes.Buffer
+		err := Normalizer{}.Transform(context.Background(), &out, name, bytes.NewReader(data), int64(len(data)), upload.Metadata{})
+		return out.String(), err
+	}
+
+	if _, err := transform("book.txt", []byte("plain")); !errors.Is(err, upload.ErrUnchanged) {
+		t.Errorf("expected ErrUnchanged for UTF-8; got: %v", err)
+	}
+	if _, err := transform("book.epub", []byte("\xe9")); !errors.Is(err, upload.ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat for EPUB; got: %v", err)
+	}
+
+	got, err := transform("book.txt", []byte("\xEF\xBB\xBFplain"))
+	if err != nil || got != "plain" {
+		t.Errorf("expected BOM to be removed; got: %q, %v", got, err)
+	}
+}
+
+func TestChapters(t *testing.T) {
+	text := `Some front matter.
+
+
+CHAPTER I
+
+AN UNEXPECTED PARTY
+
+In a hole in the ground there lived a hobbit.
+Not a nasty, dirty, wet hole.
+
+It was a hobbit-hole, and that means comfort.
+
+
+CHAPTER II
+
+ROAST MUTTON
+
+Up jumped Bilbo.
+`
+
+	chapters := Chapters(text, "The Hobbit")
+
+	titles := make([]string, len(chapters))
+	for i, c := range chapters {
+		titles[i] = c.Title
+	}
+	want := []string{"The Hobbit", "CHAPTER I: AN UNEXPECTED PARTY", "CHAPTER II: ROAST MUTTON"}
+	if strings.Join(titles, "|") != strings.Join(want, "|") {
+		t.Fatalf("incorrect chapters; expected: %q; got: %q", want, titles)
+	}
+
+	if !strings.Contains(chapters[1].Body, "<p>In a hole in the ground there lived a hobbit. Not a nasty, dirty, wet hole.</p>") {
+		t.Errorf("expected wrapped lines to be joined; got: %s", chapters[1].Body)
+	}
+	for _, c := range chapters {
+		if err := wellFormed(c.Body); err != nil {
+			t.Errorf("chapter %q is not well formed: %v", c.Title, err)
+		}
+	}
+}
+
+func TestIsHeading(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"Chapter 1", true},
+		{"CHAPTER XII", true},
+		{"chapter 3: The Beginning", true},
+		{"Chapter 1. An Unexpected Party", true},
+		{"Chapter One", true},
+		{"Book Two — The Return", true},
+		{"Prologue", true},
+		{"IV.", true},
+		{"12", true},
+		{"Part of me wanted to stay.", false},
+		{"Book it.", false},
+		{"Chapter 3 was the best of them.", false},
+		{"did.", false},
+		{"mix", false},
+	}
+	for _, tt := range tests {
+		if got := isHeading(tt.line, false); got != tt.want {
+			t.Errorf("%q: expected %t; got %t", tt.line, tt.want, got)
+		}
+	}
+}
+
+func TestChaptersWithoutHeadings(t *testing.T) {
+	chapters := Chapters("one & two\n\nthree < four\n", "Notes")
+	if len(chapters) != 1 || chapters[0].Title != "Notes" {
+		t.Fatalf("expected a single chapter; got: %+v", chapters)
+	}
+	want := "<p>one &amp; two</p>\n<p>three &lt; four</p>\n"
+	if chapters[0].Body != want {
+		t.Errorf("incorrect body; expected: %q; got: %q", want, chapters[0].Body)
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	md := "Intro with *emphasis*.\n\n" +
+		"# First\n\nSome **bold** and `a < b` code, a [link](http://example.com) and a [titled link](http://example.org \"Example\").\n\n" +
+		"## Section\n\n- one\n- two\n\n> quoted\n\n" +
+		"```\n# not a heading\n```\n\n" +
+		"# Second\n\n1. first\n2. second\n\n---\n"
+
+	chapters := Markdown(md, "Book")
+	titles := make([]string, len(chapters))
+	for i, c := range chapters {
+		titles[i] = c.Title
+		if err := wellFormed(c.Body); err != nil {
+			t.Errorf("chapter %q is not well formed: %v\n%s", c.Title, err, c.Body)
+		}
+	}
+	want := []string{"Book", "First", "Second"}
+	if strings.Join(titles, "|") != strings.Join(want, "|") {
+		t.Fatalf("incorrect chapters; expected: %q; got: %q", want, titles)
+	}
+
+	for _, s := range []string{
+		"<strong>bold</strong>",
+		"<code>a &lt; b</code>",
+		`<a href="http://example.com">link</a>`,
+		`<a href="http://example.org">titled link</a>`,
+		"<h2>Section</h2>",
+		"<ul>\n<li>one</li>\n<li>two</li>\n</ul>",
+		"<blockquote><p>quoted</p></blockquote>",
+		"<pre><code># not a heading</code></pre>",
+	} {
+		if !strings.Contains(chapters[1].Body, s) {
+			t.Errorf("expected %q in chapter; got: %s", s, chapters[1].Body)
+		}
+	}
+	if !strings.Contains(chapters[2].Body, "<ol>") || !strings.Contains(chapters[2].Body, "<hr/>") {
+		t.Errorf("expected ordered list and rule; got: %s", chapters[2].Body)
+	}
+}
+
+func TestRTF(t *testing.T) {
+	doc := `{\rtf1\ansi\ansicpg1251\deff0{\fonttbl{\f0 Times New Roman;}}{\*\generator Writer;}` +
+		`{\info{\title Ignored}}\pard\plain \f0 Hello \b world\b0 !\par` +
+		`\'cf\'f0\'e8\'e2\'e5\'f2\par ` +
+		`Caf\u233?\tab \ldblquote quoted\rdblquote  and \{braces\}\line next\par ` +
+		`Emoji \u-10179?\u-8704?}`
+
+	got, err := RTF([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Hello world!\n\nПривет\n\nCafé\t“quoted” and {braces}\nnext\n\nEmoji 😀"
+	if got != want {
+		t.Errorf("incorrect text; expected: %q; got: %q", want, got)
+	}
+
+	if _, err := RTF([]byte("plain")); !errors.Is(err, ErrNotRTF) {
+		t.Errorf("expected ErrNotRTF; got: %v", err)
+	}
+}
+
+func TestConverter(t *testing.T) {
+	data := []byte("CHAPTER 1\n\nIt was a dark and stormy night.\n\nCHAPTER 2\n\nThe end.\n")
+
+	var out bytes.Buffer
+	md := upload.Metadata{Title: "Storm", Authors: []string{"Someone"}, Language: "en"}
+	if err := (Converter{}).Transform(context.Background(), &out, "storm.txt", bytes.NewReader(data), int64(len(data)), md); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(out.Bytes())
+	if problems := epub.Check(r, r.Size()); len(problems) > 0 {
+		t.Errorf("expected a valid EPUB; got problems: %+v", problems)
+	}
+
+	got, err := epub.Extractor{}.Extract("storm.epub", r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Storm" || got.Language != "en" {
+		t.Errorf("incorrect metadata; got: %+v", got)
+	}
+
+	if name := (Converter{}).Rename("dir/storm.txt"); name != "dir/storm.epub" {
+		t.Errorf("incorrect name; got: %q", name)
+	}
+}
+
+func wellFormed(body string) error {
+	d := xml.NewDecoder(strings.NewReader("<body>" + body + "</body>"))
+	for {
+		if _, err := d.Token(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
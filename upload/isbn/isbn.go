@@ -0,0 +1,149 @@
+// Package isbn validates ISBNs and finds them in the text of books.
+package isbn
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// candidates are runs of digits, optionally separated by hyphens or
+	// spaces, ending with a digit or the ISBN-10 check character
+	reCandidate = regexp.MustCompile(`\b\d[\d\- ]{8,15}[\dXx]\b`)
+
+	// a label in front of a candidate
+	reLabel = regexp.MustCompile(`(?i)ISBN(?:-1[03])?[\s:#.]*(?:\([^)]{0,20}\)[\s:]*)?$`)
+)
+
+// Normalize strips the separators from the ISBN-10 or ISBN-13 and validates
+// its checksum. Valid ISBNs are returned as ISBN-13.
+func Normalize(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	for _, prefix := range []string{"urn:isbn:", "isbn:", "isbn"} {
+		if len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+			s = s[len(prefix):]
+			break
+		}
+	}
+
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '-' || r == ' ':
+			return -1
+		case r == 'x':
+			return 'X'
+		}
+		return r
+	}, strings.TrimSpace(s))
+
+	switch {
+	case len(s) == 10 && valid10(s):
+		return to13(s), true
+	case len(s) == 13 && valid13(s):
+		return s, true
+	}
+	return "", false
+}
+
+// Valid reports whether s is a valid ISBN-10 or ISBN-13.
+func Valid(s string) bool {
+	_, ok := Normalize(s)
+	return ok
+}
+
+// Find returns the valid ISBNs found in the text, as ISBN-13, in the order
+// they appear. To avoid mistaking other numbers for ISBNs, only numbers
+// labelled as ISBN, or 13 digit numbers with the 978/979 prefix, are returned.
+func Find(text string) []string {
+	var found []string
+	seen := make(map[string]bool)
+
+	for pos := 0; pos < len(text); {
+		loc := reCandidate.FindStringIndex(text[pos:])
+		if loc == nil {
+			break
+		}
+		loc[0], loc[1] = pos+loc[0], pos+loc[1]
+		candidate := text[loc[0]:loc[1]]
+
+		n, ok := Normalize(candidate)
+		if !ok {
+			// the candidate may have swallowed a number in front of the ISBN,
+			// like the year in "2019 978-0-…", so retry from the next run of
+			// digits
+			pos = nextDigits(text, loc[0])
+			continue
+		}
+		pos = loc[1]
+		if seen[n] {
+			continue
+		}
+
+		labelled := reLabel.MatchString(text[max(0, loc[0]-32):loc[0]])
+		digits := strings.NewReplacer("-", "", " ", "").Replace(candidate)
+		prefixed := len(digits) == 13 && (strings.HasPrefix(digits, "978") || strings.HasPrefix(digits, "979"))
+		if !labelled && !prefixed {
+			continue
+		}
+
+		seen[n] = true
+		found = append(found, n)
+	}
+
+	return found
+}
+
+// nextDigits returns the offset following the run of digits at i.
+func nextDigits(text string, i int) int {
+	for i < len(text) && text[i] >= '0' && text[i] <= '9' {
+		i++
+	}
+	return i
+}
+
+func valid10(s string) bool {
+	sum := 0
+	for i := 0; i < 10; i++ {
+		var d int
+		switch c := s[i]; {
+		case c >= '0' && c <= '9':
+			d = int(c - '0')
+		case c == 'X' && i == 9:
+			d = 10
+		default:
+			return false
+		}
+		sum += (10 - i) * d
+	}
+	return sum%11 == 0
+}
+
+func valid13(s string) bool {
+	sum := 0
+	for i := 0; i < 13; i++ {
+		c := s[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// to13 converts a valid ISBN-10 to ISBN-13.
+func to13(s string) string {
+	s = "978" + s[:9]
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(s[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return s + string(rune('0'+(10-sum%10)%10))
+}
@@ -0,0 +1,53 @@
+package isbn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{in: "978-0-261-10295-8", want: "9780261102958", ok: true},
+		{in: "0-261-10295-8", want: "9780261102958", ok: true},
+		{in: "urn:isbn:9780261102958", want: "9780261102958", ok: true},
+		{in: "080442957X", want: "9780804429573", ok: true},
+		{in: "080442957x", want: "9780804429573", ok: true},
+		{in: "978-0-261-10295-5"},
+		{in: "0-261-10295-5"},
+		{in: "12345"},
+		{in: "97802611029X4"},
+	}
+
+	for _, tt := range tests {
+		got, ok := Normalize(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Normalize(%q); expected: %q, %v; got: %q, %v", tt.in, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	text := `First published 1937. Phone 0261102958.
+ISBN 0-261-10295-8 (paperback)
+ISBN-13: 978-0-618-00221-4
+Also 9780261102217 and again 978-0-261-10295-8.
+Order no. 1234567890`
+
+	want := []string{"9780261102958", "9780618002214", "9780261102217"}
+	if got := Find(text); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect isbns; expected: %v; got: %v", want, got)
+	}
+}
+
+func TestFindAfterNumber(t *testing.T) {
+	text := "Copyright 2019 978-0-306-40615-7. All rights reserved."
+
+	want := []string{"9780306406157"}
+	if got := Find(text); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect isbns; expected: %v; got: %v", want, got)
+	}
+}
@@ -0,0 +1,130 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+var (
+	ErrInvalidKey = errors.New("template produced an invalid key")
+)
+
+// KeyTemplate builds the key (path) a file is stored under from its original
+// filename and metadata, e.g. "{{ .Author }}/{{ .Title }}{{ .Ext }}". Values
+// are sanitized before being passed to the template so they can never add
+// path segments of their own.
+type KeyTemplate struct {
+	t *template.Template
+}
+
+// KeyData is the data made available to a KeyTemplate.
+type KeyData struct {
+	Filename    string
+	Name        string
+	Ext         string
+	Title       string
+	Author      string
+	Authors     []string
+	Series      string
+	SeriesIndex float64
+	Tags        []string
+	Language    string
+	ISBN        string
+	Date        string
+	Year        string
+}
+
+var keyFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"default": func(def, v string) string {
+		if v == "" {
+			return def
+		}
+		return v
+	},
+}
+
+// ParseKeyTemplate parses the text as a KeyTemplate.
+func ParseKeyTemplate(text string) (*KeyTemplate, error) {
+	t, err := template.New("key").Funcs(keyFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// render against sample data so mistakes are found at startup
+	kt := &KeyTemplate{t: t}
+	if _, err := kt.Execute("sample.epub", Metadata{Title: "Title", Authors: []string{"Author"}}); err != nil {
+		return nil, err
+	}
+
+	return kt, nil
+}
+
+// Execute renders the key for the file.
+func (kt *KeyTemplate) Execute(filename string, md Metadata) (string, error) {
+	ext := path.Ext(filename)
+	data := KeyData{
+		Filename:    sanitize(filename),
+		Name:        sanitize(strings.TrimSuffix(filename, ext)),
+		Ext:         sanitize(ext),
+		Title:       sanitize(md.Title),
+		Series:      sanitize(md.Series),
+		SeriesIndex: md.SeriesIndex,
+		Language:    sanitize(md.Language),
+		ISBN:        sanitize(md.ISBN),
+		Date:        sanitize(md.Date),
+	}
+	for _, a := range md.Authors {
+		data.Authors = append(data.Authors, sanitize(a))
+	}
+	if len(data.Authors) > 0 {
+		data.Author = data.Authors[0]
+	}
+	if len(data.Date) >= 4 {
+		data.Year = data.Date[:4]
+	}
+	for _, t := range md.Tags {
+		data.Tags = append(data.Tags, sanitize(t))
+	}
+
+	var b strings.Builder
+	if err := kt.t.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	// collapse empty segments left behind by missing values
+	segs := strings.Split(b.String(), "/")
+	keep := segs[:0]
+	for _, s := range segs {
+		s = strings.TrimSpace(s)
+		if s == "" || s == "." || s == ".." {
+			continue
+		}
+		keep = append(keep, s)
+	}
+	if len(keep) == 0 {
+		return "", fmt.Errorf("%w: %q", ErrInvalidKey, b.String())
+	}
+
+	return strings.Join(keep, "/"), nil
+}
+
+// sanitize strips characters which are unsafe in file names across the
+// supported stores.
+func sanitize(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case isControl(r):
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,56 @@
+package upload
+
+import (
+	"testing"
+)
+
+func TestKeyTemplate(t *testing.T) {
+	kt, err := ParseKeyTemplate(`{{ .Author }}/{{ with .Series }}{{ . }}/{{ end }}{{ .Title }}{{ .Ext }}`)
+	if err != nil {
+		t.Fatalf("ParseKeyTemplate: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		md       Metadata
+		want     string
+	}{
+		{
+			name:     "full",
+			filename: "book.epub",
+			md:       Metadata{Title: "The Hobbit", Authors: []string{"Tolkien"}, Series: "Middle Earth"},
+			want:     "Tolkien/Middle Earth/The Hobbit.epub",
+		},
+		{
+			name:     "missing segments",
+			filename: "book.epub",
+			md:       Metadata{Title: "Dune"},
+			want:     "Dune.epub",
+		},
+		{
+			name:     "slashes in values",
+			filename: "book.pdf",
+			md:       Metadata{Title: "AC/DC", Authors: []string{"../../etc"}},
+			want:     ".._.._etc/AC_DC.pdf",
+		},
+		{
+			name:     "traversal",
+			filename: "book.pdf",
+			md:       Metadata{Title: "..", Authors: []string{".."}},
+			want:     "...pdf",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := kt.Execute(tt.filename, tt.md)
+			if err != nil {
+				t.Fatalf("Execute: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("incorrect key; expected: %q; got: %q", tt.want, got)
+			}
+		})
+	}
+}
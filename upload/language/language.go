@@ -0,0 +1,109 @@
+// Package language detects the language of uploads from a sample of their
+// text, for books whose metadata does not state it.
+package language
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/abadojack/whatlanggo"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+const (
+	// the size of the sample of text detection is run on
+	sampleSize = 16 << 10
+
+	// samples with fewer letters than this are too short to tell
+	minLetters = 200
+)
+
+var (
+	ErrNoText = errors.New("not enough text to detect the language")
+)
+
+// Sampler returns a sample of the text of the files it supports, up to max
+// bytes, with the markup removed. Samplers return upload.ErrUnsupportedFormat
+// for files they do not understand.
+type Sampler interface {
+	Sample(name string, r io.ReaderAt, size int64, max int) (string, error)
+}
+
+// Detector is an upload.Processor setting the language of uploads whose
+// metadata has none, using a trigram detector over a sample of their text.
+type Detector struct {
+	samplers      []Sampler
+	minConfidence float64
+}
+
+// NewDetector returns a detector using the first sampler supporting the
+// format of the upload. Detections less confident than minConfidence, between
+// 0 and 1, are ignored.
+func NewDetector(minConfidence float64, samplers ...Sampler) *Detector {
+	return &Detector{samplers: samplers, minConfidence: minConfidence}
+}
+
+// Process implements the upload.Processor interface.
+func (d *Detector) Process(ctx context.Context, f *upload.File) error {
+	if f.Metadata.Language != "" {
+		return nil
+	}
+
+	for _, s := range d.samplers {
+		text, err := s.Sample(f.Name, f, f.Size(), sampleSize)
+		switch {
+		case errors.Is(err, upload.ErrUnsupportedFormat):
+			continue
+		case err != nil:
+			return fmt.Errorf("%T: %w", s, err)
+		}
+
+		lang, confidence, err := Detect(text)
+		switch {
+		case errors.Is(err, ErrNoText):
+			return nil
+		case err != nil:
+			return err
+		case confidence < d.minConfidence:
+			return nil
+		}
+
+		f.Metadata.Language = lang
+		return nil
+	}
+
+	return nil
+}
+
+func (d *Detector) String() string { return "language" }
+
+// Detect returns the language of the text as an ISO 639-1 code, or ISO 639-3
+// for languages without one, and the confidence of the detection between 0
+// and 1.
+func Detect(text string) (string, float64, error) {
+	letters := 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	if letters < minLetters {
+		return "", 0, ErrNoText
+	}
+
+	info := whatlanggo.Detect(text)
+	if info.Lang < 0 {
+		return "", 0, ErrNoText
+	}
+
+	code := info.Lang.Iso6391()
+	if code == "" {
+		code = info.Lang.Iso6393()
+	}
+	return strings.ToLower(code), info.Confidence, nil
+}
@@ -0,0 +1,83 @@
+package language
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+var samples = map[string]string{
+	"en": `It was the best of times, it was the worst of times, it was the age of
+wisdom, it was the age of foolishness, it was the epoch of belief, it was the
+epoch of incredulity, it was the season of Light, it was the season of
+Darkness, it was the spring of hope, it was the winter of despair.`,
+	"de": `Als Gregor Samsa eines Morgens aus unruhigen Träumen erwachte, fand er
+sich in seinem Bett zu einem ungeheueren Ungeziefer verwandelt. Er lag auf
+seinem panzerartig harten Rücken und sah, wenn er den Kopf ein wenig hob,
+seinen gewölbten, braunen, von bogenförmigen Versteifungen geteilten Bauch.`,
+	"fr": `Longtemps, je me suis couché de bonne heure. Parfois, à peine ma bougie
+éteinte, mes yeux se fermaient si vite que je n'avais pas le temps de me dire:
+Je m'endors. Et, une demi-heure après, la pensée qu'il était temps de chercher
+le sommeil m'éveillait; je voulais poser le volume que je croyais avoir dans
+les mains et souffler ma lumière.`,
+}
+
+func TestDetect(t *testing.T) {
+	for want, text := range samples {
+		got, confidence, err := Detect(text)
+		if err != nil {
+			t.Errorf("%s: %v", want, err)
+			continue
+		}
+		if got != want || confidence <= 0 {
+			t.Errorf("expected: %s; got: %s (%.2f)", want, got, confidence)
+		}
+	}
+
+	if _, _, err := Detect("Chapter 1"); !errors.Is(err, ErrNoText) {
+		t.Errorf("expected ErrNoText; got: %v", err)
+	}
+}
+
+// textSampler returns the content of .txt files.
+type textSampler struct{}
+
+func (textSampler) Sample(name string, r io.ReaderAt, size int64, max int) (string, error) {
+	if !strings.HasSuffix(name, ".txt") {
+		return "", upload.ErrUnsupportedFormat
+	}
+	b, err := io.ReadAll(io.NewSectionReader(r, 0, min(size, int64(max))))
+	return string(b), err
+}
+
+func TestDetector(t *testing.T) {
+	tests := []struct {
+		name string
+		md   upload.Metadata
+		want string
+	}{
+		{name: "book.txt", want: "de"},
+		{name: "book.txt", md: upload.Metadata{Language: "en"}, want: "en"},
+		{name: "book.bin", want: ""},
+	}
+
+	core := upload.NewCore(zap.NewNop().Sugar(), nil, upload.WithProcessors(NewDetector(0.5, textSampler{})))
+	data := []byte(samples["de"])
+
+	for _, tt := range tests {
+		res, err := core.Inspect(context.Background(), tt.name, bytes.NewReader(data), int64(len(data)), tt.md)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if res.Metadata.Language != tt.want {
+			t.Errorf("%s: expected: %q; got: %q", tt.name, tt.want, res.Metadata.Language)
+		}
+	}
+}
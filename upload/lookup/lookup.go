@@ -0,0 +1,124 @@
+// Package lookup enriches upload metadata with the details a book database
+// holds for the ISBN of the upload.
+package lookup
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+var (
+	ErrNotFound = errors.New("book not found")
+)
+
+// Provider looks up a book by its ISBN-13, returning ErrNotFound for unknown
+// books.
+type Provider interface {
+	Lookup(ctx context.Context, isbn string) (upload.Metadata, error)
+}
+
+// Enricher implements upload.Enricher using a Provider.
+type Enricher struct {
+	provider Provider
+}
+
+func NewEnricher(provider Provider) *Enricher {
+	return &Enricher{provider: provider}
+}
+
+// Enrich implements the upload.Enricher interface. Uploads without an ISBN, or
+// with one the provider does not know, are left as they are.
+func (e *Enricher) Enrich(ctx context.Context, md upload.Metadata) (upload.Metadata, error) {
+	if md.ISBN == "" {
+		return upload.Metadata{}, nil
+	}
+
+	found, err := e.provider.Lookup(ctx, md.ISBN)
+	if errors.Is(err, ErrNotFound) {
+		return upload.Metadata{}, nil
+	}
+	return found, err
+}
+
+// =============================================================================
+
+// Cache wraps a Provider, keeping its answers, including unknown books, for a
+// while. Errors other than ErrNotFound are not cached.
+type Cache struct {
+	provider Provider
+	ttl      time.Duration
+	size     int
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	md      upload.Metadata
+	err     error
+	expires time.Time
+}
+
+// NewCache caches the answers of the provider for ttl, holding at most size
+// books.
+func NewCache(provider Provider, ttl time.Duration, size int) *Cache {
+	if size < 1 {
+		size = 1
+	}
+	return &Cache{
+		provider: provider,
+		ttl:      ttl,
+		size:     size,
+		entries:  make(map[string]cacheEntry),
+	}
+}
+
+// Lookup implements the Provider interface.
+func (c *Cache) Lookup(ctx context.Context, isbn string) (upload.Metadata, error) {
+	c.mu.Lock()
+	e, ok := c.entries[isbn]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.md, e.err
+	}
+
+	md, err := c.provider.Lookup(ctx, isbn)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return md, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.size {
+		c.evict()
+	}
+	c.entries[isbn] = cacheEntry{md: md, err: err, expires: time.Now().Add(c.ttl)}
+
+	return md, err
+}
+
+// evict drops the expired entries, or the entry expiring first when none has
+// expired yet.
+func (c *Cache) evict() {
+	now := time.Now()
+
+	var oldest string
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+			continue
+		}
+		if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+			oldest = k
+		}
+	}
+
+	if len(c.entries) >= c.size && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
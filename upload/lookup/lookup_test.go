@@ -0,0 +1,102 @@
+package lookup
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+// fakeOpenLibrary serves a single book, counting the requests it gets.
+func fakeOpenLibrary(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		q := r.URL.Query()
+		if r.URL.Path != "/api/books" || q.Get("jscmd") != "data" || q.Get("format") != "json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if q.Get("bibkeys") != "ISBN:9780261102958" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"ISBN:9780261102958": {
+			"title": "The Hobbit",
+			"subtitle": "or There and Back Again",
+			"authors": [{"name": "J. R. R. Tolkien", "url": "https://openlibrary.org/authors/OL26320A"}],
+			"subjects": [{"name": "Fantasy"}, {"name": "Dragons"}]
+		}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestEnrich(t *testing.T) {
+	var requests atomic.Int32
+	srv := fakeOpenLibrary(t, &requests)
+
+	ol := NewOpenLibrary(zap.NewNop().Sugar(), srv.URL, time.Second)
+	e := NewEnricher(NewCache(ol, time.Hour, 10))
+	ctx := context.Background()
+
+	want := upload.Metadata{
+		Title:   "The Hobbit: or There and Back Again",
+		Authors: []string{"J. R. R. Tolkien"},
+		Tags:    []string{"Fantasy", "Dragons"},
+		ISBN:    "9780261102958",
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := e.Enrich(ctx, upload.Metadata{ISBN: "9780261102958"})
+		if err != nil {
+			t.Fatalf("Enrich: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("incorrect metadata; expected: %+v; got: %+v", want, got)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := e.Enrich(ctx, upload.Metadata{ISBN: "9780618002214"})
+		if err != nil || !got.IsZero() {
+			t.Errorf("expected no metadata for an unknown book; got: %+v, %v", got, err)
+		}
+	}
+
+	if got, err := e.Enrich(ctx, upload.Metadata{Title: "No ISBN"}); err != nil || !got.IsZero() {
+		t.Errorf("expected no metadata without an isbn; got: %+v, %v", got, err)
+	}
+
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected cached answers; got %d requests", n)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	var requests atomic.Int32
+	srv := fakeOpenLibrary(t, &requests)
+
+	c := NewCache(NewOpenLibrary(zap.NewNop().Sugar(), srv.URL, time.Second), time.Hour, 1)
+	ctx := context.Background()
+
+	for _, isbn := range []string{"9780261102958", "9780618002214", "9780261102958"} {
+		c.Lookup(ctx, isbn)
+	}
+
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected the cache to hold a single book; got %d requests", n)
+	}
+}
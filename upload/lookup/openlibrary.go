@@ -0,0 +1,116 @@
+package lookup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+const (
+	// DefaultOpenLibraryURL is the public OpenLibrary instance.
+	DefaultOpenLibraryURL = "https://openlibrary.org"
+
+	maxSubjects     = 10
+	maxResponseSize = 1 << 20
+)
+
+// OpenLibrary looks up books using the OpenLibrary Books API, or any service
+// implementing the same `/api/books?bibkeys=ISBN:...&jscmd=data` endpoint.
+type OpenLibrary struct {
+	log     *zap.SugaredLogger
+	client  *http.Client
+	baseURL string
+}
+
+func NewOpenLibrary(log *zap.SugaredLogger, baseURL string, timeout time.Duration) *OpenLibrary {
+	if baseURL == "" {
+		baseURL = DefaultOpenLibraryURL
+	}
+	return &OpenLibrary{
+		log:     log,
+		client:  &http.Client{Timeout: timeout},
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+type openLibraryBook struct {
+	Title    string `json:"title"`
+	Subtitle string `json:"subtitle"`
+	Authors  []struct {
+		Name string `json:"name"`
+	} `json:"authors"`
+	Subjects []struct {
+		Name string `json:"name"`
+	} `json:"subjects"`
+}
+
+// Lookup implements the Provider interface.
+func (o *OpenLibrary) Lookup(ctx context.Context, isbn string) (upload.Metadata, error) {
+	key := "ISBN:" + isbn
+
+	q := url.Values{}
+	q.Set("bibkeys", key)
+	q.Set("format", "json")
+	q.Set("jscmd", "data")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.baseURL+"/api/books?"+q.Encode(), nil)
+	if err != nil {
+		return upload.Metadata{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return upload.Metadata{}, fmt.Errorf("openlibrary: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return upload.Metadata{}, fmt.Errorf("openlibrary: unexpected status %s", resp.Status)
+	}
+
+	var books map[string]openLibraryBook
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&books); err != nil {
+		return upload.Metadata{}, fmt.Errorf("openlibrary: decode: %w", err)
+	}
+
+	o.log.Infow("openlibrary lookup", "isbn", isbn, "found", len(books) > 0, "duration", time.Since(start))
+
+	book, ok := books[key]
+	if !ok {
+		return upload.Metadata{}, ErrNotFound
+	}
+
+	md := upload.Metadata{
+		Title: strings.TrimSpace(book.Title),
+		ISBN:  isbn,
+	}
+	if sub := strings.TrimSpace(book.Subtitle); sub != "" && md.Title != "" {
+		md.Title += ": " + sub
+	}
+	for _, a := range book.Authors {
+		if n := strings.TrimSpace(a.Name); n != "" {
+			md.Authors = append(md.Authors, n)
+		}
+	}
+	for _, s := range book.Subjects {
+		if len(md.Tags) == maxSubjects {
+			break
+		}
+		if n := strings.TrimSpace(s.Name); n != "" {
+			md.Tags = append(md.Tags, n)
+		}
+	}
+
+	return md, nil
+}
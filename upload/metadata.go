@@ -0,0 +1,258 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/funayman/ebook-uploader/upload/isbn"
+	"github.com/funayman/ebook-uploader/validate"
+)
+
+const (
+	maxTitleLen = 512
+	maxNameLen  = 256
+	maxTags     = 64
+)
+
+var (
+	ErrTooLong          = errors.New("value is too long")
+	ErrTooMany          = errors.New("too many values")
+	ErrInvalidLanguage  = errors.New("invalid language code")
+	ErrInvalidIndex     = errors.New("series index must be a positive number")
+	ErrIndexNoSeries    = errors.New("series index provided without a series")
+	ErrInvalidCharacter = errors.New("value contains invalid characters")
+	ErrInvalidISBN      = errors.New("invalid isbn")
+	ErrInvalidDate      = errors.New("date must be formatted as YYYY, YYYY-MM or YYYY-MM-DD")
+
+	// loose BCP 47 check: primary language subtag with optional subtags
+	reLanguage = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{1,8})*$`)
+
+	// ISO 8601 calendar date with reduced precision
+	reDate = regexp.MustCompile(`^[0-9]{4}(-(0[1-9]|1[0-2])(-(0[1-9]|[12][0-9]|3[01]))?)?$`)
+)
+
+// Metadata describes the book being uploaded. Every field is optional; values
+// supplied by the uploader take precedence over values extracted from the
+// file itself.
+type Metadata struct {
+	Title       string   `json:"title,omitempty"`
+	Authors     []string `json:"authors,omitempty"`
+	Series      string   `json:"series,omitempty"`
+	SeriesIndex float64  `json:"series_index,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	ISBN        string   `json:"isbn,omitempty"`
+	Date        string   `json:"date,omitempty"`
+}
+
+// IsZero reports whether no metadata has been set.
+func (m Metadata) IsZero() bool {
+	return m.Title == "" &&
+		len(m.Authors) == 0 &&
+		m.Series == "" &&
+		m.SeriesIndex == 0 &&
+		len(m.Tags) == 0 &&
+		m.Language == "" &&
+		m.ISBN == "" &&
+		m.Date == ""
+}
+
+// Merge fills in the fields of m that are empty with those from other.
+func (m Metadata) Merge(other Metadata) Metadata {
+	if m.Title == "" {
+		m.Title = other.Title
+	}
+	if len(m.Authors) == 0 {
+		m.Authors = other.Authors
+	}
+	if m.Series == "" {
+		m.Series = other.Series
+		if m.SeriesIndex == 0 && validIndex(other.SeriesIndex) {
+			m.SeriesIndex = other.SeriesIndex
+		}
+	}
+	if len(m.Tags) == 0 {
+		m.Tags = other.Tags
+	}
+	if m.Language == "" {
+		m.Language = other.Language
+	}
+	if m.ISBN == "" {
+		m.ISBN = other.ISBN
+	}
+	if m.Date == "" {
+		m.Date = other.Date
+	}
+	return m
+}
+
+// validIndex reports whether the series index is a finite number which is not
+// negative, the only ones which can be encoded and stored.
+func validIndex(f float64) bool {
+	return f >= 0 && !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// Validate checks the metadata for values that cannot be stored. The returned
+// error is a validate.FieldErrors keyed by the json field name.
+func (m Metadata) Validate() error {
+	var fe validate.FieldErrors
+
+	checkText := func(field, v string, max int) {
+		switch {
+		case utf8.RuneCountInString(v) > max:
+			fe.Add(field, ErrTooLong)
+		case !utf8.ValidString(v) || strings.ContainsFunc(v, isControl):
+			fe.Add(field, ErrInvalidCharacter)
+		}
+	}
+
+	checkText("title", m.Title, maxTitleLen)
+	checkText("series", m.Series, maxNameLen)
+
+	for _, a := range m.Authors {
+		checkText("authors", a, maxNameLen)
+	}
+
+	if len(m.Tags) > maxTags {
+		fe.Add("tags", ErrTooMany)
+	}
+	for _, t := range m.Tags {
+		checkText("tags", t, maxNameLen)
+	}
+
+	switch {
+	case !validIndex(m.SeriesIndex):
+		fe.Add("series_index", ErrInvalidIndex)
+	case m.SeriesIndex > 0 && m.Series == "":
+		fe.Add("series_index", ErrIndexNoSeries)
+	}
+
+	if m.Language != "" && !reLanguage.MatchString(m.Language) {
+		fe.Add("language", ErrInvalidLanguage)
+	}
+
+	if m.ISBN != "" && !isbn.Valid(m.ISBN) {
+		fe.Add("isbn", ErrInvalidISBN)
+	}
+
+	if m.Date != "" && !reDate.MatchString(m.Date) {
+		fe.Add("date", ErrInvalidDate)
+	}
+
+	return fe.Err()
+}
+
+// Map flattens the metadata into key/value pairs suitable for object storage
+// metadata. Empty fields are omitted.
+func (m Metadata) Map() map[string]string {
+	kv := make(map[string]string)
+	set := func(k, v string) {
+		if v != "" {
+			kv[k] = v
+		}
+	}
+
+	set("title", m.Title)
+	set("authors", strings.Join(m.Authors, " & "))
+	set("series", m.Series)
+	if m.SeriesIndex > 0 {
+		set("series-index", strconv.FormatFloat(m.SeriesIndex, 'f', -1, 64))
+	}
+	set("tags", strings.Join(m.Tags, ", "))
+	set("language", m.Language)
+	set("isbn", m.ISBN)
+	set("date", m.Date)
+
+	return kv
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// =============================================================================
+
+type ctxKey int
+
+const (
+	metadataKey ctxKey = iota + 1
+	uploaderKey
+	traceIDKey
+	locationsKey
+)
+
+// WithMetadata returns a copy of ctx carrying the metadata of the upload. Stores
+// use GetMetadata to attach it to the objects they write.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey, md)
+}
+
+// GetMetadata returns the metadata stored in the context.
+func GetMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey).(Metadata)
+	return md
+}
+
+// WithUploader returns a copy of ctx carrying the name of the user uploading
+// the file, as authenticated by the web service.
+func WithUploader(ctx context.Context, uploader string) context.Context {
+	return context.WithValue(ctx, uploaderKey, uploader)
+}
+
+// GetUploader returns the name of the uploader stored in the context.
+func GetUploader(ctx context.Context) string {
+	u, _ := ctx.Value(uploaderKey).(string)
+	return u
+}
+
+// WithTraceID returns a copy of ctx carrying the trace ID of the request
+// uploading the file, for the stores logging or reporting work done after the
+// upload.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey, traceID)
+}
+
+// GetTraceID returns the trace ID stored in the context.
+func GetTraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey).(string)
+	return id
+}
+
+// Location is where a store saved an upload, reported by the stores adding
+// books to a library which gives them an ID.
+type Location struct {
+	Store string `json:"store"`
+	ID    string `json:"id,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+type locations struct {
+	mu   sync.Mutex
+	list []Location
+}
+
+// withLocations returns a copy of ctx collecting the locations reported by the
+// stores.
+func withLocations(ctx context.Context) (context.Context, *locations) {
+	l := &locations{}
+	return context.WithValue(ctx, locationsKey, l), l
+}
+
+// ReportLocation records where a store saved the upload, for the Result of
+// Core.Save. It is safe for concurrent use; locations reported outside of
+// Core.Save are dropped.
+func ReportLocation(ctx context.Context, loc Location) {
+	l, ok := ctx.Value(locationsKey).(*locations)
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.list = append(l.list, loc)
+}
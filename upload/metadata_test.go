@@ -0,0 +1,23 @@
+package upload
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestMergeSeriesIndex(t *testing.T) {
+	for _, index := range []float64{math.NaN(), math.Inf(1), -1} {
+		md := Metadata{}.Merge(Metadata{Series: "Discworld", SeriesIndex: index})
+		if md.Series != "Discworld" || md.SeriesIndex != 0 {
+			t.Errorf("%v: expected the series without its index; got %+v", index, md)
+		}
+		if _, err := json.Marshal(Result{Metadata: md}); err != nil {
+			t.Errorf("%v: json.Marshal: %v", index, err)
+		}
+	}
+
+	if md := (Metadata{}).Merge(Metadata{Series: "Discworld", SeriesIndex: 4}); md.SeriesIndex != 4 {
+		t.Errorf("expected index 4; got %v", md.SeriesIndex)
+	}
+}
@@ -0,0 +1,366 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrReadOnly = errors.New("file is read only")
+)
+
+// Processor is a step of the pipeline an upload passes through between being
+// received and being stored. Processors read the content of the file, attach
+// metadata and problems to it, replace its content, or refuse it by returning
+// a RejectError. Any other error is logged and the upload carries on to the
+// next processor, so a failing processor never loses an upload.
+type Processor interface {
+	Process(ctx context.Context, f *File) error
+}
+
+// ProcessorFunc adapts a function to the Processor interface.
+type ProcessorFunc func(ctx context.Context, f *File) error
+
+// Process implements the Processor interface.
+func (fn ProcessorFunc) Process(ctx context.Context, f *File) error {
+	return fn(ctx, f)
+}
+
+// RejectError is returned by a processor or a store refusing an upload. The
+// upload is not stored, by the store refusing it, and the reason is reported to
+// the uploader.
+type RejectError struct {
+	// Code identifies the kind of rejection, such as "duplicate".
+	Code   string
+	Reason string
+	// Err is the error the rejection stems from, nil when there is none.
+	Err error
+}
+
+// Reject returns a RejectError.
+func Reject(code, reason string) error {
+	return &RejectError{Code: code, Reason: reason}
+}
+
+// RejectErr returns a RejectError giving the error as the reason, which
+// errors.Is and errors.As still find.
+func RejectErr(code string, err error) error {
+	return &RejectError{Code: code, Reason: err.Error(), Err: err}
+}
+
+// Error implements the error interface.
+func (e *RejectError) Error() string {
+	return "rejected: " + e.Reason
+}
+
+// Unwrap returns the error the rejection stems from.
+func (e *RejectError) Unwrap() error {
+	return e.Err
+}
+
+// IsRejected reports whether the error is, or wraps, a RejectError.
+func IsRejected(err error) bool {
+	var re *RejectError
+	return errors.As(err, &re)
+}
+
+// =============================================================================
+
+// File is an upload passing through the processors. It gives random access to
+// the current content of the upload, which processors may replace.
+type File struct {
+	// Name is the file name of the upload, updated when a processor changes
+	// its format.
+	Name     string
+	Metadata Metadata
+	Problems []Problem
+
+	r        io.ReaderAt
+	size     int64
+	spool    *SpooledFile
+	readOnly bool
+
+	// kept are the earlier contents stored along with the upload
+	kept []keptFile
+
+	// version counts the replacements of the content, checks records the
+	// version each validator last saw so problems can be marked as fixed and
+	// validated the problems they found, the only ones which can be fixed
+	version   int
+	checks    []check
+	validated []Problem
+}
+
+type check struct {
+	validator Validator
+	version   int
+}
+
+// keptFile is content replaced by a Keeper, stored under the name it had.
+type keptFile struct {
+	name  string
+	spool *SpooledFile
+}
+
+// ReadAt implements the io.ReaderAt interface over the current content.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	return f.r.ReadAt(p, off)
+}
+
+// Size returns the size of the current content.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// ReadOnly reports whether the content may be replaced. Files are read only
+// while being inspected, when nothing will be stored.
+func (f *File) ReadOnly() bool {
+	return f.readOnly
+}
+
+// Replace replaces the content of the file with what write writes. The current
+// content stays readable until write returns; nothing is replaced when it
+// fails.
+func (f *File) Replace(write func(w io.Writer) error) error {
+	return f.replace(write, false)
+}
+
+// replace replaces the content as Replace does, keeping the current content
+// to be stored along with the upload when keep is set.
+func (f *File) replace(write func(w io.Writer) error, keep bool) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+
+	out, err := newSpool()
+	if err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	if err := write(out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.finish(); err != nil {
+		out.Close()
+		return fmt.Errorf("spool: %w", err)
+	}
+
+	switch {
+	case keep && f.spool != nil:
+		f.kept = append(f.kept, keptFile{name: f.Name, spool: f.spool})
+	case f.spool != nil:
+		f.spool.Close()
+	}
+	f.r, f.size, f.spool = out, out.size, out
+	f.version++
+
+	return nil
+}
+
+// close releases the content spooled by the file.
+func (f *File) close() {
+	if f.spool != nil {
+		f.spool.Close()
+	}
+	for _, k := range f.kept {
+		k.spool.Close()
+	}
+}
+
+// =============================================================================
+
+// Inspect returns a processor filling in the metadata the uploader did not
+// provide with the metadata embedded in the file, using the first extractor
+// supporting its format.
+func Inspect(extractors ...Extractor) Processor {
+	return inspectProcessor(extractors)
+}
+
+type inspectProcessor []Extractor
+
+func (p inspectProcessor) Process(ctx context.Context, f *File) error {
+	var errs []error
+	for _, e := range p {
+		md, err := e.Extract(f.Name, f, f.size)
+		switch {
+		case errors.Is(err, ErrUnsupportedFormat):
+			continue
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%T: %w", e, err))
+			continue
+		}
+		f.Metadata = f.Metadata.Merge(md)
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+func (p inspectProcessor) String() string { return "inspect" }
+
+// Validate returns a processor reporting the problems found by the validators
+// supporting the format of the file. Problems no longer found once the
+// pipeline replaced the content are marked as fixed.
+func Validate(validators ...Validator) Processor {
+	return validateProcessor(validators)
+}
+
+type validateProcessor []Validator
+
+func (p validateProcessor) Process(ctx context.Context, f *File) error {
+	var errs []error
+	for _, v := range p {
+		ps, err := v.Validate(ctx, f.Name, f, f.size)
+		switch {
+		case errors.Is(err, ErrUnsupportedFormat):
+			continue
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%T: %w", v, err))
+			continue
+		}
+		f.Problems = append(f.Problems, ps...)
+		f.validated = append(f.validated, ps...)
+		f.checks = append(f.checks, check{validator: v, version: f.version})
+	}
+	return errors.Join(errs...)
+}
+
+func (p validateProcessor) String() string { return "validate" }
+
+// Transform returns a processor applying the transformers, in order, to the
+// content of the file. Transformers implementing Renamer rename the file when
+// they rewrite it, and those implementing Keeper have the content they
+// rewrote stored as well. A failing transformer leaves the content as it was.
+func Transform(transformers ...Transformer) Processor {
+	return transformProcessor(transformers)
+}
+
+type transformProcessor []Transformer
+
+func (p transformProcessor) Process(ctx context.Context, f *File) error {
+	if f.readOnly {
+		return nil
+	}
+
+	var errs []error
+	for _, t := range p {
+		k, ok := t.(Keeper)
+		keep := ok && k.KeepOriginal()
+
+		err := f.replace(func(w io.Writer) error {
+			return t.Transform(ctx, w, f.Name, f, f.size, f.Metadata)
+		}, keep)
+		switch {
+		case errors.Is(err, ErrUnsupportedFormat), errors.Is(err, ErrUnchanged):
+			continue
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%T: %w", t, err))
+			continue
+		}
+		if r, ok := t.(Renamer); ok {
+			f.Name = r.Rename(f.Name)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p transformProcessor) String() string { return "transform" }
+
+// Enrich returns a processor filling in the metadata neither the uploader nor
+// the file provided using the enrichers, in order.
+func Enrich(enrichers ...Enricher) Processor {
+	return enrichProcessor(enrichers)
+}
+
+type enrichProcessor []Enricher
+
+func (p enrichProcessor) Process(ctx context.Context, f *File) error {
+	var errs []error
+	for _, e := range p {
+		found, err := e.Enrich(ctx, f.Metadata)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%T: %w", e, err))
+			continue
+		}
+		f.Metadata = f.Metadata.Merge(found)
+	}
+	return errors.Join(errs...)
+}
+
+func (p enrichProcessor) String() string { return "enrich" }
+
+// =============================================================================
+
+// process runs the processors over the file, stopping at the first rejection.
+func (c *Core) process(ctx context.Context, f *File) error {
+	for _, p := range c.processors {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		version := f.version
+		err := p.Process(ctx, f)
+		switch {
+		case IsRejected(err):
+			c.log.Infow("upload rejected", "filename", f.Name, "processor", processorName(p), "error", err)
+			return err
+		case err != nil:
+			c.log.Warnw("process", "filename", f.Name, "processor", processorName(p), "error", err)
+		}
+
+		if f.version != version {
+			c.log.Infow("transformed upload", "filename", f.Name, "processor", processorName(p), "bytes", f.size)
+		}
+	}
+
+	c.markFixed(ctx, f)
+
+	return nil
+}
+
+// markFixed validates the final content again when it was replaced since it
+// was validated, marking the problems no longer found as fixed.
+func (c *Core) markFixed(ctx context.Context, f *File) {
+	if len(f.Problems) == 0 {
+		return
+	}
+
+	stale := false
+	for _, ch := range f.checks {
+		stale = stale || ch.version != f.version
+	}
+	if !stale {
+		return
+	}
+
+	// problems reported by other processors are still there
+	found := make(map[Problem]int, len(f.validated))
+	for _, p := range f.validated {
+		found[p]++
+	}
+	var after []Problem
+	for _, p := range f.Problems {
+		if found[p] > 0 {
+			found[p]--
+			continue
+		}
+		after = append(after, p)
+	}
+
+	for _, ch := range f.checks {
+		ps, err := ch.validator.Validate(ctx, f.Name, f, f.size)
+		if err != nil {
+			continue
+		}
+		after = append(after, ps...)
+	}
+	f.Problems = markFixed(f.Problems, after)
+}
+
+func processorName(p Processor) string {
+	if s, ok := p.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", p)
+}
@@ -0,0 +1,194 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+type memStorer struct {
+	key  string
+	data string
+	md   Metadata
+}
+
+func (s *memStorer) Save(ctx context.Context, key string, r io.ReadCloser) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.key, s.data, s.md = key, string(b), GetMetadata(ctx)
+	return nil
+}
+
+type titleExtractor struct{}
+
+func (titleExtractor) Extract(name string, r io.ReaderAt, size int64) (Metadata, error) {
+	b, err := io.ReadAll(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return Metadata{}, err
+	}
+	return Metadata{Title: strings.SplitN(string(b), "\n", 2)[0]}, nil
+}
+
+// lowerValidator reports a problem for upper case content.
+type lowerValidator struct{}
+
+func (lowerValidator) Validate(ctx context.Context, name string, r io.ReaderAt, size int64) ([]Problem, error) {
+	b, err := io.ReadAll(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(string(b)) != string(b) {
+		return []Problem{{Code: "CASE", Severity: SeverityWarning, Message: "upper case"}}, nil
+	}
+	return nil, nil
+}
+
+// lowerTransformer lowers the content and renames the file to .low.
+type lowerTransformer struct{}
+
+func (lowerTransformer) Transform(ctx context.Context, w io.Writer, name string, r io.ReaderAt, size int64, md Metadata) error {
+	b, err := io.ReadAll(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, strings.ToLower(string(b)))
+	return err
+}
+
+func (lowerTransformer) Rename(name string) string {
+	return strings.TrimSuffix(name, ".txt") + ".low"
+}
+
+type failingTransformer struct{}
+
+func (failingTransformer) Transform(ctx context.Context, w io.Writer, name string, r io.ReaderAt, size int64, md Metadata) error {
+	io.WriteString(w, "partial")
+	return errors.New("broken")
+}
+
+func TestCoreProcessors(t *testing.T) {
+	var seen Metadata
+	store := &memStorer{}
+	core := NewCore(zap.NewNop().Sugar(), store, WithProcessors(
+		Inspect(titleExtractor{}),
+		Validate(lowerValidator{}),
+		Transform(failingTransformer{}, lowerTransformer{}),
+		ProcessorFunc(func(ctx context.Context, f *File) error {
+			seen = f.Metadata
+			f.Metadata.Tags = append(f.Metadata.Tags, "processed")
+			f.Problems = append(f.Problems, Problem{Code: "DUPLICATE", Severity: SeverityWarning})
+			return nil
+		}),
+	))
+
+	src := io.NopCloser(strings.NewReader("Title\nBODY"))
+	res, err := core.Save(context.Background(), "book.txt", src, Metadata{Authors: []string{"Me"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Key != "book.low" || store.data != "title\nbody" {
+		t.Errorf("expected transformed and renamed file; got: %q, %q", res.Key, store.data)
+	}
+	if seen.Title != "Title" || len(seen.Authors) != 1 {
+		t.Errorf("expected merged metadata; got: %+v", seen)
+	}
+	if len(store.md.Tags) != 1 || store.md.Tags[0] != "processed" {
+		t.Errorf("expected metadata attached by processor; got: %+v", store.md)
+	}
+	if len(res.Problems) != 2 || !res.Problems[0].Fixed || res.Problems[1].Fixed {
+		t.Errorf("expected only the validated problem to be fixed; got: %+v", res.Problems)
+	}
+}
+
+func TestCoreReject(t *testing.T) {
+	store := &memStorer{}
+	core := NewCore(zap.NewNop().Sugar(), store, WithProcessors(
+		ProcessorFunc(func(ctx context.Context, f *File) error {
+			return errors.New("ignored")
+		}),
+		ProcessorFunc(func(ctx context.Context, f *File) error {
+			return Reject("too-small", "file is empty")
+		}),
+		ProcessorFunc(func(ctx context.Context, f *File) error {
+			t.Error("processor after rejection called")
+			return nil
+		}),
+	))
+
+	_, err := core.Save(context.Background(), "book.txt", io.NopCloser(strings.NewReader("")), Metadata{})
+
+	var re *RejectError
+	if !errors.As(err, &re) || re.Code != "too-small" {
+		t.Fatalf("expected rejection; got: %v", err)
+	}
+	if store.key != "" {
+		t.Errorf("expected nothing to be stored; got: %q", store.key)
+	}
+}
+
+func TestCoreInspect(t *testing.T) {
+	store := &memStorer{}
+	core := NewCore(zap.NewNop().Sugar(), store, WithProcessors(
+		Inspect(titleExtractor{}),
+		Validate(lowerValidator{}),
+		Transform(lowerTransformer{}),
+	))
+
+	data := []byte("Title\nBODY")
+	res, err := core.Inspect(context.Background(), "book.txt", bytes.NewReader(data), int64(len(data)), Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Metadata.Title != "Title" || len(res.Problems) != 1 || res.Problems[0].Fixed {
+		t.Errorf("incorrect inspection; got: %+v", res)
+	}
+	if store.key != "" {
+		t.Errorf("expected nothing to be stored; got: %q", store.key)
+	}
+}
+
+// keepingTransformer lowers the content like lowerTransformer, keeping the
+// original.
+type keepingTransformer struct{ lowerTransformer }
+
+func (keepingTransformer) KeepOriginal() bool { return true }
+
+// keysStorer records the content saved under every key.
+type keysStorer map[string]string
+
+func (s keysStorer) Save(ctx context.Context, key string, r io.ReadCloser) error {
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s[key] = string(b)
+	return nil
+}
+
+func TestCoreKeeper(t *testing.T) {
+	kt, err := ParseKeyTemplate("{{ .Title }}/{{ .Filename }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := keysStorer{}
+	core := NewCore(zap.NewNop().Sugar(), store, WithKeyTemplate(kt), WithProcessors(
+		Transform(keepingTransformer{}),
+	))
+
+	res, err := core.Save(context.Background(), "book.txt", io.NopCloser(strings.NewReader("BODY")), Metadata{Title: "Mort"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Key != "Mort/book.low" || len(store) != 2 || store["Mort/book.low"] != "body" || store["Mort/book.txt"] != "BODY" {
+		t.Errorf("expected the transformed file and the original; got %q: %q", res.Key, store)
+	}
+}
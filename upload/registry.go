@@ -0,0 +1,161 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inhies/go-bytesize"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrUnknownScheme = errors.New("no store registered for scheme")
+	ErrStoreOption   = errors.New("invalid store option")
+)
+
+// StoreOpener opens the store described by the URL, its scheme being the one
+// the opener was registered for.
+type StoreOpener func(ctx context.Context, log *zap.SugaredLogger, u *url.URL) (Storer, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = make(map[string]StoreOpener)
+)
+
+// RegisterStore makes a store available under the URL scheme. Store packages
+// call it from their init function, so that importing the package is enough to
+// open its URLs. It panics when the scheme is registered twice or the opener is
+// nil.
+func RegisterStore(scheme string, open StoreOpener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+
+	scheme = strings.ToLower(scheme)
+	if open == nil {
+		panic("upload: RegisterStore opener is nil")
+	}
+	if _, dup := openers[scheme]; dup {
+		panic("upload: RegisterStore called twice for scheme " + scheme)
+	}
+	openers[scheme] = open
+}
+
+// StoreSchemes returns the registered URL schemes, sorted.
+func StoreSchemes() []string {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+
+	schemes := make([]string, 0, len(openers))
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// OpenStore opens the store of the URL with the opener registered for its
+// scheme. Locations without a scheme are paths and open as file URLs.
+func OpenStore(ctx context.Context, log *zap.SugaredLogger, rawURL string) (Storer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// plain paths, including windows drive letters parsed as schemes
+		u = &url.URL{Scheme: "file", Path: rawURL}
+	}
+
+	openersMu.RLock()
+	open, ok := openers[strings.ToLower(u.Scheme)]
+	openersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q (registered: %s)", ErrUnknownScheme, u.Scheme, strings.Join(StoreSchemes(), ", "))
+	}
+
+	store, err := open(ctx, log, u)
+	if err != nil {
+		return nil, fmt.Errorf("open %s store: %w", u.Scheme, err)
+	}
+	return store, nil
+}
+
+// CheckStoreOptions returns an error naming the first query parameter of the
+// URL which is not one of the options known to the store, catching misspelt
+// options before they are silently ignored.
+func CheckStoreOptions(u *url.URL, known ...string) error {
+	names := make([]string, 0, len(u.Query()))
+	for name := range u.Query() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !slices.Contains(known, name) {
+			return fmt.Errorf("%w: unknown option %q", ErrStoreOption, name)
+		}
+	}
+	return nil
+}
+
+// BoolStoreOption returns the boolean value of the URL option, false when it
+// is not set. An option given without a value, as in ?atomic, is true.
+func BoolStoreOption(u *url.URL, name string) (bool, error) {
+	q := u.Query()
+	if !q.Has(name) {
+		return false, nil
+	}
+	switch strings.ToLower(q.Get(name)) {
+	case "", "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: %s=%q is not a boolean", ErrStoreOption, name, q.Get(name))
+}
+
+// IntStoreOption returns the integer value of the URL option, 0 when it is not
+// set.
+func IntStoreOption(u *url.URL, name string) (int, error) {
+	v := u.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s=%q is not a number", ErrStoreOption, name, v)
+	}
+	return n, nil
+}
+
+// DurationStoreOption returns the duration of the URL option, such as 30s, 0
+// when it is not set.
+func DurationStoreOption(u *url.URL, name string) (time.Duration, error) {
+	v := u.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s=%q is not a duration", ErrStoreOption, name, v)
+	}
+	return d, nil
+}
+
+// SizeStoreOption returns the size in bytes of the URL option, such as 4MB, 0
+// when it is not set.
+func SizeStoreOption(u *url.URL, name string) (int64, error) {
+	v := u.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	size, err := bytesize.Parse(v)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s=%q is not a size", ErrStoreOption, name, v)
+	}
+	return int64(size), nil
+}
@@ -0,0 +1,65 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestOpenStore(t *testing.T) {
+	var opened []string
+	RegisterStore("test-registry", func(_ context.Context, _ *zap.SugaredLogger, u *url.URL) (Storer, error) {
+		if err := CheckStoreOptions(u, "flag", "n", "timeout", "size"); err != nil {
+			return nil, err
+		}
+		if _, err := BoolStoreOption(u, "flag"); err != nil {
+			return nil, err
+		}
+		if _, err := IntStoreOption(u, "n"); err != nil {
+			return nil, err
+		}
+		if _, err := DurationStoreOption(u, "timeout"); err != nil {
+			return nil, err
+		}
+		if _, err := SizeStoreOption(u, "size"); err != nil {
+			return nil, err
+		}
+		opened = append(opened, u.Host+u.Path)
+		return &memStorer{}, nil
+	})
+
+	log := zap.NewNop().Sugar()
+	if _, err := OpenStore(context.Background(), log, "TEST-REGISTRY://host/path?flag&n=2&timeout=30s&size=4MB"); err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	if len(opened) != 1 || opened[0] != "host/path" {
+		t.Errorf("unexpected opens: %q", opened)
+	}
+
+	tests := []struct {
+		url string
+		err error
+	}{
+		{"test-registry://host?flag=maybe", ErrStoreOption},
+		{"test-registry://host?other=1", ErrStoreOption},
+		{"test-registry://host?n=two", ErrStoreOption},
+		{"test-registry://host?timeout=30", ErrStoreOption},
+		{"test-registry://host?size=big", ErrStoreOption},
+		{"nope://host", ErrUnknownScheme},
+	}
+	for _, tt := range tests {
+		if _, err := OpenStore(context.Background(), log, tt.url); !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected %v; got: %v", tt.url, tt.err, err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a scheme twice to panic")
+		}
+	}()
+	RegisterStore("test-registry", func(context.Context, *zap.SugaredLogger, *url.URL) (Storer, error) { return nil, nil })
+}
@@ -0,0 +1,376 @@
+package upload
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/inhies/go-bytesize"
+)
+
+// DefaultStore is the name of the store given to NewCore, used for uploads no
+// rule matches.
+const DefaultStore = "default"
+
+var (
+	ErrInvalidRule  = errors.New("invalid routing rule")
+	ErrUnknownStore = errors.New("unknown store")
+
+	// fields understood by the rules and the operators they support
+	ruleFields = map[string]string{
+		"format":   "= != ~",
+		"ext":      "= != ~",
+		"name":     "= != ~",
+		"size":     "< <= > >=",
+		"uploader": "= != ~",
+		"title":    "= != ~",
+		"author":   "= != ~",
+		"series":   "= != ~",
+		"tag":      "= != ~",
+		"language": "= != ~",
+		"isbn":     "= != ~",
+	}
+
+	// operators, longest first so "<=" is not taken for "<"
+	ruleOps = []string{"!=", "<=", ">=", "=", "~", "<", ">"}
+)
+
+// Rule routes the uploads matching all of its conditions to a store.
+type Rule struct {
+	Name       string
+	Conditions []Condition
+	Store      string
+}
+
+// Condition compares a field of an upload with one or more values.
+type Condition struct {
+	Field  string
+	Op     string
+	Values []string
+
+	re   *regexp.Regexp
+	size int64
+}
+
+// ParseRules parses routing rules, one per line. Blank lines and lines starting
+// with # are ignored. A rule is an optional name, the conditions and the store
+// the uploads matching it are saved to:
+//
+//	comics: format=comic -> comics
+//	german: language=de|de-AT author!="Unknown" -> calibre-de
+//	big: size>200MB -> nas
+//	* -> default
+//
+// The fields are format, ext, name, size, uploader, title, author, series, tag,
+// language and isbn. Values separated by | are alternatives, = and != compare
+// without regard to case and ~ matches a regular expression. Languages also
+// match their regional variants, so language=de matches "de-AT".
+func ParseRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", len(rules)+1)
+		}
+		rules = append(rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// ParseRule parses a single routing rule, see ParseRules.
+func ParseRule(text string) (Rule, error) {
+	var rule Rule
+
+	conds, store, ok := strings.Cut(text, "->")
+	if !ok {
+		return Rule{}, fmt.Errorf("%w: missing -> store", ErrInvalidRule)
+	}
+	rule.Store = strings.TrimSpace(store)
+	if rule.Store == "" || strings.ContainsAny(rule.Store, " \t") {
+		return Rule{}, fmt.Errorf("%w: invalid store %q", ErrInvalidRule, rule.Store)
+	}
+
+	// the name is whatever precedes a colon outside of a value
+	if i := strings.Index(conds, ":"); i >= 0 && !strings.ContainsAny(conds[:i], "=~<>\"") {
+		rule.Name = strings.TrimSpace(conds[:i])
+		conds = conds[i+1:]
+	}
+
+	tokens, err := splitQuoted(conds)
+	if err != nil {
+		return Rule{}, err
+	}
+	if len(tokens) == 1 && tokens[0] == "*" {
+		return rule, nil
+	}
+	if len(tokens) == 0 {
+		return Rule{}, fmt.Errorf("%w: no conditions, use * to match everything", ErrInvalidRule)
+	}
+
+	for _, tok := range tokens {
+		c, err := parseCondition(tok)
+		if err != nil {
+			return Rule{}, err
+		}
+		rule.Conditions = append(rule.Conditions, c)
+	}
+
+	return rule, nil
+}
+
+func parseCondition(tok string) (Condition, error) {
+	i := strings.IndexAny(tok, "!=~<>")
+	if i <= 0 {
+		return Condition{}, fmt.Errorf("%w: condition %q", ErrInvalidRule, tok)
+	}
+
+	c := Condition{Field: strings.ToLower(tok[:i])}
+	for _, op := range ruleOps {
+		if strings.HasPrefix(tok[i:], op) {
+			c.Op = op
+			break
+		}
+	}
+	value := tok[i+len(c.Op):]
+
+	ops, ok := ruleFields[c.Field]
+	switch {
+	case !ok:
+		return Condition{}, fmt.Errorf("%w: unknown field %q", ErrInvalidRule, c.Field)
+	case c.Op == "" || !slices.Contains(strings.Fields(ops), c.Op):
+		return Condition{}, fmt.Errorf("%w: %s does not support %q", ErrInvalidRule, c.Field, tok[i:])
+	case value == "":
+		return Condition{}, fmt.Errorf("%w: condition %q has no value", ErrInvalidRule, tok)
+	}
+
+	switch c.Op {
+	case "~":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return Condition{}, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+		}
+		c.re = re
+		c.Values = []string{value}
+	case "<", "<=", ">", ">=":
+		size, err := bytesize.Parse(value)
+		if err != nil {
+			return Condition{}, fmt.Errorf("%w: size %q: %v", ErrInvalidRule, value, err)
+		}
+		c.size = int64(size)
+		c.Values = []string{value}
+	default:
+		c.Values = strings.Split(value, "|")
+	}
+
+	return c, nil
+}
+
+// splitQuoted splits the text at whitespace outside of double quotes, removing
+// the quotes.
+func splitQuoted(text string) ([]string, error) {
+	var (
+		tokens []string
+		tok    strings.Builder
+		quoted bool
+		inTok  bool
+	)
+	for _, r := range text {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inTok = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inTok {
+				tokens = append(tokens, tok.String())
+				tok.Reset()
+				inTok = false
+			}
+		default:
+			tok.WriteRune(r)
+			inTok = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("%w: unterminated quote", ErrInvalidRule)
+	}
+	if inTok {
+		tokens = append(tokens, tok.String())
+	}
+	return tokens, nil
+}
+
+// String returns the condition as written in a rule.
+func (c Condition) String() string {
+	return c.Field + c.Op + strings.Join(c.Values, "|")
+}
+
+// match reports whether the condition holds for the upload, and why.
+func (c Condition) match(in RouteInput) (bool, string) {
+	if c.Field == "size" {
+		var ok bool
+		switch c.Op {
+		case "<":
+			ok = in.Size < c.size
+		case "<=":
+			ok = in.Size <= c.size
+		case ">":
+			ok = in.Size > c.size
+		case ">=":
+			ok = in.Size >= c.size
+		}
+		return ok, fmt.Sprintf("%s: size is %s", c, bytesize.ByteSize(in.Size))
+	}
+
+	values := in.field(c.Field)
+
+	matched := slices.ContainsFunc(values, func(v string) bool {
+		if c.re != nil {
+			return c.re.MatchString(v)
+		}
+		return slices.ContainsFunc(c.Values, func(want string) bool {
+			return strings.EqualFold(v, want) ||
+				c.Field == "language" && len(v) > len(want) && strings.EqualFold(v[:len(want)+1], want+"-")
+		})
+	})
+	if c.Op == "!=" {
+		matched = !matched
+	}
+
+	got := "empty"
+	if len(values) > 0 {
+		got = strconv.Quote(strings.Join(values, ", "))
+	}
+	return matched, fmt.Sprintf("%s: %s is %s", c, c.Field, got)
+}
+
+// =============================================================================
+
+// RouteInput is what the rules know about an upload.
+type RouteInput struct {
+	Name     string
+	Size     int64
+	Uploader string
+	Metadata Metadata
+}
+
+func (in RouteInput) field(name string) []string {
+	one := func(v string) []string {
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	}
+
+	md := in.Metadata
+	switch name {
+	case "format":
+		return one(Format(in.Name))
+	case "ext":
+		return one(strings.ToLower(path.Ext(in.Name)))
+	case "name":
+		return one(path.Base(in.Name))
+	case "uploader":
+		return one(in.Uploader)
+	case "title":
+		return one(md.Title)
+	case "author":
+		return md.Authors
+	case "series":
+		return one(md.Series)
+	case "tag":
+		return md.Tags
+	case "language":
+		return one(md.Language)
+	case "isbn":
+		return one(md.ISBN)
+	}
+	return nil
+}
+
+// Route is the store chosen for an upload.
+type Route struct {
+	Store string `json:"store"`
+	// Rule is the name of the matching rule, empty when no rule matched and
+	// the upload goes to the default store.
+	Rule string `json:"rule,omitempty"`
+	// Explain lists the conditions of the rules tried, in order, and what
+	// they found.
+	Explain []string `json:"explain"`
+}
+
+// Router picks the store uploads are saved to using the first rule they match.
+// Uploads matching no rule are saved to the default store.
+type Router struct {
+	rules  []Rule
+	stores map[string]Storer
+}
+
+// NewRouter returns a router for the rules, which may refer to the stores by
+// name and to the default store as DefaultStore.
+func NewRouter(stores map[string]Storer, rules []Rule) (*Router, error) {
+	for _, r := range rules {
+		if _, ok := stores[r.Store]; !ok && r.Store != DefaultStore {
+			return nil, fmt.Errorf("%w: %q used by %s", ErrUnknownStore, r.Store, r.Name)
+		}
+	}
+	return &Router{rules: rules, stores: stores}, nil
+}
+
+// Route returns the store for the upload.
+func (r *Router) Route(in RouteInput) Route {
+	route := Route{Store: DefaultStore, Explain: []string{}}
+
+	for _, rule := range r.rules {
+		matched := true
+		for _, c := range rule.Conditions {
+			ok, why := c.match(in)
+			mark := "✓"
+			if !ok {
+				mark = "✗"
+			}
+			route.Explain = append(route.Explain, fmt.Sprintf("%s: %s %s", rule.Name, mark, why))
+			if !ok {
+				matched = false
+				break
+			}
+		}
+		if len(rule.Conditions) == 0 {
+			route.Explain = append(route.Explain, fmt.Sprintf("%s: ✓ matches everything", rule.Name))
+		}
+
+		if matched {
+			route.Store, route.Rule = rule.Store, rule.Name
+			return route
+		}
+	}
+
+	route.Explain = append(route.Explain, "no rule matched, using the default store")
+	return route
+}
+
+// storer returns the store of the route, falling back to def.
+func (r *Router) storer(route Route, def Storer) Storer {
+	if s, ok := r.stores[route.Store]; ok {
+		return s
+	}
+	return def
+}
@@ -0,0 +1,104 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+const testRules = `
+# audiobooks go to Audiobookshelf
+audio: format=audiobook -> audiobookshelf
+comics: ext=.cbz|.cbr -> komga
+german: language=de author!="Unknown Author" -> calibre-de
+big: size>=1KB -> nas
+pratchett: author~(?i)pratchett -> nas
+* -> default
+`
+
+func TestRouter(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]Storer{
+		"audiobookshelf": &memStorer{},
+		"komga":          &memStorer{},
+		"calibre-de":     &memStorer{},
+		"nas":            &memStorer{},
+	}
+	router, err := NewRouter(stores, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in    RouteInput
+		store string
+		rule  string
+	}{
+		{in: RouteInput{Name: "book.m4b"}, store: "audiobookshelf", rule: "audio"},
+		{in: RouteInput{Name: "Issue 1.CBZ"}, store: "komga", rule: "comics"},
+		{in: RouteInput{Name: "b.epub", Metadata: Metadata{Language: "de-AT"}}, store: "calibre-de", rule: "german"},
+		{in: RouteInput{Name: "b.epub", Metadata: Metadata{Language: "de", Authors: []string{"unknown author"}}}, store: DefaultStore, rule: "rule 6"},
+		{in: RouteInput{Name: "b.epub", Size: 2048}, store: "nas", rule: "big"},
+		{in: RouteInput{Name: "b.epub", Metadata: Metadata{Authors: []string{"A", "Terry Pratchett"}}}, store: "nas", rule: "pratchett"},
+		{in: RouteInput{Name: "b.epub"}, store: DefaultStore, rule: "rule 6"},
+	}
+
+	for _, tt := range tests {
+		route := router.Route(tt.in)
+		if route.Store != tt.store || route.Rule != tt.rule {
+			t.Errorf("%+v: expected: %s (%s); got: %s (%s)\n%s", tt.in, tt.store, tt.rule, route.Store, route.Rule, strings.Join(route.Explain, "\n"))
+		}
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, text := range []string{
+		"format=comic",
+		"format=comic -> ",
+		"colour=red -> nas",
+		"size=10MB -> nas",
+		"size>lots -> nas",
+		"title~( -> nas",
+		`author="Unterminated -> nas`,
+		"name: -> nas",
+	} {
+		if _, err := ParseRule(text); !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("%q: expected ErrInvalidRule; got: %v", text, err)
+		}
+	}
+
+	rules := []Rule{{Name: "r", Store: "missing"}}
+	if _, err := NewRouter(nil, rules); !errors.Is(err, ErrUnknownStore) {
+		t.Errorf("expected ErrUnknownStore; got: %v", err)
+	}
+}
+
+func TestCoreRoute(t *testing.T) {
+	def, comics := &memStorer{}, &memStorer{}
+	rule, err := ParseRule("uploader=kid -> comics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(map[string]Storer{"comics": comics}, []Rule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	core := NewCore(zap.NewNop().Sugar(), def, WithRouter(router))
+
+	ctx := WithUploader(context.Background(), "kid")
+	res, err := core.Save(ctx, "a.cbz", io.NopCloser(strings.NewReader("data")), Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Store != "comics" || comics.data != "data" || def.key != "" {
+		t.Errorf("expected upload in comics store; got: %+v", res)
+	}
+}
@@ -0,0 +1,169 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// mediaServer stands in for the scan endpoints of Audiobookshelf, Komga and
+// Kavita.
+type mediaServer struct {
+	mu          sync.Mutex
+	scans       []string
+	kavitaToken string
+}
+
+func (ms *mediaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authorized := false
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/abs/api/libraries/"):
+		authorized = r.Header.Get("Authorization") == "Bearer abs-token"
+	case strings.HasPrefix(r.URL.Path, "/api/v1/libraries/"):
+		user, password, ok := r.BasicAuth()
+		authorized = (ok && user == "admin@example.com" && password == "secret") || r.Header.Get("X-API-Key") == "komga-key"
+	case r.URL.Path == "/api/Plugin/authenticate":
+		if r.URL.Query().Get("apiKey") != "kavita-key" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ms.kavitaToken += "t"
+		w.Write([]byte(`{"username":"admin","token":"` + ms.kavitaToken + `"}`))
+		return
+	case r.URL.Path == "/api/Library/scan":
+		authorized = ms.kavitaToken != "" && r.Header.Get("Authorization") == "Bearer "+ms.kavitaToken
+	}
+	if !authorized {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if strings.Contains(r.URL.Path, "/missing/") {
+		http.NotFound(w, r)
+		return
+	}
+	ms.scans = append(ms.scans, r.URL.RequestURI())
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func TestScanners(t *testing.T) {
+	ms := &mediaServer{}
+	srv := httptest.NewServer(ms)
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		location string
+		want     string
+	}{
+		{"abs+http://abs-token@" + host + "/abs/lib-1", "/abs/api/libraries/lib-1/scan"},
+		{"komga+http://admin%40example.com:secret@" + host + "/0ABC", "/api/v1/libraries/0ABC/scan"},
+		{"komga+http://komga-key@" + host + "/0DEF", "/api/v1/libraries/0DEF/scan"},
+		{"kavita+http://kavita-key@" + host + "/2", "/api/Library/scan?force=false&libraryId=2"},
+	}
+	for _, tt := range tests {
+		s, err := Parse(srv.Client(), tt.location)
+		if err != nil {
+			t.Fatalf("Parse %s: %v", tt.location, err)
+		}
+		if err := s.Scan(context.Background()); err != nil {
+			t.Errorf("Scan %s: %v", s, err)
+			continue
+		}
+		if got := ms.scans[len(ms.scans)-1]; got != tt.want {
+			t.Errorf("expected: %s; got: %s", tt.want, got)
+		}
+	}
+
+	// expired kavita tokens are renewed
+	k, _ := Parse(srv.Client(), "kavita+http://kavita-key@"+host+"/2")
+	if err := k.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ms.kavitaToken = "expired"
+	if err := k.Scan(context.Background()); err != nil {
+		t.Errorf("expected the token to be renewed; got: %v", err)
+	}
+
+	s, _ := Parse(srv.Client(), "abs+http://wrong@"+host+"/abs/lib-1")
+	if err := s.Scan(context.Background()); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected ErrUnauthorized; got: %v", err)
+	}
+	s, _ = Parse(srv.Client(), "abs+http://abs-token@"+host+"/abs/missing")
+	if err := s.Scan(context.Background()); !errors.Is(err, ErrUnknownLibrary) {
+		t.Errorf("expected ErrUnknownLibrary; got: %v", err)
+	}
+
+	for _, loc := range []string{"http://token@abs/1", "plex+http://token@plex/1", "abs+http://abs:13378/1", "abs+http://token@abs:13378/"} {
+		if _, err := Parse(srv.Client(), loc); !errors.Is(err, ErrInvalidLocation) {
+			t.Errorf("%s: expected ErrInvalidLocation; got: %v", loc, err)
+		}
+	}
+}
+
+// fakeScanner fails with the errors, in order, before succeeding.
+type fakeScanner struct {
+	mu    sync.Mutex
+	errs  []error
+	scans int
+}
+
+func (f *fakeScanner) Scan(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.scans++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func (f *fakeScanner) String() string { return "fake" }
+
+func TestHook(t *testing.T) {
+	cfg := Config{Delay: 20 * time.Millisecond, Retries: 2, Backoff: time.Millisecond}
+
+	// triggers during the delay share a scan, failures are retried
+	f := &fakeScanner{errs: []error{errors.New("busy"), errors.New("busy")}}
+	h := NewHook(zap.NewNop().Sugar(), f, cfg)
+	h.Trigger("trace-1")
+	h.Trigger("trace-2")
+	h.Wait()
+	if f.scans != 3 {
+		t.Errorf("expected 3 attempts; got %d", f.scans)
+	}
+
+	f = &fakeScanner{errs: []error{errors.New("busy"), errors.New("busy"), errors.New("busy"), errors.New("busy")}}
+	h = NewHook(zap.NewNop().Sugar(), f, cfg)
+	h.Trigger("trace-3")
+	h.Wait()
+	if f.scans != 3 {
+		t.Errorf("expected the retries to stop after 3 attempts; got %d", f.scans)
+	}
+
+	f = &fakeScanner{errs: []error{ErrUnauthorized}}
+	h = NewHook(zap.NewNop().Sugar(), f, cfg)
+	h.Trigger("trace-4")
+	h.Wait()
+	if f.scans != 1 {
+		t.Errorf("expected refused credentials not to be retried; got %d attempts", f.scans)
+	}
+}
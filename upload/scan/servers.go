@@ -0,0 +1,151 @@
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Audiobookshelf scans a library of an Audiobookshelf server, authenticated
+// with the API token of a user allowed to scan.
+type Audiobookshelf struct {
+	server
+	token string
+}
+
+func NewAudiobookshelf(client *http.Client, serverURL, token, library string) *Audiobookshelf {
+	return &Audiobookshelf{server: server{client: client, url: serverURL, library: library}, token: token}
+}
+
+// Scan implements the Scanner interface.
+func (a *Audiobookshelf) Scan(ctx context.Context) error {
+	resp, err := a.post(ctx, "/api/libraries/"+url.PathEscape(a.library)+"/scan", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+a.token)
+	})
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	return nil
+}
+
+func (a *Audiobookshelf) String() string {
+	return "audiobookshelf " + a.url + " library " + a.library
+}
+
+// =============================================================================
+
+// Komga scans a library of a Komga server, authenticated with an API key or
+// the email and password of an administrator. The user is taken for an API key
+// when there is no password.
+type Komga struct {
+	server
+	apiKey   string
+	user     string
+	password string
+}
+
+func NewKomga(client *http.Client, serverURL, user, password, library string) *Komga {
+	k := &Komga{server: server{client: client, url: serverURL, library: library}, user: user, password: password}
+	if password == "" {
+		k.apiKey, k.user = user, ""
+	}
+	return k
+}
+
+// Scan implements the Scanner interface.
+func (k *Komga) Scan(ctx context.Context) error {
+	resp, err := k.post(ctx, "/api/v1/libraries/"+url.PathEscape(k.library)+"/scan", func(r *http.Request) {
+		if k.apiKey != "" {
+			r.Header.Set("X-API-Key", k.apiKey)
+			return
+		}
+		r.SetBasicAuth(k.user, k.password)
+	})
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	return nil
+}
+
+func (k *Komga) String() string {
+	return "komga " + k.url + " library " + k.library
+}
+
+// =============================================================================
+
+// Kavita scans a library of a Kavita server. The API key of a user is
+// exchanged for the token the API expects, which is renewed once it expired.
+type Kavita struct {
+	server
+	apiKey string
+
+	mu    sync.Mutex
+	token string
+}
+
+func NewKavita(client *http.Client, serverURL, apiKey, library string) *Kavita {
+	return &Kavita{server: server{client: client, url: serverURL, library: library}, apiKey: apiKey}
+}
+
+// Scan implements the Scanner interface.
+func (k *Kavita) Scan(ctx context.Context) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	err := k.scan(ctx)
+	if errors.Is(err, ErrUnauthorized) && k.token != "" {
+		k.token = ""
+		err = k.scan(ctx)
+	}
+	return err
+}
+
+func (k *Kavita) scan(ctx context.Context) error {
+	if k.token == "" {
+		if err := k.authenticate(ctx); err != nil {
+			return fmt.Errorf("authenticate: %w", err)
+		}
+	}
+
+	q := url.Values{"libraryId": {k.library}, "force": {"false"}}
+	resp, err := k.post(ctx, "/api/Library/scan?"+q.Encode(), func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+k.token)
+	})
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	return nil
+}
+
+// authenticate exchanges the API key for a token.
+func (k *Kavita) authenticate(ctx context.Context) error {
+	q := url.Values{"apiKey": {k.apiKey}, "pluginName": {"ebook-uploader"}}
+	resp, err := k.post(ctx, "/api/Plugin/authenticate?"+q.Encode(), func(*http.Request) {})
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	var user struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	if user.Token == "" {
+		return fmt.Errorf("%w: no token", ErrUnauthorized)
+	}
+	k.token = user.Token
+	return nil
+}
+
+func (k *Kavita) String() string {
+	return "kavita " + k.url + " library " + k.library
+}
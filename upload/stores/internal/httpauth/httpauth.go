@@ -0,0 +1,250 @@
+// Package httpauth authenticates the requests of the stores talking to HTTP
+// servers with the basic or digest authentication the server asks for.
+package httpauth
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var ErrUnsupportedChallenge = errors.New("unsupported digest challenge")
+
+// Transport sends the requests with the credentials, using digest
+// authentication once the server asked for it and basic authentication
+// otherwise. The challenge of the server is kept for the following requests,
+// and requests refused with a new challenge are sent again when their body
+// can be. Requests with a body which cannot be sent again are preceded, until
+// the server is known, by a request learning its challenge.
+type Transport struct {
+	Base     http.RoundTripper
+	User     string
+	Password string
+	// ProbeURL is requested with GET to learn the challenge of the server,
+	// the URL of the request itself is requested with OPTIONS when empty.
+	ProbeURL string
+
+	mu        sync.Mutex
+	probed    bool
+	challenge string
+	nc        int
+}
+
+// RoundTrip implements the http.RoundTripper interface. As required by the
+// interface, the body of the request is closed even when it was not sent.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	if !replayable && !t.isProbed() {
+		if err := t.probe(req); err != nil {
+			closeBody(req.Body)
+			return nil, err
+		}
+	}
+
+	sent, err := t.send(req, req.Body)
+	if err != nil || sent.resp.StatusCode != http.StatusUnauthorized {
+		return sent.resp, err
+	}
+
+	// a new challenge, such as a stale nonce, is worth another try
+	challenge := sent.resp.Header.Get("WWW-Authenticate")
+	if !replayable || challenge == "" || !t.setChallenge(challenge, sent.challenge) {
+		return sent.resp, nil
+	}
+	io.Copy(io.Discard, io.LimitReader(sent.resp.Body, 64<<10))
+	sent.resp.Body.Close()
+
+	body := req.Body
+	if req.GetBody != nil {
+		if body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	sent, err = t.send(req, body)
+	return sent.resp, err
+}
+
+type sent struct {
+	resp      *http.Response
+	challenge string
+}
+
+// send sends a copy of the request with the credentials, returning the
+// challenge they answered.
+func (t *Transport) send(req *http.Request, body io.ReadCloser) (sent, error) {
+	r := req.Clone(req.Context())
+	r.Body = body
+
+	challenge, err := t.authorize(r)
+	if err != nil {
+		closeBody(body)
+		return sent{}, err
+	}
+	resp, err := t.base().RoundTrip(r)
+	return sent{resp: resp, challenge: challenge}, err
+}
+
+// authorize sets the Authorization header answering the known challenge.
+func (t *Transport) authorize(r *http.Request) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !strings.HasPrefix(strings.ToLower(t.challenge), "digest ") {
+		r.SetBasicAuth(t.User, t.Password)
+		return t.challenge, nil
+	}
+
+	t.nc++
+	auth, err := Digest(t.challenge, t.User, t.Password, r.Method, r.URL.RequestURI(), t.nc)
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Authorization", auth)
+	return t.challenge, nil
+}
+
+// probe learns the challenge of the server with a request without a body.
+func (t *Transport) probe(req *http.Request) error {
+	method, url := http.MethodOptions, req.URL.String()
+	if t.ProbeURL != "" {
+		method, url = http.MethodGet, t.ProbeURL
+	}
+	probe, err := http.NewRequestWithContext(req.Context(), method, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.base().RoundTrip(probe)
+	if err != nil {
+		return fmt.Errorf("authenticate: %w", err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.probed = true
+	if resp.StatusCode == http.StatusUnauthorized {
+		t.challenge, t.nc = resp.Header.Get("WWW-Authenticate"), 0
+	}
+	return nil
+}
+
+// setChallenge keeps a challenge different from the one answered, reporting
+// whether it changed.
+func (t *Transport) setChallenge(challenge, answered string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.probed = true
+	if challenge == answered {
+		return false
+	}
+	t.challenge, t.nc = challenge, 0
+	return true
+}
+
+func (t *Transport) isProbed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.probed
+}
+
+func closeBody(body io.ReadCloser) {
+	if body != nil {
+		body.Close()
+	}
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// =============================================================================
+
+// Digest returns the Authorization header answering a digest challenge (RFC
+// 7616) with the MD5 algorithm, for the nc-th request using its nonce.
+func Digest(challenge, user, password, method, uri string, nc int) (string, error) {
+	params := ParseChallenge(challenge)
+	realm, nonce := params["realm"], params["nonce"]
+	if nonce == "" {
+		return "", fmt.Errorf("%w: no nonce", ErrUnsupportedChallenge)
+	}
+	if alg := params["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return "", fmt.Errorf("%w: algorithm %s", ErrUnsupportedChallenge, alg)
+	}
+
+	ha1 := MD5Hex(user + ":" + realm + ":" + password)
+	ha2 := MD5Hex(method + ":" + uri)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username=%q, realm=%q, nonce=%q, uri=%q, algorithm=MD5`, user, realm, nonce, uri)
+
+	qops := strings.Split(params["qop"], ",")
+	for i := range qops {
+		qops[i] = strings.TrimSpace(qops[i])
+	}
+	if slices.Contains(qops, "auth") {
+		cnonce := make([]byte, 8)
+		if _, err := rand.Read(cnonce); err != nil {
+			return "", err
+		}
+		cn, count := hex.EncodeToString(cnonce), fmt.Sprintf("%08x", nc)
+		response := MD5Hex(ha1 + ":" + nonce + ":" + count + ":" + cn + ":auth:" + ha2)
+		fmt.Fprintf(&b, `, response=%q, qop=auth, nc=%s, cnonce=%q`, response, count, cn)
+	} else {
+		fmt.Fprintf(&b, `, response=%q`, MD5Hex(ha1+":"+nonce+":"+ha2))
+	}
+	if opaque, ok := params["opaque"]; ok {
+		fmt.Fprintf(&b, `, opaque=%q`, opaque)
+	}
+
+	return b.String(), nil
+}
+
+// ParseChallenge returns the parameters of a digest challenge, or of the
+// Authorization header answering it, the names in lower case.
+func ParseChallenge(challenge string) map[string]string {
+	params := map[string]string{}
+	_, s, _ := strings.Cut(challenge, " ")
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, ", ") {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			value, s = rest[1:end+1], rest[min(end+2, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[name] = value
+	}
+	return params
+}
+
+// MD5Hex returns the hex encoded MD5 sum of s, as used by digest
+// authentication.
+func MD5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,216 @@
+package httpauth
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testUser     = "admin"
+	testPassword = "secret"
+	testRealm    = "books"
+)
+
+// authServer checks the basic or digest authentication of the requests,
+// answering with the body it received.
+type authServer struct {
+	digest bool
+	// algorithm is announced in the digest challenge when set.
+	algorithm string
+
+	mu       sync.Mutex
+	nonce    string
+	stale    bool
+	requests []string
+}
+
+func (as *authServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	ok, stale := as.authorized(r)
+	as.requests = append(as.requests, r.Method)
+	if !ok {
+		switch {
+		case !as.digest:
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+testRealm+`"`)
+		case as.algorithm != "":
+			w.Header().Set("WWW-Authenticate", `Digest realm="`+testRealm+`", qop="auth", nonce="`+as.nonce+`", algorithm=`+as.algorithm)
+		default:
+			challenge := `Digest realm="` + testRealm + `", qop="auth", nonce="` + as.nonce + `", algorithm="MD5", opaque="xyz"`
+			if stale {
+				challenge += `, stale=true`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	io.Copy(w, r.Body)
+}
+
+// authorized checks the credentials of the request, reporting whether they
+// were refused only because the nonce they answered is no longer valid.
+func (as *authServer) authorized(r *http.Request) (ok, stale bool) {
+	if !as.digest {
+		user, password, ok := r.BasicAuth()
+		return ok && user == testUser && password == testPassword, false
+	}
+
+	auth, found := strings.CutPrefix(r.Header.Get("Authorization"), "Digest ")
+	if !found {
+		return false, false
+	}
+	p := ParseChallenge("Digest " + auth)
+	ha1 := MD5Hex(testUser + ":" + testRealm + ":" + testPassword)
+	ha2 := MD5Hex(r.Method + ":" + r.URL.RequestURI())
+	want := MD5Hex(ha1 + ":" + p["nonce"] + ":" + p["nc"] + ":" + p["cnonce"] + ":" + p["qop"] + ":" + ha2)
+	if p["username"] != testUser || p["uri"] != r.URL.RequestURI() || p["opaque"] != "xyz" || p["response"] != want {
+		return false, false
+	}
+	if p["nonce"] != as.nonce {
+		return false, true
+	}
+	return true, false
+}
+
+// rotate changes the nonce, as servers do once it expired.
+func (as *authServer) rotate(nonce string) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.nonce = nonce
+}
+
+func (as *authServer) sent() []string {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return append([]string(nil), as.requests...)
+}
+
+// stream is a body which cannot be sent again, recording whether it was
+// closed.
+type stream struct {
+	io.Reader
+	closed bool
+}
+
+func (s *stream) Close() error {
+	s.closed = true
+	return nil
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// do sends the body to the server with the transport, returning the status
+// and the body echoed.
+func do(t *testing.T, tr *Transport, url string, body io.Reader) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestTransport(t *testing.T) {
+	for _, digest := range []bool{false, true} {
+		as := &authServer{digest: digest, nonce: "1234abcd"}
+		srv := httptest.NewServer(as)
+
+		tr := &Transport{User: testUser, Password: testPassword}
+		if status, got := do(t, tr, srv.URL+"/book.epub", strings.NewReader("replayable")); status != http.StatusOK || got != "replayable" {
+			t.Errorf("digest %t: replayable body: %d %q", digest, status, got)
+		}
+
+		tr = &Transport{User: testUser, Password: testPassword}
+		if status, got := do(t, tr, srv.URL+"/book.epub", &stream{Reader: strings.NewReader("stream")}); status != http.StatusOK || got != "stream" {
+			t.Errorf("digest %t: streamed body: %d %q", digest, status, got)
+		}
+		// the challenge is learnt once
+		if status, got := do(t, tr, srv.URL+"/book.epub", &stream{Reader: strings.NewReader("again")}); status != http.StatusOK || got != "again" {
+			t.Errorf("digest %t: second streamed body: %d %q", digest, status, got)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestTransportStaleNonce(t *testing.T) {
+	as := &authServer{digest: true, nonce: "1234abcd"}
+	srv := httptest.NewServer(as)
+	defer srv.Close()
+
+	tr := &Transport{User: testUser, Password: testPassword}
+	if status, _ := do(t, tr, srv.URL+"/a.epub", strings.NewReader("a")); status != http.StatusOK {
+		t.Fatalf("expected %d; got %d", http.StatusOK, status)
+	}
+
+	as.rotate("5678efgh")
+	before := len(as.sent())
+	if status, got := do(t, tr, srv.URL+"/b.epub", strings.NewReader("b")); status != http.StatusOK || got != "b" {
+		t.Fatalf("expected the request replayed with the new nonce; got: %d %q", status, got)
+	}
+	if n := len(as.sent()) - before; n != 2 {
+		t.Errorf("expected the stale request and its replay; got %d requests", n)
+	}
+
+	// the new nonce is kept for the following requests
+	before = len(as.sent())
+	if status, _ := do(t, tr, srv.URL+"/c.epub", strings.NewReader("c")); status != http.StatusOK {
+		t.Errorf("expected %d; got %d", http.StatusOK, status)
+	}
+	if n := len(as.sent()) - before; n != 1 {
+		t.Errorf("expected a single request; got %d", n)
+	}
+}
+
+func TestTransportClosesBody(t *testing.T) {
+	errDown := errors.New("server down")
+
+	t.Run("probe", func(t *testing.T) {
+		tr := &Transport{
+			Base: roundTripperFunc(func(*http.Request) (*http.Response, error) { return nil, errDown }),
+		}
+		body := &stream{Reader: strings.NewReader("book")}
+		req, _ := http.NewRequest(http.MethodPut, "http://books.example.com/book.epub", body)
+
+		if _, err := tr.RoundTrip(req); !errors.Is(err, errDown) {
+			t.Errorf("expected the error of the probe; got: %v", err)
+		}
+		if !body.closed {
+			t.Error("expected the body to be closed")
+		}
+	})
+
+	t.Run("challenge", func(t *testing.T) {
+		srv := httptest.NewServer(&authServer{digest: true, nonce: "1234abcd", algorithm: "SHA-256"})
+		defer srv.Close()
+
+		tr := &Transport{User: testUser, Password: testPassword}
+		body := &stream{Reader: strings.NewReader("book")}
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/book.epub", body)
+
+		if _, err := tr.RoundTrip(req); !errors.Is(err, ErrUnsupportedChallenge) {
+			t.Errorf("expected ErrUnsupportedChallenge; got: %v", err)
+		}
+		if !body.closed {
+			t.Error("expected the body to be closed")
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package uploadazure
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+const (
+	defaultBlockSize   = 4 << 20
+	defaultConcurrency = 4
+)
+
+func init() {
+	upload.RegisterStore("azure", Open)
+}
+
+// Open opens the store of an azure URL, azure://container/prefix, saving the
+// uploads as blobs under the optional prefix. The URL options configure the
+// account and the uploads:
+//
+//	account      the storage account
+//	key          the account key signing the requests
+//	sas          a shared access signature used instead of the account key
+//	service_url  the blob service, such as http://azurite:10000/devstoreaccount1
+//	block_size   the size of the blocks staged in parallel, 4MB when not set
+//	concurrency  the blocks staged at once, 4 when not set
+func Open(_ context.Context, log *zap.SugaredLogger, u *url.URL) (upload.Storer, error) {
+	if err := upload.CheckStoreOptions(u, "account", "key", "sas", "service_url", "block_size", "concurrency"); err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%w: missing container", upload.ErrStoreOption)
+	}
+	blockSize, err := upload.SizeStoreOption(u, "block_size")
+	if err != nil {
+		return nil, err
+	}
+	concurrency, err := upload.IntStoreOption(u, "concurrency")
+	if err != nil {
+		return nil, err
+	}
+
+	if blockSize == 0 {
+		blockSize = defaultBlockSize
+	}
+	if concurrency == 0 {
+		concurrency = defaultConcurrency
+	}
+
+	q := u.Query()
+	return NewStore(log, Config{
+		Account:     q.Get("account"),
+		Key:         q.Get("key"),
+		SAS:         q.Get("sas"),
+		ServiceURL:  q.Get("service_url"),
+		Container:   u.Host,
+		Prefix:      u.Path,
+		BlockSize:   blockSize,
+		Concurrency: concurrency,
+	})
+}
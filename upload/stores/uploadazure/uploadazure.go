@@ -0,0 +1,155 @@
+// Package uploadazure is an upload file store for Azure Blob Storage
+package uploadazure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+var (
+	ErrNoAccount   = errors.New("no azure storage account or service url configured")
+	ErrNoAuth      = errors.New("no azure account key or sas token configured")
+	ErrNoContainer = errors.New("no azure container configured")
+)
+
+// contentTypes are the types of the ebook formats missing from the usual MIME
+// tables.
+var contentTypes = map[string]string{
+	".epub": "application/epub+zip",
+	".mobi": "application/x-mobipocket-ebook",
+	".azw3": "application/vnd.amazon.ebook",
+	".fb2":  "application/x-fictionbook+xml",
+	".cbz":  "application/vnd.comicbook+zip",
+	".cbr":  "application/vnd.comicbook-rar",
+	".opf":  "application/oebps-package+xml",
+}
+
+// Config is the configuration of the Azure store.
+type Config struct {
+	// Account is the storage account, used to sign requests with Key and to
+	// find the service when ServiceURL is empty.
+	Account string
+	Key     string
+	// SAS is a shared access signature token used instead of the account key.
+	SAS string
+	// ServiceURL is the blob service of the account, such as
+	// http://127.0.0.1:10000/devstoreaccount1 for Azurite;
+	// https://<account>.blob.core.windows.net when empty.
+	ServiceURL string
+	Container  string
+	// Prefix is prepended to the names of the blobs.
+	Prefix string
+	// BlockSize is the size of the blocks staged in parallel, at least 1MiB;
+	// Concurrency is the number of blocks staged at once.
+	BlockSize   int64
+	Concurrency int
+
+	// options replaces the client options in tests.
+	options *azblob.ClientOptions
+}
+
+type Store struct {
+	log         *zap.SugaredLogger
+	client      *azblob.Client
+	container   string
+	prefix      string
+	blockSize   int64
+	concurrency int
+}
+
+// NewStore returns a store saving the files as block blobs of the container,
+// authenticating with the account key or the SAS token.
+func NewStore(log *zap.SugaredLogger, cfg Config) (*Store, error) {
+	if cfg.Container == "" {
+		return nil, ErrNoContainer
+	}
+	serviceURL := strings.TrimSuffix(cfg.ServiceURL, "/")
+	if serviceURL == "" {
+		if cfg.Account == "" {
+			return nil, ErrNoAccount
+		}
+		serviceURL = "https://" + cfg.Account + ".blob.core.windows.net"
+	}
+	serviceURL += "/"
+
+	var client *azblob.Client
+	var err error
+	switch {
+	case cfg.SAS != "":
+		client, err = azblob.NewClientWithNoCredential(serviceURL+"?"+strings.TrimPrefix(cfg.SAS, "?"), cfg.options)
+	case cfg.Account != "" && cfg.Key != "":
+		var cred *azblob.SharedKeyCredential
+		if cred, err = azblob.NewSharedKeyCredential(cfg.Account, cfg.Key); err != nil {
+			return nil, fmt.Errorf("azblob.NewSharedKeyCredential: %w", err)
+		}
+		client, err = azblob.NewClientWithSharedKeyCredential(serviceURL, cred, cfg.options)
+	default:
+		return nil, ErrNoAuth
+	}
+	if err != nil {
+		return nil, fmt.Errorf("azblob.NewClient: %w", err)
+	}
+
+	return &Store{
+		log:         log,
+		client:      client,
+		container:   cfg.Container,
+		prefix:      strings.Trim(cfg.Prefix, "/"),
+		blockSize:   cfg.BlockSize,
+		concurrency: cfg.Concurrency,
+	}, nil
+}
+
+// Save stages the source as the blocks of a block blob under the prefix of the
+// Store, committing them once all are staged; sources smaller than a block are
+// put in one request. The content type is found from the extension of the name
+// and any upload metadata found in the context is set as blob metadata
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	defer src.Close()
+
+	name = path.Join(s.prefix, strings.TrimPrefix(path.Clean("/"+name), "/"))
+
+	contentType := contentTypes[strings.ToLower(path.Ext(name))]
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// metadata names have to be C# identifiers and the values are sent as
+	// http headers which only allow ascii, so values are encoded as described
+	// in RFC 2047 as for S3
+	metadata := make(map[string]*string)
+	for k, v := range upload.GetMetadata(ctx).Map() {
+		value := mime.QEncoding.Encode("utf-8", v)
+		metadata[strings.ReplaceAll(k, "-", "_")] = &value
+	}
+
+	bb := s.client.ServiceClient().NewContainerClient(s.container).NewBlockBlobClient(name)
+	// the blocks are read from the source whether or not the context is done
+	_, err := bb.UploadStream(ctx, upload.ContextReader(ctx, src), &blockblob.UploadStreamOptions{
+		BlockSize:   s.blockSize,
+		Concurrency: s.concurrency,
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return fmt.Errorf("upload blob %s: %w", name, err)
+	}
+
+	s.log.Infow("saved upload to azure", "container", s.container, "blob", name, "content_type", contentType)
+	return nil
+}
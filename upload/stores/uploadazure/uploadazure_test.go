@@ -0,0 +1,362 @@
+package uploadazure
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/storetest"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+const (
+	// the well known account of the Azurite emulator
+	testAccount = "devstoreaccount1"
+	testKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	testSAS     = "sv=2021-08-06&ss=b&srt=co&sp=rwc&se=2099-01-01T00:00:00Z&sig=c2lnbmF0dXJl"
+)
+
+type blockBlob struct {
+	content     []byte
+	contentType string
+	metadata    map[string]string
+}
+
+// blobService stands in for the block blob operations of the blob service as
+// served by Azurite, with path style URLs starting with the account.
+type blobService struct {
+	t *testing.T
+
+	mu     sync.Mutex
+	blocks map[string][]byte
+	blobs  map[string]blockBlob
+	staged int
+}
+
+func newBlobService(t *testing.T) *blobService {
+	return &blobService{t: t, blocks: map[string][]byte{}, blobs: map[string]blockBlob{}}
+}
+
+func (bs *blobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !bs.authorized(r) {
+		bs.error(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+
+	name, ok := strings.CutPrefix(r.URL.Path, "/"+testAccount+"/")
+	if !ok || r.Method != http.MethodPut {
+		bs.error(w, http.StatusBadRequest, "InvalidUri")
+		return
+	}
+	container, _, _ := strings.Cut(name, "/")
+	if container != "books" {
+		bs.error(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	q := r.URL.Query()
+	switch q.Get("comp") {
+	case "block":
+		b, _ := io.ReadAll(r.Body)
+		bs.blocks[name+"#"+q.Get("blockid")] = b
+		bs.staged++
+
+	case "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			bs.error(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		blob := newBlockBlob(r)
+		for _, id := range list.Latest {
+			block, ok := bs.blocks[name+"#"+id]
+			if !ok {
+				bs.error(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			blob.content = append(blob.content, block...)
+		}
+		bs.blobs[name] = blob
+
+	case "":
+		// blobs smaller than a block are put in one request
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			bs.error(w, http.StatusBadRequest, "InvalidBlobType")
+			return
+		}
+		blob := newBlockBlob(r)
+		blob.content, _ = io.ReadAll(r.Body)
+		bs.blobs[name] = blob
+
+	default:
+		bs.error(w, http.StatusBadRequest, "UnsupportedQueryParameter")
+		return
+	}
+
+	w.Header().Set("ETag", `"0x1"`)
+	w.Header().Set("x-ms-request-compute-md5", "false")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func newBlockBlob(r *http.Request) blockBlob {
+	blob := blockBlob{contentType: r.Header.Get("x-ms-blob-content-type"), metadata: map[string]string{}}
+	for k, v := range r.Header {
+		if meta, ok := strings.CutPrefix(strings.ToLower(k), "x-ms-meta-"); ok {
+			blob.metadata[meta] = v[0]
+		}
+	}
+	return blob
+}
+
+// read returns the content of the committed blob.
+func (bs *blobService) read(name string) ([]byte, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	blob, ok := bs.blobs[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return blob.content, nil
+}
+
+func (bs *blobService) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>`+code+`</Code><Message>`+code+`</Message></Error>`)
+}
+
+// authorized checks the SAS token or the shared key signature of the request.
+func (bs *blobService) authorized(r *http.Request) bool {
+	if sig := r.URL.Query().Get("sig"); sig != "" {
+		return sig == "c2lnbmF0dXJl"
+	}
+
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "SharedKey "+testAccount+":")
+	if !ok {
+		return false
+	}
+
+	contentLength := ""
+	if r.ContentLength > 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+	var headers []string
+	for k, v := range r.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			headers = append(headers, k+":"+strings.Join(v, ","))
+		}
+	}
+	sort.Strings(headers)
+	resource := "/" + testAccount + r.URL.EscapedPath()
+	query, _ := url.ParseQuery(r.URL.RawQuery)
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(query[name], ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		r.Method,
+		r.Header.Get("Content-Encoding"),
+		r.Header.Get("Content-Language"),
+		contentLength,
+		r.Header.Get("Content-MD5"),
+		r.Header.Get("Content-Type"),
+		"",
+		r.Header.Get("If-Modified-Since"),
+		r.Header.Get("If-Match"),
+		r.Header.Get("If-None-Match"),
+		r.Header.Get("If-Unmodified-Since"),
+		r.Header.Get("Range"),
+		strings.Join(headers, "\n"),
+		resource,
+	}, "\n")
+
+	key, _ := base64.StdEncoding.DecodeString(testKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	return auth == base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// noRetries fails the tests of errors right away.
+var noRetries = &azblob.ClientOptions{ClientOptions: policy.ClientOptions{Retry: policy.RetryOptions{MaxRetries: -1}}}
+
+func TestStore(t *testing.T) {
+	bs := newBlobService(t)
+	srv := httptest.NewServer(bs)
+	defer srv.Close()
+
+	store, err := NewStore(log, Config{
+		Account:     testAccount,
+		Key:         testKey,
+		ServiceURL:  srv.URL + "/" + testAccount,
+		Container:   "books",
+		Prefix:      "/uploads/",
+		BlockSize:   1 << 20,
+		Concurrency: 2,
+		options:     noRetries,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a bit more than two blocks
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2<<20)/16+1)
+	ctx := upload.WithMetadata(context.Background(), upload.Metadata{Title: "Mort", Authors: []string{"Terry Pratchett"}, SeriesIndex: 4})
+	if err := store.Save(ctx, "Terry Pratchett/Mort.epub", io.NopCloser(bytes.NewReader(content))); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	blob, ok := bs.blobs["books/uploads/Terry Pratchett/Mort.epub"]
+	if !ok {
+		t.Fatalf("blob not committed; got: %v", bs.blobs)
+	}
+	if !bytes.Equal(blob.content, content) {
+		t.Errorf("unexpected content of %d bytes", len(blob.content))
+	}
+	if bs.staged != 3 {
+		t.Errorf("expected 3 blocks; got: %d", bs.staged)
+	}
+	if blob.contentType != "application/epub+zip" {
+		t.Errorf("unexpected content type: %q", blob.contentType)
+	}
+	want := map[string]string{"title": "Mort", "authors": "Terry Pratchett", "series_index": "4"}
+	for k, v := range want {
+		if blob.metadata[k] != v {
+			t.Errorf("metadata %s: expected %q; got: %q", k, v, blob.metadata[k])
+		}
+	}
+}
+
+func TestStoreSAS(t *testing.T) {
+	bs := newBlobService(t)
+	srv := httptest.NewServer(bs)
+	defer srv.Close()
+
+	store, err := NewStore(log, Config{
+		SAS:        "?" + testSAS,
+		ServiceURL: srv.URL + "/" + testAccount + "/",
+		Container:  "books",
+		options:    noRetries,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(context.Background(), "notes.txt", io.NopCloser(strings.NewReader("notes"))); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if blob := bs.blobs["books/notes.txt"]; string(blob.content) != "notes" || !strings.HasPrefix(blob.contentType, "text/plain") {
+		t.Errorf("unexpected blob: %+v", blob)
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	srv := httptest.NewServer(newBlobService(t))
+	defer srv.Close()
+
+	store, err := NewStore(log, Config{
+		Account:    testAccount,
+		Key:        base64.StdEncoding.EncodeToString([]byte("wrong")),
+		ServiceURL: srv.URL + "/" + testAccount,
+		Container:  "books",
+		options:    noRetries,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(context.Background(), "book.epub", io.NopCloser(strings.NewReader("epub"))); err == nil || !strings.Contains(err.Error(), "AuthenticationFailed") {
+		t.Errorf("expected an authentication error; got: %v", err)
+	}
+
+	if _, err := NewStore(log, Config{Account: testAccount, Container: "books"}); !errors.Is(err, ErrNoAuth) {
+		t.Errorf("expected ErrNoAuth; got: %v", err)
+	}
+	if _, err := NewStore(log, Config{Key: testKey, Container: "books"}); !errors.Is(err, ErrNoAccount) {
+		t.Errorf("expected ErrNoAccount; got: %v", err)
+	}
+	if _, err := NewStore(log, Config{Account: testAccount, Key: testKey}); !errors.Is(err, ErrNoContainer) {
+		t.Errorf("expected ErrNoContainer; got: %v", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Harness {
+		bs := newBlobService(t)
+		srv := httptest.NewServer(bs)
+		t.Cleanup(srv.Close)
+
+		store, err := NewStore(log, Config{
+			Account:    testAccount,
+			Key:        testKey,
+			ServiceURL: srv.URL + "/" + testAccount,
+			Container:  "books",
+			BlockSize:  1 << 20,
+			options:    noRetries,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		read := func(name string) ([]byte, error) { return bs.read("books/" + name) }
+		return storetest.Harness{Store: store, Read: read}
+	}, storetest.Options{Atomic: true, LargeSize: 4 << 20})
+}
+
+func TestOpen(t *testing.T) {
+	store, err := upload.OpenStore(context.Background(), log, "azure://books/library/new/?account="+testAccount+"&key="+url.QueryEscape(testKey)+"&block_size=1MB&concurrency=2")
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	if s := store.(*Store); s.container != "books" || s.prefix != "library/new" || s.blockSize != 1<<20 || s.concurrency != 2 {
+		t.Errorf("unexpected store: container %q prefix %q block size %d concurrency %d", s.container, s.prefix, s.blockSize, s.concurrency)
+	}
+
+	for _, u := range []string{
+		"azure:///prefix?account=" + testAccount + "&key=" + url.QueryEscape(testKey),
+		"azure://books?account=" + testAccount,
+		"azure://books?sas=x&block_size=big",
+		"azure://books?sas=x&concurrency=two",
+		"azure://books?acount=" + testAccount,
+	} {
+		if _, err := upload.OpenStore(context.Background(), log, u); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
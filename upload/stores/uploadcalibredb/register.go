@@ -0,0 +1,61 @@
+package uploadcalibredb
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+// defaultTimeout bounds the runs of calibredb when the URL does not say.
+const defaultTimeout = 5 * time.Minute
+
+func init() {
+	upload.RegisterStore("calibredb", Open)
+}
+
+// Open opens the store of a calibredb URL, calibredb:/srv/library for a local
+// library or calibredb:http://calibre:8080/#library_id for one served by a
+// content server, adding the uploads to the library with the calibredb tool.
+// The URL options configure the tool:
+//
+//	command     the calibredb command, calibredb when not set
+//	arg         an extra argument of calibredb add, repeated for each argument
+//	duplicates  the books already in the library (refuse|add|overwrite|ignore)
+//	timeout     the timeout of a single run, 5m when not set
+func Open(_ context.Context, log *zap.SugaredLogger, u *url.URL) (upload.Storer, error) {
+	if err := upload.CheckStoreOptions(u, "command", "arg", "duplicates", "timeout"); err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	duplicates, err := ParseDuplicates(q.Get("duplicates"))
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := upload.DurationStoreOption(u, "timeout")
+	if err != nil {
+		return nil, err
+	}
+	if !q.Has("timeout") {
+		timeout = defaultTimeout
+	}
+
+	library := u.Path
+	if u.Opaque != "" {
+		library = u.Opaque
+	}
+	if u.Fragment != "" {
+		library += "#" + u.Fragment
+	}
+
+	return NewStore(log, Config{
+		Command:    q.Get("command"),
+		Args:       q["arg"],
+		Library:    library,
+		Duplicates: duplicates,
+		Timeout:    timeout,
+	})
+}
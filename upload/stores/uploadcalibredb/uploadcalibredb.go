@@ -0,0 +1,269 @@
+// Package uploadcalibredb is an upload store adding books to a Calibre library
+// with the calibredb command line tool
+package uploadcalibredb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+const (
+	// StoreName is the store reported with the locations of the added books.
+	StoreName = "calibredb"
+
+	// CodeDuplicate is the code of the rejections of the books the library
+	// already holds.
+	CodeDuplicate = "DUPLICATE"
+)
+
+// Duplicates is the policy for books the library already holds.
+type Duplicates string
+
+const (
+	// Refuse leaves the library unchanged, the upload is rejected.
+	Refuse Duplicates = ""
+	// Add adds the book again as a new record.
+	Add Duplicates = "add"
+	// Overwrite merges the upload into the existing book, replacing the
+	// formats the book already has.
+	Overwrite Duplicates = "overwrite"
+	// Ignore merges the upload into the existing book, only adding the
+	// formats the book does not have yet.
+	Ignore Duplicates = "ignore"
+)
+
+var (
+	ErrNoCommand         = errors.New("no calibredb command configured")
+	ErrNoLibrary         = errors.New("no calibre library configured")
+	ErrInvalidDuplicates = errors.New("invalid duplicates policy")
+	ErrDuplicate         = errors.New("book already in the library")
+	ErrNotAdded          = errors.New("calibredb added no book")
+	ErrTimeout           = errors.New("calibredb timed out")
+
+	// calibredb add reports the books it added or merged on stdout
+	reBookIDs = regexp.MustCompile(`(?m)^(?:Added|Merged) book ids: ([0-9, ]+)$`)
+)
+
+// ParseDuplicates parses a duplicates policy as found in the configuration.
+// "refuse" and an empty string both refuse duplicates.
+func ParseDuplicates(s string) (Duplicates, error) {
+	switch Duplicates(s) {
+	case Refuse, "refuse":
+		return Refuse, nil
+	case Add, Overwrite, Ignore:
+		return Duplicates(s), nil
+	}
+	return Refuse, fmt.Errorf("%w: %q", ErrInvalidDuplicates, s)
+}
+
+// Config configures a Store. The command is invoked as
+// `Command add --library-path Library [options] Args... file`.
+type Config struct {
+	// Command is calibredb when empty.
+	Command string
+	Args    []string
+
+	// Library is the path of the library, or the URL of a content server
+	// such as http://calibre:8080/#library_id.
+	Library    string
+	Duplicates Duplicates
+
+	// Timeout bounds a single run of the command.
+	Timeout time.Duration
+}
+
+type Store struct {
+	log *zap.SugaredLogger
+	cfg Config
+
+	// calibredb does not support concurrent writes to a local library
+	mu sync.Mutex
+}
+
+func NewStore(log *zap.SugaredLogger, cfg Config) (*Store, error) {
+	if cfg.Command == "" {
+		cfg.Command = "calibredb"
+	}
+	if _, err := exec.LookPath(cfg.Command); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoCommand, err)
+	}
+	if cfg.Library == "" {
+		return nil, ErrNoLibrary
+	}
+	return &Store{log: log, cfg: cfg}, nil
+}
+
+// Save spools the source to a temporary file named after the upload and adds
+// it to the library, overriding the metadata calibredb reads from the file
+// with the metadata of the upload. The IDs of the added books are reported as
+// the locations of the upload. OPF sidecars are skipped since they are not
+// books, their source is still read to the end for the stores sharing it.
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	defer src.Close()
+
+	if strings.EqualFold(path.Ext(name), ".opf") {
+		_, err := io.Copy(io.Discard, src)
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "upload-calibredb-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// calibredb reads the title from the file name when the book has none
+	base := path.Base(name)
+	if base == "." || base == ".." || base == "/" {
+		base = "upload"
+	}
+	file := filepath.Join(dir, base)
+	if err := writeFile(file, src); err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+
+	ids, err := s.add(ctx, file, upload.GetMetadata(ctx))
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		upload.ReportLocation(ctx, upload.Location{Store: StoreName, ID: id})
+	}
+	s.log.Infow("added book with calibredb", "filename", name, "book_ids", ids, "library", s.cfg.Library)
+
+	return nil
+}
+
+// add runs calibredb add on the file and returns the IDs of the books added
+// or merged.
+func (s *Store) add(ctx context.Context, file string, md upload.Metadata) ([]string, error) {
+	if s.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.Timeout)
+		defer cancel()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cmd := exec.CommandContext(ctx, s.cfg.Command, s.args(file, md)...)
+	cmd.WaitDelay = 5 * time.Second
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &limitedBuffer{buf: &stdout, max: 4 << 10}
+	cmd.Stderr = &limitedBuffer{buf: &stderr, max: 4 << 10}
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, ErrTimeout
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", s.cfg.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	ids := parseBookIDs(stdout.String())
+	if len(ids) == 0 {
+		msg := strings.TrimSpace(stderr.String() + "\n" + stdout.String())
+		if strings.Contains(msg, "already exist") {
+			return nil, upload.RejectErr(CodeDuplicate, ErrDuplicate)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNotAdded, msg)
+	}
+	return ids, nil
+}
+
+// args returns the arguments of calibredb add for the file.
+func (s *Store) args(file string, md upload.Metadata) []string {
+	args := []string{"add", "--library-path", s.cfg.Library}
+
+	switch s.cfg.Duplicates {
+	case Add:
+		args = append(args, "--duplicates")
+	case Overwrite, Ignore:
+		args = append(args, "--automerge", string(s.cfg.Duplicates))
+	}
+
+	if md.Title != "" {
+		args = append(args, "--title", md.Title)
+	}
+	if len(md.Authors) > 0 {
+		args = append(args, "--authors", strings.Join(md.Authors, " & "))
+	}
+	if md.Series != "" {
+		args = append(args, "--series", md.Series)
+		if md.SeriesIndex > 0 {
+			args = append(args, "--series-index", strconv.FormatFloat(md.SeriesIndex, 'f', -1, 64))
+		}
+	}
+	if len(md.Tags) > 0 {
+		args = append(args, "--tags", strings.Join(md.Tags, ","))
+	}
+	if md.Language != "" {
+		args = append(args, "--languages", md.Language)
+	}
+	if md.ISBN != "" {
+		args = append(args, "--isbn", md.ISBN)
+	}
+
+	// the file is an absolute path, never mistaken for an option
+	args = append(args, s.cfg.Args...)
+	return append(args, file)
+}
+
+// parseBookIDs returns the IDs calibredb reported adding or merging.
+func parseBookIDs(out string) []string {
+	var ids []string
+	for _, m := range reBookIDs.FindAllStringSubmatch(out, -1) {
+		for _, id := range strings.Split(m[1], ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+func writeFile(name string, src io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// limitedBuffer keeps the first max bytes written to it, discarding the rest.
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if n := lb.max - lb.buf.Len(); n > 0 {
+		lb.buf.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
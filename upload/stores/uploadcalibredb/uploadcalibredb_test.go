@@ -0,0 +1,184 @@
+//go:build unix
+
+package uploadcalibredb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+// stub writes a script standing in for calibredb.
+func stub(t *testing.T, body string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "calibredb")
+	if err := os.WriteFile(p, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	return p
+}
+
+func TestStore(t *testing.T) {
+	// records the arguments and the content of the added file
+	record := filepath.Join(t.TempDir(), "record")
+	cmd := stub(t, `for a in "$@"; do echo "$a"; done > `+record+`
+for a in "$@"; do f="$a"; done
+cat "$f" >> `+record+`
+echo "Added book ids: 7"`)
+
+	store, err := NewStore(log, Config{
+		Command:    cmd,
+		Args:       []string{"--dont-notify-gui"},
+		Library:    "/books",
+		Duplicates: Overwrite,
+	})
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	core := upload.NewCore(log, store)
+
+	md := upload.Metadata{
+		Title:       "Guards! Guards!",
+		Authors:     []string{"Terry Pratchett", "Anonymous"},
+		Series:      "Discworld",
+		SeriesIndex: 8,
+		Tags:        []string{"fantasy", "humour"},
+		Language:    "en",
+	}
+	res, err := core.Save(context.Background(), "Terry Pratchett/guards.epub", io.NopCloser(strings.NewReader("epub")), md)
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if want := (upload.Location{Store: StoreName, ID: "7"}); len(res.Locations) != 1 || res.Locations[0] != want {
+		t.Errorf("expected: %+v; got: %+v", want, res.Locations)
+	}
+
+	data, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := []string{
+		"add", "--library-path", "/books", "--automerge", "overwrite",
+		"--title", "Guards! Guards!", "--authors", "Terry Pratchett & Anonymous",
+		"--series", "Discworld", "--series-index", "8", "--tags", "fantasy,humour",
+		"--languages", "en", "--dont-notify-gui",
+	}
+	if len(lines) != len(want)+2 {
+		t.Fatalf("unexpected arguments: %q", lines)
+	}
+	for i, w := range want {
+		if lines[i] != w {
+			t.Errorf("argument %d: expected: %q; got: %q", i, w, lines[i])
+		}
+	}
+	if file := lines[len(want)]; filepath.Base(file) != "guards.epub" || !filepath.IsAbs(file) {
+		t.Errorf("unexpected file: %q", file)
+	}
+	if content := lines[len(want)+1]; content != "epub" {
+		t.Errorf("unexpected content: %q", content)
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  error
+	}{
+		{"duplicate", `echo "The following books were not added as they already exist in the database (see --duplicates option or --automerge option):" >&2`, ErrDuplicate},
+		{"nothing added", `echo "nothing to see"`, ErrNotAdded},
+		{"failure", `echo "no library" >&2; exit 1`, nil},
+		{"timeout", `exec sleep 5`, ErrTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewStore(log, Config{Command: stub(t, tt.body), Library: "/books", Timeout: 200 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("NewStore: %v", err)
+			}
+
+			err = store.Save(context.Background(), "book.epub", io.NopCloser(strings.NewReader("epub")))
+			switch {
+			case err == nil:
+				t.Fatalf("expected an error")
+			case tt.err != nil && !errors.Is(err, tt.err):
+				t.Errorf("expected: %v; got: %v", tt.err, err)
+			case upload.IsRejected(err) != (tt.err == ErrDuplicate):
+				t.Errorf("expected only duplicates to be rejected; got: %v", err)
+			case tt.err == nil && !strings.Contains(err.Error(), "no library"):
+				t.Errorf("expected the output of the command; got: %v", err)
+			}
+		})
+	}
+
+	if _, err := NewStore(log, Config{Command: stub(t, ""), Library: ""}); !errors.Is(err, ErrNoLibrary) {
+		t.Errorf("expected ErrNoLibrary; got: %v", err)
+	}
+	if _, err := ParseDuplicates("maybe"); !errors.Is(err, ErrInvalidDuplicates) {
+		t.Errorf("expected ErrInvalidDuplicates; got: %v", err)
+	}
+}
+
+func TestParseBookIDs(t *testing.T) {
+	out := "Added book ids: 3, 4\nMerged book ids: 1\n"
+	if got := strings.Join(parseBookIDs(out), " "); got != "3 4 1" {
+		t.Errorf("expected: 3 4 1; got: %q", got)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	cmd := stub(t, "")
+
+	tests := []struct {
+		url     string
+		library string
+	}{
+		{url: "calibredb:/srv/books?%s", library: "/srv/books"},
+		{url: "calibredb:http://calibre:8080/?%s#books", library: "http://calibre:8080/#books"},
+	}
+	for _, tt := range tests {
+		query := "command=" + url.QueryEscape(cmd) + "&arg=--automerge&arg=new_record&duplicates=add&timeout=1m"
+		store, err := upload.OpenStore(context.Background(), log, fmt.Sprintf(tt.url, query))
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		cfg := store.(*Store).cfg
+		if cfg.Library != tt.library || cfg.Command != cmd || strings.Join(cfg.Args, " ") != "--automerge new_record" || cfg.Duplicates != Add || cfg.Timeout != time.Minute {
+			t.Errorf("%s: unexpected config: %+v", tt.url, cfg)
+		}
+	}
+
+	for _, u := range []string{
+		"calibredb:/srv/books?command=" + url.QueryEscape(cmd) + "&duplicates=merge",
+		"calibredb:/srv/books?command=" + url.QueryEscape(cmd) + "&timeout=1",
+		"calibredb:/srv/books?cmd=calibredb",
+	} {
+		if _, err := upload.OpenStore(context.Background(), log, u); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Package uploadfault is an upload store wrapping another one with faults
+// injected on a schedule: latency, errors in the middle of the source, short
+// writes and hangs. It makes the failures of remote stores reproducible in the
+// tests of handlers and store compositions
+package uploadfault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+var (
+	// ErrInjected is the error of the faults without an error of their own.
+	ErrInjected = errors.New("injected fault")
+)
+
+// Fault is what happens to a save. Latency and Hang apply before the wrapped
+// store is called; the zero Fault passes the save through.
+type Fault struct {
+	// Latency delays the save, as a slow connection would.
+	Latency time.Duration
+	// Hang blocks the save until its context is done.
+	Hang bool
+	// Err fails the save. With ErrAfter set the source returns Err once
+	// ErrAfter bytes were read, otherwise the save fails before calling the
+	// wrapped store. ErrInjected when not set and ErrAfter is.
+	Err      error
+	ErrAfter int64
+	// ShortWrite gives the wrapped store the first ShortWrite bytes of the
+	// source only, failing the save with io.ErrShortWrite once it returns.
+	ShortWrite int64
+}
+
+// IsZero reports whether the fault is the zero Fault, passing the save
+// through. The fields are compared one by one as the error may not be
+// comparable.
+func (f Fault) IsZero() bool {
+	return f.Latency == 0 && !f.Hang && f.Err == nil && f.ErrAfter == 0 && f.ShortWrite == 0
+}
+
+// Schedule returns the fault of the n-th save, counting from 0, of the name.
+type Schedule func(n int, name string) Fault
+
+// Sequence injects the faults in turn, the n-th save getting the n-th fault,
+// and passes the saves after the last one through.
+func Sequence(faults ...Fault) Schedule {
+	return func(n int, _ string) Fault {
+		if n < len(faults) {
+			return faults[n]
+		}
+		return Fault{}
+	}
+}
+
+// Cycle injects the faults in turn, starting over after the last one.
+func Cycle(faults ...Fault) Schedule {
+	return func(n int, _ string) Fault {
+		if len(faults) == 0 {
+			return Fault{}
+		}
+		return faults[n%len(faults)]
+	}
+}
+
+// Always injects the fault into every save.
+func Always(f Fault) Schedule {
+	return func(int, string) Fault { return f }
+}
+
+// Match injects the fault into the saves of names matching the pattern, as
+// used by path.Match.
+func Match(pattern string, f Fault) Schedule {
+	return func(_ int, name string) Fault {
+		if ok, _ := path.Match(pattern, name); ok {
+			return f
+		}
+		return Fault{}
+	}
+}
+
+// Call is a save through the Store and the fault it got.
+type Call struct {
+	Name  string
+	Fault Fault
+	Err   error
+}
+
+type Store struct {
+	log      *zap.SugaredLogger
+	store    upload.Storer
+	schedule Schedule
+
+	mu    sync.Mutex
+	n     int
+	calls []Call
+}
+
+// NewStore returns a store injecting the faults of the schedule into the saves
+// of the wrapped store.
+func NewStore(log *zap.SugaredLogger, store upload.Storer, schedule Schedule) *Store {
+	return &Store{log: log, store: store, schedule: schedule}
+}
+
+// Save saves the source to the wrapped store with the next fault of the
+// schedule. The source file is closed upon return, even when the wrapped
+// store is not called, so that writers of pipes are not left blocked
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	defer src.Close()
+
+	s.mu.Lock()
+	f := s.schedule(s.n, name)
+	s.n++
+	s.mu.Unlock()
+
+	err := s.save(ctx, name, src, f)
+
+	s.mu.Lock()
+	s.calls = append(s.calls, Call{Name: name, Fault: f, Err: err})
+	s.mu.Unlock()
+
+	if !f.IsZero() {
+		s.log.Debugw("injected fault", "filename", name, "fault", fmt.Sprintf("%+v", f), "error", err)
+	}
+	return err
+}
+
+func (s *Store) save(ctx context.Context, name string, src io.ReadCloser, f Fault) error {
+	if f.Latency > 0 {
+		t := time.NewTimer(f.Latency)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+	if f.Hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	if f.Err != nil && f.ErrAfter <= 0 {
+		return f.Err
+	}
+	if f.ErrAfter > 0 {
+		err := f.Err
+		if err == nil {
+			err = ErrInjected
+		}
+		src = &failingReader{ReadCloser: src, n: f.ErrAfter, err: err}
+	}
+
+	if f.ShortWrite > 0 {
+		if err := s.store.Save(ctx, name, readCloser{io.LimitReader(src, f.ShortWrite), src}); err != nil {
+			return err
+		}
+		return fmt.Errorf("save %s: %w", name, io.ErrShortWrite)
+	}
+	return s.store.Save(ctx, name, src)
+}
+
+// Calls returns the saves through the Store, in the order they completed.
+func (s *Store) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// =============================================================================
+
+// failingReader returns err once n bytes were read.
+type failingReader struct {
+	io.ReadCloser
+	n   int64
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, r.err
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
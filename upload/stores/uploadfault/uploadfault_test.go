@@ -0,0 +1,128 @@
+package uploadfault
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload/stores/uploadmem"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadmulti"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+func source(s string) io.ReadCloser {
+	return io.NopCloser(strings.NewReader(s))
+}
+
+func TestStore(t *testing.T) {
+	errDisk := errors.New("disk full")
+	mem := uploadmem.NewStore(log)
+	s := NewStore(log, mem, Sequence(
+		Fault{},
+		Fault{Err: errDisk},
+		Fault{ErrAfter: 3},
+		Fault{ShortWrite: 2},
+		Fault{Latency: 20 * time.Millisecond},
+	))
+
+	tests := []struct {
+		name string
+		err  error
+		kept string
+	}{
+		{name: "ok.epub", kept: "content"},
+		{name: "err.epub", err: errDisk},
+		{name: "mid.epub", err: ErrInjected},
+		{name: "short.epub", err: io.ErrShortWrite, kept: "co"},
+		{name: "slow.epub", kept: "content"},
+		{name: "after.epub", kept: "content"},
+	}
+	for _, tt := range tests {
+		t0 := time.Now()
+		err := s.Save(context.Background(), tt.name, source("content"))
+		if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+			t.Errorf("%s: expected %v; got: %v", tt.name, tt.err, err)
+		}
+		f, ok := mem.Get(tt.name)
+		if ok != (tt.kept != "") || string(f.Data) != tt.kept {
+			t.Errorf("%s: expected %q to be kept; got: %q", tt.name, tt.kept, f.Data)
+		}
+		if tt.name == "slow.epub" && time.Since(t0) < 20*time.Millisecond {
+			t.Errorf("%s: expected latency; got: %s", tt.name, time.Since(t0))
+		}
+	}
+
+	if calls := s.Calls(); len(calls) != len(tests) || calls[1].Fault.Err != errDisk || !errors.Is(calls[2].Err, ErrInjected) {
+		t.Errorf("unexpected calls: %+v", calls)
+	}
+}
+
+// errList is an error which cannot be compared with ==.
+type errList []error
+
+func (e errList) Error() string { return errors.Join(e...).Error() }
+
+func TestStoreUncomparableError(t *testing.T) {
+	errs := errList{errors.New("disk full"), errors.New("quota exceeded")}
+	s := NewStore(log, uploadmem.NewStore(log), Always(Fault{Err: errs}))
+
+	if err := s.Save(context.Background(), "book.epub", source("content")); err == nil || err.Error() != errs.Error() {
+		t.Errorf("expected %v; got: %v", errs, err)
+	}
+	if (Fault{Err: errs}).IsZero() || !(Fault{}).IsZero() {
+		t.Error("IsZero reports the wrong faults")
+	}
+}
+
+func TestStoreHang(t *testing.T) {
+	s := NewStore(log, uploadmem.NewStore(log), Match("*.pdf", Fault{Hang: true}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Save(ctx, "book.pdf", source("pdf")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the save to hang until the deadline; got: %v", err)
+	}
+	if err := s.Save(context.Background(), "book.epub", source("epub")); err != nil {
+		t.Errorf("expected other names to pass; got: %v", err)
+	}
+}
+
+func TestStoreMulti(t *testing.T) {
+	// stores failing without reading the source must not block the others
+	mem := uploadmem.NewStore(log)
+	multi, err := uploadmulti.NewStore(log, mem, NewStore(log, uploadmem.NewStore(log), Cycle(Fault{}, Fault{Err: ErrInjected})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		multi.Save(context.Background(), "first.epub", source(strings.Repeat("x", 1<<20)))
+		done <- multi.Save(context.Background(), "second.epub", source(strings.Repeat("x", 1<<20)))
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrInjected) {
+			t.Errorf("expected ErrInjected; got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("multi store blocked by a failing store")
+	}
+	if _, ok := mem.Get("first.epub"); !ok {
+		t.Error("expected the first save to reach the other store")
+	}
+}
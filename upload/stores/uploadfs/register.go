@@ -0,0 +1,49 @@
+package uploadfs
+
+import (
+	"context"
+	"net/url"
+	"path"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+func init() {
+	upload.RegisterStore("file", Open)
+}
+
+// Open opens the store of a file URL, file:///srv/uploads for an absolute
+// directory or file://./uploads for one relative to the working directory.
+// The atomic option, as in file:///srv/uploads?atomic=1, saves through
+// temporary files as WithAtomic.
+func Open(_ context.Context, log *zap.SugaredLogger, u *url.URL) (upload.Storer, error) {
+	if err := upload.CheckStoreOptions(u, "atomic"); err != nil {
+		return nil, err
+	}
+	atomic, err := upload.BoolStoreOption(u, "atomic")
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []Option
+	if atomic {
+		opts = append(opts, WithAtomic())
+	}
+	return NewStore(log, dirFromURL(u), opts...)
+}
+
+// dirFromURL returns the directory of the URL, reading the host of file://./x
+// and file://../x as the start of a relative path.
+func dirFromURL(u *url.URL) string {
+	switch {
+	case u.Opaque != "":
+		return u.Opaque
+	case u.Host == "" || u.Host == "localhost":
+		return u.Path
+	case u.Host == "." || u.Host == "..":
+		return path.Join(u.Host, u.Path)
+	}
+	return "//" + u.Host + u.Path
+}
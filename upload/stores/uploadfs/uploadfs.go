@@ -2,28 +2,46 @@
 package uploadfs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/inhies/go-bytesize"
 	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
 )
 
 var (
 	ErrInvalidDirectory = errors.New("invalid directory")
 	ErrNotWritable      = errors.New("cannot write to directory")
+	ErrInvalidName      = errors.New("name escapes the upload directory")
 )
 
 type Store struct {
-	log *zap.SugaredLogger
-	dir string
+	log    *zap.SugaredLogger
+	dir    string
+	atomic bool
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithAtomic writes uploads to a temporary file next to their name which is
+// renamed once complete, so that readers of the directory never see partial
+// files and failed saves leave nothing behind.
+func WithAtomic() Option {
+	return func(s *Store) {
+		s.atomic = true
+	}
 }
 
-func NewStore(log *zap.SugaredLogger, dir string) (*Store, error) {
+func NewStore(log *zap.SugaredLogger, dir string, opts ...Option) (*Store, error) {
 	fi, err := os.Stat(dir)
 	if err != nil {
 		return nil, fmt.Errorf("os.Stat: %w", err)
@@ -37,31 +55,93 @@ func NewStore(log *zap.SugaredLogger, dir string) (*Store, error) {
 		return nil, ErrNotWritable
 	}
 
-	return &Store{log: log, dir: dir}, nil
+	s := &Store{log: log, dir: dir}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
 }
 
 // Save copies the source reader contents to a new file on the system using the
 // directory within the Store and the name provided in the function as the full
-// path. The source file is closed upon return
-func (s *Store) Save(name string, src io.ReadCloser) error {
-	// defer src.Close()
+// path. Names containing slashes are saved into sub directories which are
+// created as needed. The source file is closed upon return
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	defer src.Close()
 
-	fn := filepath.Join(s.dir, name)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	dst, err := os.OpenFile(fn, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
-	if err != nil {
-		return fmt.Errorf("create file: %w", err)
+	fn := filepath.Join(s.dir, filepath.FromSlash(name))
+	if rel, err := filepath.Rel(s.dir, fn); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ErrInvalidName
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
 	}
-	defer dst.Close()
 
 	// used for debugging and time taken to copy to disk
 	t := time.Now()
 
-	n, err := io.Copy(dst, src)
+	var n int64
+	var err error
+	if s.atomic {
+		n, err = s.saveAtomic(ctx, fn, src)
+	} else {
+		n, err = s.save(ctx, fn, src)
+	}
 	if err != nil {
-		return fmt.Errorf("io.Copy: %w", err)
+		return err
 	}
 	s.log.Infow("copied file to disk", "bytes", bytesize.ByteSize(n).String(), "filename", fn, "since", time.Since(t))
 
 	return nil
 }
+
+func (s *Store) save(ctx context.Context, fn string, src io.Reader) (int64, error) {
+	dst, err := os.OpenFile(fn, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("create file: %w", err)
+	}
+	defer dst.Close()
+
+	n, err := io.Copy(dst, upload.ContextReader(ctx, src))
+	if err != nil {
+		return n, fmt.Errorf("io.Copy: %w", err)
+	}
+	return n, nil
+}
+
+// saveAtomic writes the source to a hidden temporary file in the directory of
+// the name, renaming it over the name once written and synced.
+func (s *Store) saveAtomic(ctx context.Context, fn string, src io.Reader) (int64, error) {
+	dst, err := os.CreateTemp(filepath.Dir(fn), ".upload-*.part")
+	if err != nil {
+		return 0, fmt.Errorf("create file: %w", err)
+	}
+	tmp := dst.Name()
+
+	n, err := io.Copy(dst, upload.ContextReader(ctx, src))
+	if err != nil {
+		err = fmt.Errorf("io.Copy: %w", err)
+	} else if err = dst.Sync(); err != nil {
+		err = fmt.Errorf("sync file: %w", err)
+	} else if err = dst.Chmod(0644); err != nil {
+		err = fmt.Errorf("chmod file: %w", err)
+	}
+	if cerr := dst.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("close file: %w", cerr)
+	}
+	if err == nil {
+		if err = os.Rename(tmp, fn); err != nil {
+			err = fmt.Errorf("rename file: %w", err)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return n, err
+	}
+	return n, nil
+}
@@ -0,0 +1,85 @@
+package uploadfs
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/storetest"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Harness {
+		dir := t.TempDir()
+		store, err := NewStore(log, dir)
+		if err != nil {
+			t.Fatalf("NewStore: %v", err)
+		}
+		return storetest.Harness{Store: store, Read: storetest.ReadDir(dir)}
+	}, storetest.Options{})
+}
+
+func TestConformanceAtomic(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Harness {
+		dir := t.TempDir()
+		store, err := NewStore(log, dir, WithAtomic())
+		if err != nil {
+			t.Fatalf("NewStore: %v", err)
+		}
+		return storetest.Harness{Store: store, Read: storetest.ReadDir(dir)}
+	}, storetest.Options{Atomic: true})
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		url    string
+		atomic bool
+		err    bool
+	}{
+		{url: "file://" + filepath.ToSlash(dir)},
+		{url: "file://" + filepath.ToSlash(dir) + "?atomic=1", atomic: true},
+		{url: "file://" + filepath.ToSlash(dir) + "?atomic", atomic: true},
+		{url: "file://" + filepath.ToSlash(dir) + "?atomic=0"},
+		{url: dir},
+		{url: "file://" + filepath.ToSlash(dir) + "?atomic=maybe", err: true},
+		{url: "file://" + filepath.ToSlash(dir) + "?atomc=1", err: true},
+		{url: "file://" + filepath.ToSlash(dir) + "/missing", err: true},
+	}
+	for _, tt := range tests {
+		store, err := upload.OpenStore(context.Background(), log, tt.url)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if s := store.(*Store); s.dir != dir || s.atomic != tt.atomic {
+			t.Errorf("%s: expected %s atomic %t; got %s atomic %t", tt.url, dir, tt.atomic, s.dir, s.atomic)
+		}
+	}
+
+	// file://./x is relative to the working directory
+	u, _ := url.Parse("file://./uploads/books")
+	if got := dirFromURL(u); got != "uploads/books" {
+		t.Errorf("expected uploads/books; got %s", got)
+	}
+}
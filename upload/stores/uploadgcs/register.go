@@ -0,0 +1,49 @@
+package uploadgcs
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+func init() {
+	upload.RegisterStore("gs", Open)
+}
+
+// Open opens the store of a gs URL, gs://bucket/prefix, saving the uploads
+// under the optional prefix. Credentials come from the application default
+// credentials, and the endpoint option points the client at an emulator or a
+// private endpoint.
+func Open(ctx context.Context, log *zap.SugaredLogger, u *url.URL) (upload.Storer, error) {
+	if err := upload.CheckStoreOptions(u, "endpoint"); err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%w: missing bucket", upload.ErrStoreOption)
+	}
+
+	var opts []option.ClientOption
+	if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewStoreFromClient(log, u.Host, client)
+	if err != nil {
+		return nil, err
+	}
+	if prefix := strings.Trim(u.Path, "/"); prefix != "" {
+		s.prefix = prefix + "/"
+	}
+	return s, nil
+}
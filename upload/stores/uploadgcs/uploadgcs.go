@@ -8,12 +8,15 @@ import (
 
 	"cloud.google.com/go/storage"
 	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
 )
 
 type Store struct {
 	log    *zap.SugaredLogger
 	client *storage.Client
 	bucket string
+	prefix string
 }
 
 func NewStore(log *zap.SugaredLogger, bucket string) (*Store, error) {
@@ -21,7 +24,10 @@ func NewStore(log *zap.SugaredLogger, bucket string) (*Store, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewStoreFromClient(log, bucket, client)
+}
 
+func NewStoreFromClient(log *zap.SugaredLogger, bucket string, client *storage.Client) (*Store, error) {
 	s := &Store{
 		log:    log,
 		client: client,
@@ -31,15 +37,29 @@ func NewStore(log *zap.SugaredLogger, bucket string) (*Store, error) {
 }
 
 // Save copies the source reader contents to a new file in the bucket defined
-// within the Store and the name provided in the function as the full path
-func (s *Store) Save(name string, src io.ReadCloser) error {
-	ctx := context.Background()
+// within the Store and the name provided in the function, after the prefix of
+// the store, as the full path. Any upload metadata found in the context is set
+// as object metadata. The object is only created once the whole source was
+// written, and the source file is closed upon return
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	defer src.Close()
+
+	// cancelling the writer aborts the upload instead of creating an object
+	// with the part of the source read so far
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	bkt := s.client.Bucket(s.bucket)
-	obj := bkt.Object(name)
+	obj := bkt.Object(s.prefix + name)
 	dst := obj.NewWriter(ctx)
-	defer dst.Close()
+	dst.Metadata = upload.GetMetadata(ctx).Map()
 	if _, err := io.Copy(dst, src); err != nil {
+		cancel()
+		dst.Close()
 		return fmt.Errorf("io.Copy: %w", err)
 	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("close object: %w", err)
+	}
 	return nil
 }
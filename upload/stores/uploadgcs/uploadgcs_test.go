@@ -0,0 +1,209 @@
+package uploadgcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/storetest"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+// fakeGCS stands in for the multipart and resumable uploads of the JSON API,
+// keeping the objects whose content arrived whole.
+type fakeGCS struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	sessions map[string]*session
+	url      string
+}
+
+type session struct {
+	name string
+	data []byte
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/upload/storage/v1/b/books/o" {
+		http.Error(w, "unexpected request", http.StatusNotFound)
+		return
+	}
+
+	switch q := r.URL.Query(); {
+	case q.Get("upload_id") != "":
+		f.resume(w, r, q.Get("upload_id"))
+	case r.Method == http.MethodPost && q.Get("uploadType") == "multipart":
+		f.multipart(w, r)
+	case r.Method == http.MethodPost && q.Get("uploadType") == "resumable":
+		var obj struct{ Name string }
+		if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		id := strconv.Itoa(len(f.sessions) + 1)
+		f.sessions[id] = &session{name: obj.Name}
+		f.mu.Unlock()
+		w.Header().Set("Location", f.url+r.URL.Path+"?uploadType=resumable&upload_id="+id)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeGCS) multipart(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	var obj struct{ Name string }
+	part, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&obj)
+	}
+	if err == nil {
+		part, err = mr.NextPart()
+	}
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(part)
+	}
+	if err == nil {
+		_, err = mr.NextPart()
+	}
+	if err != io.EOF {
+		http.Error(w, fmt.Sprintf("multipart: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.objects[obj.Name] = data
+	f.mu.Unlock()
+	f.respond(w, obj.Name, len(data))
+}
+
+// resume appends a chunk to the session, creating the object with the last.
+func (f *fakeGCS) resume(w http.ResponseWriter, r *http.Request, id string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.sessions[id]
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	s.data = append(s.data, data...)
+
+	// bytes 0-99/* for chunks, bytes 0-99/100 or bytes */100 for the last
+	if total := r.Header.Get("Content-Range"); !strings.HasSuffix(total, "/*") {
+		f.objects[s.name] = s.data
+		delete(f.sessions, id)
+		f.respond(w, s.name, len(s.data))
+		return
+	}
+	// clients asking for no 308 get the status in a header instead
+	w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.data)-1))
+	if r.Header.Get("X-Guploader-No-308") == "yes" {
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		return
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func (f *fakeGCS) respond(w http.ResponseWriter, name string, size int) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"bucket": "books", "name": name, "size": strconv.Itoa(size)})
+}
+
+func (f *fakeGCS) read(name string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.objects[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return b, nil
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Harness {
+		fake := &fakeGCS{objects: map[string][]byte{}, sessions: map[string]*session{}}
+		srv := httptest.NewServer(fake)
+		t.Cleanup(srv.Close)
+		fake.url = srv.URL
+
+		client, err := storage.NewClient(context.Background(),
+			option.WithEndpoint(srv.URL+"/storage/v1/"),
+			option.WithoutAuthentication(),
+		)
+		if err != nil {
+			t.Fatalf("storage.NewClient: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+
+		store, err := NewStoreFromClient(log, "books", client)
+		if err != nil {
+			t.Fatalf("NewStoreFromClient: %v", err)
+		}
+		return storetest.Harness{Store: store, Read: fake.read}
+	}, storetest.Options{Atomic: true, LargeSize: 20 << 20})
+}
+
+func TestOpen(t *testing.T) {
+	fake := &fakeGCS{objects: map[string][]byte{}, sessions: map[string]*session{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	fake.url = srv.URL
+
+	// the emulator variable also drops the authentication of the client
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+	store, err := upload.OpenStore(context.Background(), log, "gs://books/library/new?endpoint="+url.QueryEscape(srv.URL+"/storage/v1/"))
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	if err := store.Save(context.Background(), "Author/book.epub", io.NopCloser(strings.NewReader("book"))); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if b, err := fake.read("library/new/Author/book.epub"); err != nil || string(b) != "book" {
+		t.Errorf("expected the book under the prefix; got %q: %v", b, err)
+	}
+
+	for _, u := range []string{"gs:///prefix", "gs://books?endpont=x"} {
+		if _, err := upload.OpenStore(context.Background(), log, u); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
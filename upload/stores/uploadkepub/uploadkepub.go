@@ -0,0 +1,114 @@
+// Package uploadkepub wraps a Store, converting uploaded EPUBs to KEPUBs for
+// Kobo readers
+package uploadkepub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/epub"
+)
+
+// Mode controls what is saved for an EPUB upload.
+type Mode string
+
+const (
+	// Off saves uploads unchanged.
+	Off Mode = ""
+	// Alongside saves the KEPUB next to the original EPUB.
+	Alongside Mode = "alongside"
+	// Replace saves the KEPUB instead of the original EPUB.
+	Replace Mode = "replace"
+)
+
+var ErrInvalidMode = errors.New("invalid kepub mode")
+
+// ParseMode parses a mode as found in the configuration. "off" and an empty
+// string both disable the conversion.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case Off, "off":
+		return Off, nil
+	case Alongside, Replace:
+		return Mode(s), nil
+	}
+	return Off, fmt.Errorf("%w: %q", ErrInvalidMode, s)
+}
+
+type Store struct {
+	log   *zap.SugaredLogger
+	store upload.Storer
+	mode  Mode
+}
+
+func NewStore(log *zap.SugaredLogger, store upload.Storer, mode Mode) *Store {
+	return &Store{log: log, store: store, mode: mode}
+}
+
+// Save saves the source using the wrapped Store. EPUBs are converted to KEPUB
+// and saved with a .kepub.epub extension, either in addition to or instead of
+// the original depending on the mode. The conversion is done before anything
+// is saved, so when it fails only the original is saved and the upload is
+// never lost; errors of the wrapped Store are returned as they are.
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	if s.mode == Off || !epub.IsEPUB(name) || epub.KEPUBName(name) == name {
+		return s.store.Save(ctx, name, src)
+	}
+
+	sf, err := upload.SpoolContext(ctx, src)
+	if err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	defer sf.Close()
+
+	// an invalid EPUB is simply stored as is
+	if _, err := epub.Open(sf, sf.Size()); err != nil {
+		s.log.Infow("kepub conversion skipped", "filename", name, "error", err)
+		return s.store.Save(ctx, name, io.NopCloser(io.NewSectionReader(sf, 0, sf.Size())))
+	}
+
+	kf, err := convert(ctx, sf)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.log.Errorw("kepub conversion failed, saving original", "filename", name, "error", err)
+		return s.store.Save(ctx, name, io.NopCloser(io.NewSectionReader(sf, 0, sf.Size())))
+	}
+	defer kf.Close()
+
+	if s.mode == Alongside {
+		if err := s.store.Save(ctx, name, io.NopCloser(io.NewSectionReader(sf, 0, sf.Size()))); err != nil {
+			return err
+		}
+	}
+
+	kepub := epub.KEPUBName(name)
+	if err := s.store.Save(ctx, kepub, io.NopCloser(io.NewSectionReader(kf, 0, kf.Size()))); err != nil {
+		return err
+	}
+	s.log.Infow("saved kepub", "filename", kepub)
+
+	return nil
+}
+
+// convert spools the KEPUB converted from the spooled EPUB.
+func convert(ctx context.Context, sf *upload.SpooledFile) (*upload.SpooledFile, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(epub.ConvertKEPUB(pw, sf, sf.Size()))
+	}()
+
+	// spooling closes the reader, which unblocks a conversion it stopped
+	// reading early; the conversion is waited for as it reads the EPUB
+	kf, err := upload.SpoolContext(ctx, pr)
+	<-done
+	return kf, err
+}
@@ -0,0 +1,175 @@
+package uploadkepub
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload/formats/epub"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadfault"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadmem"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+// buildEPUB creates a minimal EPUB with a single chapter.
+func buildEPUB(t *testing.T) []byte {
+	t.Helper()
+
+	return buildEPUBChapter(t, `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>One</title></head><body><p>Death.</p></body></html>`)
+}
+
+// buildEPUBChapter creates a minimal EPUB with the chapter as its only
+// content document.
+func buildEPUBChapter(t *testing.T, chapter string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	mw, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw.Write([]byte(epub.MimeType))
+	for _, f := range []struct{ name, data string }{
+		{"META-INF/container.xml", `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`},
+		{"content.opf", `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>Mort</dc:title>
+    <dc:identifier id="uid">urn:uuid:1</dc:identifier>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest><item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="ch1"/></spine>
+</package>`},
+		{"ch1.xhtml", chapter},
+	} {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// isKEPUB reports whether the data is an EPUB with kobo spans.
+func isKEPUB(data []byte) bool {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return false
+	}
+	rc, err := zr.Open("ch1.xhtml")
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	ch, _ := io.ReadAll(rc)
+	return bytes.Contains(ch, []byte(`id="kobo.1.1"`))
+}
+
+func TestStore(t *testing.T) {
+	book := buildEPUB(t)
+
+	tests := []struct {
+		mode  Mode
+		name  string
+		data  []byte
+		names []string
+	}{
+		{mode: Off, name: "mort.epub", data: book, names: []string{"mort.epub"}},
+		{mode: Alongside, name: "mort.epub", data: book, names: []string{"mort.epub", "mort.kepub.epub"}},
+		{mode: Replace, name: "mort.epub", data: book, names: []string{"mort.kepub.epub"}},
+		{mode: Replace, name: "mort.pdf", data: []byte("pdf"), names: []string{"mort.pdf"}},
+		{mode: Replace, name: "mort.kepub.epub", data: book, names: []string{"mort.kepub.epub"}},
+		// not an EPUB after all: stored as is
+		{mode: Replace, name: "broken.epub", data: []byte("not a zip"), names: []string{"broken.epub"}},
+	}
+	for _, tt := range tests {
+		mem := uploadmem.NewStore(log)
+		s := NewStore(log, mem, tt.mode)
+
+		if err := s.Save(context.Background(), tt.name, io.NopCloser(bytes.NewReader(tt.data))); err != nil {
+			t.Errorf("%s %s: Save: %v", tt.mode, tt.name, err)
+			continue
+		}
+		if got := mem.Names(); strings.Join(got, ",") != strings.Join(tt.names, ",") {
+			t.Errorf("%s %s: expected %q; got %q", tt.mode, tt.name, tt.names, got)
+			continue
+		}
+		for _, name := range tt.names {
+			f, _ := mem.Get(name)
+			converted := name != tt.name
+			if converted && !isKEPUB(f.Data) {
+				t.Errorf("%s %s: expected %s to be a KEPUB", tt.mode, tt.name, name)
+			}
+			if !converted && !bytes.Equal(f.Data, tt.data) {
+				t.Errorf("%s %s: expected %s unchanged", tt.mode, tt.name, name)
+			}
+		}
+	}
+}
+
+func TestStoreFallback(t *testing.T) {
+	// a chapter without a body is a valid EPUB which cannot be converted
+	book := buildEPUBChapter(t, `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>One</title></head></html>`)
+
+	// both modes save the original alone, once, without failing the upload
+	for _, mode := range []Mode{Replace, Alongside} {
+		mem := uploadmem.NewStore(log)
+		if err := NewStore(log, mem, mode).Save(context.Background(), "mort.epub", io.NopCloser(bytes.NewReader(book))); err != nil {
+			t.Errorf("%s: Save: %v", mode, err)
+			continue
+		}
+		if f, ok := mem.Get("mort.epub"); !ok || !bytes.Equal(f.Data, book) || mem.Len() != 1 {
+			t.Errorf("%s: expected the original only; got %q", mode, mem.Names())
+		}
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	book := buildEPUB(t)
+	errKEPUB := errors.New("kepub save failed")
+
+	// a failing store is not a failed conversion, the original is not saved
+	// in place of the KEPUB
+	tests := []struct {
+		mode  Mode
+		names []string
+	}{
+		{Replace, nil},
+		{Alongside, []string{"mort.epub"}},
+	}
+	for _, tt := range tests {
+		mem := uploadmem.NewStore(log)
+		faulty := uploadfault.NewStore(log, mem, uploadfault.Match("*.kepub.epub", uploadfault.Fault{Err: errKEPUB, ErrAfter: 1}))
+		err := NewStore(log, faulty, tt.mode).Save(context.Background(), "mort.epub", io.NopCloser(bytes.NewReader(book)))
+		if !errors.Is(err, errKEPUB) {
+			t.Errorf("%s: expected the error of the KEPUB save; got: %v", tt.mode, err)
+		}
+		if got := mem.Names(); strings.Join(got, ",") != strings.Join(tt.names, ",") {
+			t.Errorf("%s: expected %q; got %q", tt.mode, tt.names, got)
+		}
+	}
+}
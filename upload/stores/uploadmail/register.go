@@ -0,0 +1,113 @@
+package uploadmail
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+const (
+	// Send-to-Kindle accepts mails of up to 50MB
+	defaultMaxSize = 50 << 20
+	defaultTimeout = 2 * time.Minute
+)
+
+func init() {
+	upload.RegisterStore("mailto", Open)
+}
+
+// Open opens the store of a mailto URL, mailto:me@kindle.com,you@kindle.com,
+// emailing the uploads to its addresses. The URL options configure the SMTP
+// server and the mails:
+//
+//	host         the SMTP server
+//	port         the port of the server, 587 for starttls and 465 for tls
+//	username     the user logging in to the server
+//	password     the password of the user
+//	tls          the TLS of the connection (starttls|tls|none)
+//	from         the sender, approved in the Kindle account
+//	recipient    the addresses of the uploads of a user as user=address,
+//	             repeated for each address
+//	max_size     the largest base64 encoded attachment, 50MB when not set
+//	kindle       refuses the formats Send-to-Kindle does not accept, unless
+//	             kindle=0
+//	convert_pdf  asks Send-to-Kindle to convert PDFs
+//	timeout      the timeout of the delivery of a single mail, 2m when not set
+func Open(_ context.Context, log *zap.SugaredLogger, u *url.URL) (upload.Storer, error) {
+	if err := upload.CheckStoreOptions(u, "host", "port", "username", "password", "tls", "from", "recipient", "max_size", "kindle", "convert_pdf", "timeout"); err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	tlsMode, err := ParseTLSMode(q.Get("tls"))
+	if err != nil {
+		return nil, err
+	}
+	port, err := upload.IntStoreOption(u, "port")
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := upload.SizeStoreOption(u, "max_size")
+	if err != nil {
+		return nil, err
+	}
+	kindle := true
+	if q.Has("kindle") {
+		if kindle, err = upload.BoolStoreOption(u, "kindle"); err != nil {
+			return nil, err
+		}
+	}
+	convertPDF, err := upload.BoolStoreOption(u, "convert_pdf")
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := upload.DurationStoreOption(u, "timeout")
+	if err != nil {
+		return nil, err
+	}
+	if !q.Has("max_size") {
+		maxSize = defaultMaxSize
+	}
+	if !q.Has("timeout") {
+		timeout = defaultTimeout
+	}
+
+	addrs, err := url.PathUnescape(u.Opaque)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", upload.ErrStoreOption, u.Opaque)
+	}
+	var to []string
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	recipients := map[string][]string{}
+	for _, r := range q["recipient"] {
+		user, addr, ok := strings.Cut(r, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: recipient %q: expected user=address", upload.ErrStoreOption, r)
+		}
+		recipients[user] = append(recipients[user], addr)
+	}
+
+	return NewStore(log, Config{
+		Host:       q.Get("host"),
+		Port:       port,
+		Username:   q.Get("username"),
+		Password:   q.Get("password"),
+		TLS:        tlsMode,
+		From:       q.Get("from"),
+		To:         to,
+		Recipients: recipients,
+		MaxSize:    maxSize,
+		Kindle:     kindle,
+		ConvertPDF: convertPDF,
+		Timeout:    timeout,
+	})
+}
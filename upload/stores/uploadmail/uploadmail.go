@@ -0,0 +1,377 @@
+// Package uploadmail is an upload store emailing uploads as attachments, for
+// example to the Send-to-Kindle address of an e-reader
+package uploadmail
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+// TLSMode is how the connection to the SMTP server is secured.
+type TLSMode string
+
+const (
+	// StartTLS upgrades the connection with STARTTLS, refusing servers which
+	// do not support it.
+	StartTLS TLSMode = "starttls"
+	// ImplicitTLS connects with TLS, usually on port 465.
+	ImplicitTLS TLSMode = "tls"
+	// NoTLS sends the mail in plain text.
+	NoTLS TLSMode = "none"
+)
+
+const (
+	// CodeKindleFormat is the code of the rejections of the formats
+	// Send-to-Kindle does not accept.
+	CodeKindleFormat = "KINDLE_FORMAT"
+	// CodeTooLarge is the code of the rejections of the uploads larger than
+	// the attachments of the mails may be.
+	CodeTooLarge = "TOO_LARGE"
+)
+
+var (
+	ErrNoServer       = errors.New("no smtp server configured")
+	ErrNoSender       = errors.New("no sender address configured")
+	ErrNoRecipients   = errors.New("no recipients for the upload")
+	ErrInvalidTLSMode = errors.New("invalid tls mode")
+	ErrNoStartTLS     = errors.New("smtp server does not support starttls")
+	ErrTooLarge       = errors.New("upload too large to email")
+	ErrKindleFormat   = errors.New("format not accepted by kindle")
+)
+
+// kindleFormats are the formats Send-to-Kindle accepts.
+var kindleFormats = map[string]bool{
+	".epub": true, ".pdf": true, ".doc": true, ".docx": true, ".rtf": true,
+	".txt": true, ".htm": true, ".html": true,
+	".jpg": true, ".jpeg": true, ".gif": true, ".png": true, ".bmp": true,
+}
+
+// kindleHints suggests the conversion of formats Kindle rejects.
+var kindleHints = map[string]string{
+	".mobi": "convert it to EPUB, Kindle no longer accepts MOBI",
+	".azw":  "convert it to EPUB, Kindle no longer accepts AZW",
+	".azw3": "convert it to EPUB, Kindle no longer accepts AZW3",
+	".prc":  "convert it to EPUB",
+	".fb2":  "convert it to EPUB",
+	".lit":  "convert it to EPUB",
+	".odt":  "convert it to DOCX or EPUB",
+	".md":   "convert it to EPUB",
+	".cbz":  "convert it to PDF",
+	".cbr":  "convert it to PDF",
+}
+
+// ParseTLSMode parses a TLS mode as found in the configuration, StartTLS when
+// empty.
+func ParseTLSMode(s string) (TLSMode, error) {
+	switch TLSMode(s) {
+	case "":
+		return StartTLS, nil
+	case StartTLS, ImplicitTLS, NoTLS:
+		return TLSMode(s), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidTLSMode, s)
+}
+
+// Config configures a Store.
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	TLS      TLSMode
+
+	// From is the sender, which has to be on the approved list of the Kindle
+	// account.
+	From string
+	// To receives the uploads of users without recipients of their own.
+	To []string
+	// Recipients are the addresses of the uploads of each user, as
+	// authenticated by the web service.
+	Recipients map[string][]string
+
+	// MaxSize refuses attachments which are larger once base64 encoded, a
+	// third larger than the book, Send-to-Kindle accepting mails of up to
+	// 50MB.
+	MaxSize int64
+	// Kindle refuses the formats Send-to-Kindle does not accept.
+	Kindle bool
+	// ConvertPDF asks Send-to-Kindle to convert PDFs to the Kindle format,
+	// with "Convert" as the subject.
+	ConvertPDF bool
+
+	// Timeout bounds the delivery of a single mail.
+	Timeout time.Duration
+}
+
+type Store struct {
+	log *zap.SugaredLogger
+	cfg Config
+
+	// tlsConfig overrides the TLS configuration, for tests
+	tlsConfig *tls.Config
+}
+
+func NewStore(log *zap.SugaredLogger, cfg Config) (*Store, error) {
+	if cfg.Host == "" {
+		return nil, ErrNoServer
+	}
+	if cfg.From == "" {
+		return nil, ErrNoSender
+	}
+	if cfg.TLS == "" {
+		cfg.TLS = StartTLS
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 587
+		if cfg.TLS == ImplicitTLS {
+			cfg.Port = 465
+		}
+	}
+	return &Store{log: log, cfg: cfg}, nil
+}
+
+// Save emails the source as an attachment to the recipients of the uploader,
+// titled after the metadata of the upload. OPF sidecars are skipped since they
+// are not books, their source is still read to the end for the stores sharing
+// it.
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	defer src.Close()
+
+	ext := strings.ToLower(path.Ext(name))
+	if ext == ".opf" {
+		_, err := io.Copy(io.Discard, src)
+		return err
+	}
+
+	if s.cfg.Kindle && !kindleFormats[ext] {
+		io.Copy(io.Discard, src)
+		if hint, ok := kindleHints[ext]; ok {
+			return upload.RejectErr(CodeKindleFormat, fmt.Errorf("%w: %s: %s", ErrKindleFormat, ext, hint))
+		}
+		return upload.RejectErr(CodeKindleFormat, fmt.Errorf("%w: %s", ErrKindleFormat, ext))
+	}
+
+	uploader := upload.GetUploader(ctx)
+	to := s.cfg.Recipients[uploader]
+	if len(to) == 0 {
+		to = s.cfg.To
+	}
+	if len(to) == 0 {
+		io.Copy(io.Discard, src)
+		return fmt.Errorf("%w: %q", ErrNoRecipients, uploader)
+	}
+
+	sf, err := upload.SpoolContext(ctx, src)
+	if err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	defer sf.Close()
+
+	if n := encodedSize(sf.Size()); s.cfg.MaxSize > 0 && n > s.cfg.MaxSize {
+		return upload.RejectErr(CodeTooLarge, fmt.Errorf("%w: %d bytes encoded", ErrTooLarge, n))
+	}
+
+	subject := upload.GetMetadata(ctx).Title
+	if subject == "" {
+		subject = strings.TrimSuffix(path.Base(name), path.Ext(name))
+	}
+	if s.cfg.ConvertPDF && ext == ".pdf" {
+		subject = "Convert"
+	}
+
+	if err := s.send(ctx, to, subject, path.Base(name), sf); err != nil {
+		return fmt.Errorf("send mail: %w", err)
+	}
+	s.log.Infow("emailed upload", "filename", name, "to", to, "bytes", sf.Size())
+
+	return nil
+}
+
+// encodedSize returns the size of n bytes once base64 encoded, without the
+// line breaks.
+func encodedSize(n int64) int64 {
+	return 4 * ((n + 2) / 3)
+}
+
+// send delivers a mail with the attachment to the recipients.
+func (s *Store) send(ctx context.Context, to []string, subject, filename string, attachment io.Reader) error {
+	if s.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.Timeout)
+		defer cancel()
+	}
+
+	c, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if s.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+
+	if err := c.Mail(s.cfg.From); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("recipient %s: %w", rcpt, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if err := writeMessage(w, s.cfg.From, to, subject, filename, attachment); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// dial connects to the SMTP server, securing the connection as configured. The
+// deadline of the context applies to the whole session.
+func (s *Store) dial(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	tlsConfig := s.tlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: s.cfg.Host}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if s.cfg.TLS == ImplicitTLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	c, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if s.cfg.TLS == StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, ErrNoStartTLS
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// writeMessage writes a MIME message with a short text and the attachment.
+func writeMessage(w io.Writer, from string, to []string, subject, filename string, attachment io.Reader) error {
+	boundary := randomHex(16)
+	contentType := mime.TypeByExtension(path.Ext(filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	domain := from[strings.LastIndex(from, "@")+1:]
+
+	headers := []string{
+		"From: " + from,
+		"To: " + strings.Join(to, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: <" + randomHex(16) + "@" + domain + ">",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="` + boundary + `"`,
+		"",
+		"--" + boundary,
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"Sent by the ebook uploader.",
+		"",
+		"--" + boundary,
+		"Content-Type: " + contentType,
+		"Content-Transfer-Encoding: base64",
+		"Content-Disposition: " + mime.FormatMediaType("attachment", map[string]string{"filename": filename}),
+		"",
+		"",
+	}
+	if _, err := io.WriteString(w, strings.Join(headers, "\r\n")); err != nil {
+		return err
+	}
+
+	lw := &lineWriter{w: w}
+	enc := base64.NewEncoder(base64.StdEncoding, lw)
+	if _, err := io.Copy(enc, attachment); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\r\n--"+boundary+"--\r\n")
+	return err
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// lineWriter breaks the base64 encoded attachment into lines of 76
+// characters, as required by MIME.
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := min(76-lw.col, len(p))
+		if _, err := lw.w.Write(p[:chunk]); err != nil {
+			return n, err
+		}
+		n += chunk
+		lw.col += chunk
+		p = p[chunk:]
+
+		if lw.col == 76 {
+			if _, err := io.WriteString(lw.w, "\r\n"); err != nil {
+				return n, err
+			}
+			lw.col = 0
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,403 @@
+package uploadmail
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/storetest"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+// message is a mail received by the smtp stand-in.
+type message struct {
+	from string
+	to   []string
+	tls  bool
+	auth string
+	data string
+}
+
+// smtpServer stands in for an SMTP server, offering STARTTLS when it has a
+// certificate.
+type smtpServer struct {
+	t    *testing.T
+	ln   net.Listener
+	cert *tls.Certificate
+
+	mu       sync.Mutex
+	messages []message
+}
+
+func newSMTPServer(t *testing.T, cert *tls.Certificate) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{t: t, ln: ln, cert: cert}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+
+	var msg message
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(cmd) {
+		case "EHLO":
+			ext := []string{"250-localhost", "250-AUTH PLAIN"}
+			if s.cert != nil && !msg.tls {
+				ext = append(ext, "250-STARTTLS")
+			}
+			for _, e := range ext {
+				tp.PrintfLine("%s", e)
+			}
+			tp.PrintfLine("250 8BITMIME")
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*s.cert}})
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			tp = textproto.NewConn(tc)
+			msg.tls = true
+		case "AUTH":
+			_, creds, _ := strings.Cut(arg, " ")
+			b, _ := base64.StdEncoding.DecodeString(creds)
+			msg.auth = string(b)
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			from, _, _ := strings.Cut(strings.TrimPrefix(arg, "FROM:"), " ")
+			msg.from = strings.Trim(from, "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			b, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(b)
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+// testCert returns the certificate of httptest, valid for 127.0.0.1, and the
+// pool trusting it.
+func testCert(t *testing.T) (*tls.Certificate, *x509.CertPool) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return &srv.TLS.Certificates[0], pool
+}
+
+// attachment returns the subject of the mail and the name and content of its
+// attachment.
+func attachment(t *testing.T, data string) (string, string, string) {
+	t.Helper()
+
+	subject, filename, content, err := parseAttachment(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subject, filename, content
+}
+
+func parseAttachment(data string) (string, string, string, error) {
+	m, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		return "", "", "", fmt.Errorf("read message: %w", err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+
+	_, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return "", "", "", fmt.Errorf("no attachment: %w", err)
+		}
+		if p.FileName() == "" {
+			continue
+		}
+		b, _ := io.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+		return subject, p.FileName(), string(b), nil
+	}
+}
+
+// read returns the attachment of the last mail received with the file name of
+// name.
+func (s *smtpServer) read(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		_, filename, content, err := parseAttachment(s.messages[i].data)
+		if err == nil && filename == path.Base(name) {
+			return []byte(content), nil
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+func TestStore(t *testing.T) {
+	cert, pool := testCert(t)
+	srv := newSMTPServer(t, cert)
+
+	store, err := NewStore(log, Config{
+		Host:       "127.0.0.1",
+		Port:       srv.port(),
+		Username:   "uploader",
+		Password:   "secret",
+		From:       "uploader@example.com",
+		To:         []string{"family@kindle.com"},
+		Recipients: map[string][]string{"alice": {"alice@kindle.com", "alice@free.kindle.com"}},
+		MaxSize:    1 << 20,
+		Kindle:     true,
+		ConvertPDF: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.tlsConfig = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	core := upload.NewCore(log, store)
+
+	// long enough to span several lines of base64
+	book := strings.Repeat("epub content ", 20)
+	ctx := upload.WithUploader(context.Background(), "alice")
+	if _, err := core.Save(ctx, "Terry Pratchett/Mort.epub", io.NopCloser(strings.NewReader(book)), upload.Metadata{Title: "Mort – Discworld"}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := core.Save(context.Background(), "scan.pdf", io.NopCloser(strings.NewReader("pdf")), upload.Metadata{}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	if len(srv.messages) != 2 {
+		t.Fatalf("expected 2 messages; got %d", len(srv.messages))
+	}
+
+	msg := srv.messages[0]
+	if !msg.tls || msg.auth != "\x00uploader\x00secret" || msg.from != "uploader@example.com" {
+		t.Errorf("unexpected session: %+v", msg)
+	}
+	if strings.Join(msg.to, " ") != "alice@kindle.com alice@free.kindle.com" {
+		t.Errorf("unexpected recipients: %q", msg.to)
+	}
+	for _, line := range strings.Split(msg.data, "\n") {
+		if len(line) > 78 {
+			t.Errorf("line too long: %q", line)
+		}
+	}
+	subject, name, content := attachment(t, msg.data)
+	if subject != "Mort – Discworld" || name != "Mort.epub" || content != book {
+		t.Errorf("unexpected mail: %q %q %q", subject, name, content)
+	}
+
+	// uploaders without addresses use the defaults, kindle converts the pdf
+	msg = srv.messages[1]
+	if strings.Join(msg.to, " ") != "family@kindle.com" {
+		t.Errorf("unexpected recipients: %q", msg.to)
+	}
+	if subject, name, _ := attachment(t, msg.data); subject != "Convert" || name != "scan.pdf" {
+		t.Errorf("unexpected mail: %q %q", subject, name)
+	}
+}
+
+// closer records whether the source was closed.
+type closer struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestStoreErrors(t *testing.T) {
+	srv := newSMTPServer(t, nil)
+	cfg := Config{Host: "127.0.0.1", Port: srv.port(), TLS: NoTLS, From: "uploader@example.com", To: []string{"me@kindle.com"}, MaxSize: 10, Kindle: true}
+
+	store, err := NewStore(log, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Save(context.Background(), "book.mobi", io.NopCloser(strings.NewReader("mobi")))
+	if !errors.Is(err, ErrKindleFormat) || !upload.IsRejected(err) || !strings.Contains(err.Error(), "EPUB") {
+		t.Errorf("expected ErrKindleFormat as a rejection with a hint; got: %v", err)
+	}
+	if err := store.Save(context.Background(), "big.epub", io.NopCloser(strings.NewReader(strings.Repeat("x", 11)))); !errors.Is(err, ErrTooLarge) || !upload.IsRejected(err) {
+		t.Errorf("expected ErrTooLarge as a rejection; got: %v", err)
+	}
+	// 8 bytes are 12 once encoded
+	if err := store.Save(context.Background(), "big.epub", io.NopCloser(strings.NewReader(strings.Repeat("x", 8)))); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge for the encoded size; got: %v", err)
+	}
+	if err := store.Save(context.Background(), "book.opf", io.NopCloser(strings.NewReader("opf"))); err != nil {
+		t.Errorf("expected the sidecar to be skipped; got: %v", err)
+	}
+	if err := store.Save(context.Background(), "book.epub", io.NopCloser(strings.NewReader("epub"))); err != nil {
+		t.Errorf("Save without tls: %v", err)
+	}
+
+	cfg.To = nil
+	store, _ = NewStore(log, cfg)
+	if err := store.Save(context.Background(), "book.epub", io.NopCloser(strings.NewReader("epub"))); !errors.Is(err, ErrNoRecipients) {
+		t.Errorf("expected ErrNoRecipients; got: %v", err)
+	}
+
+	// the sources of the saves returning early are closed too
+	for _, name := range []string{"book.mobi", "book.opf", "book.epub"} {
+		src := &closer{Reader: strings.NewReader("book")}
+		store.Save(context.Background(), name, src)
+		if !src.closed {
+			t.Errorf("%s: expected the source to be closed", name)
+		}
+	}
+
+	// the server offers no starttls
+	cfg.TLS, cfg.To = StartTLS, []string{"me@kindle.com"}
+	store, _ = NewStore(log, cfg)
+	if err := store.Save(context.Background(), "book.epub", io.NopCloser(strings.NewReader("epub"))); !errors.Is(err, ErrNoStartTLS) {
+		t.Errorf("expected ErrNoStartTLS; got: %v", err)
+	}
+
+	if _, err := ParseTLSMode("ssl"); !errors.Is(err, ErrInvalidTLSMode) {
+		t.Errorf("expected ErrInvalidTLSMode; got: %v", err)
+	}
+	if port := strconv.Itoa(mustStore(t, Config{Host: "smtp", From: "a@b", TLS: ImplicitTLS}).cfg.Port); port != "465" {
+		t.Errorf("expected port 465 for implicit tls; got %s", port)
+	}
+}
+
+func mustStore(t *testing.T, cfg Config) *Store {
+	t.Helper()
+	s, err := NewStore(log, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Harness {
+		srv := newSMTPServer(t, nil)
+		store, err := NewStore(log, Config{Host: "127.0.0.1", Port: srv.port(), TLS: NoTLS, From: "uploader@example.com", To: []string{"me@example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storetest.Harness{Store: store, Read: srv.read}
+	}, storetest.Options{LargeSize: 4 << 20})
+}
+
+func TestOpen(t *testing.T) {
+	store, err := upload.OpenStore(context.Background(), log, "mailto:me@kindle.com,you@kindle.com?host=smtp.example.com&tls=tls&username=me&password=secret&from=me@example.com&recipient=alice%3Dalice@kindle.com&max_size=10MB&kindle&convert_pdf=1&timeout=1m")
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	cfg := store.(*Store).cfg
+	want := Config{
+		Host:       "smtp.example.com",
+		Port:       465,
+		Username:   "me",
+		Password:   "secret",
+		TLS:        ImplicitTLS,
+		From:       "me@example.com",
+		To:         []string{"me@kindle.com", "you@kindle.com"},
+		Recipients: map[string][]string{"alice": {"alice@kindle.com"}},
+		MaxSize:    10 << 20,
+		Kindle:     true,
+		ConvertPDF: true,
+		Timeout:    time.Minute,
+	}
+	if fmt.Sprint(cfg) != fmt.Sprint(want) {
+		t.Errorf("expected %+v; got %+v", want, cfg)
+	}
+
+	store, err = upload.OpenStore(context.Background(), log, "mailto:me@kindle.com?host=smtp.example.com&from=me@example.com")
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	cfg = store.(*Store).cfg
+	if !cfg.Kindle || cfg.MaxSize != 50<<20 || cfg.Timeout != 2*time.Minute {
+		t.Errorf("expected the Send-to-Kindle defaults; got %+v", cfg)
+	}
+
+	for _, u := range []string{
+		"mailto:me@kindle.com?host=smtp.example.com&from=me@example.com&tls=ssl",
+		"mailto:me@kindle.com?host=smtp.example.com&from=me@example.com&port=smtp",
+		"mailto:?host=smtp.example.com&from=me@example.com&recipient=alice",
+		"mailto:me@kindle.com?from=me@example.com",
+		"mailto:me@kindle.com?host=smtp.example.com&from=me@example.com&subject=book",
+	} {
+		if _, err := upload.OpenStore(context.Background(), log, u); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
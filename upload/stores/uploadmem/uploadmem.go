@@ -0,0 +1,112 @@
+// Package uploadmem is an upload store keeping the files in memory, for tests of
+// handlers and store compositions
+package uploadmem
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+// File is a file saved to the Store, with the upload context it was saved
+// with.
+type File struct {
+	Name     string
+	Data     []byte
+	Metadata upload.Metadata
+	Uploader string
+	SavedAt  time.Time
+}
+
+type Store struct {
+	log *zap.SugaredLogger
+
+	mu    sync.Mutex
+	files map[string]File
+	saves []string
+}
+
+func NewStore(log *zap.SugaredLogger) *Store {
+	return &Store{log: log, files: make(map[string]File)}
+}
+
+// Save reads the source into memory and keeps it under the name, replacing
+// any file saved before with the same name. Nothing is kept when the source
+// cannot be read. The source file is closed upon return
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	defer src.Close()
+
+	data, err := io.ReadAll(upload.ContextReader(ctx, src))
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	f := File{
+		Name:     name,
+		Data:     data,
+		Metadata: upload.GetMetadata(ctx),
+		Uploader: upload.GetUploader(ctx),
+		SavedAt:  time.Now(),
+	}
+
+	s.mu.Lock()
+	s.files[name] = f
+	s.saves = append(s.saves, name)
+	s.mu.Unlock()
+
+	s.log.Debugw("saved upload in memory", "filename", name, "bytes", len(data))
+	return nil
+}
+
+// Get returns the file saved under the name.
+func (s *Store) Get(name string) (File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[name]
+	return f, ok
+}
+
+// Names returns the names of the files, sorted.
+func (s *Store) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Len returns the number of files.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+// Saves returns the names of the successful saves in the order they completed,
+// including the saves replacing a file.
+func (s *Store) Saves() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.saves...)
+}
+
+// Reset removes the files and forgets the saves.
+func (s *Store) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files = make(map[string]File)
+	s.saves = nil
+}
@@ -0,0 +1,90 @@
+package uploadmem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/storetest"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore(log)
+
+	ctx := upload.WithUploader(upload.WithMetadata(context.Background(), upload.Metadata{Title: "Mort"}), "alice")
+	if err := s.Save(ctx, "a/mort.epub", io.NopCloser(strings.NewReader("mort"))); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	f, ok := s.Get("a/mort.epub")
+	if !ok || string(f.Data) != "mort" || f.Metadata.Title != "Mort" || f.Uploader != "alice" || f.SavedAt.IsZero() {
+		t.Errorf("unexpected file: %+v", f)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("book-%d.epub", i%10)
+			if err := s.Save(context.Background(), name, io.NopCloser(strings.NewReader(name))); err != nil {
+				t.Errorf("Save: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if s.Len() != 11 || len(s.Names()) != 11 || s.Names()[0] != "a/mort.epub" {
+		t.Errorf("unexpected names: %q", s.Names())
+	}
+	if len(s.Saves()) != 21 {
+		t.Errorf("expected 21 saves; got: %d", len(s.Saves()))
+	}
+
+	// failed reads keep nothing
+	err := s.Save(context.Background(), "broken.epub", io.NopCloser(iotest.ErrReader(io.ErrUnexpectedEOF)))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF; got: %v", err)
+	}
+	if _, ok := s.Get("broken.epub"); ok {
+		t.Error("expected the failed save not to be kept")
+	}
+
+	s.Reset()
+	if s.Len() != 0 || len(s.Saves()) != 0 {
+		t.Errorf("expected an empty store; got: %q", s.Names())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Harness {
+		s := NewStore(log)
+		return storetest.Harness{Store: s, Read: s.read}
+	}, storetest.Options{Atomic: true})
+}
+
+// read implements storetest.Harness.Read.
+func (s *Store) read(name string) ([]byte, error) {
+	f, ok := s.Get(name)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return f.Data, nil
+}
@@ -29,6 +29,26 @@ func (m *multiWriteCloser) Write(p []byte) (n int, err error) {
 	return m.w.Write(p)
 }
 
+// CloseWithError closes the writers, passing the error to the writers which
+// accept one such as pipes; nil is the same as Close.
+func (m *multiWriteCloser) CloseWithError(err error) error {
+	errs := make([]error, 0, len(m.cs))
+
+	for _, c := range m.cs {
+		var cerr error
+		if ce, ok := c.(interface{ CloseWithError(error) error }); ok {
+			cerr = ce.CloseWithError(err)
+		} else {
+			cerr = c.Close()
+		}
+		if cerr != nil {
+			errs = append(errs, cerr)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
 func (m *multiWriteCloser) Close() error {
 	errs := make([]error, 0, len(m.cs))
 
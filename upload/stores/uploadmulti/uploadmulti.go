@@ -2,6 +2,7 @@
 package uploadmulti
 
 import (
+	"context"
 	"errors"
 	"io"
 
@@ -27,8 +28,11 @@ func NewStore(log *zap.SugaredLogger, stores ...upload.Storer) (*Store, error) {
 }
 
 // Save copies the source reader contents to a new file in the bucket defined
-// within the Store and the name provided in the function as the full path
-func (s *Store) Save(name string, src io.ReadCloser) error {
+// within the Store and the name provided in the function as the full path. The
+// stores see the error of the source when it fails, instead of a shorter file
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	defer src.Close()
+
 	n := len(s.stores)
 
 	wcs := make([]io.WriteCloser, n)
@@ -42,15 +46,15 @@ func (s *Store) Save(name string, src io.ReadCloser) error {
 		wcs[i] = pw
 
 		go func(store upload.Storer) {
-			results <- store.Save(name, pr)
+			results <- store.Save(ctx, name, pr)
 		}(store)
 	}
 
-	go func(wc io.WriteCloser) {
-		defer wc.Close()
+	go func(wc *multiWriteCloser) {
 		_, err := io.Copy(wc, src)
+		wc.CloseWithError(err)
 		results <- err
-	}(MultiWriteCloser(wcs...))
+	}(MultiWriteCloser(wcs...).(*multiWriteCloser))
 
 	for i := 0; i < n+1; i++ {
 		if err := <-results; err != nil {
@@ -2,14 +2,19 @@ package uploadmulti
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"testing"
 
 	"github.com/funayman/logger"
 	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload/stores/uploadmem"
+	"github.com/funayman/ebook-uploader/upload/storetest"
 )
 
 var (
@@ -24,7 +29,7 @@ type testUploader struct {
 	dir string
 }
 
-func (tu testUploader) Save(name string, src io.ReadCloser) error {
+func (tu testUploader) Save(ctx context.Context, name string, src io.ReadCloser) error {
 	f, err := os.CreateTemp(tu.dir, fmt.Sprintf("*%s", name))
 	if err != nil {
 		return err
@@ -65,7 +70,7 @@ func TestMultiStore(t *testing.T) {
 	}
 	r := io.NopCloser(bytes.NewReader(buf))
 
-	if err := s.Save("test-delme.txt", r); err != nil {
+	if err := s.Save(context.Background(), "test-delme.txt", r); err != nil {
 		t.Fatalf("store.Save: %v", err)
 	}
 
@@ -78,3 +83,28 @@ func TestMultiStore(t *testing.T) {
 		t.Errorf("incorrect number of files; expected: 3; got: %d", len(files))
 	}
 }
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Harness {
+		mem1, mem2 := uploadmem.NewStore(log), uploadmem.NewStore(log)
+		s, err := NewStore(log, mem1, mem2)
+		if err != nil {
+			t.Fatalf("NewStore: %v", err)
+		}
+
+		// every store has to hold the file, though concurrent saves of a name
+		// may complete in another order in each store
+		read := func(name string) ([]byte, error) {
+			f1, ok1 := mem1.Get(name)
+			f2, ok2 := mem2.Get(name)
+			switch {
+			case !ok1 && !ok2:
+				return nil, fs.ErrNotExist
+			case ok1 != ok2 || len(f1.Data) != len(f2.Data):
+				return nil, fmt.Errorf("stores differ for %q", name)
+			}
+			return f1.Data, nil
+		}
+		return storetest.Harness{Store: s, Read: read}
+	}, storetest.Options{Atomic: true})
+}
@@ -0,0 +1,48 @@
+// Package uploadopf wraps a Store, writing an OPF metadata sidecar next to
+// every uploaded file
+package uploadopf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/formats/opf"
+)
+
+type Store struct {
+	log   *zap.SugaredLogger
+	store upload.Storer
+}
+
+func NewStore(log *zap.SugaredLogger, store upload.Storer) *Store {
+	return &Store{log: log, store: store}
+}
+
+// Save saves the source using the wrapped Store, followed by an OPF document
+// with the same name but an .opf extension holding the metadata from the
+// context. Files uploaded without any metadata do not get a sidecar.
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	if err := s.store.Save(ctx, name, src); err != nil {
+		return err
+	}
+
+	md := upload.GetMetadata(ctx)
+	if md.IsZero() {
+		return nil
+	}
+
+	sidecar := strings.TrimSuffix(name, path.Ext(name)) + ".opf"
+	if err := s.store.Save(ctx, sidecar, io.NopCloser(bytes.NewReader(opf.Sidecar(md)))); err != nil {
+		return fmt.Errorf("sidecar: %w", err)
+	}
+	s.log.Infow("saved opf sidecar", "filename", sidecar)
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package uploads3
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+func init() {
+	upload.RegisterStore("s3", Open)
+}
+
+// Open opens the store of an s3 URL, s3://bucket/prefix, saving the uploads
+// under the optional key prefix. Credentials come from the default AWS
+// configuration chain, and the URL options adjust the client:
+//
+//	endpoint    the base endpoint of S3 compatible services such as MinIO,
+//	            http endpoints sending the payload unsigned
+//	region      the region of the bucket, overriding the configuration
+//	path_style  addresses the bucket in the path rather than the host name
+func Open(ctx context.Context, log *zap.SugaredLogger, u *url.URL) (upload.Storer, error) {
+	if err := upload.CheckStoreOptions(u, "endpoint", "region", "path_style"); err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%w: missing bucket", upload.ErrStoreOption)
+	}
+	pathStyle, err := upload.BoolStoreOption(u, "path_style")
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []func(*config.LoadOptions) error
+	if region := u.Query().Get("region"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("config.LoadDefault: %w", err)
+	}
+	endpoint := u.Query().Get("endpoint")
+	if endpoint != "" {
+		cfg.BaseEndpoint = aws.String(endpoint)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = pathStyle
+		// without tls the sdk hashes the payload up front, which cannot be
+		// done for the streamed uploads without buffering them whole
+		if strings.HasPrefix(strings.ToLower(endpoint), "http://") {
+			o.APIOptions = append(o.APIOptions, v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware)
+		}
+	})
+	return &Store{log: log, client: client, bucket: u.Host, prefix: keyPrefix(u.Path)}, nil
+}
+
+// keyPrefix returns the key prefix of the URL path, ending with a slash
+// unless empty.
+func keyPrefix(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return path + "/"
+}
@@ -5,18 +5,23 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"mime"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
 )
 
 type Store struct {
 	log    *zap.SugaredLogger
 	client *s3.Client
 	bucket string
+	prefix string
 }
 
 func NewStore(log *zap.SugaredLogger, bucket string) (*Store, error) {
@@ -35,18 +40,70 @@ func NewStoreFromConfig(log *zap.SugaredLogger, bucket string, config aws.Config
 	return &Store{log: log, client: client, bucket: bucket}, nil
 }
 
-func (s Store) Save(name string, src io.ReadCloser) error {
-	ctx := context.Background()
+// Save uploads the source to the bucket defined within the Store using the name,
+// after the key prefix of the store, as the object key. Any upload metadata found in the context is set as user
+// defined object metadata. The source file is closed upon return
+func (s Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	defer src.Close()
+
+	// metadata is sent as http headers which only allow ascii so values are
+	// encoded as described in RFC 2047, as recommended by AWS
+	metadata := upload.GetMetadata(ctx).Map()
+	for k, v := range metadata {
+		metadata[k] = mime.QEncoding.Encode("utf-8", v)
+	}
 
+	// the error of the source is replaced by the failure of the retries of the
+	// sdk, so it is kept aside; sources which can seek still can
+	body := &sourceReader{r: src}
+	var r io.Reader = body
+	if seeker, ok := src.(io.Seeker); ok {
+		r = struct {
+			io.Reader
+			io.Seeker
+		}{body, seeker}
+	}
+
+	key := s.prefix + name
 	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &s.bucket,
-		Key:    &name,
-		Body:   src,
+		Bucket:   &s.bucket,
+		Key:      &key,
+		Body:     r,
+		Metadata: metadata,
 	})
 
 	if err != nil {
+		if serr := body.Err(); serr != nil {
+			return fmt.Errorf("read source: %w", serr)
+		}
 		return err
 	}
 
 	return nil
 }
+
+// sourceReader records the first error of the source other than io.EOF.
+type sourceReader struct {
+	r io.Reader
+
+	mu  sync.Mutex
+	err error
+}
+
+func (sr *sourceReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if err != nil && err != io.EOF {
+		sr.mu.Lock()
+		if sr.err == nil {
+			sr.err = err
+		}
+		sr.mu.Unlock()
+	}
+	return n, err
+}
+
+func (sr *sourceReader) Err() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.err
+}
@@ -0,0 +1,202 @@
+package uploads3
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/storetest"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+// fakeS3 stands in for PutObject, keeping the objects whose body arrived
+// whole.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, _, _ := strings.Cut(r.Host, ".")
+	if r.Method != http.MethodPut || bucket != "books" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "aws-chunked" {
+		body = newChunkedReader(r.Body)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return
+	}
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.objects[key] = b
+	f.mu.Unlock()
+
+	w.Header().Set("ETag", `"etag"`)
+}
+
+func (f *fakeS3) read(name string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.objects[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return b, nil
+}
+
+// newChunkedReader decodes the aws-chunked encoding of streamed bodies.
+func newChunkedReader(r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		defer func() { pw.CloseWithError(err) }()
+
+		br := newLineReader(r)
+		for {
+			var line string
+			if line, err = br.line(); err != nil {
+				return
+			}
+			var size int64
+			if _, err = fmt.Sscanf(strings.Split(line, ";")[0], "%x", &size); err != nil {
+				return
+			}
+			if size == 0 {
+				return
+			}
+			if _, err = io.CopyN(pw, br, size); err != nil {
+				return
+			}
+			if _, err = br.line(); err != nil {
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+type lineReader struct{ r io.Reader }
+
+func newLineReader(r io.Reader) *lineReader { return &lineReader{r: r} }
+
+func (lr *lineReader) Read(p []byte) (int, error) { return lr.r.Read(p) }
+
+// line reads up to the next CRLF, a byte at a time to leave the rest of the
+// body unread.
+func (lr *lineReader) line() (string, error) {
+	var b strings.Builder
+	c := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(lr.r, c); err != nil {
+			return "", err
+		}
+		if c[0] == '\n' {
+			return strings.TrimSuffix(b.String(), "\r"), nil
+		}
+		b.WriteByte(c[0])
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Harness {
+		fake := &fakeS3{objects: map[string][]byte{}}
+		srv := httptest.NewTLSServer(fake)
+		t.Cleanup(srv.Close)
+
+		// every bucket host is served by the fake
+		roots := x509.NewCertPool()
+		roots.AddCert(srv.Certificate())
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+			},
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"},
+		}}
+
+		store, err := NewStoreFromConfig(log, "books", aws.Config{
+			Region:       "us-east-1",
+			Credentials:  credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+			HTTPClient:   client,
+			BaseEndpoint: aws.String("https://s3.example.com"),
+		})
+		if err != nil {
+			t.Fatalf("NewStoreFromConfig: %v", err)
+		}
+		return storetest.Harness{Store: store, Read: fake.read}
+	}, storetest.Options{Atomic: true, LargeSize: 4 << 20})
+}
+
+func TestOpen(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		keys = append(keys, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	defer srv.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+
+	store, err := upload.OpenStore(context.Background(), log, "s3://books/library/new/?region=eu-west-1&path_style=1&endpoint="+url.QueryEscape(srv.URL))
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	if err := store.Save(context.Background(), "Author/book.epub", io.NopCloser(strings.NewReader("book"))); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "PUT /books/library/new/Author/book.epub" {
+		t.Errorf("unexpected requests: %q", keys)
+	}
+
+	for _, u := range []string{"s3:///prefix", "s3://books?path_style=maybe", "s3://books?endpont=x"} {
+		if _, err := upload.OpenStore(context.Background(), log, u); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
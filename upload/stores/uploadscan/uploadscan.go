@@ -0,0 +1,51 @@
+// Package uploadscan wraps a Store, triggering a library scan of the media
+// server serving the files once they are saved
+package uploadscan
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/funayman/ebook-uploader/upload"
+	"github.com/funayman/ebook-uploader/upload/scan"
+)
+
+type Store struct {
+	store upload.Storer
+	hooks []*scan.Hook
+
+	// pending tracks the scans triggered by the saves until they finished
+	pending sync.WaitGroup
+}
+
+// NewStore wraps the store, triggering the hooks after every successful save.
+func NewStore(store upload.Storer, hooks ...*scan.Hook) *Store {
+	return &Store{store: store, hooks: hooks}
+}
+
+// Save saves the source using the wrapped Store and, when it succeeded,
+// triggers the hooks with the trace ID of the request. The scans run in the
+// background and do not delay the upload.
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	if err := s.store.Save(ctx, name, src); err != nil {
+		return err
+	}
+
+	for _, h := range s.hooks {
+		h.Trigger(upload.GetTraceID(ctx))
+
+		s.pending.Add(1)
+		go func(h *scan.Hook) {
+			defer s.pending.Done()
+			h.Wait()
+		}(h)
+	}
+	return nil
+}
+
+// Close waits for the scans triggered by the saves to finish.
+func (s *Store) Close() error {
+	s.pending.Wait()
+	return nil
+}
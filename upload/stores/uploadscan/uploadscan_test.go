@@ -0,0 +1,63 @@
+package uploadscan
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/funayman/logger"
+	"go.uber.org/zap"
+
+	"github.com/funayman/ebook-uploader/upload/scan"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadfault"
+	"github.com/funayman/ebook-uploader/upload/stores/uploadmem"
+)
+
+var (
+	log *zap.SugaredLogger
+)
+
+func init() {
+	log, _ = logger.New("TESTS", logger.WithLevel("FATAL"))
+}
+
+// scanner counts the scans of the library.
+type scanner struct {
+	scans atomic.Int32
+}
+
+func (s *scanner) Scan(context.Context) error {
+	s.scans.Add(1)
+	return nil
+}
+
+func (s *scanner) String() string { return "test library" }
+
+func TestStore(t *testing.T) {
+	errBoom := errors.New("boom")
+	sc := &scanner{}
+	hook := scan.NewHook(log, sc, scan.Config{})
+
+	failing := NewStore(uploadfault.NewStore(log, uploadmem.NewStore(log), uploadfault.Always(uploadfault.Fault{Err: errBoom})), hook)
+	if err := failing.Save(context.Background(), "book.epub", io.NopCloser(strings.NewReader("book"))); !errors.Is(err, errBoom) {
+		t.Fatalf("expected the error of the store; got: %v", err)
+	}
+	hook.Wait()
+	if n := sc.scans.Load(); n != 0 {
+		t.Errorf("expected no scan after a failed save; got: %d", n)
+	}
+
+	store := NewStore(uploadmem.NewStore(log), hook)
+	if err := store.Save(context.Background(), "book.epub", io.NopCloser(strings.NewReader("book"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := sc.scans.Load(); n != 1 {
+		t.Errorf("expected a scan after the save; got: %d", n)
+	}
+}
@@ -0,0 +1,329 @@
+// Package uploadsftp is an upload store saving files to a remote server over
+// SFTP, such as a NAS
+package uploadsftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/inhies/go-bytesize"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	ErrInvalidURL   = errors.New("invalid sftp url")
+	ErrNoAuth       = errors.New("no sftp password or key configured")
+	ErrNoKnownHosts = errors.New("no known_hosts file configured")
+	ErrInvalidName  = errors.New("name escapes the upload directory")
+)
+
+// Config is the configuration of the SFTP store.
+type Config struct {
+	// URL is the server and directory uploads are saved to, such as
+	// sftp://user@nas:22/volume1/books. A password in the URL takes
+	// precedence over Password.
+	URL        string
+	Password   string
+	KeyFile    string
+	Passphrase string
+	// KnownHosts is the known_hosts file the key of the server is verified
+	// with.
+	KnownHosts string
+	// MaxConns is the number of connections kept to the server, shared by the
+	// uploads; 4 when not set.
+	MaxConns int
+	Timeout  time.Duration
+
+	// hostKeyCallback replaces KnownHosts in tests.
+	hostKeyCallback ssh.HostKeyCallback
+}
+
+type Store struct {
+	log  *zap.SugaredLogger
+	addr string
+	dir  string
+	ssh  *ssh.ClientConfig
+
+	// slots limits the connections in use, and idle holds the connections
+	// not in use
+	slots chan struct{}
+	idle  chan *conn
+
+	// dirs are the directories known to exist
+	dirs sync.Map
+}
+
+// conn is a connection to the server.
+type conn struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+func (c *conn) close() {
+	c.sftp.Close()
+	c.ssh.Close()
+}
+
+// NewStore returns a store saving the files under the directory of the URL,
+// authenticating with the password or the private key and verifying the
+// server with the known_hosts file. No connection is made until the first
+// upload.
+func NewStore(log *zap.SugaredLogger, cfg Config) (*Store, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Scheme != "sftp" || u.Hostname() == "" || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidURL, cfg.URL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	dir := path.Clean("/" + u.Path)
+	if u.Path == "" {
+		// relative to the home directory of the user
+		dir = "."
+	}
+
+	var auth []ssh.AuthMethod
+	if password, ok := u.User.Password(); ok {
+		cfg.Password = password
+	}
+	if cfg.KeyFile != "" {
+		key, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read key: %w", err)
+		}
+		var signer ssh.Signer
+		if cfg.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(cfg.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse key %s: %w", cfg.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+	if len(auth) == 0 {
+		return nil, ErrNoAuth
+	}
+
+	hostKeyCallback := cfg.hostKeyCallback
+	if hostKeyCallback == nil {
+		if cfg.KnownHosts == "" {
+			return nil, ErrNoKnownHosts
+		}
+		if hostKeyCallback, err = knownhosts.New(cfg.KnownHosts); err != nil {
+			return nil, fmt.Errorf("read known hosts: %w", err)
+		}
+	}
+
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = 4
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+
+	return &Store{
+		log:  log,
+		addr: addr,
+		dir:  dir,
+		ssh: &ssh.ClientConfig{
+			User:            u.User.Username(),
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         cfg.Timeout,
+		},
+		slots: make(chan struct{}, cfg.MaxConns),
+		idle:  make(chan *conn, cfg.MaxConns),
+	}, nil
+}
+
+// Save writes the source to a temporary file next to the destination, creating
+// the directories of the name as needed, and renames it once complete so that
+// partial uploads are never seen under the name. The source file is closed
+// upon return
+func (s *Store) Save(ctx context.Context, name string, src io.ReadCloser) error {
+	defer src.Close()
+
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return ErrInvalidName
+	}
+	fn := path.Join(s.dir, name)
+
+	c, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.save(ctx, c, fn, src)
+	s.put(c, err)
+	return err
+}
+
+func (s *Store) save(ctx context.Context, c *conn, fn string, src io.Reader) error {
+	if err := s.mkdirs(c, path.Dir(fn)); err != nil {
+		return err
+	}
+
+	// cancelling the upload closes the connection, failing the copy
+	stop := context.AfterFunc(ctx, func() { c.ssh.Close() })
+	defer stop()
+
+	t := time.Now()
+
+	tmp := path.Join(path.Dir(fn), ".upload-"+uuid.NewString()+".part")
+	dst, err := c.sftp.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	n, err := io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = s.rename(c, tmp, fn)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else {
+			c.sftp.Remove(tmp)
+		}
+		return fmt.Errorf("write %s: %w", fn, err)
+	}
+
+	s.log.Infow("copied file to sftp", "bytes", bytesize.ByteSize(n).String(), "filename", fn, "host", s.addr, "since", time.Since(t))
+	return nil
+}
+
+// rename replaces the destination with the temporary file, atomically when
+// the server supports the posix-rename extension of OpenSSH.
+func (s *Store) rename(c *conn, tmp, fn string) error {
+	if _, ok := c.sftp.HasExtension("posix-rename@openssh.com"); ok {
+		return c.sftp.PosixRename(tmp, fn)
+	}
+
+	// SFTP renames refuse existing destinations
+	if err := c.sftp.Rename(tmp, fn); err == nil || !s.exists(c, fn) {
+		return err
+	}
+	if err := c.sftp.Remove(fn); err != nil {
+		return err
+	}
+	return c.sftp.Rename(tmp, fn)
+}
+
+// mkdirs creates the directory and its parents.
+func (s *Store) mkdirs(c *conn, dir string) error {
+	if _, ok := s.dirs.Load(dir); ok {
+		return nil
+	}
+	if err := c.sftp.MkdirAll(dir); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	s.dirs.Store(dir, true)
+	return nil
+}
+
+func (s *Store) exists(c *conn, fn string) bool {
+	_, err := c.sftp.Stat(fn)
+	return err == nil
+}
+
+// get returns an idle connection, or a new one when there is none, waiting
+// while all the connections are in use.
+func (s *Store) get(ctx context.Context) (*conn, error) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		select {
+		case c := <-s.idle:
+			// the server may have closed idle connections
+			if _, err := c.sftp.Getwd(); err == nil {
+				return c, nil
+			}
+			c.close()
+			continue
+		default:
+		}
+		break
+	}
+
+	c, err := s.dial(ctx)
+	if err != nil {
+		<-s.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// put returns the connection to the idle ones unless the upload failed with
+// it, releasing its slot.
+func (s *Store) put(c *conn, err error) {
+	var status *sftp.StatusError
+	if err != nil && !errors.As(err, &status) {
+		c.close()
+	} else {
+		select {
+		case s.idle <- c:
+		default:
+			c.close()
+		}
+	}
+	<-s.slots
+}
+
+func (s *Store) dial(ctx context.Context) (*conn, error) {
+	nc, err := (&net.Dialer{Timeout: s.ssh.Timeout}).DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	nc.SetDeadline(time.Now().Add(s.ssh.Timeout))
+	sc, chans, reqs, err := ssh.NewClientConn(nc, s.addr, s.ssh)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("ssh handshake: %w", err)
+	}
+	nc.SetDeadline(time.Time{})
+	client := ssh.NewClient(sc, chans, reqs)
+
+	sftpClient, err := sftp.NewClient(client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("start sftp: %w", err)
+	}
+	return &conn{ssh: client, sftp: sftpClient}, nil
+}
+
+// Close closes the idle connections.
+func (s *Store) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// Package storetest is a conformance test suite for upload.Storer
+// implementations. Stores run it from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) storetest.Harness {
+//			dir := t.TempDir()
+//			store, _ := uploadfs.NewStore(log, dir)
+//			return storetest.Harness{Store: store, Read: storetest.ReadDir(dir)}
+//		}, storetest.Options{})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/funayman/ebook-uploader/upload"
+)
+
+// Harness is a store under test with the means to read what it saved.
+type Harness struct {
+	Store upload.Storer
+	// Read returns the content saved under the name, an error wrapping
+	// fs.ErrNotExist when nothing was.
+	Read func(name string) ([]byte, error)
+}
+
+// Options adjusts the suite to the guarantees of the store.
+type Options struct {
+	// Atomic stores never expose partial files: failed and cancelled saves
+	// leave nothing under the name, and concurrent saves of a name leave one
+	// of the contents whole.
+	Atomic bool
+	// LargeSize is the size of the large file, 16MB when not set.
+	LargeSize int64
+	// Skip names the tests the store cannot pass, such as "Unicode".
+	Skip []string
+}
+
+// errSource is the error of the failing sources.
+var errSource = errors.New("storetest: source failed")
+
+// timeout bounds the saves expected to return early.
+const timeout = 10 * time.Second
+
+// Run runs the suite, with a new harness for every test.
+func Run(t *testing.T, newHarness func(t *testing.T) Harness, opts Options) {
+	if opts.LargeSize <= 0 {
+		opts.LargeSize = 16 << 20
+	}
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, h Harness, opts Options)
+	}{
+		{"Save", testSave},
+		{"Nested", testNested},
+		{"Empty", testEmpty},
+		{"Large", testLarge},
+		{"Unicode", testUnicode},
+		{"Overwrite", testOverwrite},
+		{"Concurrent", testConcurrent},
+		{"SourceError", testSourceError},
+		{"Close", testClose},
+		{"Cancel", testCancel},
+		{"Cancelled", testCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if slices.Contains(opts.Skip, tt.name) {
+				t.Skip("skipped by the store")
+			}
+			tt.fn(t, newHarness(t), opts)
+		})
+	}
+}
+
+// ReadDir returns a Harness.Read for stores saving under a directory.
+func ReadDir(dir string) func(name string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	}
+}
+
+// =============================================================================
+
+func testSave(t *testing.T, h Harness, _ Options) {
+	save(t, h, "book.epub", []byte("content"))
+	check(t, h, "book.epub", []byte("content"))
+}
+
+func testNested(t *testing.T, h Harness, _ Options) {
+	save(t, h, "Some Author/Some Series/book.epub", []byte("nested"))
+	save(t, h, "Some Author/other.epub", []byte("other"))
+	check(t, h, "Some Author/Some Series/book.epub", []byte("nested"))
+	check(t, h, "Some Author/other.epub", []byte("other"))
+}
+
+func testEmpty(t *testing.T, h Harness, _ Options) {
+	save(t, h, "empty.txt", nil)
+	check(t, h, "empty.txt", []byte{})
+}
+
+func testLarge(t *testing.T, h Harness, opts Options) {
+	data := random(t, opts.LargeSize)
+	// hide the size and the random access of the reader, as sources arriving
+	// through a pipe
+	if err := h.Store.Save(context.Background(), "large.pdf", io.NopCloser(struct{ io.Reader }{bytes.NewReader(data)})); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	check(t, h, "large.pdf", data)
+}
+
+func testUnicode(t *testing.T, h Harness, _ Options) {
+	names := []string{
+		"Ürsula K. Le Guin/Erdsee.epub",
+		"村上春樹/ノルウェイの森.epub",
+		"Достоевский/Преступление и наказание.epub",
+		"emoji 📚 and spaces.epub",
+		"quotes 'single' and \"double\" & more.epub",
+	}
+	for _, name := range names {
+		save(t, h, name, []byte(name))
+	}
+	for _, name := range names {
+		check(t, h, name, []byte(name))
+	}
+}
+
+func testOverwrite(t *testing.T, h Harness, _ Options) {
+	save(t, h, "book.epub", []byte("the first and longer version"))
+	save(t, h, "book.epub", []byte("second"))
+	check(t, h, "book.epub", []byte("second"))
+}
+
+func testConcurrent(t *testing.T, h Harness, opts Options) {
+	const n = 8
+
+	contents := make([][]byte, n)
+	for i := range contents {
+		contents[i] = bytes.Repeat([]byte{byte('a' + i)}, 256<<10)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = h.Store.Save(context.Background(), "same.epub", io.NopCloser(bytes.NewReader(contents[i])))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("save %d: %v", i, err)
+		}
+	}
+
+	got, err := h.Read("same.epub")
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if opts.Atomic && !slices.ContainsFunc(contents, func(c []byte) bool { return bytes.Equal(c, got) }) {
+		t.Errorf("expected one of the contents whole; got %d bytes starting with %q", len(got), got[:min(len(got), 8)])
+	}
+}
+
+func testSourceError(t *testing.T, h Harness, opts Options) {
+	src := &source{r: io.MultiReader(bytes.NewReader(random(t, 64<<10)), errReader{})}
+
+	err := h.Store.Save(context.Background(), "broken.epub", src)
+	if !errors.Is(err, errSource) {
+		t.Errorf("expected the error of the source; got: %v", err)
+	}
+	if !src.closed.Load() {
+		t.Error("expected the source to be closed")
+	}
+	if opts.Atomic {
+		checkMissing(t, h, "broken.epub")
+	}
+}
+
+func testClose(t *testing.T, h Harness, _ Options) {
+	src := &source{r: bytes.NewReader([]byte("content"))}
+	if err := h.Store.Save(context.Background(), "book.epub", src); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if !src.closed.Load() {
+		t.Error("expected the source to be closed")
+	}
+	if src.afterClose.Load() {
+		t.Error("source read after it was closed")
+	}
+}
+
+func testCancel(t *testing.T, h Harness, opts Options) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// an endless source, cancelling the save once some of it was read
+	src := &source{r: endless{}, cancelAfter: 64 << 10, cancel: cancel}
+
+	err := saveWithin(t, h, ctx, "cancelled.epub", src)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled; got: %v", err)
+	}
+	if !src.closed.Load() {
+		t.Error("expected the source to be closed")
+	}
+	if opts.Atomic {
+		checkMissing(t, h, "cancelled.epub")
+	}
+}
+
+func testCancelled(t *testing.T, h Harness, _ Options) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	src := &source{r: endless{}}
+	if err := saveWithin(t, h, ctx, "cancelled.epub", src); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled; got: %v", err)
+	}
+	if !src.closed.Load() {
+		t.Error("expected the source to be closed")
+	}
+}
+
+// =============================================================================
+
+func save(t *testing.T, h Harness, name string, data []byte) {
+	t.Helper()
+
+	if err := h.Store.Save(context.Background(), name, io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatalf("Save %q: %v", name, err)
+	}
+}
+
+func check(t *testing.T, h Harness, name string, want []byte) {
+	t.Helper()
+
+	got, err := h.Read(name)
+	if err != nil {
+		t.Errorf("read %q: %v", name, err)
+		return
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%q: expected %d bytes; got %d bytes which differ", name, len(want), len(got))
+	}
+}
+
+func checkMissing(t *testing.T, h Harness, name string) {
+	t.Helper()
+
+	if b, err := h.Read(name); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%q: expected nothing to be saved; got %d bytes: %v", name, len(b), err)
+	}
+}
+
+// saveWithin saves the source, failing the test when the save does not return
+// in time.
+func saveWithin(t *testing.T, h Harness, ctx context.Context, name string, src io.ReadCloser) error {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() { done <- h.Store.Save(ctx, name, src) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		t.Fatalf("Save %q did not return within %s", name, timeout)
+		return nil
+	}
+}
+
+func random(t *testing.T, size int64) []byte {
+	t.Helper()
+
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	return b
+}
+
+// source records how the store used it, optionally cancelling the save once
+// cancelAfter bytes were read.
+type source struct {
+	r           io.Reader
+	read        atomic.Int64
+	closed      atomic.Bool
+	afterClose  atomic.Bool
+	cancelAfter int64
+	cancel      context.CancelFunc
+}
+
+func (s *source) Read(p []byte) (int, error) {
+	if s.closed.Load() {
+		s.afterClose.Store(true)
+		return 0, fmt.Errorf("storetest: read after close")
+	}
+	n, err := s.r.Read(p)
+	if read := s.read.Add(int64(n)); s.cancel != nil && read >= s.cancelAfter {
+		s.cancel()
+	}
+	return n, err
+}
+
+func (s *source) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errSource }
+
+// endless is a source which never ends.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
@@ -2,32 +2,383 @@
 package upload
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sync"
 
 	"go.uber.org/zap"
 )
 
+var (
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	ErrUnchanged         = errors.New("unchanged")
+)
+
+// Storer saves an upload under a name, which may hold slashes for sub
+// directories. Save closes the source before returning, whether it succeeds or
+// not, and reports the errors of reading the source and of the context.
 type Storer interface {
-	Save(string, io.ReadCloser) error
+	Save(context.Context, string, io.ReadCloser) error
+}
+
+// Extractor reads the metadata embedded within an uploaded file. Extractors
+// return ErrUnsupportedFormat for files they do not understand.
+type Extractor interface {
+	Extract(name string, r io.ReaderAt, size int64) (Metadata, error)
+}
+
+// Transformer rewrites an upload before it is stored, writing the new content
+// to w. Transformers return ErrUnsupportedFormat for files they do not
+// understand and ErrUnchanged when the file does not need rewriting; nothing
+// should be written to w in either case.
+type Transformer interface {
+	Transform(ctx context.Context, w io.Writer, name string, r io.ReaderAt, size int64, md Metadata) error
+}
+
+// Validator checks an upload for problems. Validators return
+// ErrUnsupportedFormat for files they do not understand.
+type Validator interface {
+	Validate(ctx context.Context, name string, r io.ReaderAt, size int64) ([]Problem, error)
+}
+
+// Renamer is implemented by transformers which change the format of an
+// upload, such as a conversion to EPUB. The rewritten file is stored, and seen
+// by the following transformers, under the name returned by Rename.
+type Renamer interface {
+	Rename(name string) string
+}
+
+// Keeper is implemented by transformers whose input is stored as well as
+// their output, such as a conversion keeping the uploaded file. The input is
+// stored under its own name once the upload was.
+type Keeper interface {
+	KeepOriginal() bool
+}
+
+// Enricher looks up metadata from a source outside the upload, such as a book
+// database queried by ISBN. Enrichers return the metadata they found, which
+// only fills in fields that are still empty.
+type Enricher interface {
+	Enrich(ctx context.Context, md Metadata) (Metadata, error)
+}
+
+// Severity of a Problem.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Problem is an issue found with an upload by a Validator.
+type Problem struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+	Fixed    bool   `json:"fixed,omitempty"`
+}
+
+// Result describes a stored upload.
+type Result struct {
+	Filename string    `json:"filename"`
+	Key      string    `json:"key,omitempty"`
+	Store    string    `json:"store,omitempty"`
+	Metadata Metadata  `json:"metadata"`
+	Problems []Problem `json:"problems,omitempty"`
+
+	// Archive is the uploaded archive the file was extracted from.
+	Archive string `json:"archive,omitempty"`
+	// Error explains why a file extracted from an archive was not saved.
+	Error string `json:"error,omitempty"`
+	// Ingestion identifies the tracking of Calibre adding the upload to its
+	// library.
+	Ingestion string `json:"ingestion,omitempty"`
+	// Locations are reported by the stores adding the upload to a library,
+	// with the ID the library gave the book.
+	Locations []Location `json:"locations,omitempty"`
 }
 
 type Core struct {
-	log    *zap.SugaredLogger
-	storer Storer
+	log        *zap.SugaredLogger
+	storer     Storer
+	processors []Processor
+	router     *Router
+	keys       *KeyTemplate
+}
+
+// Option configures optional behaviour of the Core.
+type Option func(*Core)
+
+// WithProcessors adds processors to the pipeline uploads pass through before
+// they are stored. Processors run in the order they are added.
+func WithProcessors(processors ...Processor) Option {
+	return func(c *Core) {
+		c.processors = append(c.processors, processors...)
+	}
 }
 
-func NewCore(log *zap.SugaredLogger, storer Storer) *Core {
-	return &Core{
+// WithRouter sets the router choosing the store of every upload. The store
+// given to NewCore is the default store of the router.
+func WithRouter(r *Router) Option {
+	return func(c *Core) {
+		c.router = r
+	}
+}
+
+// WithKeyTemplate sets the template used to name stored files.
+func WithKeyTemplate(kt *KeyTemplate) Option {
+	return func(c *Core) {
+		c.keys = kt
+	}
+}
+
+func NewCore(log *zap.SugaredLogger, storer Storer, opts ...Option) *Core {
+	c := &Core{
 		log:    log,
 		storer: storer,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
-func (c *Core) Save(name string, src io.ReadCloser) error {
-	if err := c.storer.Save(name, src); err != nil {
-		return fmt.Errorf("storer: %w", err)
+// Save runs the upload through the processors and stores the result under a
+// key built from its name and metadata, in the store chosen by the router if
+// there is one. The metadata is made available to the storer through the
+// context. Problems found by the processors are reported in the Result and do
+// not prevent the file from being stored, a RejectError returned by one of
+// them does.
+func (c *Core) Save(ctx context.Context, name string, src io.ReadCloser, md Metadata) (Result, error) {
+	res := Result{Filename: name}
+
+	var size int64
+	var kept []keptFile
+	if len(c.processors) > 0 || c.router != nil {
+		sf, err := Spool(src)
+		if err != nil {
+			return Result{}, fmt.Errorf("spool: %w", err)
+		}
+
+		f := &File{Name: name, Metadata: md, r: sf, size: sf.size, spool: sf}
+		defer f.close()
+
+		if err := c.process(ctx, f); err != nil {
+			return Result{}, err
+		}
+
+		if _, err := f.spool.Seek(0, io.SeekStart); err != nil {
+			return Result{}, fmt.Errorf("seek: %w", err)
+		}
+		name, md, size, src = f.Name, f.Metadata, f.size, f.spool
+		kept = f.kept
+		res.Problems = f.Problems
+	}
+
+	storer := c.storer
+	if c.router != nil {
+		route := c.router.Route(RouteInput{Name: name, Size: size, Uploader: GetUploader(ctx), Metadata: md})
+		storer = c.router.storer(route, c.storer)
+		res.Store = route.Store
+		c.log.Infow("routed upload", "filename", name, "store", route.Store, "rule", route.Rule)
+	}
+
+	key, err := c.key(name, md)
+	if err != nil {
+		return Result{}, err
+	}
+
+	ctx, locs := withLocations(WithMetadata(ctx, md))
+	if err := storer.Save(ctx, key, src); err != nil {
+		return Result{}, fmt.Errorf("storer: %w", err)
+	}
+
+	for _, k := range kept {
+		key, err := c.key(k.name, md)
+		if err != nil {
+			return Result{}, err
+		}
+		if _, err := k.spool.Seek(0, io.SeekStart); err != nil {
+			return Result{}, fmt.Errorf("seek: %w", err)
+		}
+		if err := storer.Save(ctx, key, k.spool); err != nil {
+			return Result{}, fmt.Errorf("storer: %s: %w", k.name, err)
+		}
+	}
+
+	res.Key = key
+	res.Metadata = md
+	res.Locations = locs.list
+
+	return res, nil
+}
+
+// key returns the key the file is stored under.
+func (c *Core) key(name string, md Metadata) (string, error) {
+	if c.keys == nil {
+		return name, nil
+	}
+	key, err := c.keys.Execute(name, md)
+	if err != nil {
+		return "", fmt.Errorf("key template: %w", err)
 	}
+	return key, nil
+}
+
+// Inspect runs the file through the processors without storing it, returning
+// the metadata and problems they found. The content cannot be replaced while
+// inspecting, so processors which only transform have no effect.
+func (c *Core) Inspect(ctx context.Context, name string, r io.ReaderAt, size int64, md Metadata) (Result, error) {
+	f := &File{Name: name, Metadata: md, r: r, size: size, readOnly: true}
+	err := c.process(ctx, f)
+
+	return Result{Filename: name, Metadata: f.Metadata, Problems: f.Problems}, err
+}
+
+// Route explains where the file would be stored without storing it. The file
+// is inspected first, as by Inspect, so the rules see the metadata found by
+// the processors. The route is nil when the Core has no router.
+func (c *Core) Route(ctx context.Context, name string, r io.ReaderAt, size int64, md Metadata) (Result, *Route, error) {
+	res, err := c.Inspect(ctx, name, r, size, md)
+	if err != nil || c.router == nil {
+		return res, nil, err
+	}
+
+	route := c.router.Route(RouteInput{Name: name, Size: size, Uploader: GetUploader(ctx), Metadata: res.Metadata})
+	res.Store = route.Store
+
+	return res, &route, nil
+}
+
+// markFixed marks the problems which are no longer found after transforming.
+func markFixed(before, after []Problem) []Problem {
+	remaining := make(map[Problem]int, len(after))
+	for _, p := range after {
+		remaining[p]++
+	}
+
+	for i, p := range before {
+		if remaining[p] > 0 {
+			remaining[p]--
+			continue
+		}
+		before[i].Fixed = true
+	}
+	return before
+}
+
+// =============================================================================
+
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// SpooledFile gives random access to an upload. Sources which already support
+// it (such as multipart files) are used directly, anything else is copied to a
+// temporary file which is removed on Close. Close may be called more than once
+// since storers are free to close their source as well.
+type SpooledFile struct {
+	readSeekerAt
+	w     io.Writer
+	size  int64
+	close func() error
+}
+
+// ContextReader returns a reader failing with the error of the context once it
+// is done, for stores copying the source without a context of their own.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// Spool gives random access to the source, copying it to a temporary file when
+// needed. Closing the spooled file closes the source.
+func Spool(src io.ReadCloser) (*SpooledFile, error) {
+	return SpoolContext(context.Background(), src)
+}
+
+// SpoolContext is Spool stopping the copy of the source once the context is
+// done, for stores spooling the source before they do anything else.
+func SpoolContext(ctx context.Context, src io.ReadCloser) (*SpooledFile, error) {
+	if rs, ok := src.(readSeekerAt); ok {
+		size, err := rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return &SpooledFile{readSeekerAt: rs, size: size, close: sync.OnceValue(src.Close)}, nil
+	}
+
+	sf, err := newSpool()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	if _, err := io.Copy(sf, ContextReader(ctx, src)); err != nil {
+		sf.Close()
+		return nil, err
+	}
+	if err := sf.finish(); err != nil {
+		sf.Close()
+		return nil, err
+	}
+
+	return sf, nil
+}
+
+// newSpool creates an empty spooled file backed by a temporary file. Once
+// written, finish must be called before reading it.
+func newSpool() (*SpooledFile, error) {
+	f, err := os.CreateTemp("", "upload-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() error {
+		f.Close()
+		return os.Remove(f.Name())
+	}
+
+	return &SpooledFile{readSeekerAt: f, w: f, close: sync.OnceValue(cleanup)}, nil
+}
+
+// Write appends to a spooled file created by newSpool.
+func (sf *SpooledFile) Write(p []byte) (int, error) {
+	return sf.w.Write(p)
+}
+
+// finish records the size of a spooled file created by newSpool and rewinds it.
+func (sf *SpooledFile) finish() error {
+	size, err := sf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	sf.size = size
+	_, err = sf.Seek(0, io.SeekStart)
+	return err
+}
+
+// Size returns the size of the spooled file.
+func (sf *SpooledFile) Size() int64 {
+	return sf.size
+}
 
-	return nil
+func (sf *SpooledFile) Close() error {
+	return sf.close()
 }